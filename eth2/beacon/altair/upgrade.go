@@ -0,0 +1,249 @@
+package altair
+
+import (
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	. "github.com/protolambda/ztyp/view"
+)
+
+// UpgradeToAltair converts a phase0 state, at the first slot of the Altair fork epoch, into an Altair state.
+// The pending attestations of the previous epoch are translated into participation flags,
+// and the initial sync committees are computed. The EpochsContext is updated with the new sync committees.
+func UpgradeToAltair(spec *common.Spec, epc *common.EpochsContext, pre *phase0.BeaconStateView) (*BeaconStateView, error) {
+	// Fields shared with phase0 have the same index, and their subtrees are transferred without copying.
+	slot, err := pre.Slot()
+	if err != nil {
+		return nil, err
+	}
+	epoch := spec.SlotToEpoch(slot)
+	genesisTime, err := pre.Get(_stateGenesisTime)
+	if err != nil {
+		return nil, err
+	}
+	genesisValidatorsRoot, err := pre.Get(_stateGenesisValidatorsRoot)
+	if err != nil {
+		return nil, err
+	}
+	preFork, err := pre.Fork()
+	if err != nil {
+		return nil, err
+	}
+	fork := common.Fork{
+		PreviousVersion: preFork.CurrentVersion,
+		CurrentVersion:  spec.ALTAIR_FORK_VERSION,
+		Epoch:           epoch,
+	}
+	latestBlockHeader, err := pre.Get(_stateLatestBlockHeader)
+	if err != nil {
+		return nil, err
+	}
+	blockRoots, err := pre.Get(_stateBlockRoots)
+	if err != nil {
+		return nil, err
+	}
+	stateRoots, err := pre.Get(_stateStateRoots)
+	if err != nil {
+		return nil, err
+	}
+	historicalRoots, err := pre.Get(_stateHistoricalRoots)
+	if err != nil {
+		return nil, err
+	}
+	eth1Data, err := pre.Get(_stateEth1Data)
+	if err != nil {
+		return nil, err
+	}
+	eth1DataVotes, err := pre.Get(_stateEth1DataVotes)
+	if err != nil {
+		return nil, err
+	}
+	eth1DepositIndex, err := pre.Get(_stateDepositIndex)
+	if err != nil {
+		return nil, err
+	}
+	validators, err := pre.Get(_stateValidators)
+	if err != nil {
+		return nil, err
+	}
+	balances, err := pre.Get(_stateBalances)
+	if err != nil {
+		return nil, err
+	}
+	randaoMixes, err := pre.Get(_stateRandaoMixes)
+	if err != nil {
+		return nil, err
+	}
+	slashings, err := pre.Get(_stateSlashings)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := pre.Validators()
+	if err != nil {
+		return nil, err
+	}
+	count, err := vals.ValidatorCount()
+	if err != nil {
+		return nil, err
+	}
+	previousEpochParticipation, err := AsParticipationRegistry(ParticipationRegistryType(spec).Default(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := previousEpochParticipation.FillZeroes(count); err != nil {
+		return nil, err
+	}
+	currentEpochParticipation, err := AsParticipationRegistry(ParticipationRegistryType(spec).Default(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := currentEpochParticipation.FillZeroes(count); err != nil {
+		return nil, err
+	}
+	justificationBits, err := pre.Get(_stateJustificationBits)
+	if err != nil {
+		return nil, err
+	}
+	previousJustifiedCheckpoint, err := pre.Get(_statePreviousJustifiedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	currentJustifiedCheckpoint, err := pre.Get(_stateCurrentJustifiedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	finalizedCheckpoint, err := pre.Get(_stateFinalizedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	inactivityScores, err := AsInactivityScores(InactivityScoresType(spec).Default(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := inactivityScores.FillZeroes(count); err != nil {
+		return nil, err
+	}
+	// sync committees are computed after the rest of the state is in place
+	currentSyncCommittee := common.SyncCommitteeType(spec).New()
+	nextSyncCommittee := common.SyncCommitteeType(spec).New()
+
+	stateView, err := AsBeaconStateView(BeaconStateType(spec).FromFields(
+		genesisTime,
+		genesisValidatorsRoot,
+		Uint64View(slot),
+		fork.View(),
+		latestBlockHeader,
+		blockRoots,
+		stateRoots,
+		historicalRoots,
+		eth1Data,
+		eth1DataVotes,
+		eth1DepositIndex,
+		validators,
+		balances,
+		randaoMixes,
+		slashings,
+		previousEpochParticipation,
+		currentEpochParticipation,
+		justificationBits,
+		previousJustifiedCheckpoint,
+		currentJustifiedCheckpoint,
+		finalizedCheckpoint,
+		inactivityScores,
+		currentSyncCommittee,
+		nextSyncCommittee,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	// Fill in previous epoch participation from the pre state's pending attestations
+	pendingAtts, err := pre.PreviousEpochAttestations()
+	if err != nil {
+		return nil, err
+	}
+	if err := TranslateParticipation(spec, epc, stateView, pendingAtts); err != nil {
+		return nil, err
+	}
+
+	// Fill in sync committees
+	// Note: A duplicate committee is assigned for the current and next committee at the fork boundary
+	syncCommittee, err := common.ComputeNextSyncCommittee(spec, epc, stateView)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute initial sync committee: %v", err)
+	}
+	syncCommitteeView, err := syncCommittee.View(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := stateView.SetCurrentSyncCommittee(syncCommitteeView); err != nil {
+		return nil, err
+	}
+	if err := stateView.SetNextSyncCommittee(syncCommitteeView); err != nil {
+		return nil, err
+	}
+	if err := epc.LoadSyncCommittees(stateView); err != nil {
+		return nil, err
+	}
+	return stateView, nil
+}
+
+// TranslateParticipation applies the participation flags of the given phase0 pending attestations
+// to the previous epoch participation of the Altair state.
+func TranslateParticipation(spec *common.Spec, epc *common.EpochsContext, state *BeaconStateView, atts *phase0.PendingAttestationsView) error {
+	epochParticipation, err := state.PreviousEpochParticipation()
+	if err != nil {
+		return err
+	}
+	participants := make([]common.ValidatorIndex, 0, spec.MAX_VALIDATORS_PER_COMMITTEE)
+	iter := atts.ReadonlyIter()
+	for {
+		el, ok, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		attView, err := phase0.AsPendingAttestation(el, nil)
+		if err != nil {
+			return err
+		}
+		att, err := attView.Raw()
+		if err != nil {
+			return err
+		}
+		data := &att.Data
+		// Translate attestation inclusion info to flag indices
+		applyFlags, err := GetApplicableAttestationParticipationFlags(spec, state, data, att.InclusionDelay)
+		if err != nil {
+			return err
+		}
+		if applyFlags == 0 {
+			continue
+		}
+		committee, err := epc.GetBeaconCommittee(data.Slot, data.Index)
+		if err != nil {
+			return err
+		}
+		if att.AggregationBits.BitLen() != uint64(len(committee)) {
+			return fmt.Errorf("pending attestation aggregation bits length %d does not match committee size %d",
+				att.AggregationBits.BitLen(), len(committee))
+		}
+		participants = participants[:0]                                     // reset old slice (re-used in for loop)
+		participants = append(participants, committee...)                   // add committee indices
+		participants = att.AggregationBits.FilterParticipants(participants) // only keep the participants
+
+		// Apply flags to all attesting validators
+		for _, vi := range participants {
+			existingFlags, err := epochParticipation.GetFlags(vi)
+			if err != nil {
+				return err
+			}
+			if err := epochParticipation.SetFlags(vi, existingFlags|applyFlags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
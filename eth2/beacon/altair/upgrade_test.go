@@ -0,0 +1,174 @@
+package altair
+
+import (
+	"encoding/binary"
+	"testing"
+
+	blsu "github.com/protolambda/bls12-381-util"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+)
+
+func TestUpgradeToAltair(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	vals := make([]phase0.KickstartValidatorData, 64)
+	keys := make([][32]byte, len(vals))
+	for i := range vals {
+		binary.BigEndian.PutUint64(keys[i][24:], uint64(i+1))
+		var sk blsu.SecretKey
+		if err := sk.Deserialize(&keys[i]); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := blsu.SkToPk(&sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals[i] = phase0.KickstartValidatorData{Pubkey: pub.Serialize(), Balance: spec.MAX_EFFECTIVE_BALANCE}
+	}
+	pre, _, err := phase0.KickStartStateWithSignatures(&spec, common.Root{1}, 0, vals, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hand-build the phase0 state at the fork epoch: a block at every slot of the previous epoch,
+	// and pending attestations of the previous epoch.
+	forkSlot := spec.SLOTS_PER_EPOCH
+	if err := pre.SetSlot(forkSlot); err != nil {
+		t.Fatal(err)
+	}
+	blockRoots, err := pre.BlockRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot := common.Slot(0); slot < forkSlot; slot++ {
+		if err := blockRoots.SetRoot(slot, common.Root{0xb0, byte(slot)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	epc, err := common.NewEpochsContext(&spec, pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := pre.PreviousJustifiedCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attSlot := common.Slot(3)
+	committee, err := epc.GetBeaconCommittee(attSlot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(committee) < 4 {
+		t.Fatalf("committee too small: %d", len(committee))
+	}
+	target := common.Checkpoint{Epoch: 0, Root: common.Root{0xb0, 0}}
+	head := common.Root{0xb0, byte(attSlot)}
+	pendingAtts, err := pre.PreviousEpochAttestations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []struct {
+		members      []uint64
+		target, head common.Root
+		delay        common.Slot
+	}{
+		// Matching source, target and head, included in time for all flags
+		{[]uint64{0}, target.Root, head, 1},
+		// Wrong head
+		{[]uint64{1}, target.Root, common.Root{0xff}, 1},
+		// Too late for the source and head flags
+		{[]uint64{2}, target.Root, head, 5},
+		// Wrong target, the flags of a validator are combined with the flags of earlier attestations
+		{[]uint64{0, 3}, common.Root{0xff}, head, 1},
+	} {
+		// Bitlist with a delimiter bit after the committee
+		bits := make(phase0.AttestationBits, len(committee)/8+1)
+		bits[len(committee)/8] |= 1 << (len(committee) % 8)
+		for _, m := range a.members {
+			bits.SetBit(m, true)
+		}
+		att := phase0.PendingAttestation{
+			AggregationBits: bits,
+			Data: phase0.AttestationData{
+				Slot:            attSlot,
+				Index:           0,
+				BeaconBlockRoot: a.head,
+				Source:          source,
+				Target:          common.Checkpoint{Epoch: target.Epoch, Root: a.target},
+			},
+			InclusionDelay: a.delay,
+		}
+		if err := pendingAtts.Append(att.View(&spec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post, err := UpgradeToAltair(&spec, epc, pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork, err := post.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork.PreviousVersion != spec.GENESIS_FORK_VERSION || fork.CurrentVersion != spec.ALTAIR_FORK_VERSION || fork.Epoch != 1 {
+		t.Fatalf("unexpected fork: %v", fork)
+	}
+
+	expected := map[common.ValidatorIndex]ParticipationFlags{
+		committee[0]: TIMELY_SOURCE_FLAG | TIMELY_TARGET_FLAG | TIMELY_HEAD_FLAG,
+		committee[1]: TIMELY_SOURCE_FLAG | TIMELY_TARGET_FLAG,
+		committee[2]: TIMELY_TARGET_FLAG,
+		committee[3]: TIMELY_SOURCE_FLAG,
+	}
+	prevParticipation, err := post.PreviousEpochParticipation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := prevParticipation.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currParticipation, err := post.CurrentEpochParticipation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	curr, err := currParticipation.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prev) != len(vals) || len(curr) != len(vals) {
+		t.Fatalf("expected participation of %d validators, got %d previous and %d current", len(vals), len(prev), len(curr))
+	}
+	for i := range vals {
+		vi := common.ValidatorIndex(i)
+		if prev[i] != expected[vi] {
+			t.Errorf("validator %d: expected previous epoch flags %d, got %d", vi, expected[vi], prev[i])
+		}
+		if curr[i] != 0 {
+			t.Errorf("validator %d: expected no current epoch flags, got %d", vi, curr[i])
+		}
+	}
+
+	scores, err := post.InactivityScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := scores.Length()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != uint64(len(vals)) {
+		t.Fatalf("expected %d inactivity scores, got %d", len(vals), count)
+	}
+	for i := range vals {
+		if score, err := scores.GetScore(common.ValidatorIndex(i)); err != nil || score != 0 {
+			t.Fatalf("validator %d: expected zero inactivity score, got %d (%v)", i, score, err)
+		}
+	}
+	if epc.CurrentSyncCommittee == nil || epc.NextSyncCommittee == nil {
+		t.Fatal("expected sync committees in epochs context")
+	}
+}
@@ -12,3 +12,7 @@ const GENESIS_SLOT Slot = 0
 const GENESIS_EPOCH Epoch = 0
 
 const JUSTIFICATION_BITS_LENGTH = 4
+
+const ETH_TO_GWEI Gwei = 1000000000
+
+const SAFETY_DECAY = 10
@@ -7,6 +7,7 @@ import (
 	"github.com/protolambda/ztyp/codec"
 	"github.com/protolambda/ztyp/tree"
 	"gopkg.in/yaml.v3"
+	"sync"
 )
 
 const TARGET_AGGREGATORS_PER_COMMITTEE = 16
@@ -15,6 +16,7 @@ const EPOCHS_PER_RANDOM_SUBNET_SUBSCRIPTION = 256
 const BLS_WITHDRAWAL_PREFIX = 0
 const SYNC_COMMITTEE_SUBNET_COUNT = 4
 const TARGET_AGGREGATORS_PER_SYNC_SUBCOMMITTEE = 4
+const INTERVALS_PER_SLOT = 3
 
 // Phase0
 var DOMAIN_BEACON_PROPOSER = BLSDomainType{0x00, 0x00, 0x00, 0x00}
@@ -158,6 +160,9 @@ type Config struct {
 	MIN_PER_EPOCH_CHURN_LIMIT      uint64 `yaml:"MIN_PER_EPOCH_CHURN_LIMIT" json:"MIN_PER_EPOCH_CHURN_LIMIT"`
 	CHURN_LIMIT_QUOTIENT           uint64 `yaml:"CHURN_LIMIT_QUOTIENT" json:"CHURN_LIMIT_QUOTIENT"`
 
+	// Fork choice
+	PROPOSER_SCORE_BOOST uint64 `yaml:"PROPOSER_SCORE_BOOST" json:"PROPOSER_SCORE_BOOST"`
+
 	// Deposit contract
 	DEPOSIT_CHAIN_ID         uint64      `yaml:"DEPOSIT_CHAIN_ID" json:"DEPOSIT_CHAIN_ID"`
 	DEPOSIT_NETWORK_ID       uint64      `yaml:"DEPOSIT_NETWORK_ID" json:"DEPOSIT_NETWORK_ID"`
@@ -252,17 +257,85 @@ func (spec *Spec) Wrap(des SpecObj) SSZObj {
 	return &specObj{spec, des}
 }
 
+// ForkName identifies a fork, independent of the config it is scheduled with.
+type ForkName string
+
+const (
+	Phase0Fork   ForkName = "phase0"
+	AltairFork   ForkName = "altair"
+	MergeFork    ForkName = "merge"
+	ShardingFork ForkName = "sharding"
+)
+
+// ConfigFork is a fork as scheduled by the config.
+type ConfigFork struct {
+	Name    ForkName
+	Version Version
+	Epoch   Epoch
+}
+
+// ForkScheduleFn reads the version and epoch of a fork from the config.
+type ForkScheduleFn func(c *Config) (version Version, epoch Epoch)
+
+type registeredFork struct {
+	name     ForkName
+	schedule ForkScheduleFn
+}
+
+// The genesis fork is always first, later forks are added with RegisterForkSchedule.
+var registeredForksLock sync.RWMutex
+var registeredForks = []registeredFork{
+	{name: Phase0Fork, schedule: func(c *Config) (Version, Epoch) { return c.GENESIS_FORK_VERSION, 0 }},
+	{name: AltairFork, schedule: func(c *Config) (Version, Epoch) { return c.ALTAIR_FORK_VERSION, c.ALTAIR_FORK_EPOCH }},
+	{name: MergeFork, schedule: func(c *Config) (Version, Epoch) { return c.MERGE_FORK_VERSION, c.MERGE_FORK_EPOCH }},
+	{name: ShardingFork, schedule: func(c *Config) (Version, Epoch) { return c.SHARDING_FORK_VERSION, c.SHARDING_FORK_EPOCH }},
+}
+
+// RegisterForkSchedule adds a fork to the forks of every config, after the forks that are registered already.
+// If the fork is registered already, the schedule is replaced, and the fork keeps its place.
+// Use beacon.RegisterFork to register the implementation of the fork with it.
+// This is meant to be called during init, e.g. for experimental forks:
+// fork schedules that were built before are not updated.
+func RegisterForkSchedule(name ForkName, schedule ForkScheduleFn) {
+	registeredForksLock.Lock()
+	defer registeredForksLock.Unlock()
+	for i := range registeredForks {
+		if registeredForks[i].name == name {
+			registeredForks[i].schedule = schedule
+			return
+		}
+	}
+	registeredForks = append(registeredForks, registeredFork{name: name, schedule: schedule})
+}
+
+// Forks lists the registered forks in order, as scheduled by the config, starting with the genesis fork at epoch 0.
+// A fork is only active if the forks before it are active, regardless of the scheduled epoch.
+func (c *Config) Forks() []ConfigFork {
+	registeredForksLock.RLock()
+	defer registeredForksLock.RUnlock()
+	forks := make([]ConfigFork, 0, len(registeredForks))
+	for _, f := range registeredForks {
+		version, epoch := f.schedule(c)
+		forks = append(forks, ConfigFork{Name: f.name, Version: version, Epoch: epoch})
+	}
+	return forks
+}
+
+// ForkVersion returns the version of the fork that is active at the given slot.
+// This is used for every signing domain: the registered forks are read directly, without building the list of forks.
 func (spec *Spec) ForkVersion(slot Slot) Version {
 	epoch := spec.SlotToEpoch(slot)
-	if epoch < spec.ALTAIR_FORK_EPOCH {
-		return spec.GENESIS_FORK_VERSION
-	} else if epoch < spec.MERGE_FORK_EPOCH {
-		return spec.ALTAIR_FORK_VERSION
-	} else if epoch < spec.SHARDING_FORK_EPOCH {
-		return spec.MERGE_FORK_VERSION
-	} else {
-		return spec.SHARDING_FORK_VERSION
+	registeredForksLock.RLock()
+	defer registeredForksLock.RUnlock()
+	version, _ := registeredForks[0].schedule(&spec.Config)
+	for _, f := range registeredForks[1:] {
+		v, e := f.schedule(&spec.Config)
+		if epoch < e {
+			break
+		}
+		version = v
 	}
+	return version
 }
 
 func (spec *Spec) ActiveShardCount(epoch Epoch) uint64 {
@@ -0,0 +1,35 @@
+package common
+
+// ComputeWeakSubjectivityPeriod computes the number of epochs after the epoch of a state,
+// during which it is safe to sync from the state. The EpochsContext must be that of the state.
+func ComputeWeakSubjectivityPeriod(spec *Spec, epc *EpochsContext) Epoch {
+	wsPeriod := spec.MIN_VALIDATOR_WITHDRAWABILITY_DELAY
+	N := uint64(len(epc.CurrentEpoch.ActiveIndices))
+	if N == 0 {
+		return wsPeriod
+	}
+	t := uint64(epc.TotalActiveStake / Gwei(N) / ETH_TO_GWEI)
+	T := uint64(spec.MAX_EFFECTIVE_BALANCE / ETH_TO_GWEI)
+	delta := spec.GetChurnLimit(N)
+	Delta := spec.MAX_DEPOSITS * uint64(spec.SLOTS_PER_EPOCH)
+	D := uint64(SAFETY_DECAY)
+
+	if T*(200+3*D) < t*(200+12*D) {
+		epochsForValidatorSetChurn := N * (t*(200+12*D) - T*(200+3*D)) / (600 * delta * (2*t + T))
+		epochsForBalanceTopUps := N * (200 + 3*D) / (600 * Delta)
+		if epochsForValidatorSetChurn > epochsForBalanceTopUps {
+			wsPeriod += Epoch(epochsForValidatorSetChurn)
+		} else {
+			wsPeriod += Epoch(epochsForBalanceTopUps)
+		}
+	} else {
+		wsPeriod += Epoch(3 * N * D * t / (200 * Delta * (T - t)))
+	}
+	return wsPeriod
+}
+
+// IsWithinWeakSubjectivityPeriod checks if a state of the given epoch is still safe to sync from at the current epoch.
+// The EpochsContext must be that of the state.
+func IsWithinWeakSubjectivityPeriod(spec *Spec, epc *EpochsContext, stateEpoch Epoch, currentEpoch Epoch) bool {
+	return currentEpoch <= stateEpoch+ComputeWeakSubjectivityPeriod(spec, epc)
+}
@@ -3,30 +3,18 @@ package beacon
 import (
 	"context"
 	"fmt"
-	"github.com/protolambda/zrnt/eth2/beacon/altair"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
-	"github.com/protolambda/zrnt/eth2/beacon/merge"
-	"github.com/protolambda/zrnt/eth2/beacon/phase0"
-	"github.com/protolambda/zrnt/eth2/beacon/sharding"
+	"github.com/protolambda/ztyp/codec"
+	"io"
 )
 
+// ForkDecoder allocates and decodes blocks and states of the forks in the schedule.
 type ForkDecoder struct {
-	Spec     *common.Spec
-	Genesis  common.ForkDigest
-	Altair   common.ForkDigest
-	Merge    common.ForkDigest
-	Sharding common.ForkDigest
-	// TODO more forks
+	*ForkSchedule
 }
 
 func NewForkDecoder(spec *common.Spec, genesisValRoot common.Root) *ForkDecoder {
-	return &ForkDecoder{
-		Spec:     spec,
-		Genesis:  common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genesisValRoot),
-		Altair:   common.ComputeForkDigest(spec.ALTAIR_FORK_VERSION, genesisValRoot),
-		Merge:    common.ComputeForkDigest(spec.MERGE_FORK_VERSION, genesisValRoot),
-		Sharding: common.ComputeForkDigest(spec.SHARDING_FORK_VERSION, genesisValRoot),
-	}
+	return &ForkDecoder{NewForkSchedule(spec, genesisValRoot)}
 }
 
 type OpaqueBlock interface {
@@ -35,49 +23,174 @@ type OpaqueBlock interface {
 }
 
 func (d *ForkDecoder) AllocBlock(digest common.ForkDigest) (OpaqueBlock, error) {
-	switch digest {
-	case d.Genesis:
-		return new(phase0.SignedBeaconBlock), nil
-	case d.Altair:
-		return new(altair.SignedBeaconBlock), nil
-	case d.Merge:
-		return new(merge.SignedBeaconBlock), nil
-	case d.Sharding:
-		return new(sharding.SignedBeaconBlock), nil
-	default:
-		return nil, fmt.Errorf("unrecognized fork digest: %s", digest)
+	f, err := d.ForkByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Implemented(); err != nil {
+		return nil, err
+	}
+	return f.AllocBlock(), nil
+}
+
+// AllocState allocates an empty BeaconState of the fork matching the given digest.
+func (d *ForkDecoder) AllocState(digest common.ForkDigest) (common.BeaconState, error) {
+	f, err := d.ForkByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Implemented(); err != nil {
+		return nil, err
 	}
+	return f.AllocState(d.Spec), nil
+}
+
+// AllocStateByVersion allocates an empty BeaconState of the fork matching the given fork version.
+func (d *ForkDecoder) AllocStateByVersion(version common.Version) (common.BeaconState, error) {
+	f, err := d.ForkByVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Implemented(); err != nil {
+		return nil, err
+	}
+	return f.AllocState(d.Spec), nil
+}
+
+// AllocStateBySlot allocates an empty BeaconState of the fork that is scheduled for the given slot.
+func (d *ForkDecoder) AllocStateBySlot(slot common.Slot) (common.BeaconState, error) {
+	f := d.ForkAtSlot(slot)
+	if err := f.Implemented(); err != nil {
+		return nil, err
+	}
+	return f.AllocState(d.Spec), nil
+}
+
+// DecodeState decodes a SSZ BeaconState of the fork matching the given digest.
+func (d *ForkDecoder) DecodeState(digest common.ForkDigest, length uint64, r io.Reader) (common.BeaconState, error) {
+	state, err := d.AllocState(digest)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(state, length, r)
+}
+
+// DecodeStateByVersion decodes a SSZ BeaconState of the fork matching the given fork version.
+func (d *ForkDecoder) DecodeStateByVersion(version common.Version, length uint64, r io.Reader) (common.BeaconState, error) {
+	state, err := d.AllocStateByVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(state, length, r)
+}
+
+// DecodeStateBySlot decodes a SSZ BeaconState of the fork that is scheduled for the given slot.
+func (d *ForkDecoder) DecodeStateBySlot(slot common.Slot, length uint64, r io.Reader) (common.BeaconState, error) {
+	state, err := d.AllocStateBySlot(slot)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(state, length, r)
+}
+
+func decodeState(state common.BeaconState, length uint64, r io.Reader) (common.BeaconState, error) {
+	decoded, err := state.Type().Deserialize(codec.NewDecodingReader(r, length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode state: %v", err)
+	}
+	if err := state.SetBacking(decoded.Backing()); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// StateDigest computes the fork digest of the state, based on the current version of its fork data.
+// The digest can be used to decode the encoded state again with DecodeState.
+func (d *ForkDecoder) StateDigest(state common.BeaconState) (common.ForkDigest, error) {
+	fork, err := state.Fork()
+	if err != nil {
+		return common.ForkDigest{}, err
+	}
+	return common.ComputeForkDigest(fork.CurrentVersion, d.GenesisValidatorsRoot), nil
+}
+
+// EncodeState encodes the state as SSZ. The fork is not included, see StateDigest.
+func EncodeState(state common.BeaconState, w io.Writer) error {
+	return state.Serialize(codec.NewEncodingWriter(w))
 }
 
 type StandardUpgradeableBeaconState struct {
 	common.BeaconState
+	// Forks is the fork schedule to upgrade the state with.
+	// If nil, or of another spec, it is built from the spec of the next UpgradeMaybe call, and kept.
+	Forks *ForkSchedule
 }
 
+// UpgradeMaybe upgrades the state at the first slot of an epoch where forks activate.
+// Multiple forks may activate at the same epoch, these are upgraded to in order.
+// If no fork activates, or the state is already upgraded, the state is not changed.
+// A state that is not of the forks before the activating forks, e.g. of an unrecognized fork version, is an error.
 func (s *StandardUpgradeableBeaconState) UpgradeMaybe(ctx context.Context, spec *common.Spec, epc *common.EpochsContext) error {
-	pre := s.BeaconState
-	slot, err := pre.Slot()
+	slot, err := s.BeaconState.Slot()
 	if err != nil {
 		return err
 	}
-	switch pre.(type) {
-	case *phase0.BeaconStateView:
-		if slot == common.Slot(spec.ALTAIR_FORK_EPOCH)*spec.SLOTS_PER_EPOCH {
-			// TODO: upgrade
-		}
+	if slot%spec.SLOTS_PER_EPOCH != 0 {
 		return nil
-	case *altair.BeaconStateView:
-		if slot == common.Slot(spec.MERGE_FORK_EPOCH)*spec.SLOTS_PER_EPOCH {
-			// TODO: upgrade
-		}
+	}
+	epoch := spec.SlotToEpoch(slot)
+	if s.Forks == nil || s.Forks.Spec != spec {
+		// The fork digests are not used, the genesis validators root does not matter.
+		s.Forks = NewForkSchedule(spec, common.Root{})
+	}
+	sched := s.Forks
+	active := sched.ForkAtEpoch(epoch)
+	if active.Epoch != epoch {
 		return nil
-	case *merge.BeaconStateView:
-		if slot == common.Slot(spec.SHARDING_FORK_EPOCH)*spec.SLOTS_PER_EPOCH {
-			// TODO: upgrade
-		}
+	}
+	forks := sched.Forks
+	target := 0
+	for forks[target] != active {
+		target++
+	}
+	if target == 0 {
 		return nil
-	default:
+	}
+	fork, err := s.BeaconState.Fork()
+	if err != nil {
+		return err
+	}
+	// The state is of one of the forks before the target that activate at this epoch, or of the fork before them.
+	first := target
+	for first > 1 && forks[first-1].Epoch == epoch {
+		first--
+	}
+	current := -1
+	for i := target; i >= first-1; i-- {
+		if forks[i].Version == fork.CurrentVersion {
+			current = i
+			break
+		}
+	}
+	if current < 0 {
+		return fmt.Errorf("state of fork version %s is not upgradeable to %s at epoch %d",
+			fork.CurrentVersion, active.Name, epoch)
+	}
+	if current == target {
 		return nil
 	}
+	for _, next := range forks[current+1 : target+1] {
+		if err := next.Implemented(); err != nil {
+			return err
+		}
+		post, err := next.Upgrade(spec, epc, s.BeaconState)
+		if err != nil {
+			return fmt.Errorf("failed to upgrade %s to %s state: %v", forks[current].Name, next.Name, err)
+		}
+		s.BeaconState = post
+		current++
+	}
+	return nil
 }
 
 var _ common.UpgradeableBeaconState = (*StandardUpgradeableBeaconState)(nil)
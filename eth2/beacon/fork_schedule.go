@@ -0,0 +1,173 @@
+package beacon
+
+import (
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/beacon/sharding"
+	"sync"
+)
+
+// UpgradeFn converts a state of the previous fork into a state of the upgraded fork,
+// at the first slot of the fork epoch.
+type UpgradeFn func(spec *common.Spec, epc *common.EpochsContext, pre common.BeaconState) (common.BeaconState, error)
+
+// ForkImpl provides the types and upgrade of a fork.
+type ForkImpl struct {
+	AllocBlock func() OpaqueBlock
+	AllocState func(spec *common.Spec) common.BeaconState
+	// Upgrade is nil for the genesis fork.
+	Upgrade UpgradeFn
+	// Schedule reads the version and epoch of the fork from the config.
+	// It is nil for the built-in forks, these are scheduled by common.Config.Forks already.
+	Schedule common.ForkScheduleFn
+}
+
+var forkImplsLock sync.RWMutex
+
+var forkImpls = map[common.ForkName]*ForkImpl{
+	common.Phase0Fork: {
+		AllocBlock: func() OpaqueBlock { return new(phase0.SignedBeaconBlock) },
+		AllocState: func(spec *common.Spec) common.BeaconState { return phase0.NewBeaconStateView(spec) },
+	},
+	common.AltairFork: {
+		AllocBlock: func() OpaqueBlock { return new(altair.SignedBeaconBlock) },
+		AllocState: func(spec *common.Spec) common.BeaconState { return altair.NewBeaconStateView(spec) },
+		Upgrade: func(spec *common.Spec, epc *common.EpochsContext, pre common.BeaconState) (common.BeaconState, error) {
+			s, ok := pre.(*phase0.BeaconStateView)
+			if !ok {
+				return nil, fmt.Errorf("expected phase0 state, got %T", pre)
+			}
+			return altair.UpgradeToAltair(spec, epc, s)
+		},
+	},
+	common.MergeFork: {
+		AllocBlock: func() OpaqueBlock { return new(merge.SignedBeaconBlock) },
+		AllocState: func(spec *common.Spec) common.BeaconState { return merge.NewBeaconStateView(spec) },
+		Upgrade: func(spec *common.Spec, epc *common.EpochsContext, pre common.BeaconState) (common.BeaconState, error) {
+			s, ok := pre.(*altair.BeaconStateView)
+			if !ok {
+				return nil, fmt.Errorf("expected altair state, got %T", pre)
+			}
+			return merge.UpgradeToMerge(spec, epc, s)
+		},
+	},
+	common.ShardingFork: {
+		AllocBlock: func() OpaqueBlock { return new(sharding.SignedBeaconBlock) },
+		AllocState: func(spec *common.Spec) common.BeaconState { return sharding.NewBeaconStateView(spec) },
+		Upgrade: func(spec *common.Spec, epc *common.EpochsContext, pre common.BeaconState) (common.BeaconState, error) {
+			s, ok := pre.(*merge.BeaconStateView)
+			if !ok {
+				return nil, fmt.Errorf("expected merge state, got %T", pre)
+			}
+			return sharding.UpgradeToSharding(spec, epc, s)
+		},
+	},
+}
+
+// RegisterFork registers the implementation of a fork. With a Schedule, the fork is added to
+// the forks of common.Config.Forks, after the forks registered before it, see common.RegisterForkSchedule.
+// This is meant to be called during init, e.g. for experimental forks:
+// fork schedules that were built before are not updated.
+func RegisterFork(name common.ForkName, impl *ForkImpl) {
+	forkImplsLock.Lock()
+	forkImpls[name] = impl
+	forkImplsLock.Unlock()
+	if impl.Schedule != nil {
+		common.RegisterForkSchedule(name, impl.Schedule)
+	}
+}
+
+// Fork is a scheduled fork, with its implementation.
+type Fork struct {
+	common.ConfigFork
+	Digest common.ForkDigest
+	// nil if no implementation is registered for the fork, see Implemented.
+	*ForkImpl
+}
+
+// Implemented returns an error if no implementation is registered for the fork.
+func (f *Fork) Implemented() error {
+	if f.ForkImpl == nil {
+		return fmt.Errorf("no implementation registered for fork %q", f.Name)
+	}
+	return nil
+}
+
+// ForkSchedule lists the forks of a chain in order, starting with the genesis fork.
+type ForkSchedule struct {
+	Spec                  *common.Spec
+	GenesisValidatorsRoot common.Root
+	Forks                 []*Fork
+}
+
+// NewForkSchedule builds the fork schedule of the config, with fork digests for the given genesis validators root.
+func NewForkSchedule(spec *common.Spec, genesisValRoot common.Root) *ForkSchedule {
+	configForks := spec.Forks()
+	forkImplsLock.RLock()
+	defer forkImplsLock.RUnlock()
+	forks := make([]*Fork, 0, len(configForks))
+	for _, f := range configForks {
+		forks = append(forks, &Fork{
+			ConfigFork: f,
+			Digest:     common.ComputeForkDigest(f.Version, genesisValRoot),
+			ForkImpl:   forkImpls[f.Name],
+		})
+	}
+	return &ForkSchedule{
+		Spec:                  spec,
+		GenesisValidatorsRoot: genesisValRoot,
+		Forks:                 forks,
+	}
+}
+
+// ForkAtEpoch returns the fork that is active at the given epoch.
+func (s *ForkSchedule) ForkAtEpoch(epoch common.Epoch) *Fork {
+	out := s.Forks[0]
+	for _, f := range s.Forks[1:] {
+		if epoch < f.Epoch {
+			break
+		}
+		out = f
+	}
+	return out
+}
+
+// ForkAtSlot returns the fork that is active at the given slot.
+func (s *ForkSchedule) ForkAtSlot(slot common.Slot) *Fork {
+	return s.ForkAtEpoch(s.Spec.SlotToEpoch(slot))
+}
+
+// NextFork returns the first fork that activates after the given epoch, or nil if there is none.
+// The returned fork may be scheduled for the far future.
+func (s *ForkSchedule) NextFork(epoch common.Epoch) *Fork {
+	current := s.ForkAtEpoch(epoch)
+	for i, f := range s.Forks {
+		if f == current && i+1 < len(s.Forks) {
+			return s.Forks[i+1]
+		}
+	}
+	return nil
+}
+
+// ForkByDigest returns the fork with the given digest.
+func (s *ForkSchedule) ForkByDigest(digest common.ForkDigest) (*Fork, error) {
+	for _, f := range s.Forks {
+		if f.Digest == digest {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized fork digest: %s", digest)
+}
+
+// ForkByVersion returns the fork with the given version.
+func (s *ForkSchedule) ForkByVersion(version common.Version) (*Fork, error) {
+	for _, f := range s.Forks {
+		if f.Version == version {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized fork version: %s", version)
+}
@@ -0,0 +1,217 @@
+package beacon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+)
+
+func TestForkSchedule(t *testing.T) {
+	unscheduled := ^common.Epoch(0)
+	type epochCase struct {
+		epoch common.Epoch
+		fork  common.ForkName
+		// empty if there is no next fork
+		next common.ForkName
+	}
+	cases := []struct {
+		name     string
+		altair   common.Epoch
+		merge    common.Epoch
+		sharding common.Epoch
+		epochs   []epochCase
+	}{
+		{
+			name:   "distinct epochs",
+			altair: 2, merge: 4, sharding: unscheduled,
+			epochs: []epochCase{
+				{0, common.Phase0Fork, common.AltairFork},
+				{1, common.Phase0Fork, common.AltairFork},
+				{2, common.AltairFork, common.MergeFork},
+				{3, common.AltairFork, common.MergeFork},
+				{4, common.MergeFork, common.ShardingFork},
+				{1000, common.MergeFork, common.ShardingFork},
+				{unscheduled, common.ShardingFork, ""},
+			},
+		},
+		{
+			name:   "same epoch",
+			altair: 2, merge: 2, sharding: unscheduled,
+			epochs: []epochCase{
+				{1, common.Phase0Fork, common.AltairFork},
+				{2, common.MergeFork, common.ShardingFork},
+				{3, common.MergeFork, common.ShardingFork},
+			},
+		},
+		{
+			name:   "all at genesis",
+			altair: 0, merge: 0, sharding: 0,
+			epochs: []epochCase{
+				{0, common.ShardingFork, ""},
+				{5, common.ShardingFork, ""},
+			},
+		},
+		{
+			name:   "unscheduled",
+			altair: unscheduled, merge: unscheduled, sharding: unscheduled,
+			epochs: []epochCase{
+				{0, common.Phase0Fork, common.AltairFork},
+				{1000, common.Phase0Fork, common.AltairFork},
+			},
+		},
+		{
+			// A fork is only active if the forks before it are active
+			name:   "out of order",
+			altair: 5, merge: 3, sharding: unscheduled,
+			epochs: []epochCase{
+				{3, common.Phase0Fork, common.AltairFork},
+				{4, common.Phase0Fork, common.AltairFork},
+				{5, common.MergeFork, common.ShardingFork},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			spec := *configs.Minimal
+			spec.ALTAIR_FORK_EPOCH = c.altair
+			spec.MERGE_FORK_EPOCH = c.merge
+			spec.SHARDING_FORK_EPOCH = c.sharding
+			sched := NewForkSchedule(&spec, common.Root{1})
+			if len(sched.Forks) != 4 || sched.Forks[0].Name != common.Phase0Fork {
+				t.Fatalf("unexpected forks: %v", sched.Forks)
+			}
+			for _, e := range c.epochs {
+				if f := sched.ForkAtEpoch(e.epoch); f.Name != e.fork {
+					t.Errorf("epoch %d: expected fork %s, got %s", e.epoch, e.fork, f.Name)
+				}
+				next := sched.NextFork(e.epoch)
+				if e.next == "" && next != nil {
+					t.Errorf("epoch %d: expected no next fork, got %s", e.epoch, next.Name)
+				}
+				if e.next != "" && (next == nil || next.Name != e.next) {
+					t.Errorf("epoch %d: expected next fork %s, got %v", e.epoch, e.next, next)
+				}
+				if e.epoch == unscheduled {
+					continue
+				}
+				start, err := spec.EpochStartSlot(e.epoch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, slot := range []common.Slot{start, start + spec.SLOTS_PER_EPOCH - 1} {
+					f := sched.ForkAtSlot(slot)
+					if f.Name != e.fork {
+						t.Errorf("slot %d: expected fork %s, got %s", slot, e.fork, f.Name)
+					}
+					if v := spec.ForkVersion(slot); v != f.Version {
+						t.Errorf("slot %d: expected fork version %s, got %s", slot, f.Version, v)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestForkScheduleLookup(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	spec.MERGE_FORK_EPOCH = 1
+	sched := NewForkSchedule(&spec, common.Root{1})
+	for _, f := range sched.Forks {
+		if err := f.Implemented(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := sched.ForkByVersion(f.Version); err != nil || got != f {
+			t.Errorf("expected fork %s by version %s, got %v (%v)", f.Name, f.Version, got, err)
+		}
+		digest := common.ComputeForkDigest(f.Version, common.Root{1})
+		if got, err := sched.ForkByDigest(digest); err != nil || got != f {
+			t.Errorf("expected fork %s by digest %s, got %v (%v)", f.Name, digest, got, err)
+		}
+		// The digest depends on the genesis validators root
+		if got, err := sched.ForkByDigest(common.ComputeForkDigest(f.Version, common.Root{2})); err == nil {
+			t.Errorf("expected no fork for digest of other chain, got %s", got.Name)
+		}
+	}
+	if got, err := sched.ForkByVersion(common.Version{0xff}); err == nil {
+		t.Errorf("expected no fork for unknown version, got %s", got.Name)
+	}
+}
+
+func TestUpgradeMaybeNoop(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 2
+	state := phase0.NewBeaconStateView(&spec)
+	if err := state.SetFork(common.Fork{CurrentVersion: spec.GENESIS_FORK_VERSION}); err != nil {
+		t.Fatal(err)
+	}
+	upgradeable := &StandardUpgradeableBeaconState{BeaconState: state}
+	check := func(slot common.Slot) {
+		if err := state.SetSlot(slot); err != nil {
+			t.Fatal(err)
+		}
+		if err := upgradeable.UpgradeMaybe(context.Background(), &spec, nil); err != nil {
+			t.Fatalf("slot %d: %v", slot, err)
+		}
+		if upgradeable.BeaconState != state {
+			t.Fatalf("slot %d: expected state to not be upgraded, got %T", slot, upgradeable.BeaconState)
+		}
+	}
+	// No fork activates
+	check(spec.SLOTS_PER_EPOCH)
+	check(spec.SLOTS_PER_EPOCH*2 + 1)
+	// A state of an unrecognized fork is an error, and is not changed
+	if err := state.SetFork(common.Fork{CurrentVersion: common.Version{0xff}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetSlot(spec.SLOTS_PER_EPOCH * 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := upgradeable.UpgradeMaybe(context.Background(), &spec, nil); err == nil {
+		t.Fatal("expected error for state of unrecognized fork")
+	}
+	if upgradeable.BeaconState != state {
+		t.Fatalf("expected state to not be upgraded, got %T", upgradeable.BeaconState)
+	}
+}
+
+func TestUpgradeMaybeSchedule(t *testing.T) {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 2
+	state := phase0.NewBeaconStateView(&spec)
+	if err := state.SetFork(common.Fork{CurrentVersion: spec.GENESIS_FORK_VERSION}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetSlot(spec.SLOTS_PER_EPOCH); err != nil {
+		t.Fatal(err)
+	}
+	upgradeable := &StandardUpgradeableBeaconState{BeaconState: state}
+	if err := upgradeable.UpgradeMaybe(context.Background(), &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The schedule is built once, and kept for later epochs
+	sched := upgradeable.Forks
+	if sched == nil || sched.Spec != &spec {
+		t.Fatalf("expected fork schedule of the spec, got %v", sched)
+	}
+	if err := state.SetSlot(spec.SLOTS_PER_EPOCH * 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := upgradeable.UpgradeMaybe(context.Background(), &spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	if upgradeable.Forks != sched {
+		t.Fatal("expected fork schedule to be reused")
+	}
+	// The schedule of another spec is not used
+	other := spec
+	if err := upgradeable.UpgradeMaybe(context.Background(), &other, nil); err != nil {
+		t.Fatal(err)
+	}
+	if upgradeable.Forks == sched || upgradeable.Forks.Spec != &other {
+		t.Fatal("expected fork schedule of the other spec")
+	}
+}
@@ -0,0 +1,440 @@
+package beacon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	blsu "github.com/protolambda/bls12-381-util"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/beacon/sharding"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/ztyp/tree"
+)
+
+// forkSpec schedules every fork one epoch after the previous fork.
+func forkSpec() *common.Spec {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	spec.MERGE_FORK_EPOCH = 2
+	spec.SHARDING_FORK_EPOCH = 3
+	return &spec
+}
+
+// genesisState creates a phase0 genesis state with n validators, with deterministic keys.
+func genesisState(t *testing.T, spec *common.Spec, n int) (*phase0.BeaconStateView, *common.EpochsContext) {
+	vals := make([]phase0.KickstartValidatorData, n)
+	keys := make([][32]byte, n)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(keys[i][24:], uint64(i+1))
+		var sk blsu.SecretKey
+		if err := sk.Deserialize(&keys[i]); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := blsu.SkToPk(&sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals[i] = phase0.KickstartValidatorData{Pubkey: pub.Serialize(), Balance: spec.MAX_EFFECTIVE_BALANCE}
+	}
+	state, epc, err := phase0.KickStartStateWithSignatures(spec, common.Root{1}, 0, vals, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, epc
+}
+
+func TestProcessSlotsAcrossForks(t *testing.T) {
+	spec := forkSpec()
+	ctx := context.Background()
+	state, epc := genesisState(t, spec, 64)
+	genesisValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := NewForkDecoder(spec, genesisValRoot)
+	upgradeable := &StandardUpgradeableBeaconState{BeaconState: state}
+
+	// Participation of the last Altair epoch, to translate into Merge pending attestations
+	participationSlot := spec.SLOTS_PER_EPOCH*2 - 3
+	var committee []common.ValidatorIndex
+
+	for epoch := common.Epoch(1); epoch <= 4; epoch++ {
+		start, err := spec.EpochStartSlot(epoch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if epoch == 2 {
+			// Just before the Merge, with the Altair state
+			if err := common.ProcessSlots(ctx, spec, epc, upgradeable, participationSlot+1); err != nil {
+				t.Fatal(err)
+			}
+			committee, err = epc.GetBeaconCommittee(participationSlot, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(committee) < 4 {
+				t.Fatalf("committee too small: %d", len(committee))
+			}
+			participation, err := upgradeable.BeaconState.(*altair.BeaconStateView).CurrentEpochParticipation()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, flags := range []altair.ParticipationFlags{
+				altair.TIMELY_SOURCE_FLAG | altair.TIMELY_TARGET_FLAG | altair.TIMELY_HEAD_FLAG,
+				altair.TIMELY_SOURCE_FLAG | altair.TIMELY_TARGET_FLAG,
+				altair.TIMELY_SOURCE_FLAG,
+			} {
+				if err := participation.SetFlags(committee[i], flags); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := common.ProcessSlots(ctx, spec, epc, upgradeable, start); err != nil {
+			t.Fatalf("failed to process slots to epoch %d: %v", epoch, err)
+		}
+		fork := dec.ForkAtEpoch(epoch)
+		digest, err := dec.StateDigest(upgradeable.BeaconState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest != fork.Digest {
+			t.Fatalf("epoch %d: expected state of fork %s, got digest %s", epoch, fork.Name, digest)
+		}
+		var ok bool
+		switch fork.Name {
+		case common.AltairFork:
+			_, ok = upgradeable.BeaconState.(*altair.BeaconStateView)
+			if epc.CurrentSyncCommittee == nil || epc.NextSyncCommittee == nil {
+				t.Fatal("expected sync committees after Altair upgrade")
+			}
+		case common.MergeFork:
+			_, ok = upgradeable.BeaconState.(*merge.BeaconStateView)
+		case common.ShardingFork:
+			_, ok = upgradeable.BeaconState.(*sharding.BeaconStateView)
+		}
+		if !ok {
+			t.Fatalf("epoch %d: expected state of fork %s, got %T", epoch, fork.Name, upgradeable.BeaconState)
+		}
+
+		if fork.Name != common.MergeFork {
+			continue
+		}
+		// The Altair participation is translated into pending attestations
+		atts, err := upgradeable.BeaconState.(*merge.BeaconStateView).PreviousEpochAttestations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := atts.Length()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 3 {
+			t.Fatalf("expected 3 pending attestations, got %d", count)
+		}
+		headRoot, err := common.GetBlockRootAtSlot(spec, upgradeable.BeaconState, participationSlot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetRoot, err := common.GetBlockRoot(spec, upgradeable.BeaconState, epoch-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(0); i < count; i++ {
+			attView, err := phase0.AsPendingAttestation(atts.Get(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			att, err := attView.Raw()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if att.Data.Slot != participationSlot || att.Data.Index != 0 || att.InclusionDelay != 1 {
+				t.Fatalf("unexpected pending attestation: %v", att)
+			}
+			if att.AggregationBits.BitLen() != uint64(len(committee)) || att.AggregationBits.OnesCount() != 1 || !att.AggregationBits.GetBit(i) {
+				t.Fatalf("expected pending attestation %d of committee member %d only, got %s", i, i, att.AggregationBits)
+			}
+			if matching := att.Data.Target.Root == targetRoot; matching != (i < 2) {
+				t.Fatalf("pending attestation %d: unexpected target %s", i, att.Data.Target.Root)
+			}
+			if matching := att.Data.BeaconBlockRoot == headRoot; matching != (i < 1) {
+				t.Fatalf("pending attestation %d: unexpected head %s", i, att.Data.BeaconBlockRoot)
+			}
+		}
+		if epc.CurrentSyncCommittee != nil || epc.NextSyncCommittee != nil {
+			t.Fatal("expected no sync committees after Merge upgrade")
+		}
+	}
+}
+
+func TestStateRoundTripAcrossForks(t *testing.T) {
+	spec := forkSpec()
+	ctx := context.Background()
+	state, epc := genesisState(t, spec, 64)
+	genesisValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := NewForkDecoder(spec, genesisValRoot)
+	upgradeable := &StandardUpgradeableBeaconState{BeaconState: state}
+
+	prevType := ""
+	for epoch := common.Epoch(0); epoch <= 3; epoch++ {
+		start, err := spec.EpochStartSlot(epoch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if epoch > 0 {
+			if err := common.ProcessSlots(ctx, spec, epc, upgradeable, start); err != nil {
+				t.Fatalf("failed to process slots to epoch %d: %v", epoch, err)
+			}
+		}
+		current := upgradeable.BeaconState
+		currentType := fmt.Sprintf("%T", current)
+		if currentType == prevType {
+			t.Fatalf("epoch %d: expected state to be upgraded from %s", epoch, prevType)
+		}
+
+		// The fork of the state is the fork scheduled for its slot
+		fork := dec.ForkAtSlot(start)
+		digest, err := dec.StateDigest(current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest != fork.Digest {
+			t.Fatalf("epoch %d: expected digest %s of fork %s, got %s", epoch, fork.Digest, fork.Name, digest)
+		}
+		// The state of a fork boundary slot is allocated by the new fork, the slot before it by the previous fork
+		if alloc, err := dec.AllocStateBySlot(start); err != nil || fmt.Sprintf("%T", alloc) != currentType {
+			t.Fatalf("epoch %d: expected %s for slot %d, got %T (%v)", epoch, currentType, start, alloc, err)
+		}
+		if epoch > 0 {
+			if alloc, err := dec.AllocStateBySlot(start - 1); err != nil || fmt.Sprintf("%T", alloc) != prevType {
+				t.Fatalf("epoch %d: expected %s for slot %d, got %T (%v)", epoch, prevType, start-1, alloc, err)
+			}
+		}
+
+		prevType = currentType
+		// Sharding states cannot be encoded yet: the default of the shard work union type, with an empty option,
+		// is not supported by the SSZ views.
+		if fork.Name == common.ShardingFork {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := EncodeState(current, &buf); err != nil {
+			t.Fatal(err)
+		}
+		expectedRoot := current.HashTreeRoot(tree.GetHashFn())
+		check := func(name string, decoded common.BeaconState, err error) {
+			t.Helper()
+			if err != nil {
+				t.Fatalf("epoch %d: failed to decode state %s: %v", epoch, name, err)
+			}
+			if fmt.Sprintf("%T", decoded) != currentType {
+				t.Fatalf("epoch %d: expected state %s to decode as %s, got %T", epoch, name, currentType, decoded)
+			}
+			if root := decoded.HashTreeRoot(tree.GetHashFn()); root != expectedRoot {
+				t.Fatalf("epoch %d: state %s decoded with root %s, expected %s", epoch, name, root, expectedRoot)
+			}
+		}
+		data := buf.Bytes()
+		decoded, err := dec.DecodeState(digest, uint64(len(data)), bytes.NewReader(data))
+		check("by digest", decoded, err)
+		decoded, err = dec.DecodeStateByVersion(fork.Version, uint64(len(data)), bytes.NewReader(data))
+		check("by version", decoded, err)
+		decoded, err = dec.DecodeStateBySlot(start, uint64(len(data)), bytes.NewReader(data))
+		check("by slot", decoded, err)
+		if epoch > 0 {
+			// The slot before the boundary is of another fork, with another state type
+			if decoded, err := dec.DecodeStateBySlot(start-1, uint64(len(data)), bytes.NewReader(data)); err == nil &&
+				decoded.HashTreeRoot(tree.GetHashFn()) == expectedRoot {
+				t.Fatalf("epoch %d: expected state of previous fork to not decode the same", epoch)
+			}
+		}
+	}
+}
+
+func TestMergeUpgradeRewards(t *testing.T) {
+	spec := forkSpec()
+	spec.SHARDING_FORK_EPOCH = ^common.Epoch(0)
+	ctx := context.Background()
+	state, epc := genesisState(t, spec, 64)
+	upgradeable := &StandardUpgradeableBeaconState{BeaconState: state}
+
+	// Participation of the last Altair epoch, to translate into Merge pending attestations
+	participationSlot := spec.SLOTS_PER_EPOCH*2 - 3
+	if err := common.ProcessSlots(ctx, spec, epc, upgradeable, participationSlot+1); err != nil {
+		t.Fatal(err)
+	}
+	committee, err := epc.GetBeaconCommittee(participationSlot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	participation, err := upgradeable.BeaconState.(*altair.BeaconStateView).CurrentEpochParticipation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, flags := range []altair.ParticipationFlags{
+		altair.TIMELY_SOURCE_FLAG | altair.TIMELY_TARGET_FLAG | altair.TIMELY_HEAD_FLAG,
+		altair.TIMELY_SOURCE_FLAG | altair.TIMELY_TARGET_FLAG,
+		altair.TIMELY_SOURCE_FLAG,
+	} {
+		if err := participation.SetFlags(committee[i], flags); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Just before the epoch processing of the first Merge epoch
+	lastSlot := spec.SLOTS_PER_EPOCH*3 - 1
+	if err := common.ProcessSlots(ctx, spec, epc, upgradeable, lastSlot); err != nil {
+		t.Fatal(err)
+	}
+	pre, ok := upgradeable.BeaconState.(*merge.BeaconStateView)
+	if !ok {
+		t.Fatalf("expected merge state, got %T", upgradeable.BeaconState)
+	}
+	vals, err := pre.Validators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flats, err := common.FlattenValidators(vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attesterData, err := phase0.ComputeEpochAttesterData(ctx, spec, epc, flats, pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deltas, err := phase0.AttestationRewardsAndPenalties(ctx, spec, epc, attesterData, pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inclusionRewards := common.Gwei(0)
+	for _, r := range deltas.InclusionDelay.Rewards {
+		inclusionRewards += r
+	}
+	if inclusionRewards == 0 {
+		t.Fatal("expected phase0 inclusion delay rewards for the translated attestations")
+	}
+	preBalances, err := pre.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := preBalances.AllBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := common.ProcessSlots(ctx, spec, epc, upgradeable, lastSlot+1); err != nil {
+		t.Fatal(err)
+	}
+	postBalances, err := upgradeable.BeaconState.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := postBalances.AllBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Altair paid the proposers at inclusion, and has no inclusion delay rewards:
+	// only the source, target, head and inactivity deltas apply to the translated epoch.
+	for i := range before {
+		expected := before[i]
+		for _, d := range []*common.Deltas{deltas.Source, deltas.Target, deltas.Head, deltas.Inactivity} {
+			expected += d.Rewards[i]
+		}
+		for _, d := range []*common.Deltas{deltas.Source, deltas.Target, deltas.Head, deltas.Inactivity} {
+			if d.Penalties[i] > expected {
+				expected = 0
+			} else {
+				expected -= d.Penalties[i]
+			}
+		}
+		if after[i] != expected {
+			t.Errorf("validator %d: expected balance %d, got %d (before: %d)", i, expected, after[i], before[i])
+		}
+	}
+}
+
+func TestTranslateParticipationGenesis(t *testing.T) {
+	spec := forkSpec()
+	state, epc := genesisState(t, spec, 64)
+	pre, err := altair.UpgradeToAltair(spec, epc, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// At genesis the previous epoch is the current epoch, the proposers of the next epoch are not known
+	lastSlot := spec.SLOTS_PER_EPOCH - 1
+	committee, err := epc.GetBeaconCommittee(lastSlot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	participation, err := pre.PreviousEpochParticipation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := participation.SetFlags(committee[0], altair.TIMELY_SOURCE_FLAG); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := merge.TranslateParticipation(spec, epc, pre); err == nil {
+		t.Fatal("expected error for inclusion slot without known proposers")
+	}
+}
+
+func TestShardingUpgradeShardWork(t *testing.T) {
+	spec := forkSpec()
+	ctx := context.Background()
+	state, epc := genesisState(t, spec, 64)
+	upgradeable := &StandardUpgradeableBeaconState{BeaconState: state}
+	start, err := spec.EpochStartSlot(spec.SHARDING_FORK_EPOCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := common.ProcessSlots(ctx, spec, epc, upgradeable, start); err != nil {
+		t.Fatal(err)
+	}
+	post, ok := upgradeable.BeaconState.(*sharding.BeaconStateView)
+	if !ok {
+		t.Fatalf("expected sharding state, got %T", upgradeable.BeaconState)
+	}
+	// The shard work of the fork epoch is pending, with an empty header for the committee of the shard
+	buffer, err := post.ShardBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	column, err := buffer.Column(uint64(start % spec.SHARD_STATE_MEMORY_SLOTS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, err := column.GetWork(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := work.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selector, err := status.Selector(); err != nil || selector != sharding.SHARD_WORK_PENDING {
+		t.Fatalf("expected pending shard work, got selector %d (%v)", selector, err)
+	}
+	headers, err := sharding.AsPendingShardHeaders(status.Value())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := headers.Length(); err != nil || count != 1 {
+		t.Fatalf("expected 1 pending shard header, got %d (%v)", count, err)
+	}
+	header, err := headers.Header(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot, err := header.UpdateSlot(); err != nil || slot != start {
+		t.Fatalf("expected pending shard header of slot %d, got %d (%v)", start, slot, err)
+	}
+}
@@ -0,0 +1,44 @@
+package merge
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+)
+
+// ProcessEpochRewardsAndPenalties applies the phase0 attestation rewards and penalties,
+// except for the first epoch of the Merge fork: the attestations of its previous epoch are translated
+// from Altair participation (see TranslateParticipation). Altair paid the proposers of those attestations at inclusion,
+// and has no inclusion delay rewards, so the inclusion delay deltas of the translated epoch are not applied.
+func ProcessEpochRewardsAndPenalties(ctx context.Context, spec *common.Spec, epc *common.EpochsContext,
+	attesterData *phase0.EpochAttesterData, state *BeaconStateView) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	currentEpoch := epc.CurrentEpoch.Epoch
+	if currentEpoch == common.GENESIS_EPOCH {
+		return nil
+	}
+	rewAndPenalties, err := phase0.AttestationRewardsAndPenalties(ctx, spec, epc, attesterData, state)
+	if err != nil {
+		return err
+	}
+	valCount := uint64(len(attesterData.Statuses))
+	sum := common.NewDeltas(valCount)
+	sum.Add(rewAndPenalties.Source)
+	sum.Add(rewAndPenalties.Target)
+	sum.Add(rewAndPenalties.Head)
+	if translated := epc.PreviousEpoch.Epoch < spec.MERGE_FORK_EPOCH; !translated {
+		sum.Add(rewAndPenalties.InclusionDelay)
+	}
+	sum.Add(rewAndPenalties.Inactivity)
+	balancesElements, err := common.ApplyDeltas(state, sum)
+	if err != nil {
+		return err
+	}
+	balancesView, err := phase0.AsRegistryBalances(phase0.RegistryBalancesType(spec).FromElements(balancesElements...))
+	if err != nil {
+		return err
+	}
+	return state.SetBalances(balancesView)
+}
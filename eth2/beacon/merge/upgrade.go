@@ -0,0 +1,262 @@
+package merge
+
+import (
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	. "github.com/protolambda/ztyp/view"
+)
+
+// UpgradeToMerge converts an Altair state, at the first slot of the Merge fork epoch, into a Merge state.
+// The Merge state is still based on phase0 pending attestations: the previous epoch participation flags
+// are translated into pending attestations, see TranslateParticipation. The current epoch has no participation yet.
+// Inactivity scores and sync committees have no place in the Merge state, and are dropped.
+// The latest execution payload header starts empty, the transition to the execution-layer happens later.
+func UpgradeToMerge(spec *common.Spec, epc *common.EpochsContext, pre *altair.BeaconStateView) (*BeaconStateView, error) {
+	// Fields shared with Altair have the same index, and their subtrees are transferred without copying.
+	slot, err := pre.Slot()
+	if err != nil {
+		return nil, err
+	}
+	epoch := spec.SlotToEpoch(slot)
+	genesisTime, err := pre.Get(_stateGenesisTime)
+	if err != nil {
+		return nil, err
+	}
+	genesisValidatorsRoot, err := pre.Get(_stateGenesisValidatorsRoot)
+	if err != nil {
+		return nil, err
+	}
+	preFork, err := pre.Fork()
+	if err != nil {
+		return nil, err
+	}
+	fork := common.Fork{
+		PreviousVersion: preFork.CurrentVersion,
+		CurrentVersion:  spec.MERGE_FORK_VERSION,
+		Epoch:           epoch,
+	}
+	latestBlockHeader, err := pre.Get(_stateLatestBlockHeader)
+	if err != nil {
+		return nil, err
+	}
+	blockRoots, err := pre.Get(_stateBlockRoots)
+	if err != nil {
+		return nil, err
+	}
+	stateRoots, err := pre.Get(_stateStateRoots)
+	if err != nil {
+		return nil, err
+	}
+	historicalRoots, err := pre.Get(_stateHistoricalRoots)
+	if err != nil {
+		return nil, err
+	}
+	eth1Data, err := pre.Get(_stateEth1Data)
+	if err != nil {
+		return nil, err
+	}
+	eth1DataVotes, err := pre.Get(_stateEth1DataVotes)
+	if err != nil {
+		return nil, err
+	}
+	eth1DepositIndex, err := pre.Get(_stateDepositIndex)
+	if err != nil {
+		return nil, err
+	}
+	validators, err := pre.Get(_stateValidators)
+	if err != nil {
+		return nil, err
+	}
+	balances, err := pre.Get(_stateBalances)
+	if err != nil {
+		return nil, err
+	}
+	randaoMixes, err := pre.Get(_stateRandaoMixes)
+	if err != nil {
+		return nil, err
+	}
+	slashings, err := pre.Get(_stateSlashings)
+	if err != nil {
+		return nil, err
+	}
+	previousEpochAttestations, err := TranslateParticipation(spec, epc, pre)
+	if err != nil {
+		return nil, fmt.Errorf("failed to translate previous epoch participation: %v", err)
+	}
+	currentEpochAttestations := phase0.PendingAttestationsType(spec).Default(nil)
+	justificationBits, err := pre.Get(_stateJustificationBits)
+	if err != nil {
+		return nil, err
+	}
+	previousJustifiedCheckpoint, err := pre.Get(_statePreviousJustifiedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	currentJustifiedCheckpoint, err := pre.Get(_stateCurrentJustifiedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	finalizedCheckpoint, err := pre.Get(_stateFinalizedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	latestExecutionPayloadHeader := common.ExecutionPayloadHeaderType.New()
+
+	stateView, err := AsBeaconStateView(BeaconStateType(spec).FromFields(
+		genesisTime,
+		genesisValidatorsRoot,
+		Uint64View(slot),
+		fork.View(),
+		latestBlockHeader,
+		blockRoots,
+		stateRoots,
+		historicalRoots,
+		eth1Data,
+		eth1DataVotes,
+		eth1DepositIndex,
+		validators,
+		balances,
+		randaoMixes,
+		slashings,
+		previousEpochAttestations,
+		currentEpochAttestations,
+		justificationBits,
+		previousJustifiedCheckpoint,
+		currentJustifiedCheckpoint,
+		finalizedCheckpoint,
+		latestExecutionPayloadHeader,
+	))
+	if err != nil {
+		return nil, err
+	}
+	// The shufflings and proposers of the EpochsContext still apply to the Merge state.
+	// Like an EpochsContext built for the Merge state, it has no sync committees.
+	epc.CurrentSyncCommittee = nil
+	epc.NextSyncCommittee = nil
+	return stateView, nil
+}
+
+// TranslateParticipation converts the previous epoch participation flags of the Altair state
+// into phase0 pending attestations, one per committee and kind of participation:
+// attestations with a matching head, with only a matching target, and with only a matching source.
+// The attestations are attributed to the proposer of the slot after the attestation slot, with the minimum inclusion delay.
+// Altair paid the proposers at inclusion already, and has no inclusion delay rewards:
+// the inclusion delay and proposer of the translated attestations are not rewarded, see ProcessEpochRewardsAndPenalties.
+func TranslateParticipation(spec *common.Spec, epc *common.EpochsContext, pre *altair.BeaconStateView) (*phase0.PendingAttestationsView, error) {
+	epochParticipation, err := pre.PreviousEpochParticipation()
+	if err != nil {
+		return nil, err
+	}
+	participation, err := epochParticipation.Raw()
+	if err != nil {
+		return nil, err
+	}
+	source, err := pre.PreviousJustifiedCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	epoch := epc.PreviousEpoch.Epoch
+	targetRoot, err := common.GetBlockRoot(spec, pre, epoch)
+	if err != nil {
+		return nil, err
+	}
+	startSlot, err := spec.EpochStartSlot(epoch)
+	if err != nil {
+		return nil, err
+	}
+	// Attestations are included in the previous or current epoch.
+	prevProposers, err := common.ComputeProposers(spec, pre, epoch, epc.PreviousEpoch.ActiveIndices)
+	if err != nil {
+		return nil, err
+	}
+	proposers := map[common.Epoch]*common.ProposersEpoch{epoch: prevProposers, epc.Proposers.Epoch: epc.Proposers}
+	committeeCount, err := epc.GetCommitteeCountPerSlot(epoch)
+	if err != nil {
+		return nil, err
+	}
+	out, err := phase0.AsPendingAttestations(phase0.PendingAttestationsType(spec).Default(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	const (
+		headKind = iota
+		targetKind
+		sourceKind
+		kinds
+	)
+	for slot := startSlot; slot < startSlot+spec.SLOTS_PER_EPOCH; slot++ {
+		headRoot, err := common.GetBlockRootAtSlot(spec, pre, slot)
+		if err != nil {
+			return nil, err
+		}
+		for index := common.CommitteeIndex(0); index < common.CommitteeIndex(committeeCount); index++ {
+			committee, err := epc.GetBeaconCommittee(slot, index)
+			if err != nil {
+				return nil, err
+			}
+			var bits [kinds]phase0.AttestationBits
+			for i, vi := range committee {
+				if uint64(vi) >= uint64(len(participation)) {
+					return nil, fmt.Errorf("committee member %d is not in the participation registry", vi)
+				}
+				flags := participation[vi]
+				var kind int
+				switch {
+				case flags&altair.TIMELY_HEAD_FLAG != 0:
+					kind = headKind
+				case flags&altair.TIMELY_TARGET_FLAG != 0:
+					kind = targetKind
+				case flags&altair.TIMELY_SOURCE_FLAG != 0:
+					kind = sourceKind
+				default:
+					continue
+				}
+				if bits[kind] == nil {
+					// Bitlist with the delimiter bit after the committee
+					bits[kind] = make(phase0.AttestationBits, len(committee)/8+1)
+					bits[kind][len(committee)/8] |= 1 << (len(committee) % 8)
+				}
+				bits[kind].SetBit(uint64(i), true)
+			}
+			for kind := range bits {
+				if bits[kind] == nil {
+					continue
+				}
+				// Without a previous epoch, e.g. at genesis, the inclusion slot may be in an epoch without known proposers.
+				inclusionSlot := slot + spec.MIN_ATTESTATION_INCLUSION_DELAY
+				inclusionProposers, ok := proposers[spec.SlotToEpoch(inclusionSlot)]
+				if !ok {
+					return nil, fmt.Errorf("no proposers known for inclusion slot %d", inclusionSlot)
+				}
+				proposer, err := inclusionProposers.GetBeaconProposer(inclusionSlot)
+				if err != nil {
+					return nil, err
+				}
+				data := phase0.AttestationData{
+					Slot:   slot,
+					Index:  index,
+					Source: source,
+					Target: common.Checkpoint{Epoch: epoch},
+				}
+				if kind != sourceKind {
+					data.Target.Root = targetRoot
+				}
+				if kind == headKind {
+					data.BeaconBlockRoot = headRoot
+				}
+				att := phase0.PendingAttestation{
+					AggregationBits: bits[kind],
+					Data:            data,
+					InclusionDelay:  spec.MIN_ATTESTATION_INCLUSION_DELAY,
+					ProposerIndex:   proposer,
+				}
+				if err := out.Append(att.View(spec)); err != nil {
+					return nil, fmt.Errorf("failed to add pending attestation of slot %d committee %d: %v", slot, index, err)
+				}
+			}
+		}
+	}
+	return out, nil
+}
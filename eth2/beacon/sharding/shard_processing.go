@@ -210,21 +210,27 @@ func ResetPendingShardWork(ctx context.Context, spec *common.Spec, epc *common.E
 
 	currentEpoch := spec.SlotToEpoch(slot)
 	nextEpoch := currentEpoch + 1
-	nextEpochStartSlot, _ := spec.EpochStartSlot(nextEpoch)
 
 	buffer, err := state.ShardBuffer()
 	if err != nil {
 		return err
 	}
+	return resetEpochShardWork(spec, epc, buffer, nextEpoch)
+}
+
+// resetEpochShardWork initializes the shard buffer columns of the given epoch with pending shard work
+// for every shard that has a committee.
+func resetEpochShardWork(spec *common.Spec, epc *common.EpochsContext, buffer *ShardBufferView, epoch common.Epoch) error {
+	epochStartSlot, _ := spec.EpochStartSlot(epoch)
 
-	committeesPerSlot, err := epc.GetCommitteeCountPerSlot(nextEpoch)
+	committeesPerSlot, err := epc.GetCommitteeCountPerSlot(epoch)
 	if err != nil {
 		return err
 	}
-	activeShards := spec.ActiveShardCount(nextEpoch)
+	activeShards := spec.ActiveShardCount(epoch)
 
-	end := nextEpochStartSlot + spec.SLOTS_PER_EPOCH
-	for slot := nextEpochStartSlot; slot < end; slot++ {
+	end := epochStartSlot + spec.SLOTS_PER_EPOCH
+	for slot := epochStartSlot; slot < end; slot++ {
 		bufferIndex := uint64(slot % spec.SHARD_STATE_MEMORY_SLOTS)
 
 		startShard, err := epc.StartShard(slot)
@@ -244,9 +250,10 @@ func ResetPendingShardWork(ctx context.Context, spec *common.Spec, epc *common.E
 			emptyBits := make(phase0.AttestationBits, (len(committee)/8)+1)
 			emptyBits[len(emptyBits)-1] = 1 << (uint8(len(committee)) & 7)
 
+			// The ShardWorkStatus encoders expect a pointer to the pending headers, a value is rejected.
 			column[shard] = ShardWork{Status: ShardWorkStatus{
 				Selector: SHARD_WORK_PENDING,
-				Value: PendingShardHeaders{
+				Value: &PendingShardHeaders{
 					PendingShardHeader{
 						Commitment: DataCommitment{},
 						Root:       common.Root{},
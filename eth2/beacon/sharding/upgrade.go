@@ -0,0 +1,199 @@
+package sharding
+
+import (
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	. "github.com/protolambda/ztyp/view"
+)
+
+// UpgradeToSharding converts a Merge state, at the first slot of the Sharding fork epoch, into a Sharding state.
+// Pending attestations are converted to the sharding format, with an empty shard header root.
+// The shard buffer is initialized with pending work for the current epoch, and the shard gas price starts at the minimum.
+func UpgradeToSharding(spec *common.Spec, epc *common.EpochsContext, pre *merge.BeaconStateView) (*BeaconStateView, error) {
+	// Fields shared with the Merge have the same index, and their subtrees are transferred without copying.
+	slot, err := pre.Slot()
+	if err != nil {
+		return nil, err
+	}
+	epoch := spec.SlotToEpoch(slot)
+	genesisTime, err := pre.Get(_stateGenesisTime)
+	if err != nil {
+		return nil, err
+	}
+	genesisValidatorsRoot, err := pre.Get(_stateGenesisValidatorsRoot)
+	if err != nil {
+		return nil, err
+	}
+	preFork, err := pre.Fork()
+	if err != nil {
+		return nil, err
+	}
+	fork := common.Fork{
+		PreviousVersion: preFork.CurrentVersion,
+		CurrentVersion:  spec.SHARDING_FORK_VERSION,
+		Epoch:           epoch,
+	}
+	latestBlockHeader, err := pre.Get(_stateLatestBlockHeader)
+	if err != nil {
+		return nil, err
+	}
+	blockRoots, err := pre.Get(_stateBlockRoots)
+	if err != nil {
+		return nil, err
+	}
+	stateRoots, err := pre.Get(_stateStateRoots)
+	if err != nil {
+		return nil, err
+	}
+	historicalRoots, err := pre.Get(_stateHistoricalRoots)
+	if err != nil {
+		return nil, err
+	}
+	eth1Data, err := pre.Get(_stateEth1Data)
+	if err != nil {
+		return nil, err
+	}
+	eth1DataVotes, err := pre.Get(_stateEth1DataVotes)
+	if err != nil {
+		return nil, err
+	}
+	eth1DepositIndex, err := pre.Get(_stateDepositIndex)
+	if err != nil {
+		return nil, err
+	}
+	validators, err := pre.Get(_stateValidators)
+	if err != nil {
+		return nil, err
+	}
+	balances, err := pre.Get(_stateBalances)
+	if err != nil {
+		return nil, err
+	}
+	randaoMixes, err := pre.Get(_stateRandaoMixes)
+	if err != nil {
+		return nil, err
+	}
+	slashings, err := pre.Get(_stateSlashings)
+	if err != nil {
+		return nil, err
+	}
+	prePreviousEpochAttestations, err := pre.PreviousEpochAttestations()
+	if err != nil {
+		return nil, err
+	}
+	previousEpochAttestations, err := upgradePendingAttestations(spec, prePreviousEpochAttestations)
+	if err != nil {
+		return nil, err
+	}
+	preCurrentEpochAttestations, err := pre.CurrentEpochAttestations()
+	if err != nil {
+		return nil, err
+	}
+	currentEpochAttestations, err := upgradePendingAttestations(spec, preCurrentEpochAttestations)
+	if err != nil {
+		return nil, err
+	}
+	justificationBits, err := pre.Get(_stateJustificationBits)
+	if err != nil {
+		return nil, err
+	}
+	previousJustifiedCheckpoint, err := pre.Get(_statePreviousJustifiedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	currentJustifiedCheckpoint, err := pre.Get(_stateCurrentJustifiedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	finalizedCheckpoint, err := pre.Get(_stateFinalizedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	latestExecutionPayloadHeader, err := pre.Get(_latestExecutionPayloadHeader)
+	if err != nil {
+		return nil, err
+	}
+	shardBuffer, err := AsShardBuffer(ShardBufferType(spec).Default(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := resetEpochShardWork(spec, epc, shardBuffer, epoch); err != nil {
+		return nil, err
+	}
+	shardGasPrice := Uint64View(spec.MIN_GASPRICE)
+	startShard, err := epc.StartShard(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	return AsBeaconStateView(BeaconStateType(spec).FromFields(
+		genesisTime,
+		genesisValidatorsRoot,
+		Uint64View(slot),
+		fork.View(),
+		latestBlockHeader,
+		blockRoots,
+		stateRoots,
+		historicalRoots,
+		eth1Data,
+		eth1DataVotes,
+		eth1DepositIndex,
+		validators,
+		balances,
+		randaoMixes,
+		slashings,
+		previousEpochAttestations,
+		currentEpochAttestations,
+		justificationBits,
+		previousJustifiedCheckpoint,
+		currentJustifiedCheckpoint,
+		finalizedCheckpoint,
+		latestExecutionPayloadHeader,
+		shardBuffer,
+		shardGasPrice,
+		Uint64View(startShard),
+	))
+}
+
+func upgradePendingAttestations(spec *common.Spec, pre *phase0.PendingAttestationsView) (*PendingAttestationsView, error) {
+	out, err := AsPendingAttestations(PendingAttestationsType(spec).Default(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	iter := pre.ReadonlyIter()
+	for {
+		el, ok, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		attView, err := phase0.AsPendingAttestation(el, nil)
+		if err != nil {
+			return nil, err
+		}
+		att, err := attView.Raw()
+		if err != nil {
+			return nil, err
+		}
+		upgraded := PendingAttestation{
+			AggregationBits: att.AggregationBits,
+			Data: AttestationData{
+				Slot:            att.Data.Slot,
+				Index:           att.Data.Index,
+				BeaconBlockRoot: att.Data.BeaconBlockRoot,
+				Source:          att.Data.Source,
+				Target:          att.Data.Target,
+				ShardHeaderRoot: common.Root{},
+			},
+			InclusionDelay: att.InclusionDelay,
+			ProposerIndex:  att.ProposerIndex,
+		}
+		if err := out.Append(upgraded.View(spec)); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,340 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/beacon/sharding"
+)
+
+// AddAttestation updates the forkchoice with the given attestation, received at the given current slot.
+// Once the forkchoice clock has ticked, its current slot is used instead of the given slot.
+// The committee is computed with the state of the target checkpoint, following the forkchoice on_attestation rules.
+// Warning: the attestation signature is not verified, it is up to the caller to verify.
+func (uc *UnfinalizedChain) AddAttestation(ctx context.Context, att *phase0.Attestation, currentSlot Slot) error {
+	uc.Lock()
+	defer uc.Unlock()
+	data := &att.Data
+	if err := uc.validateAttestationData(ctx, data, uc.clockSlot(currentSlot), false); err != nil {
+		return err
+	}
+	target, err := uc.targetEntry(ctx, data.Target)
+	if err != nil {
+		return err
+	}
+	epc, err := target.EpochsContext(ctx)
+	if err != nil {
+		return err
+	}
+	committee, err := epc.GetBeaconCommittee(data.Slot, data.Index)
+	if err != nil {
+		return err
+	}
+	indexedAtt, err := att.ConvertToIndexed(uc.Spec, committee)
+	if err != nil {
+		return err
+	}
+	if err := uc.validateIndexedAttestation(ctx, target, indexedAtt); err != nil {
+		return err
+	}
+	uc.applyVotes(indexedAtt)
+	return nil
+}
+
+// AddIndexedAttestations updates the forkchoice with a batch of indexed attestations, received at the given current slot.
+// Once the forkchoice clock has ticked, its current slot is used instead of the given slot.
+// Attestations from blocks may be older than the previous epoch, other attestations may not.
+// All attestations are validated before any of the votes are applied.
+// Warning: the attestation signatures are not verified, it is up to the caller to verify, e.g. with the block.
+func (uc *UnfinalizedChain) AddIndexedAttestations(ctx context.Context, atts []*phase0.IndexedAttestation,
+	currentSlot Slot, fromBlock bool) error {
+	uc.Lock()
+	defer uc.Unlock()
+	currentSlot = uc.clockSlot(currentSlot)
+	// Attestations in a batch commonly share the same target
+	targets := make(map[Checkpoint]ChainEntry)
+	for i, att := range atts {
+		data := &att.Data
+		if err := uc.validateAttestationData(ctx, data, currentSlot, fromBlock); err != nil {
+			return fmt.Errorf("invalid attestation %d: %v", i, err)
+		}
+		target, ok := targets[data.Target]
+		if !ok {
+			var err error
+			target, err = uc.targetEntry(ctx, data.Target)
+			if err != nil {
+				return fmt.Errorf("invalid attestation %d: %v", i, err)
+			}
+			targets[data.Target] = target
+		}
+		if err := uc.validateIndexedAttestation(ctx, target, att); err != nil {
+			return fmt.Errorf("invalid attestation %d: %v", i, err)
+		}
+	}
+	for _, att := range atts {
+		uc.applyVotes(att)
+	}
+	return nil
+}
+
+// AddAttesterSlashing removes the vote weight of the validators that equivocated in the given attester slashing,
+// like the forkchoice on_attester_slashing. The slashing and the attestation signatures are verified
+// against the state of the head, e.g. for a slashing candidate of an AttesterSlashingEvent.
+func (uc *UnfinalizedChain) AddAttesterSlashing(ctx context.Context, slashing *phase0.AttesterSlashing) error {
+	uc.Lock()
+	defer uc.Unlock()
+	att1, att2 := &slashing.Attestation1, &slashing.Attestation2
+	if !phase0.IsSlashableAttestationData(&att1.Data, &att2.Data) {
+		return errors.New("attester slashing has no slashable attestation data")
+	}
+	head, _, err := uc.headEntry()
+	if err != nil {
+		return err
+	}
+	epc, err := head.EpochsContext(ctx)
+	if err != nil {
+		return err
+	}
+	state, err := head.State(ctx)
+	if err != nil {
+		return err
+	}
+	if err := phase0.ValidateIndexedAttestation(uc.Spec, epc, state, att1); err != nil {
+		return fmt.Errorf("invalid attestation 1 of attester slashing: %v", err)
+	}
+	if err := phase0.ValidateIndexedAttestation(uc.Spec, epc, state, att2); err != nil {
+		return fmt.Errorf("invalid attestation 2 of attester slashing: %v", err)
+	}
+	for _, index := range intersectIndices(att1.AttestingIndices, att2.AttestingIndices) {
+		uc.ForkChoice.ProcessEquivocation(index)
+	}
+	// The removed weight may change the head.
+	if ref, err := uc.ForkChoice.Head(); err == nil {
+		uc.onHead(BlockSlotKey{Root: ref.Root, Slot: ref.Slot})
+	}
+	return nil
+}
+
+// clockSlot returns the current slot of the forkchoice clock, or the given slot if the clock has not ticked yet.
+func (uc *UnfinalizedChain) clockSlot(currentSlot Slot) Slot {
+	if slot, ok := uc.ForkChoice.CurrentSlot(); ok {
+		return slot
+	}
+	return currentSlot
+}
+
+// validateAttestationData checks the attestation against the forkchoice on_attestation rules,
+// and prepares the node of the attested block and slot to vote for.
+func (uc *UnfinalizedChain) validateAttestationData(ctx context.Context, data *phase0.AttestationData,
+	currentSlot Slot, fromBlock bool) error {
+	target := data.Target
+	// Attestations that are not from a block must be of the current or previous epoch
+	if !fromBlock {
+		currentEpoch := uc.Spec.SlotToEpoch(currentSlot)
+		previousEpoch := currentEpoch.Previous()
+		if target.Epoch != currentEpoch && target.Epoch != previousEpoch {
+			return fmt.Errorf("attestation target epoch %d is not the current epoch %d or previous epoch %d",
+				target.Epoch, currentEpoch, previousEpoch)
+		}
+	}
+	if epoch := uc.Spec.SlotToEpoch(data.Slot); target.Epoch != epoch {
+		return fmt.Errorf("attestation target epoch %d does not match epoch %d of attestation slot %d",
+			target.Epoch, epoch, data.Slot)
+	}
+	// Attestations can only affect the forkchoice of subsequent slots
+	if currentSlot < data.Slot+1 {
+		return fmt.Errorf("attestation slot %d is not before current slot %d", data.Slot, currentSlot)
+	}
+	if _, ok := uc.ForkChoice.GetSlot(target.Root); !ok {
+		return fmt.Errorf("unknown attestation target block %s", target.Root)
+	}
+	blockSlot, ok := uc.ForkChoice.GetSlot(data.BeaconBlockRoot)
+	if !ok {
+		return fmt.Errorf("unknown attested block %s", data.BeaconBlockRoot)
+	}
+	if blockSlot > data.Slot {
+		return fmt.Errorf("attested block %s at slot %d is after attestation slot %d",
+			data.BeaconBlockRoot, blockSlot, data.Slot)
+	}
+	// The target must be the checkpoint of the attested block
+	targetSlot, err := uc.Spec.EpochStartSlot(target.Epoch)
+	if err != nil {
+		return err
+	}
+	if ancestor, ok := uc.ancestorAt(data.BeaconBlockRoot, blockSlot, targetSlot); !ok || ancestor != target.Root {
+		return fmt.Errorf("attestation target %s is not the checkpoint of attested block %s",
+			target.Root, data.BeaconBlockRoot)
+	}
+	// Make sure there is a node to vote for, the attested slot may be empty.
+	if _, err := uc.towards(ctx, data.BeaconBlockRoot, data.Slot); err != nil {
+		return fmt.Errorf("failed to process attested slot %d: %v", data.Slot, err)
+	}
+	return nil
+}
+
+// ancestorAt walks back the parents of the given block, to find the block at or before the given slot.
+func (uc *UnfinalizedChain) ancestorAt(root Root, slot Slot, atSlot Slot) (ancestor Root, ok bool) {
+	for slot > atSlot {
+		if root, slot, ok = uc.parentBlock(root, slot); !ok {
+			return Root{}, false
+		}
+	}
+	return root, true
+}
+
+// targetEntry gets the entry of the state of the target checkpoint, processing empty slots up to it if necessary.
+func (uc *UnfinalizedChain) targetEntry(ctx context.Context, target Checkpoint) (ChainEntry, error) {
+	targetSlot, err := uc.Spec.EpochStartSlot(target.Epoch)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := uc.towards(ctx, target.Root, targetSlot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target checkpoint state %s:%d: %v", target.Root, targetSlot, err)
+	}
+	return entry, nil
+}
+
+// validateIndexedAttestation checks the attesting indices against the target checkpoint state.
+func (uc *UnfinalizedChain) validateIndexedAttestation(ctx context.Context, target ChainEntry, att *phase0.IndexedAttestation) error {
+	state, err := target.State(ctx)
+	if err != nil {
+		return err
+	}
+	return phase0.ValidateIndexedAttestationNoSignature(uc.Spec, state, att)
+}
+
+func (uc *UnfinalizedChain) applyVotes(att *phase0.IndexedAttestation) {
+	// Slashable votes are detected first, the candidates keep their weight until the slashing is verified.
+	for _, slashing := range uc.ForkChoice.ProcessIndexedAttestation(att) {
+		uc.Events.Send(&AttesterSlashingEvent{Slashing: slashing})
+	}
+	data := &att.Data
+	for _, index := range att.AttestingIndices {
+		// the node should exist, unless pruned during attestation processing, fine to ignore.
+		_ = uc.ForkChoice.ProcessAttestation(index, data.BeaconBlockRoot, data.Slot)
+	}
+}
+
+// applyBlockOperations updates the forkchoice with the attestations and attester slashings of a processed block,
+// like the forkchoice on_block: equivocating validators lose their vote weight, and the attestations are latest messages.
+// The operations are verified by the block processing, attestations for blocks that are not in the forkchoice are ignored.
+func (uc *UnfinalizedChain) applyBlockOperations(ctx context.Context, atts []*phase0.IndexedAttestation, equivocating []ValidatorIndex) {
+	for _, index := range equivocating {
+		uc.ForkChoice.ProcessEquivocation(index)
+	}
+	prepared := make(map[BlockSlotKey]bool)
+	for _, att := range atts {
+		data := &att.Data
+		key := BlockSlotKey{Root: data.BeaconBlockRoot, Slot: data.Slot}
+		ok, seen := prepared[key]
+		if !seen {
+			// Make sure there is a node to vote for, the attested slot may be empty.
+			blockSlot, known := uc.ForkChoice.GetSlot(data.BeaconBlockRoot)
+			ok = known && blockSlot <= data.Slot
+			if ok {
+				_, err := uc.towards(ctx, data.BeaconBlockRoot, data.Slot)
+				ok = err == nil
+			}
+			prepared[key] = ok
+		}
+		if ok {
+			uc.applyVotes(att)
+		}
+	}
+}
+
+// blockOperations extracts the indexed attestations and the validators that equivocated in the attester slashings of a block.
+// The EpochsContext must be that of the post-block state, to compute the committees of the attestations with.
+func blockOperations(spec *common.Spec, epc *common.EpochsContext, benv *common.BeaconBlockEnvelope) (
+	atts []*phase0.IndexedAttestation, equivocating []ValidatorIndex, err error) {
+	switch b := benv.SignedBlock.(type) {
+	case *phase0.SignedBeaconBlock:
+		return phase0BlockOperations(spec, epc, b.Message.Body.Attestations, b.Message.Body.AttesterSlashings)
+	case *altair.SignedBeaconBlock:
+		return phase0BlockOperations(spec, epc, b.Message.Body.Attestations, b.Message.Body.AttesterSlashings)
+	case *merge.SignedBeaconBlock:
+		return phase0BlockOperations(spec, epc, b.Message.Body.Attestations, b.Message.Body.AttesterSlashings)
+	case *sharding.SignedBeaconBlock:
+		return shardingBlockOperations(spec, epc, b.Message.Body.Attestations, b.Message.Body.AttesterSlashings)
+	default:
+		return nil, nil, fmt.Errorf("unrecognized block type %T", benv.SignedBlock)
+	}
+}
+
+func phase0BlockOperations(spec *common.Spec, epc *common.EpochsContext,
+	attestations phase0.Attestations, slashings phase0.AttesterSlashings) ([]*phase0.IndexedAttestation, []ValidatorIndex, error) {
+	atts := make([]*phase0.IndexedAttestation, 0, len(attestations))
+	for i := range attestations {
+		att := &attestations[i]
+		committee, err := epc.GetBeaconCommittee(att.Data.Slot, att.Data.Index)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get committee of attestation %d: %v", i, err)
+		}
+		indexed, err := att.ConvertToIndexed(spec, committee)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to index attestation %d: %v", i, err)
+		}
+		atts = append(atts, indexed)
+	}
+	var equivocating []ValidatorIndex
+	for i := range slashings {
+		sl := &slashings[i]
+		equivocating = append(equivocating, intersectIndices(sl.Attestation1.AttestingIndices, sl.Attestation2.AttestingIndices)...)
+	}
+	return atts, equivocating, nil
+}
+
+// shardingBlockOperations converts the sharding attestations to the phase0 form,
+// the shard data does not affect the forkchoice.
+func shardingBlockOperations(spec *common.Spec, epc *common.EpochsContext,
+	attestations sharding.Attestations, slashings sharding.AttesterSlashings) ([]*phase0.IndexedAttestation, []ValidatorIndex, error) {
+	atts := make([]*phase0.IndexedAttestation, 0, len(attestations))
+	for i := range attestations {
+		att := &attestations[i]
+		committee, err := epc.GetBeaconCommittee(att.Data.Slot, att.Data.Index)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get committee of attestation %d: %v", i, err)
+		}
+		indexed, err := att.ConvertToIndexed(spec, committee)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to index attestation %d: %v", i, err)
+		}
+		atts = append(atts, &phase0.IndexedAttestation{
+			AttestingIndices: indexed.AttestingIndices,
+			Data: phase0.AttestationData{
+				Slot:            indexed.Data.Slot,
+				Index:           indexed.Data.Index,
+				BeaconBlockRoot: indexed.Data.BeaconBlockRoot,
+				Source:          indexed.Data.Source,
+				Target:          indexed.Data.Target,
+			},
+			Signature: indexed.Signature,
+		})
+	}
+	var equivocating []ValidatorIndex
+	for i := range slashings {
+		sl := &slashings[i]
+		equivocating = append(equivocating, intersectIndices(sl.Attestation1.AttestingIndices, sl.Attestation2.AttestingIndices)...)
+	}
+	return atts, equivocating, nil
+}
+
+// intersectIndices returns the indices that are in both a and b.
+func intersectIndices(a []ValidatorIndex, b []ValidatorIndex) []ValidatorIndex {
+	inA := make(map[ValidatorIndex]struct{}, len(a))
+	for _, index := range a {
+		inA[index] = struct{}{}
+	}
+	var out []ValidatorIndex
+	for _, index := range b {
+		if _, ok := inA[index]; ok {
+			out = append(out, index)
+		}
+	}
+	return out
+}
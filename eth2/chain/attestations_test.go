@@ -0,0 +1,266 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	blsu "github.com/protolambda/bls12-381-util"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func TestAddAttestation(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+	hot, err := NewUnfinalizedChain(anchor, BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetRoot := hot.ForkChoice.Pin().Root
+	slot := anchorSlot + 1
+	preState, preEpc := td.blockPreState(t, hot, targetRoot, slot)
+	benv := td.buildAltairBlock(t, preState, preEpc, slot)
+	if err := hot.AddBlock(ctx, benv); err != nil {
+		t.Fatal(err)
+	}
+	committee, err := preEpc.GetBeaconCommittee(slot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits := make(phase0.AttestationBits, len(committee)/8+1)
+	bits[len(committee)/8] |= 1 << (len(committee) % 8)
+	bits.SetBit(0, true)
+	epoch := spec.SlotToEpoch(slot)
+	attest := func(blockRoot Root, target Root) *phase0.Attestation {
+		return &phase0.Attestation{
+			AggregationBits: bits,
+			Data: phase0.AttestationData{
+				Slot:            slot,
+				Index:           0,
+				BeaconBlockRoot: blockRoot,
+				Target:          Checkpoint{Epoch: epoch, Root: target},
+			},
+		}
+	}
+
+	if err := hot.AddAttestation(ctx, attest(Root{1}, targetRoot), slot+1); err == nil {
+		t.Fatal("expected attestation for unknown block to fail")
+	}
+	if err := hot.AddAttestation(ctx, attest(benv.BlockRoot, benv.BlockRoot), slot+1); err == nil {
+		t.Fatal("expected attestation with wrong target to fail")
+	}
+	if err := hot.AddAttestation(ctx, attest(benv.BlockRoot, targetRoot), slot); err == nil {
+		t.Fatal("expected attestation of current slot to fail")
+	}
+	late := slot + spec.SLOTS_PER_EPOCH*2
+	if err := hot.AddAttestation(ctx, attest(benv.BlockRoot, targetRoot), late); err == nil {
+		t.Fatal("expected attestation of old epoch to fail")
+	}
+	if votes := hot.ForkChoice.LatestVotes(); len(votes) != 0 {
+		t.Fatalf("expected no votes after invalid attestations, got %d", len(votes))
+	}
+
+	if err := hot.AddAttestation(ctx, attest(benv.BlockRoot, targetRoot), slot+1); err != nil {
+		t.Fatal(err)
+	}
+	votes := hot.ForkChoice.LatestVotes()
+	if len(votes) != 1 || votes[0].Index != committee[0] || votes[0].Root != benv.BlockRoot || votes[0].Slot != slot {
+		t.Fatalf("unexpected votes: %v", votes)
+	}
+
+	// Attestations from blocks may be older, and are validated as a batch
+	other := attest(benv.BlockRoot, targetRoot)
+	other.AggregationBits = bits.Copy()
+	other.AggregationBits.SetBit(0, false)
+	other.AggregationBits.SetBit(1, true)
+	indexed, err := other.ConvertToIndexed(spec, committee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := *indexed
+	invalid.Data.BeaconBlockRoot = Root{1}
+	if err := hot.AddIndexedAttestations(ctx, []*phase0.IndexedAttestation{indexed, &invalid}, late, true); err == nil {
+		t.Fatal("expected batch with invalid attestation to fail")
+	}
+	if votes := hot.ForkChoice.LatestVotes(); len(votes) != 1 {
+		t.Fatalf("expected failed batch to not change votes, got %d votes", len(votes))
+	}
+	if err := hot.AddIndexedAttestations(ctx, []*phase0.IndexedAttestation{indexed}, late, false); err == nil {
+		t.Fatal("expected old attestation that is not from a block to fail")
+	}
+	if err := hot.AddIndexedAttestations(ctx, []*phase0.IndexedAttestation{indexed}, late, true); err != nil {
+		t.Fatal(err)
+	}
+	if votes := hot.ForkChoice.LatestVotes(); len(votes) != 2 {
+		t.Fatalf("expected 2 votes, got %d", len(votes))
+	}
+
+	// A double vote is a slashing candidate, the vote of the attester is kept until the slashing is verified
+	sub := hot.Subscribe(0)
+	defer sub.Unsubscribe()
+	if err := hot.AddAttestation(ctx, attest(targetRoot, targetRoot), slot+1); err != nil {
+		t.Fatal(err)
+	}
+	var candidate *phase0.AttesterSlashing
+	select {
+	case ev := <-sub.Events():
+		slashing, ok := ev.(*AttesterSlashingEvent)
+		if !ok {
+			t.Fatalf("expected attester slashing event, got %T", ev)
+		}
+		if a, b := slashing.Slashing.Attestation1.Data, slashing.Slashing.Attestation2.Data; a.BeaconBlockRoot != benv.BlockRoot || b.BeaconBlockRoot != targetRoot {
+			t.Fatalf("unexpected attester slashing: %v", slashing.Slashing)
+		}
+		candidate = slashing.Slashing
+	default:
+		t.Fatal("expected attester slashing event")
+	}
+	if votes := hot.ForkChoice.LatestVotes(); len(votes) != 2 {
+		t.Fatalf("expected votes of slashing candidate to be kept, got %v", votes)
+	}
+	// The attestations of the candidate are not signed
+	if err := hot.AddAttesterSlashing(ctx, candidate); err == nil {
+		t.Fatal("expected attester slashing without signatures to fail")
+	}
+	if votes := hot.ForkChoice.LatestVotes(); len(votes) != 2 {
+		t.Fatalf("expected invalid attester slashing to not change votes, got %v", votes)
+	}
+	signed := *candidate
+	for _, att := range []*phase0.IndexedAttestation{&signed.Attestation1, &signed.Attestation2} {
+		att.Signature = td.sign(t, preState, committee[0], common.DOMAIN_BEACON_ATTESTER, epoch, att.Data.HashTreeRoot(tree.GetHashFn()))
+	}
+	if err := hot.AddAttesterSlashing(ctx, &signed); err != nil {
+		t.Fatal(err)
+	}
+	votes = hot.ForkChoice.LatestVotes()
+	if len(votes) != 1 || votes[0].Index == committee[0] {
+		t.Fatalf("expected vote of equivocating attester to be removed, got %v", votes)
+	}
+
+	// Once the forkchoice clock ticks, it overrides the current slot of the caller
+	genesisTime, err := preState.GenesisTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tick := func(slot Slot) {
+		t.Helper()
+		timestamp, err := spec.TimeAtSlot(slot, genesisTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hot.OnTick(ctx, timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	third := attest(benv.BlockRoot, targetRoot)
+	third.AggregationBits = bits.Copy()
+	third.AggregationBits.SetBit(0, false)
+	third.AggregationBits.SetBit(2, true)
+	tick(slot)
+	if err := hot.AddAttestation(ctx, third, slot+1); err == nil {
+		t.Fatal("expected attestation of current slot of the clock to fail")
+	}
+	tick(slot + 1)
+	if err := hot.AddAttestation(ctx, third, slot); err != nil {
+		t.Fatalf("expected attestation before current slot of the clock to be accepted: %v", err)
+	}
+	if votes := hot.ForkChoice.LatestVotes(); len(votes) != 2 {
+		t.Fatalf("expected 2 votes, got %v", votes)
+	}
+}
+
+func TestBlockAttestationVotes(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+	hot, err := NewUnfinalizedChain(anchor, BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetRoot := hot.ForkChoice.Pin().Root
+	first := td.addBlocks(t, hot, targetRoot, anchorSlot+1)[0]
+	entry, ok := hot.ByBlockSlot(first.BlockRoot, first.Slot)
+	if !ok {
+		t.Fatal("missing first block")
+	}
+	state, err := entry.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc, err := entry.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := epc.GetBeaconCommittee(first.Slot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(committee) < 2 {
+		t.Fatalf("committee too small: %d", len(committee))
+	}
+	source, err := state.CurrentJustifiedCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := spec.SlotToEpoch(first.Slot)
+	data := phase0.AttestationData{
+		Slot:            first.Slot,
+		Index:           0,
+		BeaconBlockRoot: first.BlockRoot,
+		Source:          source,
+		Target:          Checkpoint{Epoch: epoch, Root: targetRoot},
+	}
+	sign := func(index ValidatorIndex, data *phase0.AttestationData) *blsu.Signature {
+		serialized := td.sign(t, state, index, common.DOMAIN_BEACON_ATTESTER, epoch, data.HashTreeRoot(tree.GetHashFn()))
+		sig, err := serialized.Signature()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	aggregate, err := blsu.Aggregate([]*blsu.Signature{sign(committee[0], &data), sign(committee[1], &data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits := make(phase0.AttestationBits, len(committee)/8+1)
+	bits[len(committee)/8] |= 1 << (len(committee) % 8)
+	bits.SetBit(0, true)
+	bits.SetBit(1, true)
+	// The second attester double votes, and is slashed in the same block
+	double := func(blockRoot Root) phase0.IndexedAttestation {
+		d := data
+		d.BeaconBlockRoot = blockRoot
+		return phase0.IndexedAttestation{
+			AttestingIndices: []ValidatorIndex{committee[1]},
+			Data:             d,
+			Signature:        sign(committee[1], &d).Serialize(),
+		}
+	}
+	td.addBlockWith(t, hot, first.BlockRoot, first.Slot+1, func(body *altair.BeaconBlockBody) {
+		body.Attestations = phase0.Attestations{{AggregationBits: bits, Data: data, Signature: aggregate.Serialize()}}
+		body.AttesterSlashings = phase0.AttesterSlashings{{Attestation1: double(Root{1}), Attestation2: double(Root{2})}}
+	})
+
+	votes := hot.ForkChoice.LatestVotes()
+	if len(votes) != 1 {
+		t.Fatalf("expected 1 vote from the block, got %d", len(votes))
+	}
+	if vote := votes[0]; vote.Index != committee[0] || vote.Root != first.BlockRoot || vote.Slot != first.Slot {
+		t.Fatalf("unexpected vote: %v", vote)
+	}
+	// Later votes of the equivocating validator are ignored
+	if hot.ForkChoice.ProcessAttestation(committee[1], first.BlockRoot, first.Slot) {
+		t.Fatal("expected vote of equivocating validator to be ignored")
+	}
+}
@@ -0,0 +1,170 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	blsu "github.com/protolambda/bls12-381-util"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// BackfillBlocks prepends blocks older than ColdStart to the chain, e.g. after starting from a checkpoint.
+// The blocks are ordered from latest to earliest: the root of each block must match the parent root of the block after it,
+// the first block must be the parent of the earliest block in the chain.
+// The proposer signatures are verified as a batch, with pubkeys from the PubkeyCache.
+// The states of the backfilled blocks are not known, only the block roots and the post-block state roots are tracked.
+// Backfilled blocks are stored in the BlockDB, if any. Nothing is added if any of the blocks is invalid.
+func (f *FinalizedChain) BackfillBlocks(ctx context.Context, blocks []*common.BeaconBlockEnvelope) error {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.StateRoots) == 0 {
+		return fmt.Errorf("cannot backfill empty finalized chain")
+	}
+	if err := f.initBackfill(ctx); err != nil {
+		return err
+	}
+	next := f.backfillParent
+	start := f.start()
+	pubkeys := make([]*blsu.Pubkey, 0, len(blocks))
+	messages := make([][]byte, 0, len(blocks))
+	signatures := make([]*blsu.Signature, 0, len(blocks))
+	for i, benv := range blocks {
+		if next == (Root{}) {
+			return fmt.Errorf("backfill reached genesis, cannot add block %s", benv.BlockRoot)
+		}
+		if benv.BlockRoot != next {
+			return fmt.Errorf("backfill block %d has root %s, expected %s", i, benv.BlockRoot, next)
+		}
+		if AsStep(benv.Slot, true) >= start {
+			return fmt.Errorf("backfill block %s at slot %d is not before %s", benv.BlockRoot, benv.Slot, start)
+		}
+		cachedPub, ok := f.PubkeyCache.Pubkey(benv.ProposerIndex)
+		if !ok {
+			return fmt.Errorf("unknown proposer %d of backfill block %s", benv.ProposerIndex, benv.BlockRoot)
+		}
+		pub, err := cachedPub.Pubkey()
+		if err != nil {
+			return fmt.Errorf("invalid pubkey of proposer %d of backfill block %s: %v", benv.ProposerIndex, benv.BlockRoot, err)
+		}
+		sig, err := benv.Signature.Signature()
+		if err != nil {
+			return fmt.Errorf("invalid signature of backfill block %s: %v", benv.BlockRoot, err)
+		}
+		dom := common.ComputeDomain(common.DOMAIN_BEACON_PROPOSER, f.Spec.ForkVersion(benv.Slot), f.genesisValRoot)
+		signingRoot := common.ComputeSigningRoot(benv.BlockRoot, dom)
+		pubkeys = append(pubkeys, pub)
+		messages = append(messages, signingRoot[:])
+		signatures = append(signatures, sig)
+		next = benv.ParentRoot
+		start = AsStep(benv.Slot, true)
+	}
+	if valid, err := blsu.SignatureSetVerify(pubkeys, messages, signatures); err != nil {
+		return fmt.Errorf("failed to verify backfill signatures: %v", err)
+	} else if !valid {
+		return fmt.Errorf("invalid signature in backfill blocks")
+	}
+	if f.BlockDB != nil {
+		for _, benv := range blocks {
+			if _, err := f.BlockDB.Store(ctx, benv); err != nil {
+				return fmt.Errorf("failed to store backfill block %s: %v", benv.BlockRoot, err)
+			}
+		}
+	}
+
+	// Build the new prefix, from the earliest block up to the current start
+	end := f.start()
+	n := int(end - start)
+	blockRoots := make([]Root, n, n+len(f.BlockRoots))
+	stateRoots := make([]Root, n, n+len(f.StateRoots))
+	for i := len(blocks) - 1; i >= 0; i-- {
+		benv := blocks[i]
+		step := AsStep(benv.Slot, true)
+		// The block root is repeated in the gap slots after the block,
+		// the states of these, and the pre-block states, are unknown and left zero.
+		for s := step; s < end; s++ {
+			blockRoots[s-start] = benv.BlockRoot
+		}
+		stateRoots[step-start] = benv.StateRoot
+		f.StateRootsMap[benv.StateRoot] = step
+		// Track the first occurrence, this may be earlier than the gap slot the chain started at.
+		f.BlockRootsMap[benv.BlockRoot] = benv.Slot
+	}
+	f.BlockRoots = append(blockRoots, f.BlockRoots...)
+	f.StateRoots = append(stateRoots, f.StateRoots...)
+	f.backfillParent = next
+	return nil
+}
+
+// BackfillParent returns the root of the next block to backfill, zero if the backfill reached genesis.
+func (f *FinalizedChain) BackfillParent(ctx context.Context) (Root, error) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.StateRoots) == 0 {
+		return Root{}, fmt.Errorf("empty finalized chain has no backfill parent")
+	}
+	if err := f.initBackfill(ctx); err != nil {
+		return Root{}, err
+	}
+	return f.backfillParent, nil
+}
+
+// backfilled checks if any blocks were backfilled before the state that the backfill started from.
+func (f *FinalizedChain) backfilled() bool {
+	return f.backfillAnchor > f.start()
+}
+
+// initBackfill determines what to backfill from the backfill anchor state: the start state, which is stored,
+// until blocks are backfilled. The states of backfilled blocks are not stored,
+// the backfilled blocks themselves determine what comes before them.
+func (f *FinalizedChain) initBackfill(ctx context.Context) error {
+	if f.backfillInit {
+		return nil
+	}
+	backfilled := f.backfilled()
+	start := f.start()
+	anchor := start
+	if backfilled {
+		anchor = f.backfillAnchor
+	}
+	state, err := f.getState(ctx, anchor)
+	if err != nil {
+		return fmt.Errorf("failed to get state %s to backfill from: %v", anchor, err)
+	}
+	header, err := state.LatestBlockHeader()
+	if err != nil {
+		return err
+	}
+	genesisValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		return err
+	}
+	// After backfilling, BackfillBlocks tracked the parent of the earliest backfilled block.
+	if !backfilled {
+		// If the chain starts with a block, continue with its parent.
+		// Otherwise the chain starts with a gap slot, and the latest block before it is missing.
+		if start.Block() && header.Slot == start.Slot() {
+			f.backfillParent = header.ParentRoot
+		} else {
+			f.backfillParent = f.BlockRoots[0]
+		}
+	}
+	// Older proposers are in the validator registry of the anchor state, make sure the cache has them.
+	vals, err := state.Validators()
+	if err != nil {
+		return err
+	}
+	count, err := vals.ValidatorCount()
+	if err != nil {
+		return err
+	}
+	if _, ok := f.PubkeyCache.Pubkey(ValidatorIndex(count) - 1); count > 0 && !ok {
+		pc, err := common.NewPubkeyCache(vals)
+		if err != nil {
+			return fmt.Errorf("failed to load pubkeys of anchor state: %v", err)
+		}
+		f.PubkeyCache = pc
+	}
+	f.genesisValRoot = genesisValRoot
+	f.backfillAnchor = anchor
+	f.backfillInit = true
+	return nil
+}
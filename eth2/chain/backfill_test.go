@@ -0,0 +1,144 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/states"
+)
+
+func TestFinalizedChainBackfill(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+
+	// Build blocks with a gap slot, to backfill all but the last
+	src, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs := td.addBlocks(t, src, head.BlockRoot(), anchorSlot+1, anchorSlot+3, anchorSlot+4)
+	checkpointEntry, ok := src.ByBlock(envs[2].BlockRoot)
+	if !ok {
+		t.Fatal("missing checkpoint entry")
+	}
+
+	fin := NewFinalizedChain(spec, states.NewMemDB(spec))
+	if err := fin.OnFinalizedEntry(ctx, checkpointEntry); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := fin.BackfillParent(ctx); err != nil {
+		t.Fatal(err)
+	} else if next != envs[1].BlockRoot {
+		t.Fatalf("expected to backfill %s first, got %s", envs[1].BlockRoot, next)
+	}
+
+	// Blocks that are not the parent are rejected
+	if err := fin.BackfillBlocks(ctx, []*common.BeaconBlockEnvelope{envs[0]}); err == nil {
+		t.Fatal("expected backfill of non-parent block to fail")
+	}
+	// Blocks with a bad signature are rejected
+	forged := *envs[0]
+	forged.Signature = envs[1].Signature
+	if err := fin.BackfillBlocks(ctx, []*common.BeaconBlockEnvelope{envs[1], &forged}); err == nil {
+		t.Fatal("expected backfill with bad signature to fail")
+	}
+	if start := fin.ColdStart(); start != checkpointEntry.Step() {
+		t.Fatalf("failed backfill changed start to %s", start)
+	}
+
+	if err := fin.BackfillBlocks(ctx, []*common.BeaconBlockEnvelope{envs[1], envs[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if start, end := fin.ColdStart(), fin.ColdEnd(); start != AsStep(envs[0].Slot, true) || end != checkpointEntry.Step()+1 {
+		t.Fatalf("unexpected backfilled range %s - %s", start, end)
+	}
+	for _, benv := range envs {
+		entry, ok := fin.ByBlock(benv.BlockRoot)
+		if !ok {
+			t.Fatalf("missing backfilled block %s", benv.BlockRoot)
+		}
+		if entry.Step() != AsStep(benv.Slot, true) || entry.StateRoot() != benv.StateRoot {
+			t.Fatalf("unexpected entry %s for block %s", entry.Step(), benv.BlockRoot)
+		}
+		if byState, ok := fin.ByStateRoot(benv.StateRoot); !ok || byState.BlockRoot() != benv.BlockRoot {
+			t.Fatalf("failed to find block %s by state root", benv.BlockRoot)
+		}
+	}
+	if gap, ok := fin.ByCanonStep(AsStep(anchorSlot+2, true)); !ok || gap.BlockRoot() != envs[0].BlockRoot {
+		t.Fatal("expected gap slot to repeat the earlier block")
+	}
+	if next, err := fin.BackfillParent(ctx); err != nil {
+		t.Fatal(err)
+	} else if next != envs[0].ParentRoot {
+		t.Fatalf("expected to backfill %s next, got %s", envs[0].ParentRoot, next)
+	}
+}
+
+func TestFinalizedChainBackfillSaveLoad(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+
+	src, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs := td.addBlocks(t, src, head.BlockRoot(), anchorSlot+1, anchorSlot+3, anchorSlot+4)
+	checkpointEntry, ok := src.ByBlock(envs[2].BlockRoot)
+	if !ok {
+		t.Fatal("missing checkpoint entry")
+	}
+
+	stateDB := states.NewMemDB(spec)
+	fin := NewFinalizedChain(spec, stateDB)
+	if err := fin.OnFinalizedEntry(ctx, checkpointEntry); err != nil {
+		t.Fatal(err)
+	}
+	if err := fin.BackfillBlocks(ctx, []*common.BeaconBlockEnvelope{envs[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state of the backfilled start is not stored, the backfill continues from the saved progress.
+	var buf bytes.Buffer
+	if err := fin.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewFinalizedChain(spec, stateDB)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if start := loaded.ColdStart(); start != AsStep(envs[1].Slot, true) {
+		t.Fatalf("expected loaded chain to start at backfilled block, got %s", start)
+	}
+	if next, err := loaded.BackfillParent(ctx); err != nil {
+		t.Fatal(err)
+	} else if next != envs[0].BlockRoot {
+		t.Fatalf("expected to backfill %s next, got %s", envs[0].BlockRoot, next)
+	}
+	if err := loaded.BackfillBlocks(ctx, []*common.BeaconBlockEnvelope{envs[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if start := loaded.ColdStart(); start != AsStep(envs[0].Slot, true) {
+		t.Fatalf("expected loaded chain to start at %s after backfill, got %s", AsStep(envs[0].Slot, true), start)
+	}
+	if next, err := loaded.BackfillParent(ctx); err != nil {
+		t.Fatal(err)
+	} else if next != envs[0].ParentRoot {
+		t.Fatalf("expected to backfill %s next, got %s", envs[0].ParentRoot, next)
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
-	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
 	"github.com/protolambda/zrnt/eth2/db/states"
+	"io"
 	"sync"
 )
 
@@ -122,6 +123,7 @@ type FullChain interface {
 	Chain
 	HotChain
 	ColdChain
+	OrphanChain
 	Genesis() GenesisInfo
 }
 
@@ -133,13 +135,17 @@ type HotColdChain struct {
 	sync.Mutex
 	HotChain
 	ColdChain
-	Spec *common.Spec
+	// Orphans tracks the blocks that are pruned from the HotChain without being finalized.
+	Orphans OrphanStore
+	// Events is the event feed of the HotChain, shared to emit migrations to the ColdChain with.
+	Events *EventFeed
+	Spec   *common.Spec
 	GenesisInfo
 }
 
 var _ FullChain = (*HotColdChain)(nil)
 
-func NewHotColdChain(anchorState *phase0.BeaconStateView, spec *common.Spec, stateDB states.DB) (*HotColdChain, error) {
+func NewHotColdChain(anchorState common.BeaconState, spec *common.Spec, stateDB states.DB) (*HotColdChain, error) {
 	time, err := anchorState.GenesisTime()
 	if err != nil {
 		return nil, err
@@ -151,28 +157,119 @@ func NewHotColdChain(anchorState *phase0.BeaconStateView, spec *common.Spec, sta
 	c := &HotColdChain{
 		HotChain:    nil,
 		ColdChain:   NewFinalizedChain(spec, stateDB),
+		Orphans:     NewMemOrphanStore(),
 		Spec:        spec,
 		GenesisInfo: GenesisInfo{ValidatorsRoot: valRoot, Time: time},
 	}
-	hotCh, err := NewUnfinalizedChain(anchorState, BlockSinkFn(c.hotToCold), spec)
+	hotCh, err := NewUnfinalizedChain(anchorState, FinalizedBlockSinkFn(c.hotToCold), spec)
 	if err != nil {
 		return nil, err
 	}
 	c.HotChain = hotCh
+	c.Events = hotCh.Events
 
 	return c, nil
 }
 
+// LoadHotColdChain rebuilds a chain from a snapshot, as written by HotColdChain.Save.
+// The finalized part is loaded from the state DB, the unfinalized part is replayed from the block DB,
+// starting from the anchor state of the unfinalized part.
+func LoadHotColdChain(ctx context.Context, r io.Reader, spec *common.Spec,
+	stateDB states.DB, blockDB blocks.DB) (*HotColdChain, error) {
+	cold := NewFinalizedChain(spec, stateDB)
+	if err := cold.Load(r); err != nil {
+		return nil, fmt.Errorf("failed to load finalized chain: %v", err)
+	}
+	c := &HotColdChain{
+		HotChain:  nil,
+		ColdChain: cold,
+		Orphans:   NewMemOrphanStore(),
+		Spec:      spec,
+	}
+	hotCh, err := LoadUnfinalizedChain(ctx, r, FinalizedBlockSinkFn(c.hotToCold), spec, stateDB, blockDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load unfinalized chain: %v", err)
+	}
+	c.HotChain = hotCh
+	c.Events = hotCh.Events
+	pin := hotCh.ForkChoice.Pin()
+	anchor, ok := hotCh.ByBlockSlot(pin.Root, pin.Slot)
+	if !ok {
+		return nil, fmt.Errorf("missing anchor entry %s:%d", pin.Root, pin.Slot)
+	}
+	anchorState, err := anchor.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.GenesisInfo.Time, err = anchorState.GenesisTime(); err != nil {
+		return nil, err
+	}
+	if c.GenesisInfo.ValidatorsRoot, err = anchorState.GenesisValidatorsRoot(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes a snapshot of the chain to w, to restart from with LoadHotColdChain.
+// The anchor state of the unfinalized part is stored in the state DB of the finalized chain.
+// The blocks of the unfinalized chain are not written, these are expected to be in a block DB.
+func (hc *HotColdChain) Save(ctx context.Context, w io.Writer) error {
+	hc.Lock()
+	defer hc.Unlock()
+	cold, ok := hc.ColdChain.(*FinalizedChain)
+	if !ok {
+		return fmt.Errorf("cannot save cold chain of type %T", hc.ColdChain)
+	}
+	hot, ok := hc.HotChain.(*UnfinalizedChain)
+	if !ok {
+		return fmt.Errorf("cannot save hot chain of type %T", hc.HotChain)
+	}
+	if err := cold.Save(w); err != nil {
+		return fmt.Errorf("failed to save finalized chain: %v", err)
+	}
+	if err := hot.Save(ctx, w, cold.StateDB); err != nil {
+		return fmt.Errorf("failed to save unfinalized chain: %v", err)
+	}
+	return nil
+}
+
 func (hc *HotColdChain) Genesis() GenesisInfo {
 	return hc.GenesisInfo
 }
 
-func (hc *HotColdChain) hotToCold(ctx context.Context, entry ChainEntry, canonical bool) error {
+func (hc *HotColdChain) hotToCold(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error {
 	if canonical {
-		return hc.ColdChain.OnFinalizedEntry(ctx, entry)
+		if err := hc.ColdChain.OnFinalizedEntry(ctx, entry); err != nil {
+			return err
+		}
+		if hc.Events != nil {
+			hc.Events.Send(&MigrationEvent{Entry: entry})
+		}
+		return nil
 	}
-	// TODO keep track of pruned non-finalized blocks?
-	return nil
+	// Non-canonical entries without block are just alternative empty slots, only keep track of the blocks.
+	if !entry.Step().Block() || hc.Orphans == nil {
+		return nil
+	}
+	orphan, err := entryToOrphan(entry, finalized)
+	if err != nil {
+		return fmt.Errorf("failed to describe orphaned block %s: %v", entry.BlockRoot(), err)
+	}
+	return hc.Orphans.AddOrphan(ctx, orphan)
+}
+
+func (hc *HotColdChain) OrphansBySlot(start Slot, end Slot) ([]OrphanedBlock, error) {
+	if hc.Orphans == nil {
+		return nil, nil
+	}
+	return hc.Orphans.OrphansBySlot(start, end)
+}
+
+func (hc *HotColdChain) OrphansByProposer(index ValidatorIndex) ([]OrphanedBlock, error) {
+	if hc.Orphans == nil {
+		return nil, nil
+	}
+	return hc.Orphans.OrphansByProposer(index)
 }
 
 func (hc *HotColdChain) ByStateRoot(root Root) (entry ChainEntry, ok bool) {
@@ -308,4 +405,28 @@ func (fi *FullChainIter) Entry(step Step) (entry ChainEntry, err error) {
 	}
 }
 
-// TODO: chain copy
+// Copy forks off a copy of the chain, to speculatively process blocks and attestations with,
+// without affecting this chain. The hot part is copied, the cold part and the states are shared:
+// entries that are finalized in the copy are kept in memory by a ForkedColdChain,
+// and never written to the shared cold chain. The copy tracks its own orphans, and has its own event feed.
+func (hc *HotColdChain) Copy() (*HotColdChain, error) {
+	hc.Lock()
+	defer hc.Unlock()
+	hot, ok := hc.HotChain.(*UnfinalizedChain)
+	if !ok {
+		return nil, fmt.Errorf("cannot copy hot chain of type %T", hc.HotChain)
+	}
+	// Lock the hot chain, so no entries move to the cold chain while forking.
+	hot.RLock()
+	defer hot.RUnlock()
+	c := &HotColdChain{
+		ColdChain:   NewForkedColdChain(hc.ColdChain, hc.Spec),
+		Orphans:     NewMemOrphanStore(),
+		Spec:        hc.Spec,
+		GenesisInfo: hc.GenesisInfo,
+	}
+	hotCopy := hot.copy(FinalizedBlockSinkFn(c.hotToCold))
+	c.HotChain = hotCopy
+	c.Events = hotCopy.Events
+	return c, nil
+}
@@ -0,0 +1,260 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func TestSaveLoad(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, spec.SLOTS_PER_EPOCH*2)
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+	stateDB := states.NewMemDB(spec)
+	blockDB := blocks.NewFileDB(spec, dec, t.TempDir())
+
+	ctx := context.Background()
+	ch, err := NewHotColdChain(anchor, spec, stateDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, slot := range []Slot{head.Step().Slot() + 1, head.Step().Slot() + 3} {
+		benv := td.addBlocks(t, ch, head.BlockRoot(), slot)[0]
+		if _, err := blockDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		ch.HotChain.(*UnfinalizedChain).ForkChoice.ProcessAttestation(benv.ProposerIndex, benv.BlockRoot, benv.Slot)
+		if head, err = ch.Head(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An empty slot on top of the head
+	if _, err := ch.Towards(ctx, head.BlockRoot(), head.Step().Slot()+1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Equivocations and the attestations to detect slashable votes with are saved too
+	hot := ch.HotChain.(*UnfinalizedChain)
+	hot.ForkChoice.ProcessEquivocation(3)
+	hot.ForkChoice.ProcessIndexedAttestation(&phase0.IndexedAttestation{
+		AttestingIndices: []ValidatorIndex{5, 6},
+		Data: phase0.AttestationData{
+			Slot:            head.Step().Slot(),
+			BeaconBlockRoot: head.BlockRoot(),
+			Target:          Checkpoint{Epoch: spec.SlotToEpoch(head.Step().Slot()), Root: head.BlockRoot()},
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := ch.Save(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadHotColdChain(ctx, &buf, spec, stateDB, blockDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Genesis() != ch.Genesis() {
+		t.Fatalf("genesis info mismatch: %v <> %v", loaded.Genesis(), ch.Genesis())
+	}
+	loadedHead, err := loaded.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHead, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedHead.Step() != expectedHead.Step() || loadedHead.BlockRoot() != expectedHead.BlockRoot() {
+		t.Fatalf("expected head %s at %s, got %s at %s", expectedHead.BlockRoot(), expectedHead.Step(),
+			loadedHead.BlockRoot(), loadedHead.Step())
+	}
+	loadedHot := loaded.HotChain.(*UnfinalizedChain)
+	if eq := loadedHot.ForkChoice.EquivocatingIndices(); len(eq) != 1 || eq[0] != 3 {
+		t.Fatalf("expected validator 3 to be equivocating, got %v", eq)
+	}
+	if a, b := hot.ForkChoice.VoteHistory(), loadedHot.ForkChoice.VoteHistory(); len(a) != 1 || len(b) != 1 || a[0].Data != b[0].Data {
+		t.Fatalf("expected same vote history, got %v and %v", a, b)
+	}
+	if len(loadedHot.Entries) != len(hot.Entries) {
+		t.Fatalf("expected %d hot entries, got %d", len(hot.Entries), len(loadedHot.Entries))
+	}
+	for stateRoot, key := range hot.State2Key {
+		entry, ok := loaded.ByStateRoot(stateRoot)
+		if !ok {
+			t.Fatalf("missing entry %s:%d with state root %s", key.Root, key.Slot, stateRoot)
+		}
+		if entry.BlockRoot() != key.Root || entry.Step().Slot() != key.Slot {
+			t.Fatalf("expected entry %s:%d, got %s:%d", key.Root, key.Slot, entry.BlockRoot(), entry.Step().Slot())
+		}
+	}
+}
+
+func TestLoadSnapshotVersion(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	genesisValRoot, err := td.genesis.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDB := states.NewMemDB(spec)
+	blockDB := blocks.NewFileDB(spec, beacon.NewForkDecoder(spec, genesisValRoot), t.TempDir())
+
+	ctx := context.Background()
+	ch, err := NewHotColdChain(td.genesis, spec, stateDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ch.Save(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	// The finalized chain is empty, the unfinalized part follows the header
+	coldSize := binary.Size(finalizedChainSnapshot{})
+	data := buf.Bytes()
+	if _, err := LoadHotColdChain(ctx, bytes.NewReader(data), spec, stateDB, blockDB); err != nil {
+		t.Fatal(err)
+	}
+	// Both the finalized and the unfinalized part start with their version
+	for _, offset := range []int{0, coldSize} {
+		modified := append([]byte(nil), data...)
+		modified[offset] += 1
+		if _, err := LoadHotColdChain(ctx, bytes.NewReader(modified), spec, stateDB, blockDB); err == nil {
+			t.Fatalf("expected unknown snapshot version at offset %d to be rejected", offset)
+		} else if !strings.Contains(err.Error(), "unsupported") {
+			t.Fatalf("expected unsupported version error at offset %d, got: %v", offset, err)
+		}
+	}
+}
+
+func TestSaveLoadVotes(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDB := states.NewMemDB(spec)
+	blockDB := blocks.NewFileDB(spec, beacon.NewForkDecoder(spec, genesisValRoot), t.TempDir())
+
+	ctx := context.Background()
+	ch, err := NewHotColdChain(anchor, spec, stateDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hot := ch.HotChain.(*UnfinalizedChain)
+	anchorRoot := hot.ForkChoice.Pin().Root
+	first := td.addBlocks(t, ch, anchorRoot, anchorSlot+1)[0]
+	entry, ok := hot.ByBlockSlot(first.BlockRoot, first.Slot)
+	if !ok {
+		t.Fatal("missing first block")
+	}
+	state, err := entry.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc, err := entry.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := epc.GetBeaconCommittee(first.Slot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := state.CurrentJustifiedCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := spec.SlotToEpoch(first.Slot)
+	voter := committee[0]
+	// The validator votes for the anchor first, the later vote of the same epoch in the block is ignored.
+	if !hot.ForkChoice.ProcessAttestation(voter, anchorRoot, anchorSlot) {
+		t.Fatal("failed to process vote for anchor")
+	}
+	data := phase0.AttestationData{
+		Slot:            first.Slot,
+		Index:           0,
+		BeaconBlockRoot: first.BlockRoot,
+		Source:          source,
+		Target:          Checkpoint{Epoch: epoch, Root: anchorRoot},
+	}
+	sig := td.sign(t, state, voter, common.DOMAIN_BEACON_ATTESTER, epoch, data.HashTreeRoot(tree.GetHashFn()))
+	bits := make(phase0.AttestationBits, len(committee)/8+1)
+	bits[len(committee)/8] |= 1 << (len(committee) % 8)
+	bits.SetBit(0, true)
+	second := td.addBlockWith(t, ch, first.BlockRoot, first.Slot+1, func(body *altair.BeaconBlockBody) {
+		body.Attestations = phase0.Attestations{{AggregationBits: bits, Data: data, Signature: sig}}
+	})
+	for _, benv := range []*common.BeaconBlockEnvelope{first, second} {
+		if _, err := blockDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := hot.ForkChoice.LatestVotes()
+	if len(expected) != 1 || expected[0].Index != voter || expected[0].Root != anchorRoot {
+		t.Fatalf("expected vote of %d for anchor, got %v", voter, expected)
+	}
+
+	var buf bytes.Buffer
+	if err := ch.Save(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadHotColdChain(ctx, &buf, spec, stateDB, blockDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedHot := loaded.HotChain.(*UnfinalizedChain)
+	// Replaying the block must not change the votes of the snapshot.
+	if votes := loadedHot.ForkChoice.LatestVotes(); len(votes) != 1 || votes[0] != expected[0] {
+		t.Fatalf("expected votes %v, got %v", expected, votes)
+	}
+	// The vote store and the weights are the same, once the votes are applied.
+	if _, err := hot.ForkChoice.Head(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadedHot.ForkChoice.Head(); err != nil {
+		t.Fatal(err)
+	}
+	var a, b bytes.Buffer
+	if err := hot.ForkChoice.SnapshotVotes(&a); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadedHot.ForkChoice.SnapshotVotes(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Fatal("expected the same vote store after loading")
+	}
+	expectedTree, err := hot.ForkChoice.ExportTree(anchorRoot, anchorSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedTree, err := loadedHot.ForkChoice.ExportTree(anchorRoot, anchorSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expectedTree, loadedTree) {
+		t.Fatalf("expected the same forkchoice tree after loading:\n%v\n%v", expectedTree, loadedTree)
+	}
+}
@@ -0,0 +1,57 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/ztyp/tree"
+)
+
+// NewHotColdChainFromCheckpoint starts a chain from a finalized checkpoint state and its latest block,
+// instead of from genesis. The block is checked against the latest block header of the state, and stored in the blockDB.
+// The cold chain starts at the checkpoint, without any history before it:
+// the earlier blocks can be added later, backwards, with BackfillBlocks, and are stored in the blockDB.
+// The caller is expected to check that the checkpoint is recent enough, see common.IsWithinWeakSubjectivityPeriod.
+func NewHotColdChainFromCheckpoint(ctx context.Context, state common.BeaconState, block *common.BeaconBlockEnvelope,
+	spec *common.Spec, stateDB states.DB, blockDB blocks.DB) (*HotColdChain, error) {
+	if upgradeable, ok := state.(*beacon.StandardUpgradeableBeaconState); ok {
+		state = upgradeable.BeaconState
+	}
+	header, err := state.LatestBlockHeader()
+	if err != nil {
+		return nil, err
+	}
+	if header.StateRoot == (Root{}) {
+		header.StateRoot = state.HashTreeRoot(tree.GetHashFn())
+	}
+	if blockRoot := header.HashTreeRoot(tree.GetHashFn()); block.BlockRoot != blockRoot {
+		return nil, fmt.Errorf("checkpoint block %s does not match latest block header %s of state", block.BlockRoot, blockRoot)
+	}
+	if block.Slot != header.Slot || block.ParentRoot != header.ParentRoot ||
+		block.StateRoot != header.StateRoot || block.ProposerIndex != header.ProposerIndex {
+		return nil, fmt.Errorf("checkpoint block %s contents do not match latest block header of state", block.BlockRoot)
+	}
+	if _, err := blockDB.Store(ctx, block); err != nil {
+		return nil, fmt.Errorf("failed to store checkpoint block: %v", err)
+	}
+	c, err := NewHotColdChain(state, spec, stateDB)
+	if err != nil {
+		return nil, err
+	}
+	// Anchor the cold chain at the checkpoint. The anchor is finalized again when pruned from the hot chain.
+	hot := c.HotChain.(*UnfinalizedChain)
+	pin := hot.ForkChoice.Pin()
+	anchor, ok := hot.ByBlockSlot(pin.Root, pin.Slot)
+	if !ok {
+		return nil, fmt.Errorf("missing anchor entry %s:%d", pin.Root, pin.Slot)
+	}
+	if err := c.ColdChain.OnFinalizedEntry(ctx, anchor); err != nil {
+		return nil, fmt.Errorf("failed to anchor cold chain at checkpoint: %v", err)
+	}
+	// Backfilled blocks are stored in the blockDB as well.
+	c.ColdChain.(*FinalizedChain).BlockDB = blockDB
+	return c, nil
+}
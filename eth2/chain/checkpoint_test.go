@@ -0,0 +1,102 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+)
+
+func TestHotColdChainFromCheckpoint(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+
+	// Build two blocks on a chain from genesis, to sync from the second
+	src, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs := td.addBlocks(t, src, head.BlockRoot(), anchorSlot+1, anchorSlot+2)
+	checkpointEntry, ok := src.ByBlock(envs[1].BlockRoot)
+	if !ok {
+		t.Fatal("missing checkpoint entry")
+	}
+	checkpointState, err := checkpointEntry.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+	blockDB := blocks.NewFileDB(spec, dec, t.TempDir())
+
+	// A block that does not match the state is rejected
+	if _, err := NewHotColdChainFromCheckpoint(ctx, checkpointState, envs[0], spec, states.NewMemDB(spec), blockDB); err == nil {
+		t.Fatal("expected mismatching checkpoint block to be rejected")
+	}
+
+	ch, err := NewHotColdChainFromCheckpoint(ctx, checkpointState, envs[1], spec, states.NewMemDB(spec), blockDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start, end := ch.ColdStart(), ch.ColdEnd(); start != checkpointEntry.Step() || end != start+1 {
+		t.Fatalf("expected cold chain to start at checkpoint %s, got %s - %s", checkpointEntry.Step(), start, end)
+	}
+	if entry, ok := ch.ByStateRoot(envs[1].StateRoot); !ok || entry.BlockRoot() != envs[1].BlockRoot {
+		t.Fatal("missing checkpoint entry in chain")
+	}
+	if benv, err := blockDB.Get(ctx, envs[1].BlockRoot); err != nil || benv == nil {
+		t.Fatalf("checkpoint block was not stored: %v", err)
+	}
+
+	// Backfill
+	if next, err := ch.BackfillParent(ctx); err != nil || next != envs[0].BlockRoot {
+		t.Fatalf("expected to backfill parent %s of checkpoint, got %s (%v)", envs[0].BlockRoot, next, err)
+	}
+	if err := ch.BackfillBlocks(ctx, []*common.BeaconBlockEnvelope{envs[1]}); err == nil {
+		t.Fatal("expected backfill of non-parent block to fail")
+	}
+	if err := ch.BackfillBlocks(ctx, []*common.BeaconBlockEnvelope{envs[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if benv, err := blockDB.Get(ctx, envs[0].BlockRoot); err != nil || benv == nil {
+		t.Fatalf("backfilled block was not stored: %v", err)
+	}
+	if next, err := ch.BackfillParent(ctx); err != nil || next != envs[0].ParentRoot {
+		t.Fatalf("unexpected backfill progress, next: %s (%v)", next, err)
+	}
+	if entry, ok := ch.ByBlock(envs[0].BlockRoot); !ok || entry.Step() != AsStep(envs[0].Slot, true) {
+		t.Fatal("missing backfilled block in chain")
+	}
+}
+
+func TestWeakSubjectivityPeriod(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	// 64 validators with 32 ETH each: the top-ups dominate over the validator set churn.
+	N := uint64(64)
+	Delta := spec.MAX_DEPOSITS * uint64(spec.SLOTS_PER_EPOCH)
+	expected := spec.MIN_VALIDATOR_WITHDRAWABILITY_DELAY + common.Epoch(N*(200+3*common.SAFETY_DECAY)/(600*Delta))
+	if period := common.ComputeWeakSubjectivityPeriod(spec, td.epc); period != expected {
+		t.Fatalf("expected weak subjectivity period %d, got %d", expected, period)
+	}
+	if !common.IsWithinWeakSubjectivityPeriod(spec, td.epc, 10, 10+expected) {
+		t.Fatal("expected checkpoint to be within weak subjectivity period")
+	}
+	if common.IsWithinWeakSubjectivityPeriod(spec, td.epc, 10, 11+expected) {
+		t.Fatal("expected checkpoint to be outside of weak subjectivity period")
+	}
+}
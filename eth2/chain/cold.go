@@ -2,9 +2,12 @@ package chain
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
 	"github.com/protolambda/zrnt/eth2/db/states"
+	"io"
 	"sort"
 	"sync"
 )
@@ -13,6 +16,10 @@ type ColdChain interface {
 	ColdStart() Step
 	ColdEnd() Step
 	OnFinalizedEntry(ctx context.Context, entry ChainEntry) error
+	// BackfillBlocks prepends blocks before ColdStart, from latest to earliest, see FinalizedChain.BackfillBlocks.
+	BackfillBlocks(ctx context.Context, blocks []*common.BeaconBlockEnvelope) error
+	// BackfillParent returns the root of the next block to backfill, zero if the backfill reached genesis.
+	BackfillParent(ctx context.Context) (Root, error)
 	Chain
 }
 
@@ -75,6 +82,24 @@ type FinalizedChain struct {
 	Spec *common.Spec
 
 	StateDB states.DB
+
+	// BlockDB, if not nil, is used to regenerate states that are not in the StateDB, by replaying blocks.
+	// The blocks of the finalized chain are expected to be stored in it.
+	BlockDB blocks.DB
+
+	// SnapshotInterval is the number of epochs between states stored in the StateDB, if there is a BlockDB.
+	// The first state of the chain is always stored. If zero, all states are stored.
+	SnapshotInterval Epoch
+
+	// Recently regenerated states
+	regenCache *stateCache
+
+	// Backfill progress, see BackfillBlocks
+	backfillInit bool
+	// The step of the stored state that the backfill started from, the start of the chain until blocks are backfilled.
+	backfillAnchor Step
+	backfillParent Root
+	genesisValRoot Root
 }
 
 var _ ColdChain = (*FinalizedChain)(nil)
@@ -92,6 +117,18 @@ func NewFinalizedChain(spec *common.Spec, stateDB states.DB) *FinalizedChain {
 	}
 }
 
+// NewSparseFinalizedChain creates a finalized chain that only stores a state every snapshotInterval epochs.
+// Other states are regenerated from the closest earlier stored state by replaying the blocks from the blockDB.
+// Up to cacheSize regenerated states are kept in memory.
+func NewSparseFinalizedChain(spec *common.Spec, stateDB states.DB, blockDB blocks.DB,
+	snapshotInterval Epoch, cacheSize int) *FinalizedChain {
+	f := NewFinalizedChain(spec, stateDB)
+	f.BlockDB = blockDB
+	f.SnapshotInterval = snapshotInterval
+	f.regenCache = newStateCache(cacheSize)
+	return f
+}
+
 type ColdChainIter struct {
 	Chain              Chain
 	StartStep, EndStep Step
@@ -305,10 +342,10 @@ func (f *FinalizedChain) ByCanonStep(step Step) (entry ChainEntry, ok bool) {
 }
 
 func (f *FinalizedChain) byCanonStep(step Step) (entry ChainEntry, ok bool) {
-	if start := f.ColdStart(); step < start {
+	if start := f.start(); step < start {
 		return nil, false
 	}
-	if end := f.ColdEnd(); step >= end {
+	if end := f.end(); step >= end {
 		return nil, false
 	}
 	return &FinalizedEntryView{
@@ -324,14 +361,20 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 	blockRoot := entry.BlockRoot()
 
 	// If the chain is not empty, we need to verify consistency with what we add.
+	pad := false
 	if len(f.StateRoots) != 0 {
-		end := f.ColdEnd()
+		end := f.end()
+		// The last entry may be finalized again, e.g. the anchor of a chain started from a checkpoint.
+		if end == next+1 && f.StateRoots[len(f.StateRoots)-1] == entry.StateRoot() {
+			return nil
+		}
 		if end > next {
 			return fmt.Errorf("received finalized entry %s at %s, but already finalized up to later step %s", blockRoot, next, end)
 		}
 		// Any direct follow-up (block after slot, slot after block),
-		// or if the end is a gap slot, it may be left empty.
-		if !(end+1 == next || (!end.Block() && end+2 == next)) {
+		// or if the end is the block step of a gap slot, it may be left empty.
+		pad = end.Block() && end+1 == next
+		if !(end == next || pad) {
 			return fmt.Errorf("consistency issue, got %s and cannot append to %s", next, end)
 		}
 		// check parent root
@@ -342,12 +385,20 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 	}
 
 	// Before modifying the chain tracking, try to store the state, so it is safe to abort on error
-	state, err := entry.State(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve state of new finalized entry %s: %v", next, err)
+	if len(f.StateRoots) == 0 || f.isSnapshot(next) {
+		state, err := entry.State(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve state of new finalized entry %s: %v", next, err)
+		}
+		if err := f.StateDB.Store(ctx, state); err != nil {
+			return fmt.Errorf("failed to store state of new finalized entry %s: %v", next, err)
+		}
 	}
-	if err := f.StateDB.Store(ctx, state); err != nil {
-		return fmt.Errorf("failed to store state of new finalized entry %s: %v", next, err)
+
+	// The block step of a gap slot has the same block and state as the step before it.
+	if pad {
+		f.BlockRoots = append(f.BlockRoots, f.BlockRoots[len(f.BlockRoots)-1])
+		f.StateRoots = append(f.StateRoots, f.StateRoots[len(f.StateRoots)-1])
 	}
 
 	// Add block (may be a repeat of last)
@@ -364,6 +415,100 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 	return nil
 }
 
+// FinalizedChainSnapshotVersion is the version of the finalized chain encoding, see FinalizedChain.Save.
+const FinalizedChainSnapshotVersion uint64 = 2
+
+// finalizedChainSnapshot is the fixed-size part of the snapshot of a FinalizedChain.
+type finalizedChainSnapshot struct {
+	Version uint64
+	Start   Step
+	Count   uint64
+	// The backfill progress, zero if nothing was backfilled.
+	BackfillAnchor Step
+	BackfillParent Root
+}
+
+// Save writes the indices of the finalized chain: the start step, the backfill progress,
+// and the block and state root of every step. The encoding starts with the FinalizedChainSnapshotVersion.
+// The states themselves are already persisted in the StateDB.
+func (f *FinalizedChain) Save(w io.Writer) error {
+	f.RLock()
+	defer f.RUnlock()
+	header := finalizedChainSnapshot{
+		Version: FinalizedChainSnapshotVersion,
+		Start:   f.start(),
+		Count:   uint64(len(f.StateRoots)),
+	}
+	// The states of backfilled blocks are not stored, the backfill continues from the tracked progress.
+	if f.backfilled() {
+		header.BackfillAnchor = f.backfillAnchor
+		header.BackfillParent = f.backfillParent
+	}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	for i := range f.StateRoots {
+		if _, err := w.Write(f.BlockRoots[i][:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(f.StateRoots[i][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load replaces the indices of the finalized chain with those read from r, as written by Save.
+// The StateDB is expected to have the states of the loaded chain.
+func (f *FinalizedChain) Load(r io.Reader) error {
+	var header finalizedChainSnapshot
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("failed to read finalized chain header: %v", err)
+	}
+	if header.Version != FinalizedChainSnapshotVersion {
+		return fmt.Errorf("unsupported finalized chain snapshot version %d, expected %d",
+			header.Version, FinalizedChainSnapshotVersion)
+	}
+	start, count := header.Start, header.Count
+	// Don't trust the count for allocation, the roots are appended as they are read.
+	blockRoots := make([]Root, 0)
+	stateRoots := make([]Root, 0)
+	blockRootsMap := make(map[Root]Slot)
+	stateRootsMap := make(map[Root]Step)
+	for i := uint64(0); i < count; i++ {
+		var blockRoot, stateRoot Root
+		if _, err := io.ReadFull(r, blockRoot[:]); err != nil {
+			return fmt.Errorf("failed to read finalized block root %d: %v", i, err)
+		}
+		if _, err := io.ReadFull(r, stateRoot[:]); err != nil {
+			return fmt.Errorf("failed to read finalized state root %d: %v", i, err)
+		}
+		step := start + Step(i)
+		blockRoots = append(blockRoots, blockRoot)
+		if _, ok := blockRootsMap[blockRoot]; !ok {
+			blockRootsMap[blockRoot] = step.Slot()
+		}
+		stateRoots = append(stateRoots, stateRoot)
+		// Backfilled chains may have unknown states
+		if stateRoot == (Root{}) {
+			continue
+		}
+		if _, ok := stateRootsMap[stateRoot]; !ok {
+			stateRootsMap[stateRoot] = step
+		}
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.BlockRoots = blockRoots
+	f.StateRoots = stateRoots
+	f.BlockRootsMap = blockRootsMap
+	f.StateRootsMap = stateRootsMap
+	f.backfillInit = false
+	f.backfillAnchor = header.BackfillAnchor
+	f.backfillParent = header.BackfillParent
+	return nil
+}
+
 func (f *FinalizedChain) entryParentRoot(slot Slot) (root Root) {
 	return f.entryBlockRoot(AsStep(slot, false))
 }
@@ -373,7 +518,7 @@ func (f *FinalizedChain) entryBlockRoot(step Step) (root Root) {
 	defer f.RUnlock()
 	start := f.start()
 	end := f.end()
-	if start < step || step >= end {
+	if step < start || step >= end {
 		panic("out of bounds internal usage error")
 	}
 	return f.BlockRoots[step-start]
@@ -388,7 +533,7 @@ func (f *FinalizedChain) entryStateRoot(step Step) Root {
 func (f *FinalizedChain) stateRoot(step Step) Root {
 	start := f.start()
 	end := f.end()
-	if start < step || step >= end {
+	if step < start || step >= end {
 		panic("out of bounds internal usage error")
 	}
 	return f.StateRoots[step-start]
@@ -412,6 +557,11 @@ func (f *FinalizedChain) entryGetEpochsContext(ctx context.Context, step Step) (
 	if err := epc.LoadProposers(state); err != nil {
 		return nil, err
 	}
+	if syncState, ok := state.(common.SyncCommitteeBeaconState); ok {
+		if err := epc.LoadSyncCommittees(syncState); err != nil {
+			return nil, err
+		}
+	}
 	return epc, nil
 }
 
@@ -426,12 +576,18 @@ func (f *FinalizedChain) getState(ctx context.Context, step Step) (common.Beacon
 	if root == (common.Root{}) {
 		return nil, fmt.Errorf("unknown state, step out of range: %s", step)
 	}
-	state, err := f.StateDB.Get(ctx, root)
-	if err != nil {
-		return nil, err
+	// Only snapshot steps and the first step of the chain are stored
+	if f.isSnapshot(step) || step == f.start() {
+		state, err := f.StateDB.Get(ctx, root)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			return state, nil
+		}
 	}
-	if state == nil {
-		return nil, fmt.Errorf("state for state-root %x (step %s) does not exist: %v", root, step, err)
+	if f.BlockDB != nil {
+		return f.regenState(ctx, step)
 	}
-	return state, nil
+	return nil, fmt.Errorf("state for state-root %x (step %s) does not exist", root, step)
 }
@@ -0,0 +1,284 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func TestSparseFinalizedChain(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+	blockDB := blocks.NewFileDB(spec, dec, t.TempDir())
+
+	ctx := context.Background()
+	hot, err := NewUnfinalizedChain(anchor, BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := hot.ForkChoice.Pin()
+	anchorEntry, ok := hot.ByBlockSlot(pin.Root, pin.Slot)
+	if !ok {
+		t.Fatal("missing anchor entry")
+	}
+	entries := []ChainEntry{anchorEntry}
+	head := anchorEntry.BlockRoot()
+	blockSlots := map[Slot]bool{anchorSlot + 1: true, anchorSlot + 2: true, anchorSlot + 5: true, anchorSlot + 10: true}
+	for slot := anchorSlot + 1; slot <= anchorSlot+12; slot++ {
+		pre, err := hot.Towards(ctx, head, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, pre)
+		if !blockSlots[slot] {
+			continue
+		}
+		prev, ok := hot.ByBlockSlot(head, slot-1)
+		if !ok {
+			t.Fatalf("missing entry before slot %d", slot)
+		}
+		prevState, err := prev.State(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prevEpc, err := prev.EpochsContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		benv := td.buildAltairBlock(t, prevState, prevEpc, slot)
+		if err := hot.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := blockDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := hot.ByBlockSlot(benv.BlockRoot, slot)
+		if !ok {
+			t.Fatalf("missing block entry at slot %d", slot)
+		}
+		entries = append(entries, entry)
+		head = benv.BlockRoot
+	}
+
+	stateDB := &countingStateDB{DB: states.NewMemDB(spec)}
+	fin := NewSparseFinalizedChain(spec, stateDB, blockDB, 1, 2)
+	for _, entry := range entries {
+		if err := fin.OnFinalizedEntry(ctx, entry); err != nil {
+			t.Fatalf("failed to add entry %s: %v", entry.Step(), err)
+		}
+	}
+	// The anchor, and the gap slot at the start of the next epoch
+	if count := stateDB.Stats().Count; count != 2 {
+		t.Fatalf("expected 2 stored states, got %d", count)
+	}
+	if start, end := fin.ColdStart(), fin.ColdEnd(); start != entries[0].Step() || end != entries[len(entries)-1].Step()+1 {
+		t.Fatalf("unexpected cold chain range %s - %s", start, end)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		expected := entries[i]
+		entry, ok := fin.ByCanonStep(expected.Step())
+		if !ok {
+			t.Fatalf("missing finalized entry at %s", expected.Step())
+		}
+		if entry.BlockRoot() != expected.BlockRoot() {
+			t.Fatalf("expected block root %s at %s, got %s", expected.BlockRoot(), expected.Step(), entry.BlockRoot())
+		}
+		state, err := entry.State(ctx)
+		if err != nil {
+			t.Fatalf("failed to get state at %s: %v", expected.Step(), err)
+		}
+		if root := state.HashTreeRoot(tree.GetHashFn()); root != expected.StateRoot() {
+			t.Fatalf("expected state root %s at %s, got %s", expected.StateRoot(), expected.Step(), root)
+		}
+	}
+	// Only the stored snapshots are looked up
+	if stateDB.misses != 0 {
+		t.Fatalf("expected no lookups of states that are not stored, got %d", stateDB.misses)
+	}
+}
+
+// countingStateDB counts the lookups of states that are not in the DB.
+type countingStateDB struct {
+	states.DB
+	misses int
+}
+
+func (db *countingStateDB) Get(ctx context.Context, root Root) (common.BeaconState, error) {
+	state, err := db.DB.Get(ctx, root)
+	if state == nil {
+		db.misses++
+	}
+	return state, err
+}
+
+// testFinalizedEntry is a chain entry with fixed roots, to test the indexing of the finalized chain.
+type testFinalizedEntry struct {
+	step                          Step
+	parentRoot, blockRoot, stRoot Root
+	state                         common.BeaconState
+}
+
+func (e *testFinalizedEntry) Step() Step {
+	return e.step
+}
+
+func (e *testFinalizedEntry) BlockRoot() Root {
+	return e.blockRoot
+}
+
+func (e *testFinalizedEntry) ParentRoot() Root {
+	return e.parentRoot
+}
+
+func (e *testFinalizedEntry) StateRoot() Root {
+	return e.stRoot
+}
+
+func (e *testFinalizedEntry) EpochsContext(ctx context.Context) (*common.EpochsContext, error) {
+	return nil, nil
+}
+
+func (e *testFinalizedEntry) State(ctx context.Context) (common.BeaconState, error) {
+	return e.state, nil
+}
+
+// testFinalizedEntries creates entries of a finalized chain, starting with a block at slot 4,
+// followed by a gap slot 5, and a block at slot 6.
+func testFinalizedEntries(spec *common.Spec) []*testFinalizedEntry {
+	state := phase0.NewBeaconStateView(spec)
+	return []*testFinalizedEntry{
+		{AsStep(4, true), Root{3}, Root{4}, Root{0x10}, state},
+		{AsStep(5, false), Root{4}, Root{4}, Root{0x11}, state},
+		{AsStep(6, false), Root{4}, Root{4}, Root{0x12}, state},
+		{AsStep(6, true), Root{4}, Root{6}, Root{0x13}, state},
+	}
+}
+
+func TestFinalizedChainGapSlot(t *testing.T) {
+	spec := testSpec()
+	ctx := context.Background()
+	fin := NewFinalizedChain(spec, states.NewMemDB(spec))
+	for _, e := range testFinalizedEntries(spec) {
+		if err := fin.OnFinalizedEntry(ctx, e); err != nil {
+			t.Fatalf("failed to add entry %s: %v", e.step, err)
+		}
+	}
+	if start, end := fin.ColdStart(), fin.ColdEnd(); start != AsStep(4, true) || end != AsStep(7, false) {
+		t.Fatalf("unexpected cold chain range %s - %s", start, end)
+	}
+	// The block step of the gap slot repeats the slot step, the later steps are not shifted.
+	expected := []struct {
+		step             Step
+		blockRoot, state Root
+	}{
+		{AsStep(4, true), Root{4}, Root{0x10}},
+		{AsStep(5, false), Root{4}, Root{0x11}},
+		{AsStep(5, true), Root{4}, Root{0x11}},
+		{AsStep(6, false), Root{4}, Root{0x12}},
+		{AsStep(6, true), Root{6}, Root{0x13}},
+	}
+	for _, e := range expected {
+		entry, ok := fin.ByCanonStep(e.step)
+		if !ok {
+			t.Fatalf("missing entry at %s", e.step)
+		}
+		if entry.BlockRoot() != e.blockRoot || entry.StateRoot() != e.state {
+			t.Fatalf("step %s: expected block %s and state %s, got %s and %s",
+				e.step, e.blockRoot, e.state, entry.BlockRoot(), entry.StateRoot())
+		}
+	}
+	// The gap slot state is known by its slot step
+	if entry, ok := fin.ByStateRoot(Root{0x11}); !ok || entry.Step() != AsStep(5, false) {
+		t.Fatalf("expected gap slot state at step 5:0, got %v", entry)
+	}
+	if entry, ok := fin.ByBlockSlot(Root{4}, 5); !ok || entry.StateRoot() != (Root{0x11}) {
+		t.Fatalf("expected gap slot entry of block 4 at slot 5, got %v", entry)
+	}
+}
+
+func TestFinalizedChainAppend(t *testing.T) {
+	spec := testSpec()
+	ctx := context.Background()
+	fin := NewFinalizedChain(spec, states.NewMemDB(spec))
+	entries := testFinalizedEntries(spec)
+	if err := fin.OnFinalizedEntry(ctx, entries[0]); err != nil {
+		t.Fatal(err)
+	}
+	// The end step is exclusive, an entry after a slot step cannot skip to the block step of the next slot.
+	skip := &testFinalizedEntry{AsStep(5, true), Root{4}, Root{5}, Root{0x20}, entries[0].state}
+	if err := fin.OnFinalizedEntry(ctx, skip); err == nil {
+		t.Fatal("expected entry that skips a step to fail")
+	}
+	// An earlier step cannot be finalized again with a different state
+	again := *entries[0]
+	again.stRoot = Root{0x20}
+	if err := fin.OnFinalizedEntry(ctx, &again); err == nil {
+		t.Fatal("expected entry before the end to fail")
+	}
+	// The entry at the end step is appended
+	if err := fin.OnFinalizedEntry(ctx, entries[1]); err != nil {
+		t.Fatalf("expected entry at the end step to be appended: %v", err)
+	}
+	if end := fin.ColdEnd(); end != AsStep(5, true) {
+		t.Fatalf("expected end 5:1, got %s", end)
+	}
+	// Only the block step of a gap slot may be left empty
+	if err := fin.OnFinalizedEntry(ctx, entries[3]); err == nil {
+		t.Fatal("expected entry that skips a slot step to fail")
+	}
+	if err := fin.OnFinalizedEntry(ctx, entries[2]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinalizedChainBounds(t *testing.T) {
+	spec := testSpec()
+	ctx := context.Background()
+	fin := NewFinalizedChain(spec, states.NewMemDB(spec))
+	entries := testFinalizedEntries(spec)
+	for _, e := range entries {
+		if err := fin.OnFinalizedEntry(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every step within the range can be read, not just the start step
+	for _, e := range entries {
+		if root := fin.entryBlockRoot(e.step); root != e.blockRoot {
+			t.Fatalf("step %s: expected block root %s, got %s", e.step, e.blockRoot, root)
+		}
+		if root := fin.entryStateRoot(e.step); root != e.stRoot {
+			t.Fatalf("step %s: expected state root %s, got %s", e.step, e.stRoot, root)
+		}
+	}
+	outOfBounds := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected %s to panic", name)
+			}
+		}()
+		fn()
+	}
+	for _, step := range []Step{fin.ColdStart() - 1, fin.ColdEnd()} {
+		outOfBounds("block root of step "+step.String(), func() { fin.entryBlockRoot(step) })
+		outOfBounds("state root of step "+step.String(), func() { fin.entryStateRoot(step) })
+	}
+	if _, ok := fin.ByCanonStep(fin.ColdEnd()); ok {
+		t.Fatal("expected no entry at the end step")
+	}
+}
@@ -0,0 +1,143 @@
+package chain
+
+import (
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultEventBuffer is the buffer size of a subscription, if none is specified.
+const DefaultEventBuffer = 64
+
+// ChainEvent is implemented by all the event types that a chain emits to its subscribers:
+// *BlockEvent, *HeadEvent, *ReorgEvent, *JustifiedEvent, *FinalizedEvent, *MigrationEvent and *AttesterSlashingEvent.
+type ChainEvent interface {
+	isChainEvent()
+}
+
+// BlockEvent is emitted when a block is added to the hot chain.
+type BlockEvent struct {
+	Entry ChainEntry
+}
+
+// HeadEvent is emitted when the head of the chain changes.
+type HeadEvent struct {
+	Head     BlockSlotKey
+	Previous BlockSlotKey
+}
+
+// ReorgEvent is emitted, after the HeadEvent, when the new head does not build on the previous head.
+type ReorgEvent struct {
+	OldHead BlockSlotKey
+	NewHead BlockSlotKey
+	// CommonAncestor is the last block that the old and new head both build on.
+	CommonAncestor BlockSlotKey
+	// Depth is the number of slots of the old head that were reverted, after the common ancestor.
+	Depth uint64
+}
+
+// JustifiedEvent is emitted when the justified checkpoint of the forkchoice changes.
+type JustifiedEvent struct {
+	Checkpoint Checkpoint
+	Previous   Checkpoint
+}
+
+// FinalizedEvent is emitted when the finalized checkpoint of the forkchoice changes.
+// The pruned entries are emitted before this event.
+type FinalizedEvent struct {
+	Checkpoint Checkpoint
+	Previous   Checkpoint
+}
+
+// MigrationEvent is emitted when a canonical entry moves from the hot chain to the cold chain.
+type MigrationEvent struct {
+	Entry ChainEntry
+}
+
+// AttesterSlashingEvent is emitted when the votes of added attestations are slashable.
+// The attestation signatures may not be verified, the slashing is a candidate, e.g. for the operations pool.
+// The vote weight of the validators is only removed once the slashing is verified, see AddAttesterSlashing.
+type AttesterSlashingEvent struct {
+	Slashing *phase0.AttesterSlashing
+}
+
+func (*BlockEvent) isChainEvent()            {}
+func (*HeadEvent) isChainEvent()             {}
+func (*ReorgEvent) isChainEvent()            {}
+func (*JustifiedEvent) isChainEvent()        {}
+func (*FinalizedEvent) isChainEvent()        {}
+func (*MigrationEvent) isChainEvent()        {}
+func (*AttesterSlashingEvent) isChainEvent() {}
+
+type ChainEvents interface {
+	// Subscribe starts a subscription to the events of the chain, buffering up to the given number of events.
+	// If the buffer is full, new events are dropped for the subscriber, the chain does not block.
+	Subscribe(buffer int) *Subscription
+}
+
+// EventFeed delivers chain events to all its subscriptions, without blocking on slow subscribers.
+type EventFeed struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewEventFeed() *EventFeed {
+	return &EventFeed{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe adds a subscription with the given buffer size, or DefaultEventBuffer if the size is not positive.
+func (f *EventFeed) Subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+	sub := &Subscription{feed: f, ch: make(chan ChainEvent, buffer)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[sub] = struct{}{}
+	return sub
+}
+
+// Send delivers the event to every subscription that has buffer space left.
+func (f *EventFeed) Send(ev ChainEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (f *EventFeed) unsubscribe(sub *Subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[sub]; !ok {
+		return
+	}
+	delete(f.subs, sub)
+	close(sub.ch)
+}
+
+// Subscription is a bounded queue of chain events for a single subscriber.
+type Subscription struct {
+	feed    *EventFeed
+	ch      chan ChainEvent
+	dropped uint64
+}
+
+// Events returns the channel to receive events from. It is closed when unsubscribing.
+func (s *Subscription) Events() <-chan ChainEvent {
+	return s.ch
+}
+
+// Dropped returns the number of events that were not delivered because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops the delivery of events, and closes the events channel. It is safe to call multiple times.
+func (s *Subscription) Unsubscribe() {
+	s.feed.unsubscribe(s)
+}
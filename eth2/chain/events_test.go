@@ -0,0 +1,119 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/states"
+)
+
+func TestEventFeed(t *testing.T) {
+	feed := NewEventFeed()
+	sub := feed.Subscribe(2)
+	for i := 0; i < 3; i++ {
+		feed.Send(&BlockEvent{})
+	}
+	if dropped := sub.Dropped(); dropped != 1 {
+		t.Fatalf("expected 1 dropped event, got %d", dropped)
+	}
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	feed.Send(&BlockEvent{})
+	count := 0
+	for range sub.Events() {
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 buffered events, got %d", count)
+	}
+}
+
+func TestHeadAndReorgEvents(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ch, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchorKey := BlockSlotKey{Root: head.BlockRoot(), Slot: anchorSlot}
+	sub := ch.Subscribe(0)
+	defer sub.Unsubscribe()
+	fc := ch.HotChain.(*UnfinalizedChain).ForkChoice
+
+	// Two competing blocks that both build on the anchor
+	addBlock := func(slot Slot) *common.BeaconBlockEnvelope {
+		return td.addBlocks(t, ch, anchorKey.Root, slot)[0]
+	}
+	nextEvent := func() ChainEvent {
+		t.Helper()
+		select {
+		case ev := <-sub.Events():
+			return ev
+		default:
+			t.Fatal("expected event")
+			return nil
+		}
+	}
+
+	a := addBlock(anchorSlot + 1)
+	if ev, ok := nextEvent().(*BlockEvent); !ok || ev.Entry.BlockRoot() != a.BlockRoot {
+		t.Fatalf("expected block event for %s, got %v", a.BlockRoot, ev)
+	}
+	fc.ProcessAttestation(0, a.BlockRoot, a.Slot)
+	if _, err := ch.Head(); err != nil {
+		t.Fatal(err)
+	}
+	// Drain the head changes towards the first block
+	keyA := BlockSlotKey{Root: a.BlockRoot, Slot: a.Slot}
+	for {
+		ev, ok := nextEvent().(*HeadEvent)
+		if !ok {
+			t.Fatalf("expected head event, got %v", ev)
+		}
+		if ev.Head == keyA {
+			break
+		}
+	}
+
+	b := addBlock(anchorSlot + 2)
+	if ev, ok := nextEvent().(*BlockEvent); !ok || ev.Entry.BlockRoot() != b.BlockRoot {
+		t.Fatalf("expected block event for %s, got %v", b.BlockRoot, ev)
+	}
+	// More votes for the second block cause a reorg
+	fc.ProcessAttestation(1, b.BlockRoot, b.Slot)
+	fc.ProcessAttestation(2, b.BlockRoot, b.Slot)
+	if _, err := ch.Head(); err != nil {
+		t.Fatal(err)
+	}
+	keyB := BlockSlotKey{Root: b.BlockRoot, Slot: b.Slot}
+	if ev, ok := nextEvent().(*HeadEvent); !ok || ev.Head != keyB || ev.Previous != keyA {
+		t.Fatalf("expected head event from %v to %v, got %v", keyA, keyB, ev)
+	}
+	expected := ReorgEvent{OldHead: keyA, NewHead: keyB, CommonAncestor: anchorKey, Depth: 1}
+	if ev, ok := nextEvent().(*ReorgEvent); !ok || *ev != expected {
+		t.Fatalf("expected reorg event %v, got %v", expected, ev)
+	}
+
+	// The reorg is remembered in the head history
+	hot := ch.HotChain.(*UnfinalizedChain)
+	last, ok := hot.LastReorg()
+	if !ok || last.OldHead != keyA || last.NewHead != keyB || last.CommonAncestor != anchorKey || last.Depth != 1 {
+		t.Fatalf("unexpected last reorg: %v", last)
+	}
+	changes := hot.HeadChanges()
+	if len(changes) == 0 || changes[len(changes)-1] != last {
+		t.Fatalf("expected reorg as last head change, got %v", changes)
+	}
+	stats := hot.HeadStats()
+	epoch := spec.SlotToEpoch(anchorSlot)
+	if len(stats) != 1 || stats[0].Epoch != epoch || stats[0].HeadChanges != uint64(len(changes)) ||
+		stats[0].Reorgs != 1 || stats[0].MaxDepth != 1 {
+		t.Fatalf("unexpected head stats: %v", stats)
+	}
+}
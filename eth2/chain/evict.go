@@ -0,0 +1,211 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/ztyp/tree"
+	"sort"
+)
+
+// StateEvictionPolicy bounds the number of states that the hot chain keeps in memory,
+// for when the chain does not finalize for a long time.
+// The states at epoch boundaries and of recent heads are kept, other states are evicted first.
+// Evicted states are regenerated on demand, by replaying blocks from the nearest kept ancestor.
+type StateEvictionPolicy struct {
+	// MaxStates is the memory budget, in number of hot states. Zero to keep all states.
+	// The anchor, justified, finalized and head states are always kept, and may exceed the budget.
+	MaxStates int
+	// RecentHeads is the number of latest blocks to keep the state of, besides the head.
+	RecentHeads int
+}
+
+// hotRegen is shared by the entries of a hot chain, to regenerate evicted states with.
+type hotRegen struct {
+	spec    *common.Spec
+	blockDB blocks.DB
+}
+
+// SetStateEviction starts evicting states from memory, following the given policy.
+// The blocks of the chain are stored in the blockDB, to regenerate states with.
+func (uc *UnfinalizedChain) SetStateEviction(blockDB blocks.DB, policy StateEvictionPolicy) {
+	uc.Lock()
+	defer uc.Unlock()
+	uc.regen.blockDB = blockDB
+	uc.eviction = policy
+	uc.evictStates()
+}
+
+// regenState replays the blocks and slots from the nearest ancestor that still has its state.
+func (e *HotEntry) regenState(ctx context.Context) (common.BeaconState, error) {
+	var path []*HotEntry
+	base := e
+	for {
+		base.stateLock.RLock()
+		state, pre := base.state, base.pre
+		base.stateLock.RUnlock()
+		if state != nil {
+			break
+		}
+		if pre == nil {
+			return nil, fmt.Errorf("no ancestor with state to regenerate %s:%d from", e.self.Root, e.self.Slot)
+		}
+		path = append(path, base)
+		base = pre
+	}
+	if e.regen == nil || e.regen.blockDB == nil {
+		return nil, fmt.Errorf("no block DB to regenerate state of %s:%d", e.self.Root, e.self.Slot)
+	}
+	spec := e.regen.spec
+	state, err := base.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+	epc := base.epc.Clone()
+	for i := len(path) - 1; i >= 0; i-- {
+		next := path[i]
+		if next.Step().Block() {
+			benv, err := e.regen.blockDB.Get(ctx, next.self.Root)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get block %s to regenerate state: %v", next.self.Root, err)
+			}
+			if benv == nil {
+				return nil, fmt.Errorf("missing block %s to regenerate state", next.self.Root)
+			}
+			// The block was verified when it was added, the state root is checked at the end.
+			if err := common.PostSlotTransition(ctx, spec, epc, state, benv, false); err != nil {
+				return nil, fmt.Errorf("failed to replay block %s: %v", next.self.Root, err)
+			}
+		} else {
+			upgradeable := &beacon.StandardUpgradeableBeaconState{BeaconState: state}
+			if err := common.ProcessSlots(ctx, spec, epc, upgradeable, next.self.Slot); err != nil {
+				return nil, fmt.Errorf("failed to replay slot processing to slot %d: %v", next.self.Slot, err)
+			}
+			state = upgradeable.BeaconState
+		}
+	}
+	if root := state.HashTreeRoot(tree.GetHashFn()); root != e.stateRoot {
+		return nil, fmt.Errorf("regenerated state of %s:%d has root %s, expected %s", e.self.Root, e.self.Slot, root, e.stateRoot)
+	}
+	return state, nil
+}
+
+// clone copies the entry, with the same state, and the clones of the entries it was transitioned from.
+// The clones that were made already are tracked in clones, to share them between the entries that transition from them.
+// The entries that the state was transitioned from may already be pruned, these are cloned too.
+func (e *HotEntry) clone(clones map[*HotEntry]*HotEntry) *HotEntry {
+	if c, ok := clones[e]; ok {
+		return c
+	}
+	e.stateLock.RLock()
+	state, pre := e.state, e.pre
+	e.stateLock.RUnlock()
+	c := &HotEntry{
+		self:      e.self,
+		parent:    e.parent,
+		epc:       e.epc,
+		stateRoot: e.stateRoot,
+		state:     state,
+		regen:     e.regen,
+		proposer:  e.proposer,
+	}
+	if pre != nil {
+		c.pre = pre.clone(clones)
+	}
+	clones[e] = c
+	return c
+}
+
+// evict drops the state of the entry, if it can be regenerated.
+func (e *HotEntry) evict() bool {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	if e.state == nil || e.pre == nil {
+		return false
+	}
+	e.state = nil
+	return true
+}
+
+// detach forgets the entry that the state was transitioned from, if the entry still has its state.
+// This releases the history of pruned entries, without breaking the regeneration of any later entry.
+func (e *HotEntry) detach() {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	if e.state != nil {
+		e.pre = nil
+	}
+}
+
+// evictStates drops states that are not needed, until the chain is within the memory budget of the policy.
+// States of recent blocks and of the head, justified and finalized entries are kept.
+// Then the states at epoch boundaries are kept, and evicted last, oldest first.
+// The states of the given entries are kept as well, e.g. an entry that is about to be used.
+func (uc *UnfinalizedChain) evictStates(keepEntries ...*HotEntry) {
+	if uc.eviction.MaxStates <= 0 || uc.regen.blockDB == nil {
+		return
+	}
+	count := 0
+	blockEntries := make([]*HotEntry, 0)
+	for _, entry := range uc.Entries {
+		entry.stateLock.RLock()
+		if entry.state != nil {
+			count++
+		}
+		entry.stateLock.RUnlock()
+		if entry.Step().Block() {
+			blockEntries = append(blockEntries, entry)
+		}
+	}
+	if count <= uc.eviction.MaxStates {
+		return
+	}
+	keep := make(map[*HotEntry]struct{})
+	for _, entry := range keepEntries {
+		keep[entry] = struct{}{}
+	}
+	sort.Slice(blockEntries, func(i, j int) bool {
+		return blockEntries[i].self.Slot > blockEntries[j].self.Slot
+	})
+	for i := 0; i < len(blockEntries) && i < uc.eviction.RecentHeads; i++ {
+		keep[blockEntries[i]] = struct{}{}
+	}
+	if entry, ok := uc.Entries[uc.head]; ok {
+		keep[entry] = struct{}{}
+	}
+	for _, cp := range []Checkpoint{uc.ForkChoice.Justified(), uc.ForkChoice.Finalized()} {
+		slot, _ := uc.Spec.EpochStartSlot(cp.Epoch)
+		if entry, ok := uc.Entries[BlockSlotKey{Root: cp.Root, Slot: slot}]; ok {
+			keep[entry] = struct{}{}
+		}
+	}
+	candidates := make([]*HotEntry, 0, len(uc.Entries))
+	for _, entry := range uc.Entries {
+		if _, ok := keep[entry]; !ok {
+			candidates = append(candidates, entry)
+		}
+	}
+	isBoundary := func(e *HotEntry) bool {
+		return e.self.Slot%uc.Spec.SLOTS_PER_EPOCH == 0
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if isBoundary(a) != isBoundary(b) {
+			return !isBoundary(a)
+		}
+		if a.self.Slot != b.self.Slot {
+			return a.self.Slot < b.self.Slot
+		}
+		return a.Step() < b.Step()
+	})
+	for _, entry := range candidates {
+		if count <= uc.eviction.MaxStates {
+			break
+		}
+		if entry.evict() {
+			count--
+		}
+	}
+}
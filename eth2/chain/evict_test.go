@@ -0,0 +1,178 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func TestHotStateEviction(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+	hot, err := NewUnfinalizedChain(anchor, BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+	blockDB := blocks.NewFileDB(spec, dec, t.TempDir())
+	hot.SetStateEviction(blockDB, StateEvictionPolicy{MaxStates: 3, RecentHeads: 1})
+
+	var added []ChainEntry
+	for _, benv := range td.addBlocks(t, hot, hot.ForkChoice.Pin().Root, anchorSlot+1, anchorSlot+2, anchorSlot+4, anchorSlot+5) {
+		entry, ok := hot.ByBlockSlot(benv.BlockRoot, benv.Slot)
+		if !ok {
+			t.Fatalf("missing block at slot %d", benv.Slot)
+		}
+		added = append(added, entry)
+	}
+
+	kept := 0
+	for _, entry := range hot.Entries {
+		if entry.state != nil {
+			kept++
+		}
+	}
+	if kept > 3 {
+		t.Fatalf("expected at most 3 states in memory, got %d", kept)
+	}
+	first := added[0].(*HotEntry)
+	if first.state != nil {
+		t.Fatal("expected state of first block to be evicted")
+	}
+	if last := added[len(added)-1].(*HotEntry); last.state == nil {
+		t.Fatal("expected state of latest block to be kept")
+	}
+	// Evicted states are regenerated, with the same state root
+	for _, entry := range hot.Entries {
+		state, err := entry.State(ctx)
+		if err != nil {
+			t.Fatalf("failed to get state of %s: %v", entry.Step(), err)
+		}
+		if root := state.HashTreeRoot(tree.GetHashFn()); root != entry.StateRoot() {
+			t.Fatalf("state of %s has root %s, expected %s", entry.Step(), root, entry.StateRoot())
+		}
+	}
+	if first.state != nil {
+		t.Fatal("regenerated state should not be kept in memory")
+	}
+}
+
+// failingBlockDB fails to store blocks while fail is set.
+type failingBlockDB struct {
+	blocks.DB
+	fail bool
+}
+
+func (db *failingBlockDB) Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (bool, error) {
+	if db.fail {
+		return false, errors.New("disk full")
+	}
+	return db.DB.Store(ctx, benv)
+}
+
+func TestAddBlockStoreFailure(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+	hot, err := NewUnfinalizedChain(anchor, BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockDB := &failingBlockDB{DB: blocks.NewFileDB(spec, beacon.NewForkDecoder(spec, genesisValRoot), t.TempDir()), fail: true}
+	hot.SetStateEviction(blockDB, StateEvictionPolicy{MaxStates: 3, RecentHeads: 1})
+
+	preState, preEpc := td.blockPreState(t, hot, hot.ForkChoice.Pin().Root, anchorSlot+1)
+	benv := td.buildAltairBlock(t, preState, preEpc, anchorSlot+1)
+	if err := hot.AddBlock(ctx, benv); err == nil {
+		t.Fatal("expected block to not be added if it cannot be stored")
+	}
+	// The chain and forkchoice are not changed, the block can be retried.
+	if _, ok := hot.ByBlockSlot(benv.BlockRoot, benv.Slot); ok {
+		t.Fatal("unexpected entry of block that was not stored")
+	}
+	if _, ok := hot.ForkChoice.GetSlot(benv.BlockRoot); ok {
+		t.Fatal("unexpected forkchoice node of block that was not stored")
+	}
+	blockDB.fail = false
+	if err := hot.AddBlock(ctx, benv); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hot.ByBlockSlot(benv.BlockRoot, benv.Slot); !ok {
+		t.Fatal("missing block after retry")
+	}
+}
+
+func TestCopyStateEviction(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+	hot, err := NewUnfinalizedChain(anchor, BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+	hot.SetStateEviction(blocks.NewFileDB(spec, dec, t.TempDir()), StateEvictionPolicy{MaxStates: 3, RecentHeads: 1})
+
+	envs := td.addBlocks(t, hot, hot.ForkChoice.Pin().Root, anchorSlot+1)
+	c := hot.Copy(BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}))
+	for key, entry := range c.Entries {
+		if entry == hot.Entries[key] {
+			t.Fatalf("entry %s:%d is shared with the copy", key.Root, key.Slot)
+		}
+	}
+	// Evicting states of the original does not affect the copy, the copy does not evict states.
+	td.addBlocks(t, hot, envs[0].BlockRoot, anchorSlot+2, anchorSlot+4, anchorSlot+5)
+	first, ok := hot.Entries[BlockSlotKey{Root: envs[0].BlockRoot, Slot: envs[0].Slot}]
+	if !ok || first.state != nil {
+		t.Fatal("expected state of first block to be evicted from the original")
+	}
+	for key, entry := range c.Entries {
+		if entry.state == nil {
+			t.Fatalf("state of entry %s:%d of the copy was evicted", key.Root, key.Slot)
+		}
+	}
+	// Blocks added to the copy transition from the entries of the copy.
+	td.addBlocks(t, c, envs[0].BlockRoot, anchorSlot+3)
+	for key, entry := range c.Entries {
+		for pre := entry.pre; pre != nil; pre = pre.pre {
+			if pre == hot.Entries[pre.self] {
+				t.Fatalf("entry %s:%d of the copy transitions from an entry of the original", key.Root, key.Slot)
+			}
+		}
+		if _, err := entry.State(ctx); err != nil {
+			t.Fatalf("failed to get state of %s:%d of the copy: %v", key.Root, key.Slot, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"sync"
+)
+
+// ForkedColdChain is the cold part of a chain copy. It shares the cold chain it was forked from, without modifying it:
+// the shared chain is only queried up to where it ended at the time of forking,
+// and entries that are finalized in the copy are kept in a FinalizedChain of its own, with states in memory.
+type ForkedColdChain struct {
+	sync.RWMutex
+
+	// Base is the shared cold chain
+	Base ColdChain
+	// BaseEnd is the end step (exclusive) of the Base at the time of forking
+	BaseEnd Step
+
+	// Tail tracks the entries finalized after forking.
+	// If the Base is not empty, the Tail starts with the last entry of the Base, to check consistency against.
+	Tail *FinalizedChain
+}
+
+var _ ColdChain = (*ForkedColdChain)(nil)
+
+// NewForkedColdChain forks off the given cold chain, from where it ends now.
+func NewForkedColdChain(base ColdChain, spec *common.Spec) *ForkedColdChain {
+	tail := NewFinalizedChain(spec, states.NewMemDB(spec))
+	if fin, ok := base.(*FinalizedChain); ok {
+		fin.RLock()
+		tail.PubkeyCache = fin.PubkeyCache
+		fin.RUnlock()
+	}
+	return &ForkedColdChain{
+		Base:    base,
+		BaseEnd: base.ColdEnd(),
+		Tail:    tail,
+	}
+}
+
+// inBase checks if the entry is part of the shared chain, as it was at the time of forking.
+func (f *ForkedColdChain) inBase(entry ChainEntry, ok bool) (ChainEntry, bool) {
+	if !ok || entry.Step() >= f.BaseEnd {
+		return nil, false
+	}
+	return entry, true
+}
+
+// inTail checks if the entry is part of the tail, excluding the last entry of the Base it starts with.
+func (f *ForkedColdChain) inTail(entry ChainEntry, ok bool) (ChainEntry, bool) {
+	if !ok || entry.Step() < f.BaseEnd {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (f *ForkedColdChain) ColdStart() Step {
+	if f.BaseEnd == 0 {
+		return f.Tail.ColdStart()
+	}
+	return f.Base.ColdStart()
+}
+
+func (f *ForkedColdChain) ColdEnd() Step {
+	if end := f.Tail.ColdEnd(); end > f.BaseEnd {
+		return end
+	}
+	return f.BaseEnd
+}
+
+func (f *ForkedColdChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.Tail.ColdEnd() == 0 && f.BaseEnd != 0 {
+		last, ok := f.Base.ByCanonStep(f.BaseEnd - 1)
+		if !ok {
+			return fmt.Errorf("missing last entry %s of forked cold chain", f.BaseEnd-1)
+		}
+		if err := f.Tail.OnFinalizedEntry(ctx, last); err != nil {
+			return fmt.Errorf("failed to continue from last entry of forked cold chain: %v", err)
+		}
+	}
+	return f.Tail.OnFinalizedEntry(ctx, entry)
+}
+
+// BackfillBlocks is not supported by a fork: the shared cold chain is not modified by the copy.
+func (f *ForkedColdChain) BackfillBlocks(ctx context.Context, blocks []*common.BeaconBlockEnvelope) error {
+	return fmt.Errorf("cannot backfill forked cold chain")
+}
+
+// BackfillParent returns the next block to backfill of the chain that the fork starts with.
+func (f *ForkedColdChain) BackfillParent(ctx context.Context) (Root, error) {
+	if f.BaseEnd == 0 {
+		return f.Tail.BackfillParent(ctx)
+	}
+	return f.Base.BackfillParent(ctx)
+}
+
+func (f *ForkedColdChain) ByStateRoot(root Root) (entry ChainEntry, ok bool) {
+	if entry, ok := f.inTail(f.Tail.ByStateRoot(root)); ok {
+		return entry, true
+	}
+	return f.inBase(f.Base.ByStateRoot(root))
+}
+
+func (f *ForkedColdChain) ByBlock(root Root) (entry ChainEntry, ok bool) {
+	// The first occurrence of the block is looked for, the Tail may repeat the last block of the Base.
+	if entry, ok := f.inBase(f.Base.ByBlock(root)); ok {
+		return entry, true
+	}
+	return f.inTail(f.Tail.ByBlock(root))
+}
+
+func (f *ForkedColdChain) ByBlockSlot(root Root, slot Slot) (entry ChainEntry, ok bool) {
+	if entry, ok := f.inBase(f.Base.ByBlockSlot(root, slot)); ok {
+		return entry, true
+	}
+	return f.inTail(f.Tail.ByBlockSlot(root, slot))
+}
+
+func (f *ForkedColdChain) Search(parentRoot *Root, slot *Slot) ([]SearchEntry, error) {
+	base, err := f.Base.Search(parentRoot, slot)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := f.Tail.Search(parentRoot, slot)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]SearchEntry, 0, len(base)+len(tail))
+	for _, e := range base {
+		if e.Step() < f.BaseEnd {
+			out = append(out, e)
+		}
+	}
+	for _, e := range tail {
+		if e.Step() >= f.BaseEnd {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (f *ForkedColdChain) Closest(fromBlockRoot Root, toSlot Slot) (entry ChainEntry, ok bool) {
+	// The Tail knows the last block of the Base, and can continue from there.
+	if entry, ok := f.Tail.Closest(fromBlockRoot, toSlot); ok {
+		return entry, true
+	}
+	entry, ok = f.Base.Closest(fromBlockRoot, toSlot)
+	if !ok {
+		return nil, false
+	}
+	if entry.Step() < f.BaseEnd {
+		return entry, true
+	}
+	// The Base continued after forking, the closest known entry is then the last at the time of forking.
+	last, ok := f.Base.ByCanonStep(f.BaseEnd - 1)
+	if !ok || last.BlockRoot() != fromBlockRoot {
+		return nil, false
+	}
+	return last, true
+}
+
+func (f *ForkedColdChain) InSubtree(anchor Root, root Root) (unknown bool, inSubtree bool) {
+	// The cold chain is linear: anything later is in the subtree.
+	anchorEntry, ok := f.ByBlock(anchor)
+	if !ok {
+		return true, false
+	}
+	rootEntry, ok := f.ByBlock(root)
+	if !ok {
+		return true, false
+	}
+	return false, anchorEntry.Step().Slot() <= rootEntry.Step().Slot()
+}
+
+func (f *ForkedColdChain) ByCanonStep(step Step) (entry ChainEntry, ok bool) {
+	if step < f.BaseEnd {
+		return f.Base.ByCanonStep(step)
+	}
+	return f.Tail.ByCanonStep(step)
+}
+
+func (f *ForkedColdChain) Iter() (ChainIter, error) {
+	return &ColdChainIter{
+		Chain:     f,
+		StartStep: f.ColdStart(),
+		EndStep:   f.ColdEnd(),
+	}, nil
+}
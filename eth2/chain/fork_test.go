@@ -0,0 +1,144 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+)
+
+func TestHotColdChainCopy(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ch, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockDB := blocks.NewFileDB(spec, beacon.NewForkDecoder(spec, genesisValRoot), t.TempDir())
+	ch.HotChain.(*UnfinalizedChain).SetStateEviction(blockDB, StateEvictionPolicy{})
+	addBlock := func(ch *HotColdChain, parent Root, slot Slot) *common.BeaconBlockEnvelope {
+		benv := td.addBlocks(t, ch, parent, slot)[0]
+		ch.HotChain.(*UnfinalizedChain).ForkChoice.ProcessAttestation(benv.ProposerIndex, benv.BlockRoot, benv.Slot)
+		return benv
+	}
+	anchorHead, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := addBlock(ch, anchorHead.BlockRoot(), anchorSlot+1)
+
+	cp, err := ch.Copy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cp.ByBlock(a.BlockRoot); !ok {
+		t.Fatal("copy is missing block of original")
+	}
+	b := addBlock(cp, a.BlockRoot, anchorSlot+2)
+
+	if _, ok := cp.ByBlock(b.BlockRoot); !ok {
+		t.Fatal("copy is missing its own block")
+	}
+	if head, err := cp.Head(); err != nil {
+		t.Fatal(err)
+	} else if head.BlockRoot() != b.BlockRoot {
+		t.Fatalf("expected copy head %s, got %s", b.BlockRoot, head.BlockRoot())
+	}
+	if _, ok := ch.ByBlock(b.BlockRoot); ok {
+		t.Fatal("block of copy was added to original")
+	}
+	if _, ok := ch.ByStateRoot(b.StateRoot); ok {
+		t.Fatal("state of copy was added to original")
+	}
+	if _, exists := blockDB.Size(a.BlockRoot); !exists {
+		t.Fatal("expected block of original in block DB")
+	}
+	if _, exists := blockDB.Size(b.BlockRoot); exists {
+		t.Fatal("block of copy was stored in block DB of original")
+	}
+	if head, err := ch.Head(); err != nil {
+		t.Fatal(err)
+	} else if head.BlockRoot() != a.BlockRoot {
+		t.Fatalf("expected original head %s, got %s", a.BlockRoot, head.BlockRoot())
+	}
+	if votes := ch.HotChain.(*UnfinalizedChain).ForkChoice.LatestVotes(); len(votes) != 1 {
+		t.Fatalf("expected 1 vote in original, got %d", len(votes))
+	}
+}
+
+func TestForkedColdChain(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+	hot, err := NewUnfinalizedChain(anchor, BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool) error {
+		return nil
+	}), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := hot.ForkChoice.Pin()
+	anchorEntry, ok := hot.ByBlockSlot(pin.Root, pin.Slot)
+	if !ok {
+		t.Fatal("missing anchor entry")
+	}
+	entries := []ChainEntry{anchorEntry}
+	for slot := anchorSlot + 1; slot <= anchorSlot+6; slot++ {
+		entry, err := hot.Towards(ctx, pin.Root, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	stateDB := states.NewMemDB(spec)
+	base := NewFinalizedChain(spec, stateDB)
+	for _, entry := range entries[:3] {
+		if err := base.OnFinalizedEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	baseEnd := base.ColdEnd()
+	baseCount := stateDB.Stats().Count
+	forked := NewForkedColdChain(base, spec)
+	for _, entry := range entries[3:] {
+		if err := forked.OnFinalizedEntry(ctx, entry); err != nil {
+			t.Fatalf("failed to add entry %s: %v", entry.Step(), err)
+		}
+	}
+	if end := base.ColdEnd(); end != baseEnd {
+		t.Fatalf("base cold chain changed from end %s to %s", baseEnd, end)
+	}
+	if count := stateDB.Stats().Count; count != baseCount {
+		t.Fatalf("expected %d states in base state DB, got %d", baseCount, count)
+	}
+	if start, end := forked.ColdStart(), forked.ColdEnd(); start != entries[0].Step() || end != entries[len(entries)-1].Step()+1 {
+		t.Fatalf("unexpected forked cold chain range %s - %s", start, end)
+	}
+	for _, expected := range entries {
+		entry, ok := forked.ByCanonStep(expected.Step())
+		if !ok {
+			t.Fatalf("missing forked entry at %s", expected.Step())
+		}
+		if entry.StateRoot() != expected.StateRoot() {
+			t.Fatalf("expected state root %s at %s, got %s", expected.StateRoot(), expected.Step(), entry.StateRoot())
+		}
+		if byRoot, ok := forked.ByStateRoot(expected.StateRoot()); !ok || byRoot.Step() != expected.Step() {
+			t.Fatalf("failed to find forked entry at %s by state root", expected.Step())
+		}
+	}
+	last := entries[len(entries)-1]
+	if closest, ok := forked.Closest(pin.Root, last.Step().Slot()); !ok || closest.Step() != last.Step() {
+		t.Fatalf("expected closest entry at %s", last.Step())
+	}
+}
@@ -0,0 +1,145 @@
+package chain
+
+import (
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"sort"
+	"sync"
+)
+
+// DefaultHeadHistoryLimit is the number of head changes that the hot chain remembers.
+const DefaultHeadHistoryLimit = 1024
+
+// HeadChange describes a change of the head block of the chain.
+type HeadChange struct {
+	// Slot of the new head
+	Slot    Slot
+	OldHead BlockSlotKey
+	NewHead BlockSlotKey
+	// CommonAncestor is the last block that the old and new head both build on.
+	// This is the old head itself if the chain did not reorg, or zero if the ancestor was pruned.
+	CommonAncestor BlockSlotKey
+	// Depth is the number of blocks of the old head that were reverted, zero if the chain did not reorg.
+	Depth uint64
+}
+
+// Reorg returns true if the new head does not build on the old head.
+func (hc *HeadChange) Reorg() bool {
+	return hc.Depth > 0
+}
+
+// EpochHeadStats summarizes the head changes of an epoch.
+type EpochHeadStats struct {
+	Epoch       Epoch
+	HeadChanges uint64
+	Reorgs      uint64
+	MaxDepth    uint64
+}
+
+type HeadTracker interface {
+	// HeadChanges returns the remembered head changes, oldest first.
+	HeadChanges() []HeadChange
+	// LastReorg returns the latest head change that was a reorg, if any is remembered.
+	LastReorg() (change HeadChange, ok bool)
+	// HeadStats summarizes the remembered head changes per epoch, ordered by epoch.
+	// Epochs without head changes are omitted.
+	HeadStats() []EpochHeadStats
+}
+
+// HeadHistory remembers a bounded number of the latest head changes.
+type HeadHistory struct {
+	sync.RWMutex
+	spec    *common.Spec
+	limit   int
+	changes []HeadChange
+}
+
+var _ HeadTracker = (*HeadHistory)(nil)
+
+// NewHeadHistory creates a history that remembers up to limit head changes.
+func NewHeadHistory(spec *common.Spec, limit int) *HeadHistory {
+	return &HeadHistory{spec: spec, limit: limit}
+}
+
+func (h *HeadHistory) add(change HeadChange) {
+	h.Lock()
+	defer h.Unlock()
+	if h.limit <= 0 {
+		return
+	}
+	if len(h.changes) >= h.limit {
+		// drop the oldest changes, and reuse the slice
+		n := copy(h.changes, h.changes[len(h.changes)-h.limit+1:])
+		h.changes = h.changes[:n]
+	}
+	h.changes = append(h.changes, change)
+}
+
+// Copy returns an independent copy of the history.
+func (h *HeadHistory) Copy() *HeadHistory {
+	h.RLock()
+	defer h.RUnlock()
+	return &HeadHistory{
+		spec:    h.spec,
+		limit:   h.limit,
+		changes: append([]HeadChange(nil), h.changes...),
+	}
+}
+
+func (h *HeadHistory) HeadChanges() []HeadChange {
+	h.RLock()
+	defer h.RUnlock()
+	return append([]HeadChange(nil), h.changes...)
+}
+
+func (h *HeadHistory) LastReorg() (change HeadChange, ok bool) {
+	h.RLock()
+	defer h.RUnlock()
+	for i := len(h.changes) - 1; i >= 0; i-- {
+		if h.changes[i].Reorg() {
+			return h.changes[i], true
+		}
+	}
+	return HeadChange{}, false
+}
+
+func (h *HeadHistory) HeadStats() []EpochHeadStats {
+	h.RLock()
+	defer h.RUnlock()
+	byEpoch := make(map[Epoch]*EpochHeadStats)
+	for i := range h.changes {
+		change := &h.changes[i]
+		epoch := h.spec.SlotToEpoch(change.Slot)
+		stats, ok := byEpoch[epoch]
+		if !ok {
+			stats = &EpochHeadStats{Epoch: epoch}
+			byEpoch[epoch] = stats
+		}
+		stats.HeadChanges++
+		if change.Reorg() {
+			stats.Reorgs++
+			if change.Depth > stats.MaxDepth {
+				stats.MaxDepth = change.Depth
+			}
+		}
+	}
+	out := make([]EpochHeadStats, 0, len(byEpoch))
+	for _, stats := range byEpoch {
+		out = append(out, *stats)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Epoch < out[j].Epoch
+	})
+	return out
+}
+
+func (uc *UnfinalizedChain) HeadChanges() []HeadChange {
+	return uc.HeadHistory.HeadChanges()
+}
+
+func (uc *UnfinalizedChain) LastReorg() (change HeadChange, ok bool) {
+	return uc.HeadHistory.LastReorg()
+}
+
+func (uc *UnfinalizedChain) HeadStats() []EpochHeadStats {
+	return uc.HeadHistory.HeadStats()
+}
@@ -0,0 +1,126 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/db/states"
+)
+
+func TestHeadHistoryLimit(t *testing.T) {
+	spec := testSpec()
+	h := NewHeadHistory(spec, 3)
+	for i := Slot(1); i <= 5; i++ {
+		h.add(HeadChange{Slot: i, OldHead: BlockSlotKey{Slot: i - 1}, NewHead: BlockSlotKey{Slot: i}})
+	}
+	changes := h.HeadChanges()
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 remembered head changes, got %d", len(changes))
+	}
+	for i, change := range changes {
+		if expected := Slot(3 + i); change.Slot != expected {
+			t.Fatalf("expected head change %d at slot %d, got %d", i, expected, change.Slot)
+		}
+	}
+	if _, ok := h.LastReorg(); ok {
+		t.Fatal("expected no reorg")
+	}
+}
+
+func TestHeadStats(t *testing.T) {
+	spec := testSpec()
+	h := NewHeadHistory(spec, DefaultHeadHistoryLimit)
+	nextEpoch := Slot(spec.SLOTS_PER_EPOCH)
+	deep := HeadChange{Slot: 3, OldHead: BlockSlotKey{Root: Root{1}, Slot: 2}, NewHead: BlockSlotKey{Root: Root{2}, Slot: 3},
+		CommonAncestor: BlockSlotKey{Root: Root{3}, Slot: 0}, Depth: 2}
+	shallow := HeadChange{Slot: 4, OldHead: BlockSlotKey{Root: Root{2}, Slot: 3}, NewHead: BlockSlotKey{Root: Root{4}, Slot: 4},
+		CommonAncestor: BlockSlotKey{Root: Root{5}, Slot: 2}, Depth: 1}
+	extend := HeadChange{Slot: nextEpoch, OldHead: shallow.NewHead, NewHead: BlockSlotKey{Root: Root{6}, Slot: nextEpoch},
+		CommonAncestor: shallow.NewHead}
+	for _, change := range []HeadChange{deep, shallow, extend} {
+		h.add(change)
+	}
+	// The latest reorg is remembered, even if the head changed again since
+	if last, ok := h.LastReorg(); !ok || last != shallow {
+		t.Fatalf("expected last reorg %v, got %v", shallow, last)
+	}
+	stats := h.HeadStats()
+	expected := []EpochHeadStats{
+		{Epoch: 0, HeadChanges: 2, Reorgs: 2, MaxDepth: 2},
+		{Epoch: 1, HeadChanges: 1, Reorgs: 0, MaxDepth: 0},
+	}
+	if len(stats) != len(expected) {
+		t.Fatalf("expected stats of %d epochs, got %v", len(expected), stats)
+	}
+	for i := range expected {
+		if stats[i] != expected[i] {
+			t.Fatalf("expected stats %v, got %v", expected[i], stats[i])
+		}
+	}
+}
+
+func TestDeepReorg(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ch, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hot := ch.HotChain.(*UnfinalizedChain)
+	fc := hot.ForkChoice
+
+	// Two branches build on block c, the first with a gap slot before its head
+	//
+	//	anchor -- c -- a1 -- * -- a2
+	//	          |
+	//	          * -- b
+	c := td.addBlocks(t, ch, head.BlockRoot(), anchorSlot+1)[0]
+	a := td.addBlocks(t, ch, c.BlockRoot, anchorSlot+2, anchorSlot+4)
+	b := td.addBlocks(t, ch, c.BlockRoot, anchorSlot+3)[0]
+	keyA := BlockSlotKey{Root: a[1].BlockRoot, Slot: a[1].Slot}
+	keyB := BlockSlotKey{Root: b.BlockRoot, Slot: b.Slot}
+	keyC := BlockSlotKey{Root: c.BlockRoot, Slot: c.Slot}
+
+	fc.ProcessAttestation(0, keyA.Root, keyA.Slot)
+	if head, err := ch.Head(); err != nil || head.BlockRoot() != keyA.Root {
+		t.Fatalf("expected head %v, got %v (%v)", keyA, head, err)
+	}
+	if _, ok := hot.LastReorg(); ok {
+		t.Fatal("expected no reorg while extending the chain")
+	}
+	fc.ProcessAttestation(1, keyB.Root, keyB.Slot)
+	fc.ProcessAttestation(2, keyB.Root, keyB.Slot)
+	if head, err := ch.Head(); err != nil || head.BlockRoot() != keyB.Root {
+		t.Fatalf("expected head %v, got %v (%v)", keyB, head, err)
+	}
+
+	// The reorg reverts the blocks of the old head after block c, the gap slot is not counted
+	last, ok := hot.LastReorg()
+	expected := HeadChange{Slot: keyB.Slot, OldHead: keyA, NewHead: keyB, CommonAncestor: keyC, Depth: 2}
+	if !ok || last != expected {
+		t.Fatalf("expected last reorg %v, got %v", expected, last)
+	}
+	changes := hot.HeadChanges()
+	stats := hot.HeadStats()
+	if len(stats) != 1 || stats[0].Epoch != spec.SlotToEpoch(anchorSlot) || stats[0].HeadChanges != uint64(len(changes)) ||
+		stats[0].Reorgs != 1 || stats[0].MaxDepth != 2 {
+		t.Fatalf("unexpected head stats: %v", stats)
+	}
+
+	// An empty slot on top of the head block does not change the head block
+	if _, err := ch.Towards(context.Background(), keyB.Root, keyB.Slot+1); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := ch.Head(); err != nil || head.BlockRoot() != keyB.Root || head.Step().Slot() != keyB.Slot+1 {
+		t.Fatalf("expected head %s at slot %d, got %v (%v)", keyB.Root, keyB.Slot+1, head, err)
+	}
+	if after := hot.HeadChanges(); len(after) != len(changes) {
+		t.Fatalf("expected %d head changes after empty slot, got %d", len(changes), len(after))
+	}
+}
@@ -1,15 +1,23 @@
 package chain
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/beacon/sharding"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
 	"github.com/protolambda/zrnt/eth2/forkchoice"
 	"github.com/protolambda/zrnt/eth2/forkchoice/proto"
 	"github.com/protolambda/ztyp/tree"
+	"io"
+	"sort"
 	"sync"
 )
 
@@ -17,16 +25,28 @@ type HotEntry struct {
 	self   BlockSlotKey
 	parent Root
 	epc    *common.EpochsContext
-	state  common.BeaconState
+	// Root of the state, known even if the state is evicted
+	stateRoot Root
+
+	stateLock sync.RWMutex
+	// The state, nil if evicted from memory
+	state common.BeaconState
+	// The entry that the state was transitioned from, to regenerate an evicted state with. Nil for the anchor.
+	pre *HotEntry
+	// The blocks and spec to regenerate an evicted state with.
+	regen *hotRegen
+	// The proposer of the block, as in the block envelope. Only set if the entry has a block.
+	proposer ValidatorIndex
 }
 
 func NewHotEntry(self BlockSlotKey, parent Root,
 	state common.BeaconState, epc *common.EpochsContext) *HotEntry {
 	return &HotEntry{
-		self:   self,
-		parent: parent,
-		epc:    epc,
-		state:  state,
+		self:      self,
+		parent:    parent,
+		epc:       epc,
+		stateRoot: state.HashTreeRoot(tree.GetHashFn()),
+		state:     state,
 	}
 }
 
@@ -43,25 +63,40 @@ func (e *HotEntry) BlockRoot() (root Root) {
 }
 
 func (e *HotEntry) StateRoot() Root {
-	return e.state.HashTreeRoot(tree.GetHashFn())
+	return e.stateRoot
 }
 
 func (e *HotEntry) EpochsContext(context.Context) (*common.EpochsContext, error) {
 	return e.epc.Clone(), nil
 }
 
-func (e *HotEntry) State(context.Context) (common.BeaconState, error) {
+func (e *HotEntry) State(ctx context.Context) (common.BeaconState, error) {
+	e.stateLock.RLock()
+	state := e.state
+	e.stateLock.RUnlock()
+	if state == nil {
+		// The regenerated state is not shared, no need to copy it
+		return e.regenState(ctx)
+	}
 	// Return a copy of the view, the state itself may not be modified
-	return e.state.CopyState()
+	return state.CopyState()
 }
 
 type HotChain interface {
 	Chain
+	ChainEvents
+	HeadTracker
 	JustifiedCheckpoint() Checkpoint
 	FinalizedCheckpoint() Checkpoint
 	Justified() (ChainEntry, error)
 	Finalized() (ChainEntry, error)
 	Head() (ChainEntry, error)
+	// OptimisticHead returns the head, like Head, and whether the head is optimistic:
+	// the execution engine did not verify the execution payload of the head block yet.
+	OptimisticHead() (head ChainEntry, optimistic bool, err error)
+	// ProcessExecutionStatus updates the execution status of a block, once the execution engine responds,
+	// and the head if it changes as a result. Blocks with an invalid payload, and their descendants, are never the head.
+	ProcessExecutionStatus(ctx context.Context, blockRoot Root, status forkchoice.ExecutionStatus) error
 	// First gets the closets ref from the given block root to the requested slot,
 	// then transitions empty slots to get up to the requested slot.
 	// A strict context should be provided to avoid costly long transitions.
@@ -69,8 +104,20 @@ type HotChain interface {
 	Towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error)
 	// Process a block. If there is an error, the chain is not mutated, and can be continued to use.
 	AddBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error
-	// Process an attestation. If there is an error, the chain is not mutated, and can be continued to use.
-	AddAttestation(att *phase0.Attestation) error
+	// Process an attestation, received at the given current slot.
+	// Once the forkchoice clock has ticked (see OnTick), its current slot is used instead.
+	// If there is an error, the votes are not changed, and the chain can be continued to use.
+	AddAttestation(ctx context.Context, att *phase0.Attestation, currentSlot Slot) error
+	// Process a batch of indexed attestations, e.g. the attestations of a block.
+	// Like AddAttestation, the current slot of the forkchoice clock is used once it has ticked.
+	// If there is an error, none of the votes are changed, and the chain can be continued to use.
+	AddIndexedAttestations(ctx context.Context, atts []*phase0.IndexedAttestation, currentSlot Slot, fromBlock bool) error
+	// Process an attester slashing, after verifying it, to remove the vote weight of the equivocating validators.
+	// If there is an error, the votes are not changed, and the chain can be continued to use.
+	AddAttesterSlashing(ctx context.Context, slashing *phase0.AttesterSlashing) error
+	// OnTick updates the current time of the forkchoice, and the head if it changes as a result.
+	// After the first tick, updates of the justified checkpoint and attestations may be held back until later ticks.
+	OnTick(ctx context.Context, time common.Timestamp) error
 }
 
 type UnfinalizedChain struct {
@@ -93,8 +140,27 @@ type UnfinalizedChain struct {
 	// Non-canonical non-empty entries are still available, to track what is getting abandoned by the chain
 	BlockSink BlockSink
 
+	// The finalized checkpoint of the forkchoice update that is in progress, and may prune entries.
+	pruneFinalized Checkpoint
+
+	// Events delivers the changes of the chain to subscribers
+	Events *EventFeed
+
+	// The last head that was found, to detect head changes and reorgs with
+	head BlockSlotKey
+
+	// HeadHistory keeps track of the latest head changes
+	HeadHistory *HeadHistory
+
 	// Spec is holds configuration information for the parameters and types of the chain
 	Spec *common.Spec
+
+	// Forks is the fork schedule of the chain, to upgrade states and check blocks against
+	Forks *beacon.ForkSchedule
+
+	// Which states to keep in memory, see SetStateEviction
+	eviction StateEvictionPolicy
+	regen    *hotRegen
 }
 
 var _ HotChain = (*UnfinalizedChain)(nil)
@@ -175,16 +241,43 @@ func (fn BlockSinkFn) Sink(ctx context.Context, entry ChainEntry, canonical bool
 	return fn(ctx, entry, canonical)
 }
 
-func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, spec *common.Spec) (*UnfinalizedChain, error) {
-	fin, err := anchorState.FinalizedCheckpoint()
-	if err != nil {
-		return nil, err
+// FinalizedBlockSink is a BlockSink that also handles the finalized checkpoint that caused an entry to be pruned.
+// The hot chain calls SinkFinalized instead of Sink, if the sink implements it.
+type FinalizedBlockSink interface {
+	BlockSink
+	// SinkFinalized handles blocks like Sink, with the new finalized checkpoint that caused the entry to be pruned.
+	SinkFinalized(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error
+}
+
+type FinalizedBlockSinkFn func(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error
+
+// Sink handles the entry with a zero finalized checkpoint, the hot chain calls SinkFinalized instead.
+func (fn FinalizedBlockSinkFn) Sink(ctx context.Context, entry ChainEntry, canonical bool) error {
+	return fn(ctx, entry, canonical, Checkpoint{})
+}
+
+func (fn FinalizedBlockSinkFn) SinkFinalized(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error {
+	return fn(ctx, entry, canonical, finalized)
+}
+
+// NewUnfinalizedChain creates a hot chain, starting from the given anchor state, of any fork.
+// The EpochsContext of the anchor includes the fork-specific data, e.g. sync committees.
+func NewUnfinalizedChain(anchorState common.BeaconState, sink BlockSink, spec *common.Spec) (*UnfinalizedChain, error) {
+	// The chain tracks the fork-specific state types, not the upgradeable wrapper.
+	if upgradeable, ok := anchorState.(*beacon.StandardUpgradeableBeaconState); ok {
+		anchorState = upgradeable.BeaconState
 	}
-	just, err := anchorState.CurrentJustifiedCheckpoint()
+	just, fin, err := stateJustFin(anchorState)
 	if err != nil {
 		return nil, err
 	}
+	return newUnfinalizedChain(anchorState, just, fin, sink, spec)
+}
 
+// newUnfinalizedChain creates a hot chain from the given anchor state,
+// with a forkchoice that starts with the given justified and finalized checkpoints.
+func newUnfinalizedChain(anchorState common.BeaconState, just Checkpoint, fin Checkpoint,
+	sink BlockSink, spec *common.Spec) (*UnfinalizedChain, error) {
 	latestHeader, err := anchorState.LatestBlockHeader()
 	if err != nil {
 		return nil, err
@@ -202,31 +295,46 @@ func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, sp
 	if err != nil {
 		return nil, err
 	}
+	genesisValRoot, err := anchorState.GenesisValidatorsRoot()
+	if err != nil {
+		return nil, err
+	}
+	forks := beacon.NewForkSchedule(spec, genesisValRoot)
+	regen := &hotRegen{spec: spec}
 	anchor := BlockSlotKey{Root: anchorBlockRoot, Slot: slot}
 	anchorBlock := &HotEntry{
 		self: anchor,
 		// parent root may be equal to anchorBlockRoot if the anchor state is of a gap slot.
-		parent: latestHeader.ParentRoot,
-		epc:    epc,
-		state:  anchorState,
+		parent:    latestHeader.ParentRoot,
+		epc:       epc,
+		stateRoot: anchorState.HashTreeRoot(tree.GetHashFn()),
+		state:     anchorState,
+		regen:     regen,
+		proposer:  latestHeader.ProposerIndex,
 	}
 	uc := &UnfinalizedChain{
-		ForkChoice: nil,
-		Entries:    map[BlockSlotKey]*HotEntry{anchor: anchorBlock},
-		State2Key:  map[Root]BlockSlotKey{latestHeader.StateRoot: anchor},
-		BlockSink:  sink,
-		Spec:       spec,
+		ForkChoice:  nil,
+		Entries:     map[BlockSlotKey]*HotEntry{anchor: anchorBlock},
+		State2Key:   map[Root]BlockSlotKey{latestHeader.StateRoot: anchor},
+		BlockSink:   sink,
+		Events:      NewEventFeed(),
+		head:        anchor,
+		HeadHistory: NewHeadHistory(spec, DefaultHeadHistoryLimit),
+		Spec:        spec,
+		Forks:       forks,
+		regen:       regen,
 	}
-	balancesView, err := anchorState.Balances()
+	balances, err := stateJustifiedBalances(spec, anchorState)
 	if err != nil {
 		return nil, err
 	}
-	balances, err := balancesView.AllBalances()
+	genesisTime, err := anchorState.GenesisTime()
 	if err != nil {
 		return nil, err
 	}
 	fc, err := proto.NewProtoForkChoice(
 		spec,
+		genesisTime,
 		fin,
 		just,
 		anchorBlockRoot, slot,
@@ -241,6 +349,42 @@ func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, sp
 	return uc, nil
 }
 
+// Copy returns a copy of the hot chain, that sinks pruned entries into the given sink.
+// The states of the entries are immutable and shared, the entries, the forkchoice and the indices are copied:
+// changes to the copy do not affect this chain, and vice-versa. The copy has its own event feed.
+// The copy has no block DB: its blocks are not stored in the block DB of this chain, and its states are not evicted,
+// unless the copy is given its own block DB with SetStateEviction.
+func (uc *UnfinalizedChain) Copy(sink BlockSink) *UnfinalizedChain {
+	uc.RLock()
+	defer uc.RUnlock()
+	return uc.copy(sink)
+}
+
+func (uc *UnfinalizedChain) copy(sink BlockSink) *UnfinalizedChain {
+	c := &UnfinalizedChain{
+		Entries:     make(map[BlockSlotKey]*HotEntry, len(uc.Entries)),
+		State2Key:   make(map[Root]BlockSlotKey, len(uc.State2Key)),
+		BlockSink:   sink,
+		Events:      NewEventFeed(),
+		head:        uc.head,
+		HeadHistory: uc.HeadHistory.Copy(),
+		Spec:        uc.Spec,
+		Forks:       uc.Forks,
+		eviction:    uc.eviction,
+		regen:       &hotRegen{spec: uc.Spec},
+	}
+	// The entries are cloned, evicting a state or detaching an entry in one chain must not affect the other.
+	clones := make(map[*HotEntry]*HotEntry, len(uc.Entries))
+	for k, v := range uc.Entries {
+		c.Entries[k] = v.clone(clones)
+	}
+	for k, v := range uc.State2Key {
+		c.State2Key[k] = v
+	}
+	c.ForkChoice = uc.ForkChoice.Copy(proto.NodeSinkFn(c.onPrunedNode))
+	return c
+}
+
 // onPrunedNode handles when nodes leave the forkchoice, and thus get removed from the hot view of the chain.
 // Includes empty slots and nodes of the slot pre-block processing (even if the block exists)
 func (uc *UnfinalizedChain) onPrunedNode(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
@@ -254,7 +398,11 @@ func (uc *UnfinalizedChain) onPrunedNode(ctx context.Context, ref forkchoice.Nod
 	// Remove node from hot state
 	delete(uc.Entries, key)
 	delete(uc.State2Key, entry.StateRoot())
+	entry.detach()
 	// Move the node to the sink.
+	if sink, ok := uc.BlockSink.(FinalizedBlockSink); ok {
+		return sink.SinkFinalized(ctx, entry, canonical, uc.pruneFinalized)
+	}
 	return uc.BlockSink.Sink(ctx, entry, canonical)
 }
 
@@ -342,9 +490,43 @@ func stateJustFin(state common.BeaconState) (justified Checkpoint, finalized Che
 	return justifiedCh, finalizedCh, nil
 }
 
+// helper function to fetch the balances for vote weights from a justified state:
+// the effective balances of the active validators, zero for inactive validators.
+func stateJustifiedBalances(spec *common.Spec, state common.BeaconState) ([]forkchoice.Gwei, error) {
+	slot, err := state.Slot()
+	if err != nil {
+		return nil, err
+	}
+	vals, err := state.Validators()
+	if err != nil {
+		return nil, err
+	}
+	flat, err := common.FlattenValidators(vals)
+	if err != nil {
+		return nil, err
+	}
+	epoch := spec.SlotToEpoch(slot)
+	balances := make([]forkchoice.Gwei, len(flat), len(flat))
+	for i := range flat {
+		if flat[i].IsActive(epoch) {
+			balances[i] = flat[i].EffectiveBalance
+		}
+	}
+	return balances, nil
+}
+
 func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error) {
 	uc.Lock()
 	defer uc.Unlock()
+	entry, err := uc.towards(ctx, fromBlockRoot, toSlot)
+	if err != nil {
+		return nil, err
+	}
+	uc.evictStates(entry.(*HotEntry))
+	return entry, nil
+}
+
+func (uc *UnfinalizedChain) towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error) {
 	closest, ok := uc.closest(fromBlockRoot, toSlot)
 	if !ok {
 		return nil, fmt.Errorf("failed to find starting point to root %s to go towards slot %d", fromBlockRoot, toSlot)
@@ -363,7 +545,7 @@ func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toS
 		return nil, err
 	}
 
-	var last *HotEntry
+	last := closest.(*HotEntry)
 	// Process empty slots
 	for slot := closest.Step().Slot(); slot < toSlot; {
 		if err := common.ProcessSlot(ctx, uc.Spec, state); err != nil {
@@ -381,15 +563,14 @@ func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toS
 		if err := state.SetSlot(slot); err != nil {
 			return nil, err
 		}
-		// TODO: check for fork boundary, and execute state upgrade if necessary.
 		if isEpochEnd {
 			if err := epc.RotateEpochs(state); err != nil {
 				return nil, err
 			}
 		}
 
-		// Check for state upgrades
-		upgradeable := beacon.StandardUpgradeableBeaconState{BeaconState: state}
+		// Upgrade the state at fork boundaries. The entry tracks the upgraded state, and its state root.
+		upgradeable := beacon.StandardUpgradeableBeaconState{BeaconState: state, Forks: uc.Forks}
 		if err := upgradeable.UpgradeMaybe(ctx, uc.Spec, epc); err != nil {
 			return nil, fmt.Errorf("failed BeaconState upgrade-check/process: %v", err)
 		}
@@ -402,27 +583,37 @@ func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toS
 		// Make the forkchoice aware of this new slot
 		uc.ForkChoice.ProcessSlot(fromBlockRoot, slot, justified.Epoch, finalized.Epoch)
 		// Make the forkchoice aware of latest justified/finalized data. Lazy-fetch the balances if necessary.
-		if err := uc.ForkChoice.UpdateJustified(ctx, fromBlockRoot, finalized, justified,
+		// Entries pruned by a new finalized checkpoint are sinked with the checkpoint.
+		uc.pruneFinalized = finalized
+		prevJustified, prevFinalized := uc.ForkChoice.Justified(), uc.ForkChoice.Finalized()
+		// The balances may be fetched later, when the justified checkpoint update is held back until the next epoch.
+		justState := state
+		if err := uc.ForkChoice.UpdateJustified(ctx, fromBlockRoot, justified, finalized,
 			func() ([]forkchoice.Gwei, error) {
-				balancesView, err := state.Balances()
-				if err != nil {
-					return nil, err
-				}
-				return balancesView.AllBalances()
+				return stateJustifiedBalances(uc.Spec, justState)
 			}); err != nil {
 			return nil, fmt.Errorf("failed to update forkchoice with new justification data: %v", err)
 		}
+		if cp := uc.ForkChoice.Justified(); cp != prevJustified {
+			uc.Events.Send(&JustifiedEvent{Checkpoint: cp, Previous: prevJustified})
+		}
+		if cp := uc.ForkChoice.Finalized(); cp != prevFinalized {
+			uc.Events.Send(&FinalizedEvent{Checkpoint: cp, Previous: prevFinalized})
+		}
 
 		// Track the entry
 		key := BlockSlotKey{Root: fromBlockRoot, Slot: slot}
+		stateRoot := state.HashTreeRoot(tree.GetHashFn())
 		entry := &HotEntry{
-			self:   key,
-			epc:    epc,
-			state:  state,
-			parent: fromBlockRoot,
+			self:      key,
+			epc:       epc,
+			stateRoot: stateRoot,
+			state:     state,
+			parent:    fromBlockRoot,
+			pre:       last,
+			regen:     uc.regen,
 		}
 		uc.Entries[key] = entry
-		stateRoot := state.HashTreeRoot(tree.GetHashFn())
 		uc.State2Key[stateRoot] = key
 		last = entry
 
@@ -492,23 +683,169 @@ func (uc *UnfinalizedChain) Finalized() (ChainEntry, error) {
 func (uc *UnfinalizedChain) Head() (ChainEntry, error) {
 	uc.Lock()
 	defer uc.Unlock()
+	entry, _, err := uc.headEntry()
+	return entry, err
+}
+
+func (uc *UnfinalizedChain) OptimisticHead() (head ChainEntry, optimistic bool, err error) {
+	uc.Lock()
+	defer uc.Unlock()
+	entry, key, err := uc.headEntry()
+	if err != nil {
+		return nil, false, err
+	}
+	// Empty slots share the execution status of the block before them.
+	status, ok := uc.ForkChoice.ExecutionStatus(key.Root)
+	if !ok {
+		return nil, false, fmt.Errorf("unknown execution status of head %s:%d", key.Root, key.Slot)
+	}
+	return entry, status == forkchoice.ExecutionSyncing, nil
+}
+
+func (uc *UnfinalizedChain) headEntry() (ChainEntry, BlockSlotKey, error) {
 	ref, err := uc.ForkChoice.Head()
 	if err != nil {
-		return nil, err
+		return nil, BlockSlotKey{}, err
 	}
-	entry, ok := uc.byBlockSlot(BlockSlotKey{Root: ref.Root, Slot: ref.Slot})
+	key := BlockSlotKey{Root: ref.Root, Slot: ref.Slot}
+	entry, ok := uc.byBlockSlot(key)
 	if !ok {
-		return nil, fmt.Errorf("forkchoice found head node that is not in the hot chain: %s:%d",
+		return nil, BlockSlotKey{}, fmt.Errorf("forkchoice found head node that is not in the hot chain: %s:%d",
 			ref.Root, ref.Slot)
 	}
-	return entry, nil
+	uc.onHead(key)
+	return entry, key, nil
+}
+
+// onHead emits a HeadEvent if the head changed since it was last found, and a ReorgEvent if the
+// new head does not build on the previous head.
+// Only changes of the head block are remembered in the HeadHistory, not empty slots on top of the same head block.
+func (uc *UnfinalizedChain) onHead(head BlockSlotKey) {
+	prev := uc.head
+	if prev == head {
+		return
+	}
+	uc.head = head
+	uc.Events.Send(&HeadEvent{Head: head, Previous: prev})
+	if prev.Root == head.Root {
+		return
+	}
+	change := HeadChange{Slot: head.Slot, OldHead: prev, NewHead: head}
+	// The common ancestor may be unknown if the previous head was pruned, then there is no reorg to report.
+	if ancestor, depth, ok := uc.commonAncestor(prev.Root, head.Root); ok {
+		change.CommonAncestor = ancestor
+		change.Depth = depth
+	}
+	uc.HeadHistory.add(change)
+	if change.Reorg() {
+		uc.Events.Send(&ReorgEvent{
+			OldHead:        change.OldHead,
+			NewHead:        change.NewHead,
+			CommonAncestor: change.CommonAncestor,
+			Depth:          change.Depth,
+		})
+	}
+}
+
+// commonAncestor walks back the parents of the two block roots, until it finds a block that both build on.
+// The depth is the number of blocks of a after the common ancestor, zero if b builds on a.
+func (uc *UnfinalizedChain) commonAncestor(a Root, b Root) (ancestor BlockSlotKey, depth uint64, ok bool) {
+	aSlot, ok := uc.ForkChoice.GetSlot(a)
+	if !ok {
+		return BlockSlotKey{}, 0, false
+	}
+	bSlot, ok := uc.ForkChoice.GetSlot(b)
+	if !ok {
+		return BlockSlotKey{}, 0, false
+	}
+	for a != b {
+		// Step back the later of the two. At the same slot, the roots differ, and both are stepped back in turn.
+		if aSlot >= bSlot {
+			if a, aSlot, ok = uc.parentBlock(a, aSlot); !ok {
+				return BlockSlotKey{}, 0, false
+			}
+			depth++
+		} else {
+			if b, bSlot, ok = uc.parentBlock(b, bSlot); !ok {
+				return BlockSlotKey{}, 0, false
+			}
+		}
+	}
+	return BlockSlotKey{Root: a, Slot: aSlot}, depth, true
+}
+
+// parentBlock returns the parent block of the given block, if it is still in the hot chain.
+func (uc *UnfinalizedChain) parentBlock(root Root, slot Slot) (parent Root, parentSlot Slot, ok bool) {
+	entry, ok := uc.Entries[BlockSlotKey{Root: root, Slot: slot}]
+	if !ok || entry.parent == root {
+		return Root{}, 0, false
+	}
+	parentSlot, ok = uc.ForkChoice.GetSlot(entry.parent)
+	return entry.parent, parentSlot, ok
+}
+
+// checkTowardsFork checks that processing the slots towards the given slot results in a state of the given fork:
+// the state to process from is of the fork of its own slot, and the forks after it, up to the given fork,
+// are implemented to upgrade the state with.
+func (uc *UnfinalizedChain) checkTowardsFork(ctx context.Context, fromBlockRoot Root, toSlot Slot, fork *beacon.Fork) error {
+	closest, ok := uc.closest(fromBlockRoot, toSlot)
+	if !ok {
+		return fmt.Errorf("failed to find starting point to root %s to go towards slot %d", fromBlockRoot, toSlot)
+	}
+	state, err := closest.State(ctx)
+	if err != nil {
+		return err
+	}
+	stateFork, err := state.Fork()
+	if err != nil {
+		return err
+	}
+	slot := closest.Step().Slot()
+	current := uc.Forks.ForkAtSlot(slot)
+	if stateFork.CurrentVersion != current.Version {
+		return fmt.Errorf("pre-state of block at slot %d has fork version %s at slot %d, expected %s of fork %s",
+			toSlot, stateFork.CurrentVersion, slot, current.Version, current.Name)
+	}
+	upgrade := false
+	for _, f := range uc.Forks.Forks {
+		if upgrade {
+			if err := f.Implemented(); err != nil {
+				return fmt.Errorf("cannot upgrade pre-state of block at slot %d: %v", toSlot, err)
+			}
+		}
+		if f == fork {
+			break
+		}
+		if f == current {
+			upgrade = true
+		}
+	}
+	return nil
 }
 
 func (uc *UnfinalizedChain) AddBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error {
 	uc.Lock()
 	defer uc.Unlock()
+	if err := uc.addBlock(ctx, benv); err != nil {
+		return err
+	}
+	uc.evictStates()
+	return nil
+}
+
+func (uc *UnfinalizedChain) addBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error {
+	fork := uc.Forks.ForkAtSlot(benv.Slot)
+	if benv.ForkDigest != fork.Digest {
+		return fmt.Errorf("block fork digest %s does not match digest %s of fork %s at slot %d",
+			benv.ForkDigest, fork.Digest, fork.Name, benv.Slot)
+	}
+
+	// Check the fork of the pre-state before towards adds the empty slots to the chain.
+	if err := uc.checkTowardsFork(ctx, benv.ParentRoot, benv.Slot, fork); err != nil {
+		return err
+	}
 
-	pre, err := uc.Towards(ctx, benv.ParentRoot, benv.Slot)
+	pre, err := uc.towards(ctx, benv.ParentRoot, benv.Slot)
 	if err != nil {
 		return fmt.Errorf("failed to prepare for block, towards-slot failed: %v", err)
 	}
@@ -526,53 +863,295 @@ func (uc *UnfinalizedChain) AddBlock(ctx context.Context, benv *common.BeaconBlo
 	if err := common.PostSlotTransition(ctx, uc.Spec, epc, state, benv, true); err != nil {
 		return err
 	}
+	atts, equivocating, err := blockOperations(uc.Spec, epc, benv)
+	if err != nil {
+		return fmt.Errorf("failed to get attestations and attester slashings of block: %v", err)
+	}
 
 	justified, finalized, err := stateJustFin(state)
 	if err != nil {
 		return err
 	}
 
-	// Make the forkchoice aware of the new block
-	uc.ForkChoice.ProcessBlock(benv.ParentRoot, benv.BlockRoot, benv.Slot, justified.Epoch, finalized.Epoch)
+	// Regenerating evicted states replays the blocks, store the block before tracking it.
+	// Nothing is changed yet if storing fails, the block can be retried.
+	if uc.regen.blockDB != nil {
+		if _, err := uc.regen.blockDB.Store(ctx, benv); err != nil {
+			return fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+		}
+	}
+
+	// Make the forkchoice aware of the new block.
+	// A block with an execution payload is not validated until the execution engine reports on it.
+	if hasExecutionPayload(uc.Spec, benv) {
+		uc.ForkChoice.ProcessPayloadBlock(benv.ParentRoot, benv.BlockRoot, benv.Slot, justified.Epoch, finalized.Epoch)
+	} else {
+		uc.ForkChoice.ProcessBlock(benv.ParentRoot, benv.BlockRoot, benv.Slot, justified.Epoch, finalized.Epoch)
+	}
+	// A timely block gets the proposer boost, if the forkchoice is ticked.
+	uc.ForkChoice.ProcessProposerBoost(benv.BlockRoot, benv.Slot)
 
 	key := BlockSlotKey{Slot: benv.Slot, Root: benv.BlockRoot}
-	uc.Entries[key] = &HotEntry{
-		self:   key,
-		parent: benv.ParentRoot,
-		epc:    epc,
-		state:  state,
+	entry := &HotEntry{
+		self:      key,
+		parent:    benv.ParentRoot,
+		epc:       epc,
+		stateRoot: benv.StateRoot,
+		state:     state,
+		pre:       pre.(*HotEntry),
+		regen:     uc.regen,
+		proposer:  benv.ProposerIndex,
 	}
+	uc.Entries[key] = entry
 	uc.State2Key[benv.StateRoot] = key
+	uc.Events.Send(&BlockEvent{Entry: entry})
+
+	// The votes in the block may change the head as well
+	uc.applyBlockOperations(ctx, atts, equivocating)
 
+	// The block may change the head. If the head cannot be found, the next Head() call reports the error.
+	if ref, err := uc.ForkChoice.Head(); err == nil {
+		uc.onHead(BlockSlotKey{Root: ref.Root, Slot: ref.Slot})
+	}
 	return nil
 }
 
-// AddAttestation updates the forkchoice with the given attestation.
-// Warning: the attestation signature is not verified, it is up to the caller to verify.
-func (uc *UnfinalizedChain) AddAttestation(att *phase0.Attestation) error {
+// hasExecutionPayload checks if the block carries a non-empty execution payload.
+func hasExecutionPayload(spec *common.Spec, benv *common.BeaconBlockEnvelope) bool {
+	var payload *common.ExecutionPayload
+	switch b := benv.SignedBlock.(type) {
+	case *merge.SignedBeaconBlock:
+		payload = &b.Message.Body.ExecutionPayload
+	case *sharding.SignedBeaconBlock:
+		payload = &b.Message.Body.ExecutionPayload
+	default:
+		return false
+	}
+	empty := common.ExecutionPayloadType.DefaultNode().MerkleRoot(tree.GetHashFn())
+	return payload.HashTreeRoot(spec, tree.GetHashFn()) != empty
+}
+
+func (uc *UnfinalizedChain) OnTick(ctx context.Context, time common.Timestamp) error {
 	uc.Lock()
 	defer uc.Unlock()
+	prevJustified := uc.ForkChoice.Justified()
+	if err := uc.ForkChoice.OnTick(ctx, time); err != nil {
+		return err
+	}
+	if cp := uc.ForkChoice.Justified(); cp != prevJustified {
+		uc.Events.Send(&JustifiedEvent{Checkpoint: cp, Previous: prevJustified})
+	}
+	// The held back votes and justified checkpoint may change the head.
+	if ref, err := uc.ForkChoice.Head(); err == nil {
+		uc.onHead(BlockSlotKey{Root: ref.Root, Slot: ref.Slot})
+	}
+	return nil
+}
 
-	data := &att.Data
-	node, ok := uc.ByBlockSlot(data.BeaconBlockRoot, data.Slot)
-	if ok {
-		return fmt.Errorf("unknown block and slot pair: %s, %d", data.BeaconBlockRoot, data.Slot)
+func (uc *UnfinalizedChain) ProcessExecutionStatus(ctx context.Context, blockRoot Root, status forkchoice.ExecutionStatus) error {
+	uc.Lock()
+	defer uc.Unlock()
+	if !uc.ForkChoice.ProcessExecutionStatus(blockRoot, status) {
+		return fmt.Errorf("cannot change execution status of block %s to %s", blockRoot, status)
+	}
+	// An invalid payload may change the head.
+	if ref, err := uc.ForkChoice.Head(); err == nil {
+		uc.onHead(BlockSlotKey{Root: ref.Root, Slot: ref.Slot})
 	}
-	epc, err := node.EpochsContext(context.Background())
+	return nil
+}
+
+func (uc *UnfinalizedChain) Subscribe(buffer int) *Subscription {
+	return uc.Events.Subscribe(buffer)
+}
+
+// hotEntryRecord is the persisted form of a HotEntry, the state is stored separately or replayed.
+type hotEntryRecord struct {
+	Slot      Slot
+	Root      Root
+	Parent    Root
+	StateRoot Root
+}
+
+func (r *hotEntryRecord) step() Step {
+	return AsStep(r.Slot, r.Parent != r.Root)
+}
+
+// UnfinalizedChainSnapshotVersion is the version of the hot chain encoding, see UnfinalizedChain.Save.
+const UnfinalizedChainSnapshotVersion uint64 = 2
+
+// Save writes a snapshot of the hot chain: the forkchoice checkpoints, the chain entries, and the forkchoice votes.
+// The votes are written as a snapshot of the vote store, with the equivocating validators,
+// and the attestations to detect slashable votes with.
+// The state of the anchor entry (the finalized entry, or the pinned anchor if nothing was finalized since)
+// is stored in the given state DB, the other entries are rebuilt from the blocks by LoadUnfinalizedChain.
+// The encoding starts with the UnfinalizedChainSnapshotVersion.
+func (uc *UnfinalizedChain) Save(ctx context.Context, w io.Writer, stateDB states.DB) error {
+	uc.RLock()
+	defer uc.RUnlock()
+	justified := uc.ForkChoice.Justified()
+	finalized := uc.ForkChoice.Finalized()
+	// The chain starts at the pinned anchor, until the first finalization moves it to the finalized entry.
+	var anchorKey BlockSlotKey
+	if pin := uc.ForkChoice.Pin(); pin != nil {
+		anchorKey = BlockSlotKey{Root: pin.Root, Slot: pin.Slot}
+	} else {
+		finSlot, _ := uc.Spec.EpochStartSlot(finalized.Epoch)
+		anchorKey = BlockSlotKey{Root: finalized.Root, Slot: finSlot}
+	}
+	anchor, ok := uc.Entries[anchorKey]
+	if !ok {
+		return fmt.Errorf("missing anchor entry %s:%d", anchorKey.Root, anchorKey.Slot)
+	}
+	anchorState, err := anchor.State(ctx)
 	if err != nil {
 		return err
 	}
-	committee, err := epc.GetBeaconCommittee(data.Slot, data.Index)
-	if err != nil {
+	if err := stateDB.Store(ctx, anchorState); err != nil {
+		return fmt.Errorf("failed to store anchor state: %v", err)
+	}
+
+	records := make([]hotEntryRecord, 0, len(uc.Entries))
+	for key, entry := range uc.Entries {
+		records = append(records, hotEntryRecord{
+			Slot:      key.Slot,
+			Root:      key.Root,
+			Parent:    entry.parent,
+			StateRoot: entry.StateRoot(),
+		})
+	}
+	// Ordered by step, to replay parents before children.
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i].step(), records[j].step()
+		if a == b {
+			return bytes.Compare(records[i].Root[:], records[j].Root[:]) < 0
+		}
+		return a < b
+	})
+
+	if err := binary.Write(w, binary.LittleEndian, UnfinalizedChainSnapshotVersion); err != nil {
 		return err
 	}
-	indexedAtt, err := att.ConvertToIndexed(uc.Spec, committee)
-	if err != nil {
+	if err := binary.Write(w, binary.LittleEndian, [2]Checkpoint{justified, finalized}); err != nil {
 		return err
 	}
-	for _, index := range indexedAtt.AttestingIndices {
-		// the node should exist, unless pruned during attestation processing, fine to ignore.
-		_ = uc.ForkChoice.ProcessAttestation(index, data.BeaconBlockRoot, data.Slot)
+	if err := binary.Write(w, binary.LittleEndian, anchorKey); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(records))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, records); err != nil {
+		return err
+	}
+	if err := uc.ForkChoice.SnapshotVotes(w); err != nil {
+		return fmt.Errorf("failed to write forkchoice votes: %v", err)
 	}
 	return nil
 }
+
+// LoadUnfinalizedChain rebuilds a hot chain from a snapshot, as written by UnfinalizedChain.Save.
+// The anchor state is loaded from the state DB, and all blocks of the hot chain are replayed from the block DB.
+// The forkchoice is pinned to the anchor, and starts at the snapshot checkpoints and votes,
+// with the balances of the anchor state.
+func LoadUnfinalizedChain(ctx context.Context, r io.Reader, sink BlockSink, spec *common.Spec,
+	stateDB states.DB, blockDB blocks.DB) (*UnfinalizedChain, error) {
+	var version uint64
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, fmt.Errorf("failed to read hot chain snapshot version: %v", err)
+	}
+	if version != UnfinalizedChainSnapshotVersion {
+		return nil, fmt.Errorf("unsupported hot chain snapshot version %d, expected %d",
+			version, UnfinalizedChainSnapshotVersion)
+	}
+	var checkpoints [2]Checkpoint
+	if err := binary.Read(r, binary.LittleEndian, &checkpoints); err != nil {
+		return nil, fmt.Errorf("failed to read hot chain checkpoints: %v", err)
+	}
+	justified, finalized := checkpoints[0], checkpoints[1]
+	var anchorKey BlockSlotKey
+	if err := binary.Read(r, binary.LittleEndian, &anchorKey); err != nil {
+		return nil, fmt.Errorf("failed to read hot chain anchor: %v", err)
+	}
+	var count uint64
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	records := make([]hotEntryRecord, 0)
+	for i := uint64(0); i < count; i++ {
+		var rec hotEntryRecord
+		if err := binary.Read(r, binary.LittleEndian, &rec); err != nil {
+			return nil, fmt.Errorf("failed to read hot entry %d: %v", i, err)
+		}
+		records = append(records, rec)
+	}
+	votes, err := proto.RestoreProtoVoteStore(spec, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forkchoice votes: %v", err)
+	}
+
+	var anchorStateRoot Root
+	found := false
+	for i := range records {
+		if rec := &records[i]; rec.Slot == anchorKey.Slot && rec.Root == anchorKey.Root {
+			anchorStateRoot = rec.StateRoot
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("missing anchor entry %s:%d in snapshot", anchorKey.Root, anchorKey.Slot)
+	}
+	anchorState, err := stateDB.Get(ctx, anchorStateRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load anchor state %s: %v", anchorStateRoot, err)
+	}
+	if anchorState == nil {
+		return nil, fmt.Errorf("anchor state %s is not in state DB", anchorStateRoot)
+	}
+	uc, err := newUnfinalizedChain(anchorState, justified, finalized, sink, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	uc.Lock()
+	defer uc.Unlock()
+	for i := range records {
+		rec := &records[i]
+		key := BlockSlotKey{Root: rec.Root, Slot: rec.Slot}
+		// Entries before the anchor do not build on the anchor state, and are not restored.
+		if rec.Slot < anchorKey.Slot || (rec.Slot == anchorKey.Slot && key != anchorKey) {
+			continue
+		}
+		// Already restored, e.g. the anchor, or a pre-block entry restored with its block.
+		if _, ok := uc.Entries[key]; !ok {
+			if rec.step().Block() {
+				benv, err := blockDB.Get(ctx, rec.Root)
+				if err != nil {
+					return nil, fmt.Errorf("failed to load block %s: %v", rec.Root, err)
+				}
+				if benv == nil {
+					return nil, fmt.Errorf("block %s is not in block DB", rec.Root)
+				}
+				if err := uc.addBlock(ctx, benv); err != nil {
+					return nil, fmt.Errorf("failed to replay block %s at slot %d: %v", rec.Root, rec.Slot, err)
+				}
+			} else if _, err := uc.towards(ctx, rec.Parent, rec.Slot); err != nil {
+				return nil, fmt.Errorf("failed to replay empty slot %d after %s: %v", rec.Slot, rec.Parent, err)
+			}
+		}
+		entry, ok := uc.Entries[key]
+		if !ok {
+			return nil, fmt.Errorf("failed to restore entry %s:%d", rec.Root, rec.Slot)
+		}
+		if stateRoot := entry.StateRoot(); stateRoot != rec.StateRoot {
+			return nil, fmt.Errorf("restored entry %s:%d has state root %s, expected %s",
+				rec.Root, rec.Slot, stateRoot, rec.StateRoot)
+		}
+	}
+	// The replayed blocks added votes of their attestations again, the snapshot votes replace these.
+	if err := uc.ForkChoice.SetVotes(votes); err != nil {
+		return nil, fmt.Errorf("failed to restore forkchoice votes: %v", err)
+	}
+	return uc, nil
+}
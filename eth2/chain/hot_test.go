@@ -0,0 +1,325 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func TestAltairAnchor(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	if _, ok := anchor.(*altair.BeaconStateView); !ok {
+		t.Fatalf("expected altair anchor state, got %T", anchor)
+	}
+
+	ch, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc, err := head.EpochsContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epc.CurrentSyncCommittee == nil || epc.NextSyncCommittee == nil {
+		t.Fatal("expected sync committees in anchor EpochsContext")
+	}
+
+	for _, slot := range []Slot{anchorSlot + 1, anchorSlot + 2, anchorSlot + 4} {
+		benv := td.addBlocks(t, ch, head.BlockRoot(), slot)[0]
+		// Without votes the empty slot and the block are tied, have a validator vote for the block.
+		ch.HotChain.(*UnfinalizedChain).ForkChoice.ProcessAttestation(benv.ProposerIndex, benv.BlockRoot, benv.Slot)
+		head, err = ch.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.BlockRoot() != benv.BlockRoot {
+			t.Fatalf("expected head %s at slot %d, got %s", benv.BlockRoot, slot, head.BlockRoot())
+		}
+		if head.StateRoot() != benv.StateRoot {
+			t.Fatalf("expected head state root %s, got %s", benv.StateRoot, head.StateRoot())
+		}
+		if _, ok := ch.ByStateRoot(benv.StateRoot); !ok {
+			t.Fatalf("block state at slot %d not found", slot)
+		}
+		headState, err := head.State(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := headState.(*altair.BeaconStateView); !ok {
+			t.Fatalf("expected altair head state, got %T", headState)
+		}
+	}
+}
+
+func TestForkUpgradeTowards(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	// Anchor in phase0, before the Altair fork
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, spec.SLOTS_PER_EPOCH-3)
+	if _, ok := anchor.(*phase0.BeaconStateView); !ok {
+		t.Fatalf("expected phase0 anchor state, got %T", anchor)
+	}
+	ch, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Transition into the fork epoch
+	forkSlot := spec.SLOTS_PER_EPOCH
+	entry, err := ch.Towards(context.Background(), head.BlockRoot(), forkSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := entry.State(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.(*altair.BeaconStateView); !ok {
+		t.Fatalf("expected altair state at fork slot, got %T", state)
+	}
+	byRoot, ok := ch.ByStateRoot(entry.StateRoot())
+	if !ok {
+		t.Fatal("upgraded state is not tracked by state root")
+	}
+	if byRoot.Step() != entry.Step() {
+		t.Fatalf("expected entry at %s, got %s", entry.Step(), byRoot.Step())
+	}
+	epc, err := entry.EpochsContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epc.CurrentSyncCommittee == nil {
+		t.Fatal("expected sync committee in EpochsContext after upgrade")
+	}
+
+	// Build on top of the upgraded state
+	benv := td.buildAltairBlock(t, state, epc, forkSlot+1)
+
+	// A block with the digest of the previous fork is rejected
+	badEnv := *benv
+	genesisValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	badEnv.ForkDigest = common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genesisValRoot)
+	if err := ch.AddBlock(context.Background(), &badEnv); err == nil {
+		t.Fatal("expected block with phase0 fork digest to be rejected")
+	}
+
+	if err := ch.AddBlock(context.Background(), benv); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ch.ByStateRoot(benv.StateRoot); !ok {
+		t.Fatal("block post-state is not tracked by state root")
+	}
+}
+
+func TestOptimisticHead(t *testing.T) {
+	spec := testMergeSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ch, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchorHead, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pre, err := ch.Towards(context.Background(), anchorHead.BlockRoot(), anchorSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preState, err := pre.State(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	preEpc, err := pre.EpochsContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// A block without execution payload is valid, its status cannot be changed.
+	empty := td.buildMergeBlock(t, preState, preEpc, anchorSlot+1, common.Hash32{})
+	if err := ch.AddBlock(ctx, empty); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []forkchoice.ExecutionStatus{forkchoice.ExecutionValid, forkchoice.ExecutionSyncing, forkchoice.ExecutionInvalid} {
+		if err := ch.ProcessExecutionStatus(ctx, empty.BlockRoot, status); err == nil {
+			t.Fatalf("expected status %d of valid block to be rejected", status)
+		}
+	}
+
+	// The block with an execution payload is imported before the execution engine verified it
+	benv := td.buildMergeBlock(t, preState, preEpc, anchorSlot+2, common.Hash32{1})
+	if err := ch.AddBlock(ctx, benv); err != nil {
+		t.Fatal(err)
+	}
+	ch.HotChain.(*UnfinalizedChain).ForkChoice.ProcessAttestation(benv.ProposerIndex, benv.BlockRoot, benv.Slot)
+	head, optimistic, err := ch.OptimisticHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.BlockRoot() != benv.BlockRoot || !optimistic {
+		t.Fatalf("expected optimistic head %s, got %s (optimistic: %v)", benv.BlockRoot, head.BlockRoot(), optimistic)
+	}
+	if err := ch.ProcessExecutionStatus(ctx, benv.BlockRoot, forkchoice.ExecutionSyncing); err == nil {
+		t.Fatal("expected syncing block to not be marked as syncing again")
+	}
+
+	// The execution payload turns out to be invalid, the head falls back to the anchor.
+	sub := ch.Subscribe(10)
+	defer sub.Unsubscribe()
+	if err := ch.ProcessExecutionStatus(ctx, benv.BlockRoot, forkchoice.ExecutionInvalid); err != nil {
+		t.Fatal(err)
+	}
+	head, optimistic, err = ch.OptimisticHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.BlockRoot() != anchorHead.BlockRoot() || optimistic {
+		t.Fatalf("expected validated head %s, got %s (optimistic: %v)", anchorHead.BlockRoot(), head.BlockRoot(), optimistic)
+	}
+	select {
+	case ev := <-sub.Events():
+		if _, ok := ev.(*HeadEvent); !ok {
+			t.Fatalf("expected head event, got %T", ev)
+		}
+	default:
+		t.Fatal("expected head event after invalidation of the head")
+	}
+
+	// Invalid blocks stay invalid
+	for _, status := range []forkchoice.ExecutionStatus{forkchoice.ExecutionValid, forkchoice.ExecutionSyncing, forkchoice.ExecutionInvalid} {
+		if err := ch.ProcessExecutionStatus(ctx, benv.BlockRoot, status); err == nil {
+			t.Fatalf("expected status %d of invalid block to be rejected", status)
+		}
+	}
+
+	// Another payload block is validated, and is final once valid.
+	other := td.buildMergeBlock(t, preState, preEpc, anchorSlot+3, common.Hash32{2})
+	if err := ch.AddBlock(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ProcessExecutionStatus(ctx, other.BlockRoot, forkchoice.ExecutionValid); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []forkchoice.ExecutionStatus{forkchoice.ExecutionValid, forkchoice.ExecutionSyncing, forkchoice.ExecutionInvalid} {
+		if err := ch.ProcessExecutionStatus(ctx, other.BlockRoot, status); err == nil {
+			t.Fatalf("expected status %d of valid block to be rejected", status)
+		}
+	}
+}
+
+func TestJustifiedBalances(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	state, _ := td.processSlots(t, td.genesis, td.epc, spec.SLOTS_PER_EPOCH*2)
+	vals, err := state.Validators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An exited validator does not count towards the total active balance
+	exited, err := vals.Validator(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exited.SetExitEpoch(1); err != nil {
+		t.Fatal(err)
+	}
+	// A balance above the maximum effective balance weighs as much as the others
+	balancesView, err := state.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := balancesView.SetBalance(2, spec.MAX_EFFECTIVE_BALANCE*2); err != nil {
+		t.Fatal(err)
+	}
+
+	balances, err := stateJustifiedBalances(spec, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 64 {
+		t.Fatalf("expected 64 balances, got %d", len(balances))
+	}
+	for i, b := range balances {
+		expected := spec.MAX_EFFECTIVE_BALANCE
+		if i == 1 {
+			expected = 0
+		}
+		if b != expected {
+			t.Fatalf("validator %d: expected balance %d, got %d", i, expected, b)
+		}
+	}
+}
+
+func TestAddBlockForkMismatch(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH - 4
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	// A phase0 state with the version of the next fork
+	if err := anchor.(*phase0.BeaconStateView).SetFork(common.Fork{
+		PreviousVersion: spec.GENESIS_FORK_VERSION,
+		CurrentVersion:  spec.ALTAIR_FORK_VERSION,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hot := ch.HotChain.(*UnfinalizedChain)
+	sub := ch.Subscribe(10)
+	defer sub.Unsubscribe()
+	entries := len(hot.Entries)
+
+	// The block is checked against the fork of the slot, before any empty slots are processed
+	slot := anchorSlot + 2
+	genesisValRoot, err := anchor.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	benv := &common.BeaconBlockEnvelope{
+		ForkDigest: common.ComputeForkDigest(spec.ForkVersion(slot), genesisValRoot),
+		Slot:       slot,
+		ParentRoot: head.BlockRoot(),
+	}
+	if err := ch.AddBlock(context.Background(), benv); err == nil {
+		t.Fatal("expected block on pre-state of other fork to be rejected")
+	}
+	if len(hot.Entries) != entries {
+		t.Fatalf("expected %d entries, got %d", entries, len(hot.Entries))
+	}
+	if _, ok := hot.ByBlockSlot(head.BlockRoot(), anchorSlot+1); ok {
+		t.Fatal("expected no empty slot to be added")
+	}
+	select {
+	case ev := <-sub.Events():
+		t.Fatalf("expected no events, got %v", ev)
+	default:
+	}
+}
@@ -0,0 +1,111 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// OrphanedBlock is a block that was pruned from the hot chain, without becoming part of the finalized chain.
+type OrphanedBlock struct {
+	BlockRoot     Root
+	Slot          Slot
+	ParentRoot    Root
+	ProposerIndex ValidatorIndex
+	// Finalized is the finalized checkpoint that caused the block to be pruned
+	Finalized Checkpoint
+}
+
+type OrphanStore interface {
+	// AddOrphan records an orphaned block. Adding a block that is already known is a no-op.
+	AddOrphan(ctx context.Context, orphan *OrphanedBlock) error
+	// OrphansBySlot returns the orphaned blocks with start <= slot < end, ordered by slot.
+	OrphansBySlot(start Slot, end Slot) ([]OrphanedBlock, error)
+	// OrphansByProposer returns the orphaned blocks of the given proposer, ordered by slot.
+	OrphansByProposer(index ValidatorIndex) ([]OrphanedBlock, error)
+}
+
+type OrphanChain interface {
+	// OrphansBySlot returns the blocks that were abandoned by the chain with start <= slot < end, ordered by slot.
+	OrphansBySlot(start Slot, end Slot) ([]OrphanedBlock, error)
+	// OrphansByProposer returns the blocks of the given proposer that were abandoned by the chain, ordered by slot.
+	OrphansByProposer(index ValidatorIndex) ([]OrphanedBlock, error)
+}
+
+// MemOrphanStore keeps all orphaned blocks in memory.
+type MemOrphanStore struct {
+	sync.RWMutex
+	// Ordered by slot
+	orphans []OrphanedBlock
+	known   map[Root]struct{}
+}
+
+var _ OrphanStore = (*MemOrphanStore)(nil)
+
+func NewMemOrphanStore() *MemOrphanStore {
+	return &MemOrphanStore{known: make(map[Root]struct{})}
+}
+
+func (m *MemOrphanStore) AddOrphan(ctx context.Context, orphan *OrphanedBlock) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.known[orphan.BlockRoot]; ok {
+		return nil
+	}
+	m.known[orphan.BlockRoot] = struct{}{}
+	// insert after any orphans of the same slot
+	i := sort.Search(len(m.orphans), func(i int) bool {
+		return m.orphans[i].Slot > orphan.Slot
+	})
+	m.orphans = append(m.orphans, OrphanedBlock{})
+	copy(m.orphans[i+1:], m.orphans[i:])
+	m.orphans[i] = *orphan
+	return nil
+}
+
+func (m *MemOrphanStore) OrphansBySlot(start Slot, end Slot) ([]OrphanedBlock, error) {
+	m.RLock()
+	defer m.RUnlock()
+	i := sort.Search(len(m.orphans), func(i int) bool {
+		return m.orphans[i].Slot >= start
+	})
+	j := sort.Search(len(m.orphans), func(i int) bool {
+		return m.orphans[i].Slot >= end
+	})
+	if i >= j {
+		return nil, nil
+	}
+	return append([]OrphanedBlock(nil), m.orphans[i:j]...), nil
+}
+
+func (m *MemOrphanStore) OrphansByProposer(index ValidatorIndex) (out []OrphanedBlock, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	for i := range m.orphans {
+		if m.orphans[i].ProposerIndex == index {
+			out = append(out, m.orphans[i])
+		}
+	}
+	return out, nil
+}
+
+// entryToOrphan describes the block of a non-canonical hot chain entry.
+// The proposer is that of the block envelope the entry was added with, the state of the entry is not needed.
+func entryToOrphan(entry ChainEntry, finalized Checkpoint) (*OrphanedBlock, error) {
+	hotEntry, ok := entry.(*HotEntry)
+	if !ok {
+		return nil, fmt.Errorf("orphaned entry %s of type %T is not a hot entry", entry.Step(), entry)
+	}
+	step := entry.Step()
+	if !step.Block() {
+		return nil, fmt.Errorf("orphaned entry %s has no block", step)
+	}
+	return &OrphanedBlock{
+		BlockRoot:     entry.BlockRoot(),
+		Slot:          step.Slot(),
+		ParentRoot:    entry.ParentRoot(),
+		ProposerIndex: hotEntry.proposer,
+		Finalized:     finalized,
+	}, nil
+}
@@ -0,0 +1,118 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func TestOrphanedBlocks(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ch, err := NewHotColdChain(anchor, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two competing blocks that both build on the anchor
+	var forks []ChainEntry
+	for _, slot := range []Slot{anchorSlot + 1, anchorSlot + 2} {
+		benv := td.addBlocks(t, ch, head.BlockRoot(), slot)[0]
+		entry, ok := ch.ByBlock(benv.BlockRoot)
+		if !ok {
+			t.Fatalf("missing block entry at slot %d", slot)
+		}
+		forks = append(forks, entry)
+	}
+
+	finalized := Checkpoint{Epoch: 3, Root: forks[0].BlockRoot()}
+	orphan := forks[1]
+	// Pruned empty slots are not tracked
+	emptyEntry, ok := ch.ByBlockSlot(head.BlockRoot(), anchorSlot+1)
+	if !ok {
+		t.Fatal("missing empty slot entry")
+	}
+	if err := ch.hotToCold(ctx, emptyEntry, false, finalized); err != nil {
+		t.Fatal(err)
+	}
+	orphanState, err := orphan.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := orphanState.LatestBlockHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The orphan is described without its state: the state cannot be regenerated, the chain has no block DB.
+	if !orphan.(*HotEntry).evict() {
+		t.Fatal("failed to evict state of orphan")
+	}
+	if err := ch.hotToCold(ctx, orphan, false, finalized); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := OrphanedBlock{
+		BlockRoot:     orphan.BlockRoot(),
+		Slot:          anchorSlot + 2,
+		ParentRoot:    head.BlockRoot(),
+		ProposerIndex: header.ProposerIndex,
+		Finalized:     finalized,
+	}
+	bySlot, err := ch.OrphansBySlot(anchorSlot, anchorSlot+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bySlot) != 1 || bySlot[0] != expected {
+		t.Fatalf("unexpected orphans by slot: %v", bySlot)
+	}
+	if outside, err := ch.OrphansBySlot(anchorSlot, anchorSlot+2); err != nil {
+		t.Fatal(err)
+	} else if len(outside) != 0 {
+		t.Fatalf("expected no orphans before slot %d, got %v", anchorSlot+2, outside)
+	}
+	byProposer, err := ch.OrphansByProposer(header.ProposerIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byProposer) != 1 || byProposer[0] != expected {
+		t.Fatalf("unexpected orphans by proposer: %v", byProposer)
+	}
+}
+
+func TestFinalizedBlockSink(t *testing.T) {
+	spec := testSpec()
+	td := newTestChainData(t, spec, 64)
+	anchorSlot := spec.SLOTS_PER_EPOCH * 2
+	anchor, _ := td.processSlots(t, td.genesis, td.epc, anchorSlot)
+	ctx := context.Background()
+	var sinked []Checkpoint
+	hot, err := NewUnfinalizedChain(anchor, FinalizedBlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error {
+		sinked = append(sinked, finalized)
+		return nil
+	}), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	benv := td.addBlocks(t, hot, hot.ForkChoice.Pin().Root, anchorSlot+1)[0]
+
+	// Pruned entries are sinked with the finalized checkpoint that pruned them
+	finalized := Checkpoint{Epoch: 3, Root: Root{1}}
+	hot.Lock()
+	hot.pruneFinalized = finalized
+	err = hot.onPrunedNode(ctx, forkchoice.NodeRef{Root: benv.BlockRoot, Slot: benv.Slot}, false)
+	hot.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sinked) != 1 || sinked[0] != finalized {
+		t.Fatalf("expected entry to be sinked with checkpoint %v, got %v", finalized, sinked)
+	}
+}
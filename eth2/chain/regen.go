@@ -0,0 +1,144 @@
+package chain
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/ztyp/tree"
+	"sync"
+)
+
+// stateCache is a LRU cache of states, keyed by state root. A nil cache is empty.
+type stateCache struct {
+	sync.Mutex
+	size    int
+	order   *list.List
+	entries map[Root]*list.Element
+}
+
+type stateCacheEntry struct {
+	root  Root
+	state common.BeaconState
+}
+
+func newStateCache(size int) *stateCache {
+	return &stateCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[Root]*list.Element, size),
+	}
+}
+
+// get returns the cached state, the state must not be modified.
+func (c *stateCache) get(root Root) (common.BeaconState, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[root]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*stateCacheEntry).state, true
+}
+
+func (c *stateCache) add(root Root, state common.BeaconState) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.entries[root]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[root] = c.order.PushFront(&stateCacheEntry{root: root, state: state})
+	for c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*stateCacheEntry).root)
+	}
+}
+
+// isSnapshot checks if the state of the step is stored in the StateDB.
+func (f *FinalizedChain) isSnapshot(step Step) bool {
+	if f.BlockDB == nil || f.SnapshotInterval == 0 {
+		return true
+	}
+	return step.Slot()%(Slot(f.SnapshotInterval)*f.Spec.SLOTS_PER_EPOCH) == 0
+}
+
+// regenState regenerates the state of the given step,
+// by replaying the blocks from the closest earlier state that is cached or stored.
+// Only the closest earlier snapshot step (or the first step of the chain) is looked up in the StateDB.
+func (f *FinalizedChain) regenState(ctx context.Context, step Step) (common.BeaconState, error) {
+	target := f.stateRoot(step)
+	if state, ok := f.regenCache.get(target); ok {
+		return state.CopyState()
+	}
+	start := f.start()
+	var state common.BeaconState
+	base := step
+	for base > start {
+		base--
+		root := f.stateRoot(base)
+		if cached, ok := f.regenCache.get(root); ok {
+			copied, err := cached.CopyState()
+			if err != nil {
+				return nil, err
+			}
+			state = copied
+			break
+		}
+		if base == start || f.isSnapshot(base) {
+			stored, err := f.StateDB.Get(ctx, root)
+			if err != nil {
+				return nil, err
+			}
+			state = stored
+			break
+		}
+	}
+	if state == nil {
+		return nil, fmt.Errorf("no stored state to regenerate state of step %s from", step)
+	}
+	epc, err := common.NewEpochsContext(f.Spec, state)
+	if err != nil {
+		return nil, err
+	}
+	for s := base + 1; s <= step; s++ {
+		if s.Block() {
+			blockRoot := f.BlockRoots[s-start]
+			// Gap slot, the block step has the same state as the slot step.
+			if blockRoot == f.BlockRoots[s-1-start] {
+				continue
+			}
+			benv, err := f.BlockDB.Get(ctx, blockRoot)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get block %s to regenerate step %s: %v", blockRoot, s, err)
+			}
+			if benv == nil {
+				return nil, fmt.Errorf("missing block %s to regenerate step %s", blockRoot, s)
+			}
+			// The block is finalized, and the state root is checked at the end.
+			if err := common.PostSlotTransition(ctx, f.Spec, epc, state, benv, false); err != nil {
+				return nil, fmt.Errorf("failed to replay block %s at step %s: %v", blockRoot, s, err)
+			}
+		} else {
+			upgradeable := &beacon.StandardUpgradeableBeaconState{BeaconState: state}
+			if err := common.ProcessSlots(ctx, f.Spec, epc, upgradeable, s.Slot()); err != nil {
+				return nil, fmt.Errorf("failed to replay slot processing of step %s: %v", s, err)
+			}
+			state = upgradeable.BeaconState
+		}
+	}
+	if root := state.HashTreeRoot(tree.GetHashFn()); root != target {
+		return nil, fmt.Errorf("regenerated state of step %s has root %s, expected %s", step, root, target)
+	}
+	f.regenCache.add(target, state)
+	return state.CopyState()
+}
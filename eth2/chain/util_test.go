@@ -0,0 +1,265 @@
+package chain
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	blsu "github.com/protolambda/bls12-381-util"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/merge"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/ztyp/tree"
+)
+
+// testSpec is the minimal config, with Altair activated at epoch 1, and later forks unscheduled.
+func testSpec() *common.Spec {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	spec.MERGE_FORK_EPOCH = ^common.Epoch(0)
+	spec.SHARDING_FORK_EPOCH = ^common.Epoch(0)
+	return &spec
+}
+
+// testMergeSpec is the minimal config, with Altair activated at epoch 1, the Merge at epoch 2,
+// and an execution engine that accepts every payload.
+func testMergeSpec() *common.Spec {
+	spec := testSpec()
+	spec.MERGE_FORK_EPOCH = 2
+	spec.ExecutionEngine = acceptingEngine{}
+	return spec
+}
+
+type acceptingEngine struct{}
+
+func (acceptingEngine) NewBlock(ctx context.Context, executionPayload *common.ExecutionPayload) (bool, error) {
+	return true, nil
+}
+
+type testChainData struct {
+	spec    *common.Spec
+	keys    []blsu.SecretKey
+	genesis *phase0.BeaconStateView
+	epc     *common.EpochsContext
+}
+
+// newTestChainData creates a genesis state with n validators, with deterministic secret keys.
+func newTestChainData(t *testing.T, spec *common.Spec, n int) *testChainData {
+	vals := make([]phase0.KickstartValidatorData, n)
+	rawKeys := make([][32]byte, n)
+	keys := make([]blsu.SecretKey, n)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(rawKeys[i][24:], uint64(i+1))
+		if err := keys[i].Deserialize(&rawKeys[i]); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := blsu.SkToPk(&keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals[i] = phase0.KickstartValidatorData{
+			Pubkey:  pub.Serialize(),
+			Balance: spec.MAX_EFFECTIVE_BALANCE,
+		}
+	}
+	state, epc, err := phase0.KickStartStateWithSignatures(spec, common.Root{1}, 0, vals, rawKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testChainData{spec: spec, keys: keys, genesis: state, epc: epc}
+}
+
+// processSlots copies the state and transitions it to the given slot, including fork upgrades.
+func (td *testChainData) processSlots(t *testing.T, state common.BeaconState, epc *common.EpochsContext, slot common.Slot) (common.BeaconState, *common.EpochsContext) {
+	state, err := state.CopyState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc = epc.Clone()
+	upgradeable := &beacon.StandardUpgradeableBeaconState{BeaconState: state}
+	if err := common.ProcessSlots(context.Background(), td.spec, epc, upgradeable, slot); err != nil {
+		t.Fatal(err)
+	}
+	return upgradeable.BeaconState, epc
+}
+
+func (td *testChainData) sign(t *testing.T, state common.BeaconState, index common.ValidatorIndex,
+	domainType common.BLSDomainType, epoch common.Epoch, root common.Root) common.BLSSignature {
+	domain, err := common.GetDomain(state, domainType, epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingRoot := common.ComputeSigningRoot(root, domain)
+	return blsu.Sign(&td.keys[index], signingRoot[:]).Serialize()
+}
+
+// buildAltairBlock builds an empty signed Altair block at the given slot, on top of the given pre-state.
+func (td *testChainData) buildAltairBlock(t *testing.T, pre common.BeaconState, epc *common.EpochsContext, slot common.Slot) *common.BeaconBlockEnvelope {
+	return td.buildAltairBlockWith(t, pre, epc, slot, nil)
+}
+
+// buildAltairBlockWith builds a signed Altair block at the given slot, on top of the given pre-state,
+// with the operations that are added to the body by fill, if not nil.
+func (td *testChainData) buildAltairBlockWith(t *testing.T, pre common.BeaconState, epc *common.EpochsContext,
+	slot common.Slot, fill func(body *altair.BeaconBlockBody)) *common.BeaconBlockEnvelope {
+	spec := td.spec
+	state, epc := td.processSlots(t, pre, epc, slot)
+	header, err := state.LatestBlockHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposer, err := epc.GetBeaconProposer(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth1Data, err := state.Eth1Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := spec.SlotToEpoch(slot)
+	block := &altair.SignedBeaconBlock{
+		Message: altair.BeaconBlock{
+			Slot:          slot,
+			ProposerIndex: proposer,
+			ParentRoot:    header.HashTreeRoot(tree.GetHashFn()),
+			Body: altair.BeaconBlockBody{
+				RandaoReveal: td.sign(t, state, proposer, common.DOMAIN_RANDAO, epoch, epoch.HashTreeRoot(tree.GetHashFn())),
+				Eth1Data:     eth1Data,
+				SyncAggregate: altair.SyncAggregate{
+					SyncCommitteeBits: make(altair.SyncCommitteeBits, spec.SYNC_COMMITTEE_SIZE/8),
+					// Empty aggregate: point at infinity
+					SyncCommitteeSignature: common.BLSSignature{0xc0},
+				},
+			},
+		},
+	}
+	if fill != nil {
+		fill(&block.Message.Body)
+	}
+	genesisValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := common.ComputeForkDigest(spec.ForkVersion(slot), genesisValRoot)
+	// Process the unsigned block to compute the state root
+	if err := common.PostSlotTransition(context.Background(), spec, epc, state, block.Envelope(spec, digest), false); err != nil {
+		t.Fatal(err)
+	}
+	block.Message.StateRoot = state.HashTreeRoot(tree.GetHashFn())
+	blockRoot := block.Message.HashTreeRoot(spec, tree.GetHashFn())
+	block.Signature = td.sign(t, state, proposer, common.DOMAIN_BEACON_PROPOSER, epoch, blockRoot)
+	return block.Envelope(spec, digest)
+}
+
+// buildMergeBlock builds a signed Merge block at the given slot, on top of the given pre-state,
+// with an execution payload with the given block hash, or without execution payload if the hash is zero.
+func (td *testChainData) buildMergeBlock(t *testing.T, pre common.BeaconState, epc *common.EpochsContext,
+	slot common.Slot, blockHash common.Hash32) *common.BeaconBlockEnvelope {
+	spec := td.spec
+	state, epc := td.processSlots(t, pre, epc, slot)
+	header, err := state.LatestBlockHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposer, err := epc.GetBeaconProposer(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth1Data, err := state.Eth1Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisTime, err := state.GenesisTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp, err := spec.TimeAtSlot(slot, genesisTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := spec.SlotToEpoch(slot)
+	block := &merge.SignedBeaconBlock{
+		Message: merge.BeaconBlock{
+			Slot:          slot,
+			ProposerIndex: proposer,
+			ParentRoot:    header.HashTreeRoot(tree.GetHashFn()),
+			Body: merge.BeaconBlockBody{
+				RandaoReveal: td.sign(t, state, proposer, common.DOMAIN_RANDAO, epoch, epoch.HashTreeRoot(tree.GetHashFn())),
+				Eth1Data:     eth1Data,
+			},
+		},
+	}
+	if blockHash != (common.Hash32{}) {
+		block.Message.Body.ExecutionPayload = common.ExecutionPayload{
+			BlockHash: blockHash,
+			Timestamp: timestamp,
+		}
+	}
+	genesisValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := common.ComputeForkDigest(spec.ForkVersion(slot), genesisValRoot)
+	// Process the unsigned block to compute the state root
+	if err := common.PostSlotTransition(context.Background(), spec, epc, state, block.Envelope(spec, digest), false); err != nil {
+		t.Fatal(err)
+	}
+	block.Message.StateRoot = state.HashTreeRoot(tree.GetHashFn())
+	blockRoot := block.Message.HashTreeRoot(spec, tree.GetHashFn())
+	block.Signature = td.sign(t, state, proposer, common.DOMAIN_BEACON_PROPOSER, epoch, blockRoot)
+	return block.Envelope(spec, digest)
+}
+
+// testBlockChain is a chain to build and add blocks with, e.g. the hot chain or the full chain.
+type testBlockChain interface {
+	Towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error)
+	AddBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error
+}
+
+// blockPreState returns the state and context to build a block at the given slot with, on top of the parent block.
+func (td *testChainData) blockPreState(t *testing.T, ch testBlockChain, parent Root, slot Slot) (common.BeaconState, *common.EpochsContext) {
+	t.Helper()
+	ctx := context.Background()
+	pre, err := ch.Towards(ctx, parent, slot-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := pre.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc, err := pre.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, epc
+}
+
+// addBlockWith builds a signed Altair block at the given slot on top of the parent block, and adds it to the chain.
+// The operations are added to the body by fill, if not nil.
+func (td *testChainData) addBlockWith(t *testing.T, ch testBlockChain, parent Root, slot Slot,
+	fill func(body *altair.BeaconBlockBody)) *common.BeaconBlockEnvelope {
+	t.Helper()
+	state, epc := td.blockPreState(t, ch, parent, slot)
+	benv := td.buildAltairBlockWith(t, state, epc, slot, fill)
+	if err := ch.AddBlock(context.Background(), benv); err != nil {
+		t.Fatalf("failed to add block at slot %d: %v", slot, err)
+	}
+	return benv
+}
+
+// addBlocks builds and adds an empty Altair block at each of the given slots, each on top of the previous block,
+// starting on top of the parent block. The slots that are skipped are left empty.
+func (td *testChainData) addBlocks(t *testing.T, ch testBlockChain, parent Root, slots ...Slot) []*common.BeaconBlockEnvelope {
+	t.Helper()
+	envs := make([]*common.BeaconBlockEnvelope, 0, len(slots))
+	for _, slot := range slots {
+		benv := td.addBlockWith(t, ch, parent, slot, nil)
+		envs = append(envs, benv)
+		parent = benv.BlockRoot
+	}
+	return envs
+}
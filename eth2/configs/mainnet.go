@@ -84,6 +84,7 @@ var Mainnet = &common.Spec{
 		EJECTION_BALANCE:                    16_000_000_000,
 		MIN_PER_EPOCH_CHURN_LIMIT:           4,
 		CHURN_LIMIT_QUOTIENT:                1 << 16,
+		PROPOSER_SCORE_BOOST:                70,
 		DEPOSIT_CHAIN_ID:                    1,
 		DEPOSIT_NETWORK_ID:                  1,
 		DEPOSIT_CONTRACT_ADDRESS:            [20]byte{0x00, 0x00, 0x00, 0x00, 0x21, 0x9a, 0xb5, 0x40, 0x35, 0x6c, 0xBB, 0x83, 0x9C, 0xbe, 0x05, 0x30, 0x3d, 0x77, 0x05, 0xFa},
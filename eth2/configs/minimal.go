@@ -84,6 +84,7 @@ var Minimal = &common.Spec{
 		EJECTION_BALANCE:                    16_000_000_000,
 		MIN_PER_EPOCH_CHURN_LIMIT:           4,
 		CHURN_LIMIT_QUOTIENT:                1 << 16,
+		PROPOSER_SCORE_BOOST:                70,
 		DEPOSIT_CHAIN_ID:                    5,
 		DEPOSIT_NETWORK_ID:                  5,
 		DEPOSIT_CONTRACT_ADDRESS:            [20]byte{0x12, 0x34, 0x56, 0x78, 0x90, 0x12, 0x34, 0x56, 0x78, 0x90, 0x12, 0x34, 0x56, 0x78, 0x90, 0x12, 0x34, 0x56, 0x78, 0x90},
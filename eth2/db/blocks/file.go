@@ -94,7 +94,11 @@ func (db *FileDB) Get(ctx context.Context, root common.Root) (envelope *common.B
 	if err != nil {
 		return nil, err
 	}
-	return decodeOpaqueBlock(block, db.spec, digest, uint64(info.Size()), f)
+	size := uint64(info.Size())
+	if size < 4 {
+		return nil, fmt.Errorf("block %s is corrupt, expected fork digest", root)
+	}
+	return decodeOpaqueBlock(block, db.spec, digest, size-4, f)
 }
 
 func (db *FileDB) Size(root common.Root) (size uint64, exists bool) {
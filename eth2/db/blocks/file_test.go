@@ -0,0 +1,54 @@
+package blocks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+)
+
+func TestFileDBGet(t *testing.T) {
+	spec := configs.Mainnet
+	genesisValRoot := common.Root{1}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+	db := NewFileDB(spec, dec, t.TempDir())
+	ctx := context.Background()
+
+	phase0Block := &phase0.SignedBeaconBlock{Message: phase0.BeaconBlock{Slot: 1, ParentRoot: common.Root{2}}}
+	altairBlock := &altair.SignedBeaconBlock{Message: altair.BeaconBlock{Slot: 2, ParentRoot: common.Root{3}}}
+	altairBlock.Message.Body.SyncAggregate.SyncCommitteeBits = make(altair.SyncCommitteeBits, spec.SYNC_COMMITTEE_SIZE/8)
+	envs := []*common.BeaconBlockEnvelope{
+		phase0Block.Envelope(spec, common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genesisValRoot)),
+		altairBlock.Envelope(spec, common.ComputeForkDigest(spec.ALTAIR_FORK_VERSION, genesisValRoot)),
+	}
+	for _, benv := range envs {
+		if exists, err := db.Store(ctx, benv); err != nil || exists {
+			t.Fatalf("failed to store block %s (exists: %v): %v", benv.BlockRoot, exists, err)
+		}
+	}
+	for _, expected := range envs {
+		// The stored fork digest is not part of the block
+		size, ok := db.Size(expected.BlockRoot)
+		if !ok || size != expected.SignedBlock.ByteLength(spec) {
+			t.Fatalf("expected block size %d, got %d (exists: %v)", expected.SignedBlock.ByteLength(spec), size, ok)
+		}
+		benv, err := db.Get(ctx, expected.BlockRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if benv == nil {
+			t.Fatalf("missing block %s", expected.BlockRoot)
+		}
+		if benv.BlockRoot != expected.BlockRoot || benv.ForkDigest != expected.ForkDigest || benv.Slot != expected.Slot {
+			t.Fatalf("expected block %s of digest %s at slot %d, got block %s of digest %s at slot %d",
+				expected.BlockRoot, expected.ForkDigest, expected.Slot, benv.BlockRoot, benv.ForkDigest, benv.Slot)
+		}
+	}
+	if benv, err := db.Get(ctx, common.Root{0xff}); err != nil || benv != nil {
+		t.Fatalf("expected no block for unknown root, got %v (%v)", benv, err)
+	}
+}
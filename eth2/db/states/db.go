@@ -20,5 +20,9 @@ type DB interface {
 	Get(ctx context.Context, root common.Root) (state common.BeaconState, err error)
 	// Remove removes a state from the DB. Removing a state that does not exist is safe.
 	Remove(root common.Root) error
+	// Stats shows some database statistics such as latest write key and entry count.
+	Stats() DBStats
+	// List all known state roots
+	List() []common.Root
 	io.Closer
 }
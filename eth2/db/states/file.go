@@ -0,0 +1,180 @@
+package states
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/ztyp/tree"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// FileDB is a simple file-based state database. Each entry is named after 0x prefix state root, with .ssz extension.
+// All entries start with a 4 byte fork digest to decode the rest of the state with.
+type FileDB struct {
+	spec     *common.Spec
+	dec      *beacon.ForkDecoder
+	basePath string
+}
+
+var _ DB = (*FileDB)(nil)
+
+func NewFileDB(spec *common.Spec, dec *beacon.ForkDecoder, basePath string) *FileDB {
+	return &FileDB{spec, dec, basePath}
+}
+
+func (db *FileDB) rootToPath(root common.Root) string {
+	return path.Join(db.basePath, "0x"+hex.EncodeToString(root[:])+".ssz")
+}
+
+// Store writes the state to a temporary file first, and renames it once synced,
+// so a state file is never partially written. Does not overwrite if the file already exists.
+func (db *FileDB) Store(ctx context.Context, state common.BeaconState) error {
+	digest, err := db.dec.StateDigest(state)
+	if err != nil {
+		return err
+	}
+	root := state.HashTreeRoot(tree.GetHashFn())
+	outPath := db.rootToPath(root)
+	if _, err := os.Stat(outPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// The temporary file name does not look like a state file, it is ignored by List and Stats.
+	f, err := ioutil.TempFile(db.basePath, ".tmp-state-")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if err := db.writeState(f, digest, state); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to store state %s: %v", root, err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (db *FileDB) writeState(f *os.File, digest common.ForkDigest, state common.BeaconState) error {
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(digest[:]); err != nil {
+		return err
+	}
+	if err := beacon.EncodeState(state, w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (db *FileDB) Get(ctx context.Context, root common.Root) (state common.BeaconState, err error) {
+	outPath := db.rootToPath(root)
+	f, err := os.Open(outPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(info.Size())
+	if size < 4 {
+		return nil, fmt.Errorf("state %s is corrupt, expected fork digest", root)
+	}
+	var digest common.ForkDigest
+	if _, err := io.ReadFull(f, digest[:]); err != nil {
+		return nil, err
+	}
+	return db.dec.DecodeState(digest, size-4, bufio.NewReader(f))
+}
+
+func (db *FileDB) Remove(root common.Root) error {
+	outPath := db.rootToPath(root)
+	err := os.Remove(outPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (db *FileDB) Stats() DBStats {
+	files, err := ioutil.ReadDir(db.basePath)
+	if err != nil {
+		return DBStats{}
+	}
+	// count files, and return latest write, and count of valid looking SSZ state files
+	lastMod := common.Root{}
+	lastModTime := time.Time{}
+	count := int64(0)
+	for _, f := range files {
+		root, ok := fileNameToRoot(f.Name())
+		if !ok {
+			continue
+		}
+		if lastModTime.Before(f.ModTime()) {
+			lastModTime = f.ModTime()
+			lastMod = root
+		}
+		count += 1
+	}
+	return DBStats{
+		Count:     count,
+		LastWrite: lastMod,
+	}
+}
+
+func (db *FileDB) List() (out []common.Root) {
+	files, err := ioutil.ReadDir(db.basePath)
+	if err != nil {
+		return nil
+	}
+	out = make([]common.Root, 0, len(files))
+	for _, f := range files {
+		if root, ok := fileNameToRoot(f.Name()); ok {
+			out = append(out, root)
+		}
+	}
+	return out
+}
+
+func fileNameToRoot(name string) (root common.Root, ok bool) {
+	if len(name) != 2+64+4 || !strings.HasPrefix(name, "0x") || !strings.HasSuffix(name, ".ssz") {
+		return common.Root{}, false
+	}
+	if _, err := hex.Decode(root[:], []byte(name[2:2+64])); err != nil {
+		return common.Root{}, false
+	}
+	return root, true
+}
+
+func (db *FileDB) Path() string {
+	return db.basePath
+}
+
+func (db *FileDB) Close() error {
+	return nil
+}
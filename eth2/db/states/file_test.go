@@ -0,0 +1,121 @@
+package states
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func TestFileDBReopen(t *testing.T) {
+	spec := configs.Mainnet
+	genesisValRoot := common.Root{1}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+
+	phase0State := phase0.NewBeaconStateView(spec)
+	if err := phase0State.SetGenesisValidatorsRoot(genesisValRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err := phase0State.SetFork(common.Fork{CurrentVersion: spec.GENESIS_FORK_VERSION}); err != nil {
+		t.Fatal(err)
+	}
+	altairState := altair.NewBeaconStateView(spec)
+	if err := altairState.SetGenesisValidatorsRoot(genesisValRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err := altairState.SetFork(common.Fork{
+		PreviousVersion: spec.GENESIS_FORK_VERSION,
+		CurrentVersion:  spec.ALTAIR_FORK_VERSION,
+		Epoch:           spec.ALTAIR_FORK_EPOCH,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	db := NewFileDB(spec, dec, dir)
+	ctx := context.Background()
+	for _, state := range []common.BeaconState{phase0State, altairState} {
+		if err := db.Store(ctx, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Storing again does not overwrite
+	if err := db.Store(ctx, altairState); err != nil {
+		t.Fatal(err)
+	}
+	phase0Root := phase0State.HashTreeRoot(tree.GetHashFn())
+	info, err := os.Stat(db.rootToPath(phase0Root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0644 {
+		t.Fatalf("expected state file mode 0644, got %o", mode)
+	}
+	if err := db.Remove(phase0Root); err != nil {
+		t.Fatal(err)
+	}
+	// Removing a missing state is not an error
+	if err := db.Remove(phase0Root); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = NewFileDB(spec, dec, dir)
+	defer db.Close()
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+	stats := db.Stats()
+	altairRoot := altairState.HashTreeRoot(tree.GetHashFn())
+	if stats.Count != 1 || stats.LastWrite != altairRoot {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+	if list := db.List(); len(list) != 1 || list[0] != altairRoot {
+		t.Fatalf("unexpected listed states: %v", list)
+	}
+	if state, err := db.Get(ctx, phase0Root); err != nil {
+		t.Fatal(err)
+	} else if state != nil {
+		t.Fatal("expected removed state to be gone")
+	}
+	state, err := db.Get(ctx, altairRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.(*altair.BeaconStateView); !ok {
+		t.Fatalf("expected altair state, got %T", state)
+	}
+	var expectedBuf, gotBuf bytes.Buffer
+	if err := beacon.EncodeState(altairState, &expectedBuf); err != nil {
+		t.Fatal(err)
+	}
+	if err := beacon.EncodeState(state, &gotBuf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expectedBuf.Bytes(), gotBuf.Bytes()) {
+		t.Fatal("loaded state does not match stored state")
+	}
+
+	// A truncated state file is reported as corrupt
+	if err := ioutil.WriteFile(db.rootToPath(phase0Root), []byte{1, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(ctx, phase0Root); err == nil {
+		t.Fatal("expected truncated state to be corrupt")
+	}
+}
@@ -11,8 +11,14 @@ type MemDB struct {
 	// beacon.Root -> tree.Node (backing of BeaconStateView)
 	data sync.Map
 	spec *common.Spec
+
+	statsLock sync.Mutex
+	count     int64
+	lastWrite common.Root
 }
 
+var _ DB = (*MemDB)(nil)
+
 func NewMemDB(spec *common.Spec) *MemDB {
 	return &MemDB{spec: spec}
 }
@@ -20,7 +26,18 @@ func NewMemDB(spec *common.Spec) *MemDB {
 func (db *MemDB) Store(ctx context.Context, state common.BeaconState) error {
 	// Released when the block is removed from the DB
 	root := state.HashTreeRoot(tree.GetHashFn())
-	db.data.Store(root, state)
+	// Store a separate view, the caller may continue to mutate the original.
+	state, err := state.CopyState()
+	if err != nil {
+		return err
+	}
+	_, existed := db.data.LoadOrStore(root, state)
+	db.statsLock.Lock()
+	defer db.statsLock.Unlock()
+	if !existed {
+		db.count += 1
+	}
+	db.lastWrite = root
 	return nil
 }
 
@@ -33,14 +50,38 @@ func (db *MemDB) Get(ctx context.Context, root common.Root) (state common.Beacon
 	if !ok {
 		panic("in-memory db was corrupted with unexpected state type")
 	}
-	return
+	// Return a separate view, the stored state may not be mutated.
+	return state.CopyState()
 }
 
 func (db *MemDB) Remove(root common.Root) error {
-	db.data.Delete(root)
+	_, existed := db.data.LoadAndDelete(root)
+	if existed {
+		db.statsLock.Lock()
+		db.count -= 1
+		db.statsLock.Unlock()
+	}
 	return nil
 }
 
+func (db *MemDB) Stats() DBStats {
+	db.statsLock.Lock()
+	defer db.statsLock.Unlock()
+	// return a copy (struct is small and has no pointers)
+	return DBStats{
+		Count:     db.count,
+		LastWrite: db.lastWrite,
+	}
+}
+
+func (db *MemDB) List() (out []common.Root) {
+	db.data.Range(func(key, value interface{}) bool {
+		out = append(out, key.(common.Root))
+		return true
+	})
+	return out
+}
+
 func (db *MemDB) Close() error {
 	return nil
 }
@@ -0,0 +1,329 @@
+package states
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/ztyp/tree"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	nodeRecord   byte = 1
+	stateRecord  byte = 2
+	removeRecord byte = 3
+)
+
+const (
+	leftPairFlag  byte = 1 << 0
+	rightPairFlag byte = 1 << 1
+)
+
+// Record sizes, excluding the record kind byte
+const (
+	// root, flags, left, right
+	nodeRecordSize = 32 + 1 + 32 + 32
+	// root, fork digest
+	stateRecordSize = 32 + 4
+	// root
+	removeRecordSize = 32
+)
+
+// NodeDB is a state database that stores the binary merkle tree nodes of states, keyed by node root.
+// States that share subtrees, like consecutive states of the same chain, share the storage of the common nodes.
+//
+// Nodes and state roots are appended to a single file, and indexed in memory when the DB is opened.
+// Removing a state only removes it from the index, the nodes are not garbage-collected.
+type NodeDB struct {
+	sync.RWMutex
+	spec *common.Spec
+	dec  *beacon.ForkDecoder
+	f    *os.File
+	// end of the last complete record
+	size int64
+	// node root -> file offset of the node contents (flags, left, right)
+	nodes map[common.Root]int64
+	// state root -> fork digest to allocate the state view with
+	states    map[common.Root]common.ForkDigest
+	lastWrite common.Root
+}
+
+var _ DB = (*NodeDB)(nil)
+
+// OpenNodeDB opens the node database at the given file path, and creates it if it does not exist yet.
+// An incomplete record at the end of the file, e.g. after a crash during a write, is discarded.
+func OpenNodeDB(spec *common.Spec, dec *beacon.ForkDecoder, filePath string) (*NodeDB, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db := &NodeDB{
+		spec:   spec,
+		dec:    dec,
+		f:      f,
+		nodes:  make(map[common.Root]int64),
+		states: make(map[common.Root]common.ForkDigest),
+	}
+	if err := db.loadIndex(); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to load node db index: %v", err)
+	}
+	return db, nil
+}
+
+func (db *NodeDB) loadIndex() error {
+	r := bufio.NewReader(db.f)
+	var offset int64
+	var buf [nodeRecordSize]byte
+	for {
+		kind, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var size int
+		switch kind {
+		case nodeRecord:
+			size = nodeRecordSize
+		case stateRecord:
+			size = stateRecordSize
+		case removeRecord:
+			size = removeRecordSize
+		default:
+			return fmt.Errorf("unknown record kind %d at offset %d", kind, offset)
+		}
+		if _, err := io.ReadFull(r, buf[:size]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				// incomplete write, the record is discarded
+				break
+			}
+			return err
+		}
+		var root common.Root
+		copy(root[:], buf[:32])
+		switch kind {
+		case nodeRecord:
+			db.nodes[root] = offset + 1 + 32
+		case stateRecord:
+			var digest common.ForkDigest
+			copy(digest[:], buf[32:36])
+			db.states[root] = digest
+			db.lastWrite = root
+		case removeRecord:
+			delete(db.states, root)
+		}
+		offset += 1 + int64(size)
+	}
+	db.size = offset
+	// drop any incomplete record, new records are appended after the last complete one.
+	return db.f.Truncate(offset)
+}
+
+func (db *NodeDB) Store(ctx context.Context, state common.BeaconState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	digest, err := db.dec.StateDigest(state)
+	if err != nil {
+		return err
+	}
+	hFn := tree.GetHashFn()
+	root := state.HashTreeRoot(hFn)
+
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.states[root]; ok {
+		return nil
+	}
+	var buf bytes.Buffer
+	pending := make(map[common.Root]int64)
+	if err := db.appendNodes(&buf, pending, state.Backing(), hFn); err != nil {
+		return fmt.Errorf("failed to encode nodes of state %s: %v", root, err)
+	}
+	buf.WriteByte(stateRecord)
+	buf.Write(root[:])
+	buf.Write(digest[:])
+	if _, err := db.f.WriteAt(buf.Bytes(), db.size); err != nil {
+		return fmt.Errorf("failed to write state %s: %v", root, err)
+	}
+	if err := db.f.Sync(); err != nil {
+		return err
+	}
+	// Only index the new nodes after they are safely written
+	for k, v := range pending {
+		db.nodes[k] = v
+	}
+	db.size += int64(buf.Len())
+	db.states[root] = digest
+	db.lastWrite = root
+	return nil
+}
+
+// appendNodes encodes the pair node and all of its pair node descendants that are not stored yet.
+// Children are encoded before their parents.
+func (db *NodeDB) appendNodes(buf *bytes.Buffer, pending map[common.Root]int64, node tree.Node, hFn tree.HashFn) error {
+	root := node.MerkleRoot(hFn)
+	if _, ok := db.nodes[root]; ok {
+		return nil
+	}
+	if _, ok := pending[root]; ok {
+		return nil
+	}
+	left, err := node.Left()
+	if err != nil {
+		return err
+	}
+	right, err := node.Right()
+	if err != nil {
+		return err
+	}
+	var flags byte
+	if !left.IsLeaf() {
+		flags |= leftPairFlag
+		if err := db.appendNodes(buf, pending, left, hFn); err != nil {
+			return err
+		}
+	}
+	if !right.IsLeaf() {
+		flags |= rightPairFlag
+		if err := db.appendNodes(buf, pending, right, hFn); err != nil {
+			return err
+		}
+	}
+	leftRoot := left.MerkleRoot(hFn)
+	rightRoot := right.MerkleRoot(hFn)
+	buf.WriteByte(nodeRecord)
+	buf.Write(root[:])
+	pending[root] = db.size + int64(buf.Len())
+	buf.WriteByte(flags)
+	buf.Write(leftRoot[:])
+	buf.Write(rightRoot[:])
+	return nil
+}
+
+func (db *NodeDB) Get(ctx context.Context, root common.Root) (state common.BeaconState, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	digest, ok := db.states[root]
+	if !ok {
+		return nil, nil
+	}
+	state, err = db.dec.AllocState(digest)
+	if err != nil {
+		return nil, err
+	}
+	// Subtrees that occur multiple times are only loaded once
+	memo := make(map[common.Root]tree.Node)
+	backing, err := db.loadNode(root, memo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state %s: %v", root, err)
+	}
+	if err := state.SetBacking(backing); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+var errMissingNode = errors.New("missing node")
+
+func (db *NodeDB) loadNode(root common.Root, memo map[common.Root]tree.Node) (tree.Node, error) {
+	if n, ok := memo[root]; ok {
+		return n, nil
+	}
+	offset, ok := db.nodes[root]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errMissingNode, root)
+	}
+	var buf [nodeRecordSize - 32]byte
+	if _, err := db.f.ReadAt(buf[:], offset); err != nil {
+		return nil, err
+	}
+	flags := buf[0]
+	var leftRoot, rightRoot common.Root
+	copy(leftRoot[:], buf[1:33])
+	copy(rightRoot[:], buf[33:65])
+	left, err := db.loadChild(leftRoot, flags&leftPairFlag != 0, memo)
+	if err != nil {
+		return nil, err
+	}
+	right, err := db.loadChild(rightRoot, flags&rightPairFlag != 0, memo)
+	if err != nil {
+		return nil, err
+	}
+	n := &tree.PairNode{Value: root, LeftChild: left, RightChild: right}
+	memo[root] = n
+	return n, nil
+}
+
+func (db *NodeDB) loadChild(root common.Root, isPair bool, memo map[common.Root]tree.Node) (tree.Node, error) {
+	if isPair {
+		return db.loadNode(root, memo)
+	}
+	leaf := root
+	return &leaf, nil
+}
+
+func (db *NodeDB) Remove(root common.Root) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.states[root]; !ok {
+		return nil
+	}
+	var buf [1 + removeRecordSize]byte
+	buf[0] = removeRecord
+	copy(buf[1:], root[:])
+	if _, err := db.f.WriteAt(buf[:], db.size); err != nil {
+		return fmt.Errorf("failed to remove state %s: %v", root, err)
+	}
+	// Like a stored state, a removed state must not come back after a crash.
+	if err := db.f.Sync(); err != nil {
+		return err
+	}
+	db.size += int64(len(buf))
+	delete(db.states, root)
+	return nil
+}
+
+func (db *NodeDB) Stats() DBStats {
+	db.RLock()
+	defer db.RUnlock()
+	return DBStats{
+		Count:     int64(len(db.states)),
+		LastWrite: db.lastWrite,
+	}
+}
+
+func (db *NodeDB) List() (out []common.Root) {
+	db.RLock()
+	defer db.RUnlock()
+	out = make([]common.Root, 0, len(db.states))
+	for root := range db.states {
+		out = append(out, root)
+	}
+	return out
+}
+
+// NodeCount is the number of unique tree nodes in the DB, shared between all states.
+func (db *NodeDB) NodeCount() int {
+	db.RLock()
+	defer db.RUnlock()
+	return len(db.nodes)
+}
+
+func (db *NodeDB) Path() string {
+	return db.f.Name()
+}
+
+func (db *NodeDB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	return db.f.Close()
+}
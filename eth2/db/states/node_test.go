@@ -0,0 +1,130 @@
+package states
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func TestNodeDBReopen(t *testing.T) {
+	spec := configs.Mainnet
+	genesisValRoot := common.Root{1}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+
+	phase0State := phase0.NewBeaconStateView(spec)
+	if err := phase0State.SetGenesisValidatorsRoot(genesisValRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err := phase0State.SetFork(common.Fork{CurrentVersion: spec.GENESIS_FORK_VERSION}); err != nil {
+		t.Fatal(err)
+	}
+	altairState := altair.NewBeaconStateView(spec)
+	if err := altairState.SetGenesisValidatorsRoot(genesisValRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err := altairState.SetFork(common.Fork{
+		PreviousVersion: spec.GENESIS_FORK_VERSION,
+		CurrentVersion:  spec.ALTAIR_FORK_VERSION,
+		Epoch:           spec.ALTAIR_FORK_EPOCH,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// A second Altair state shares most of its nodes with the first
+	nextState, err := altairState.CopyState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nextState.SetSlot(123); err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(t.TempDir(), "states.db")
+	db, err := OpenNodeDB(spec, dec, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode&0111 != 0 {
+		t.Fatalf("expected node db file to not be executable, got mode %o", mode)
+	}
+	ctx := context.Background()
+	if err := db.Store(ctx, phase0State); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Store(ctx, altairState); err != nil {
+		t.Fatal(err)
+	}
+	nodeCount := db.NodeCount()
+	if err := db.Store(ctx, nextState); err != nil {
+		t.Fatal(err)
+	}
+	// Only the path to the changed slot field is new
+	if added := db.NodeCount() - nodeCount; added > 10 {
+		t.Fatalf("expected only a few new nodes for a slot change, got %d", added)
+	}
+	if err := db.Remove(phase0State.HashTreeRoot(tree.GetHashFn())); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenNodeDB(spec, dec, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stats := db.Stats()
+	nextRoot := nextState.HashTreeRoot(tree.GetHashFn())
+	if stats.Count != 2 {
+		t.Fatalf("expected 2 states, got %d", stats.Count)
+	}
+	if stats.LastWrite != nextRoot {
+		t.Fatalf("expected last write %s, got %s", nextRoot, stats.LastWrite)
+	}
+	if got := len(db.List()); got != 2 {
+		t.Fatalf("expected 2 listed states, got %d", got)
+	}
+	if state, err := db.Get(ctx, phase0State.HashTreeRoot(tree.GetHashFn())); err != nil {
+		t.Fatal(err)
+	} else if state != nil {
+		t.Fatal("expected removed state to be gone")
+	}
+	for _, expected := range []common.BeaconState{altairState, nextState} {
+		root := expected.HashTreeRoot(tree.GetHashFn())
+		state, err := db.Get(ctx, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state == nil {
+			t.Fatalf("missing state %s", root)
+		}
+		if _, ok := state.(*altair.BeaconStateView); !ok {
+			t.Fatalf("expected altair state, got %T", state)
+		}
+		// The loaded nodes carry their stored roots, compare the actual contents
+		var expectedBuf, gotBuf bytes.Buffer
+		if err := beacon.EncodeState(expected, &expectedBuf); err != nil {
+			t.Fatal(err)
+		}
+		if err := beacon.EncodeState(state, &gotBuf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expectedBuf.Bytes(), gotBuf.Bytes()) {
+			t.Fatalf("loaded state %s does not match stored state", root)
+		}
+	}
+}
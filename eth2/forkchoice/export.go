@@ -0,0 +1,112 @@
+package forkchoice
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ExportNode is a node of an exported forkchoice tree.
+type ExportNode struct {
+	NodeRef
+	// Block is true if the node is the block itself, false if it is an empty slot after the block.
+	Block      bool `json:"block"`
+	ParentRoot Root `json:"parent_root"`
+	// Parent is the forkchoice parent, one slot before the node. Nil for the anchor.
+	Parent *NodeRef   `json:"parent"`
+	Weight SignedGwei `json:"weight"`
+	// BestChild and BestDescendant are nil if there are none, e.g. for a leaf node or a subtree without viable head.
+	BestChild      *NodeRef `json:"best_child"`
+	BestDescendant *NodeRef `json:"best_descendant"`
+	JustifiedEpoch Epoch    `json:"justified_epoch"`
+	FinalizedEpoch Epoch    `json:"finalized_epoch"`
+	// ExecutionStatus is the status of the execution payload of the block, shared by the empty slots after it.
+	ExecutionStatus ExecutionStatus `json:"execution_status"`
+	// Viable is true if the node matches the justified and finalized checkpoints of the forkchoice,
+	// and the execution payload is not invalid.
+	Viable bool `json:"viable"`
+	// Canonical is true if the node is on the chain from the anchor to the head.
+	Canonical bool `json:"canonical"`
+}
+
+// ForkchoiceTree is a snapshot of a forkchoice subtree, to export as JSON or DOT.
+// The nodes are ordered parents first.
+type ForkchoiceTree struct {
+	Anchor NodeRef      `json:"anchor"`
+	Head   NodeRef      `json:"head"`
+	Nodes  []ExportNode `json:"nodes"`
+}
+
+// WriteJSON writes the tree as indented JSON.
+func (t *ForkchoiceTree) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+// WriteDOT writes the tree as a Graphviz digraph, with an edge from each node to its parent.
+// Blocks are drawn as boxes and empty slots as ellipses. The canonical chain is filled and drawn in bold,
+// the head has a double border, and nodes that are not viable for the head are dashed.
+func (t *ForkchoiceTree) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	nodeID := func(ref NodeRef) string {
+		return fmt.Sprintf("%s:%d", ref.Root, ref.Slot)
+	}
+	short := func(root Root) string {
+		return fmt.Sprintf("%x", root[:4])
+	}
+	fmt.Fprintln(bw, "digraph forkchoice {")
+	fmt.Fprintln(bw, "  rankdir=RL;")
+	for i := range t.Nodes {
+		n := &t.Nodes[i]
+		label := fmt.Sprintf("slot %d\\nroot %s\\nparent %s\\nweight %d\\njustified %d finalized %d",
+			n.Slot, short(n.Root), short(n.ParentRoot), n.Weight, n.JustifiedEpoch, n.FinalizedEpoch)
+		if n.BestChild != nil {
+			label += fmt.Sprintf("\\nbest child %s:%d", short(n.BestChild.Root), n.BestChild.Slot)
+		}
+		if n.BestDescendant != nil {
+			label += fmt.Sprintf("\\nbest descendant %s:%d", short(n.BestDescendant.Root), n.BestDescendant.Slot)
+		}
+		if n.ExecutionStatus != ExecutionValid {
+			label += fmt.Sprintf("\\nexecution %s", n.ExecutionStatus)
+		}
+		attrs := fmt.Sprintf("label=\"%s\"", label)
+		if n.Block {
+			attrs += ", shape=box"
+		} else {
+			attrs += ", shape=ellipse"
+		}
+		style := ""
+		if n.Canonical {
+			style = "filled,bold"
+			attrs += ", fillcolor=lightblue"
+		}
+		if !n.Viable {
+			if style != "" {
+				style += ","
+			}
+			style += "dashed"
+		}
+		if style != "" {
+			attrs += fmt.Sprintf(", style=\"%s\"", style)
+		}
+		if n.NodeRef == t.Head {
+			attrs += ", peripheries=2"
+		}
+		fmt.Fprintf(bw, "  \"%s\" [%s];\n", nodeID(n.NodeRef), attrs)
+	}
+	for i := range t.Nodes {
+		n := &t.Nodes[i]
+		if n.Parent == nil {
+			continue
+		}
+		edge := ""
+		if n.Canonical {
+			edge = " [style=bold, color=blue]"
+		}
+		fmt.Fprintf(bw, "  \"%s\" -> \"%s\"%s;\n", nodeID(n.NodeRef), nodeID(*n.Parent), edge)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
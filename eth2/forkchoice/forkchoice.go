@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"sync"
 )
 
@@ -19,20 +20,37 @@ type ProtoForkChoice struct {
 	justified Checkpoint
 	finalized Checkpoint
 	spec      *common.Spec
+
+	// The clock, see OnTick. Until the first tick, the forkchoice is not time-aware:
+	// justification is updated immediately, and votes are applied without delay.
+	genesisTime Timestamp
+	time        Timestamp
+	ticked      bool
+	// The best justified checkpoint that was not applied yet, and the balances of its state.
+	bestJustified         Checkpoint
+	bestJustifiedBalances func() ([]Gwei, error)
+	// Votes for the current slot or later, held back until the slot has passed.
+	queuedVotes []LatestVote
+	// If the vote changes were applied since the last tick
+	votesApplied bool
+	// If the proposer boost changed since the score changes were last applied
+	boostChanged bool
 }
 
 var _ Forkchoice = (*ProtoForkChoice)(nil)
 
-func NewForkChoice(spec *common.Spec, finalized Checkpoint, justified Checkpoint,
+func NewForkChoice(spec *common.Spec, genesisTime Timestamp, finalized Checkpoint, justified Checkpoint,
 	anchorRoot Root, anchorSlot Slot, graph ForkchoiceGraph, votes VoteStore,
 	initialBalances []Gwei) (Forkchoice, error) {
 	fc := &ProtoForkChoice{
-		protoArray: graph,
-		voteStore:  votes,
-		balances:   nil,
-		justified:  justified,
-		finalized:  finalized,
-		spec:       spec,
+		protoArray:    graph,
+		voteStore:     votes,
+		balances:      nil,
+		justified:     justified,
+		finalized:     finalized,
+		spec:          spec,
+		genesisTime:   genesisTime,
+		bestJustified: justified,
 	}
 	if err := fc.SetPin(anchorRoot, anchorSlot); err != nil {
 		return nil, err
@@ -68,6 +86,7 @@ func (fc *ProtoForkChoice) SetPin(root Root, slot Slot) error {
 
 // UpdateJustified updates what is recognized as justified and finalized checkpoint,
 // and adjusts justified balances for vote weights.
+// The justified balances are the effective balances of the active validators of the justified state.
 // If the finalized checkpoint changes, it triggers pruning.
 // Note that pruning can prune the pre-block node of the start slot of the finalized epoch, if it is not a gap slot.
 // And the finalizing node with the block will remain.
@@ -82,7 +101,7 @@ func (fc *ProtoForkChoice) UpdateJustified(ctx context.Context, trigger Root, ju
 	}
 	if fc.pin != nil && trigger != fc.pin.Root {
 		// check trigger against pin, to ensure no justification/finalization of data that conflicts with the pin.
-		if unknown, inSubtree := fc.InSubtree(fc.pin.Root, trigger); unknown {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.pin.Root, trigger); unknown {
 			return fmt.Errorf("cannot justify/finalize with unknown trigger when forkchoice is pinned")
 		} else if !inSubtree {
 			return fmt.Errorf("cannot justify/finalize outside of pinned forkchoice tree")
@@ -91,13 +110,29 @@ func (fc *ProtoForkChoice) UpdateJustified(ctx context.Context, trigger Root, ju
 
 	prevFinalized := fc.finalized
 
-	if err := fc.updateJustified(justified, finalized, justifiedStateBalances); err != nil {
+	if fc.ticked && finalized == prevFinalized {
+		// Remember the best justified checkpoint, to apply at the next epoch boundary if not applied now.
+		if justified.Epoch > fc.bestJustified.Epoch {
+			fc.bestJustified = justified
+			fc.bestJustifiedBalances = justifiedStateBalances
+		}
+		if !fc.shouldUpdateJustified(justified) {
+			return nil
+		}
+	}
+
+	if err := fc.updateJustified(finalized, justified, justifiedStateBalances); err != nil {
 		return err
 	}
+	if justified.Epoch >= fc.bestJustified.Epoch {
+		fc.bestJustified = justified
+		fc.bestJustifiedBalances = nil
+	}
 
 	// prune if we finalized something, and undo the pin.
 	if prevFinalized != finalized {
 		fc.pin = nil
+		fc.voteStore.PruneVoteHistory(finalized.Epoch)
 		finSlot, _ := fc.spec.EpochStartSlot(finalized.Epoch)
 		if err := fc.protoArray.OnPrune(ctx, finalized.Root, finSlot); err != nil {
 			return err
@@ -114,7 +149,7 @@ func (fc *ProtoForkChoice) updateJustified(finalized Checkpoint, justified Check
 
 	// check if new finalized checkpoint is valid
 	if fc.finalized != finalized {
-		if unknown, inSubtree := fc.InSubtree(fc.finalized.Root, finalized.Root); unknown {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.finalized.Root, finalized.Root); unknown {
 			return fmt.Errorf("unknown finalized checkpoint: %s", finalized)
 		} else if !inSubtree || fc.finalized.Epoch > finalized.Epoch {
 			return fmt.Errorf("new finalized checkpoint %s is outside of finalized subtree: %s",
@@ -122,7 +157,7 @@ func (fc *ProtoForkChoice) updateJustified(finalized Checkpoint, justified Check
 		}
 	}
 	if fc.justified != justified {
-		if unknown, inSubtree := fc.InSubtree(fc.finalized.Root, justified.Root); unknown {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.finalized.Root, justified.Root); unknown {
 			return fmt.Errorf("unknown justified checkpoint: %s", justified)
 		} else if !inSubtree || fc.finalized.Epoch > justified.Epoch {
 			return fmt.Errorf("new justified checkpoint %s is outside of finalized subtree: %s",
@@ -138,9 +173,10 @@ func (fc *ProtoForkChoice) updateJustified(finalized Checkpoint, justified Check
 
 	deltas := fc.voteStore.ComputeDeltas(fc.protoArray.Indices(), oldBals, newBals)
 
-	if err := fc.protoArray.ApplyScoreChanges(deltas, justified.Epoch, finalized.Epoch); err != nil {
+	if err := fc.protoArray.ApplyScoreChanges(deltas, justified.Epoch, finalized.Epoch, fc.proposerBoostScore(newBals)); err != nil {
 		return err
 	}
+	fc.boostChanged = false
 
 	fc.balances = newBals
 	fc.justified = justified
@@ -149,16 +185,142 @@ func (fc *ProtoForkChoice) updateJustified(finalized Checkpoint, justified Check
 	return nil
 }
 
-// TODO: skip based on time (like rate limiting) or based on amount of changes
+// shouldUpdateJustified checks if the justified checkpoint can be updated now, or has to wait for the next epoch,
+// to prevent a bouncing attack: only early in the epoch, or if the new checkpoint builds on the current one.
+func (fc *ProtoForkChoice) shouldUpdateJustified(justified Checkpoint) bool {
+	if uint64(fc.currentSlot()%fc.spec.SLOTS_PER_EPOCH) < fc.spec.SAFE_SLOTS_TO_UPDATE_JUSTIFIED {
+		return true
+	}
+	unknown, inSubtree := fc.protoArray.InSubtree(fc.justified.Root, justified.Root)
+	return !unknown && inSubtree
+}
+
+// TODO: skip based on amount of changes
 //  (if not bigger than previous difference between head-node contenders)
 func (fc *ProtoForkChoice) updateVotesMaybe() error {
-	if !fc.voteStore.HasChanges() {
-		return nil
+	// A changed proposer boost is applied immediately, together with any vote changes.
+	if !fc.boostChanged {
+		if !fc.voteStore.HasChanges() {
+			return nil
+		}
+		// With a clock, the vote changes are rate-limited to once per tick.
+		if fc.ticked && fc.votesApplied {
+			return nil
+		}
 	}
 
 	deltas := fc.voteStore.ComputeDeltas(fc.protoArray.Indices(), fc.balances, fc.balances)
 
-	return fc.protoArray.ApplyScoreChanges(deltas, fc.justified.Epoch, fc.finalized.Epoch)
+	if err := fc.protoArray.ApplyScoreChanges(deltas, fc.justified.Epoch, fc.finalized.Epoch, fc.proposerBoostScore(fc.balances)); err != nil {
+		return err
+	}
+	fc.votesApplied = true
+	fc.boostChanged = false
+	return nil
+}
+
+// proposerBoostScore computes the weight of the proposer boost: a fraction of the average committee weight,
+// based on the total active balance of the justified state.
+// The justified balances are the effective balances of the active validators, zero for inactive validators,
+// so their sum is the total active balance, with the same minimum of one effective balance increment.
+func (fc *ProtoForkChoice) proposerBoostScore(balances []Gwei) Gwei {
+	total := Gwei(0)
+	for _, b := range balances {
+		total += b
+	}
+	if total < fc.spec.EFFECTIVE_BALANCE_INCREMENT {
+		total = fc.spec.EFFECTIVE_BALANCE_INCREMENT
+	}
+	committeeWeight := total / Gwei(fc.spec.SLOTS_PER_EPOCH)
+	return committeeWeight * Gwei(fc.spec.PROPOSER_SCORE_BOOST) / 100
+}
+
+func (fc *ProtoForkChoice) currentSlot() Slot {
+	return fc.spec.TimeToSlot(fc.time, fc.genesisTime)
+}
+
+// OnTick updates the time of the forkchoice, like the spec on_tick:
+// at the start of an epoch the best justified checkpoint is applied, if it was held back,
+// and votes for slots that have passed are applied.
+// After the first tick, the forkchoice is time-aware, until then the time is ignored.
+func (fc *ProtoForkChoice) OnTick(ctx context.Context, time Timestamp) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.ticked && time < fc.time {
+		return nil
+	}
+	prevSlot := fc.currentSlot()
+	wasTicked := fc.ticked
+	fc.time = time
+	fc.ticked = true
+	fc.votesApplied = false
+	slot := fc.currentSlot()
+
+	// The proposer boost only lasts for the slot of the block
+	if slot > prevSlot {
+		fc.protoArray.ResetProposerBoost()
+		fc.boostChanged = true
+	}
+
+	// Apply the held back votes of passed slots
+	remaining := fc.queuedVotes[:0]
+	for _, vote := range fc.queuedVotes {
+		if vote.Slot < slot {
+			fc.processAttestation(vote.Index, vote.Root, vote.Slot)
+		} else {
+			remaining = append(remaining, vote)
+		}
+	}
+	fc.queuedVotes = remaining
+
+	// Update the justified checkpoint at the start of a new epoch
+	if !wasTicked || slot <= prevSlot || slot%fc.spec.SLOTS_PER_EPOCH != 0 {
+		return nil
+	}
+	if fc.bestJustified.Epoch > fc.justified.Epoch && fc.bestJustifiedBalances != nil {
+		if err := fc.updateJustified(fc.finalized, fc.bestJustified, fc.bestJustifiedBalances); err != nil {
+			return fmt.Errorf("failed to apply best justified checkpoint: %v", err)
+		}
+		fc.bestJustifiedBalances = nil
+	}
+	return nil
+}
+
+func (fc *ProtoForkChoice) CurrentSlot() (slot Slot, ok bool) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	if !fc.ticked {
+		return 0, false
+	}
+	return fc.currentSlot(), true
+}
+
+func (fc *ProtoForkChoice) Copy(sink PrunedNodeSink) Forkchoice {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	var pin *NodeRef
+	if fc.pin != nil {
+		p := *fc.pin
+		pin = &p
+	}
+	return &ProtoForkChoice{
+		protoArray: fc.protoArray.Copy(sink),
+		voteStore:  fc.voteStore.Copy(),
+		// the balances are replaced, not modified, when updated
+		balances:              fc.balances,
+		pin:                   pin,
+		justified:             fc.justified,
+		finalized:             fc.finalized,
+		spec:                  fc.spec,
+		genesisTime:           fc.genesisTime,
+		time:                  fc.time,
+		ticked:                fc.ticked,
+		bestJustified:         fc.bestJustified,
+		bestJustifiedBalances: fc.bestJustifiedBalances,
+		queuedVotes:           append([]LatestVote(nil), fc.queuedVotes...),
+		votesApplied:          fc.votesApplied,
+		boostChanged:          fc.boostChanged,
+	}
 }
 
 func (fc *ProtoForkChoice) Justified() Checkpoint {
@@ -175,19 +337,66 @@ func (fc *ProtoForkChoice) Finalized() Checkpoint {
 
 func (fc *ProtoForkChoice) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool) {
 	fc.mu.Lock()
-	fc.mu.Unlock()
+	defer fc.mu.Unlock()
+	// Votes can only affect the forkchoice of later slots, hold them back until then.
+	// Votes for slots past the current slot are not valid yet.
+	if fc.ticked && headSlot >= fc.currentSlot() {
+		if headSlot > fc.currentSlot() {
+			return false
+		}
+		if blockSlot, ok := fc.protoArray.GetSlot(blockRoot); !ok || blockSlot > headSlot {
+			return false
+		}
+		fc.queuedVotes = append(fc.queuedVotes, LatestVote{Index: index, NodeRef: NodeRef{Root: blockRoot, Slot: headSlot}})
+		return true
+	}
+	return fc.processAttestation(index, blockRoot, headSlot)
+}
+
+func (fc *ProtoForkChoice) processAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool) {
 	// only add the vote if we can. Don't add if it's not within view.
+	// The head slot may be a gap slot after the block.
 	blockSlot, ok := fc.protoArray.GetSlot(blockRoot)
-	if !ok || blockSlot < headSlot {
+	if !ok || blockSlot > headSlot {
 		return false
 	}
 	return fc.voteStore.ProcessAttestation(index, blockRoot, headSlot)
 }
 
+func (fc *ProtoForkChoice) ProcessEquivocation(index ValidatorIndex) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.voteStore.ProcessEquivocation(index)
+}
+
+func (fc *ProtoForkChoice) ProcessIndexedAttestation(att *phase0.IndexedAttestation) []*phase0.AttesterSlashing {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.voteStore.ProcessIndexedAttestation(att)
+}
+
+func (fc *ProtoForkChoice) LatestVotes() []LatestVote {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.voteStore.LatestVotes()
+}
+
+func (fc *ProtoForkChoice) EquivocatingIndices() []ValidatorIndex {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.voteStore.EquivocatingIndices()
+}
+
+func (fc *ProtoForkChoice) VoteHistory() []*phase0.IndexedAttestation {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.voteStore.VoteHistory()
+}
+
 func (fc *ProtoForkChoice) CanonicalChain(anchorRoot Root, anchorSlot Slot) ([]ExtendedNodeRef, error) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
-	return fc.CanonicalChain(anchorRoot, anchorSlot)
+	return fc.protoArray.CanonicalChain(anchorRoot, anchorSlot)
 }
 
 func (fc *ProtoForkChoice) ProcessSlot(parentRoot Root, slot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) {
@@ -202,6 +411,48 @@ func (fc *ProtoForkChoice) ProcessBlock(parentRoot Root, blockRoot Root, blockSl
 	return fc.protoArray.ProcessBlock(parentRoot, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch)
 }
 
+func (fc *ProtoForkChoice) ProcessPayloadBlock(parentRoot Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.protoArray.ProcessPayloadBlock(parentRoot, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch)
+}
+
+// ProcessProposerBoost boosts the block if it is timely: received in its own slot,
+// before the attestations of the slot are due. The boost is removed again at the next slot.
+// Blocks are not boosted until the forkchoice has a time, see OnTick.
+func (fc *ProtoForkChoice) ProcessProposerBoost(blockRoot Root, blockSlot Slot) (ok bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if !fc.ticked || blockSlot != fc.currentSlot() {
+		return false
+	}
+	slotStart, err := fc.spec.TimeAtSlot(blockSlot, fc.genesisTime)
+	if err != nil {
+		return false
+	}
+	if fc.time-slotStart >= fc.spec.SECONDS_PER_SLOT/common.INTERVALS_PER_SLOT {
+		return false
+	}
+	if !fc.protoArray.ProcessProposerBoost(blockRoot, blockSlot) {
+		return false
+	}
+	fc.boostChanged = true
+	return true
+}
+
+func (fc *ProtoForkChoice) ResetProposerBoost() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.protoArray.ResetProposerBoost()
+	fc.boostChanged = true
+}
+
+func (fc *ProtoForkChoice) ProcessExecutionStatus(blockRoot Root, status ExecutionStatus) (ok bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.protoArray.ProcessExecutionStatus(blockRoot, status)
+}
+
 func (fc *ProtoForkChoice) InSubtree(anchor Root, root Root) (unknown bool, inSubtree bool) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
@@ -232,6 +483,21 @@ func (fc *ProtoForkChoice) GetSlot(root Root) (slot Slot, ok bool) {
 	return fc.protoArray.GetSlot(root)
 }
 
+func (fc *ProtoForkChoice) ExecutionStatus(blockRoot Root) (status ExecutionStatus, ok bool) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.protoArray.ExecutionStatus(blockRoot)
+}
+
+func (fc *ProtoForkChoice) ExportTree(anchorRoot Root, anchorSlot Slot) (*ForkchoiceTree, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.updateVotesMaybe(); err != nil {
+		return nil, err
+	}
+	return fc.protoArray.ExportTree(anchorRoot, anchorSlot)
+}
+
 func (fc *ProtoForkChoice) FindHead(anchorRoot Root, anchorSlot Slot) (NodeRef, error) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
@@ -2,7 +2,10 @@ package forkchoice
 
 import (
 	"context"
+	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"io"
 )
 
 type Root = common.Root
@@ -10,12 +13,69 @@ type Epoch = common.Epoch
 type Slot = common.Slot
 type ValidatorIndex = common.ValidatorIndex
 type Gwei = common.Gwei
+type Timestamp = common.Timestamp
 type Checkpoint = common.Checkpoint
 type NodeRef = common.NodeRef
 type ExtendedNodeRef = common.ExtendedNodeRef
 type SignedGwei int64
 type NodeIndex uint64
 
+// ExecutionStatus is the status of the execution payload of a block, as reported by the execution engine.
+type ExecutionStatus uint8
+
+const (
+	// ExecutionValid is the status of a block with a valid execution payload, or without execution payload.
+	ExecutionValid ExecutionStatus = iota
+	// ExecutionSyncing is the status of a block that is imported optimistically:
+	// the execution engine did not verify the execution payload yet.
+	ExecutionSyncing
+	// ExecutionInvalid is the status of a block with an invalid execution payload, or with an invalid ancestor.
+	// Invalid blocks are never the head.
+	ExecutionInvalid
+)
+
+func (s ExecutionStatus) String() string {
+	switch s {
+	case ExecutionValid:
+		return "VALID"
+	case ExecutionSyncing:
+		return "SYNCING"
+	case ExecutionInvalid:
+		return "INVALID"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", uint8(s))
+	}
+}
+
+func (s ExecutionStatus) MarshalText() ([]byte, error) {
+	if s > ExecutionInvalid {
+		return nil, fmt.Errorf("unknown execution status %d", uint8(s))
+	}
+	return []byte(s.String()), nil
+}
+
+func (s *ExecutionStatus) UnmarshalText(text []byte) error {
+	for _, v := range []ExecutionStatus{ExecutionValid, ExecutionSyncing, ExecutionInvalid} {
+		if string(text) == v.String() {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown execution status %q", text)
+}
+
+// PrunedNodeSinkFn is a PrunedNodeSink implemented by a function.
+type PrunedNodeSinkFn func(ctx context.Context, ref NodeRef, canonical bool) error
+
+func (fn PrunedNodeSinkFn) OnPrunedNode(ctx context.Context, ref NodeRef, canonical bool) error {
+	return fn(ctx, ref, canonical)
+}
+
+// PrunedNodeSink receives the nodes that are pruned from the forkchoice, and if they were canonical.
+type PrunedNodeSink interface {
+	OnPrunedNode(ctx context.Context, ref NodeRef, canonical bool) error
+}
+
 type ForkchoiceView interface {
 	CanonicalChain(anchorRoot Root, anchorSlot Slot) ([]ExtendedNodeRef, error)
 	ClosestToSlot(anchor Root, slot Slot) (closest NodeRef, err error)
@@ -24,32 +84,77 @@ type ForkchoiceView interface {
 	FindHead(anchorRoot Root, anchorSlot Slot) (NodeRef, error)
 	InSubtree(anchor Root, root Root) (unknown bool, inSubtree bool)
 	Search(anchor NodeRef, parentRoot *Root, slot *Slot) (nonCanon []NodeRef, canon []NodeRef, err error)
+	// ExportTree returns the forkchoice subtree of the anchor, with the forkchoice data of every node, for debugging.
+	ExportTree(anchorRoot Root, anchorSlot Slot) (*ForkchoiceTree, error)
+	// ExecutionStatus returns the execution status of the given block, ok=false if the block is unknown.
+	ExecutionStatus(blockRoot Root) (status ExecutionStatus, ok bool)
 }
 
 type ForkchoiceNodeInput interface {
 	ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch)
 	ProcessBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool)
+	// ProcessPayloadBlock adds a block with an execution payload, like ProcessBlock.
+	// The block is syncing until the execution engine responds, see ProcessExecutionStatus.
+	ProcessPayloadBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool)
+	// ProcessProposerBoost temporarily boosts the weight of the given block, replacing any previous boost.
+	// If the block is unknown, or does not qualify for the boost, no changes are made, and ok=false is returned.
+	ProcessProposerBoost(blockRoot Root, blockSlot Slot) (ok bool)
+	// ResetProposerBoost removes the proposer boost, if any.
+	ResetProposerBoost()
+	// ProcessExecutionStatus updates the execution status of a syncing block, once the execution engine responds.
+	// Only the syncing to valid, and syncing to invalid transitions are allowed.
+	// A valid block makes its syncing ancestors valid, an invalid block makes its descendants invalid.
+	// If the block is unknown, or the status cannot change, ok=false is returned.
+	ProcessExecutionStatus(blockRoot Root, status ExecutionStatus) (ok bool)
 }
 
 type ForkchoiceGraph interface {
 	ForkchoiceView
 	ForkchoiceNodeInput
 	Indices() map[NodeRef]NodeIndex
-	ApplyScoreChanges(deltas []SignedGwei, justifiedEpoch Epoch, finalizedEpoch Epoch) error
+	// ApplyScoreChanges applies the vote deltas, and moves the proposer boost score to the currently boosted block.
+	ApplyScoreChanges(deltas []SignedGwei, justifiedEpoch Epoch, finalizedEpoch Epoch, proposerBoostScore Gwei) error
 	OnPrune(ctx context.Context, anchorRoot Root, anchorSlot Slot) error
+	// Copy returns an independent copy of the graph, that prunes into the given sink.
+	Copy(sink PrunedNodeSink) ForkchoiceGraph
 }
 
 type VoteInput interface {
 	// ProcessAttestation overrides any previous vote, and applies voting weight to the new root/slot.
 	// If the root/slot combination does not exist, no changes are made, and ok=false is returned.
 	// It is up to the caller if nodes should be added, to then process the attestation.
+	// Once the forkchoice has a current time, votes of the current slot are held back until the slot has passed,
+	// and votes of later slots are rejected with ok=false.
 	ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool)
+	// ProcessEquivocation removes the voting weight of a validator that equivocated, e.g. with an attester slashing.
+	// Any later votes of the validator are ignored.
+	ProcessEquivocation(index ValidatorIndex)
+	// ProcessIndexedAttestation tracks the source and target votes of the attesters, to detect double and surround votes.
+	// The returned attester slashings are candidates: the signatures of the attestations are not verified.
+	// No vote weight is removed, use ProcessEquivocation once a slashing is verified.
+	ProcessIndexedAttestation(att *phase0.IndexedAttestation) []*phase0.AttesterSlashing
+}
+
+// LatestVote is the latest vote of a validator, as tracked by the forkchoice.
+type LatestVote struct {
+	Index ValidatorIndex
+	NodeRef
 }
 
 type VoteStore interface {
 	VoteInput
 	HasChanges() bool
+	// LatestVotes returns the latest vote of every validator that voted, ordered by validator index.
+	LatestVotes() []LatestVote
+	// EquivocatingIndices returns the validators that are equivocating, ordered by validator index.
+	EquivocatingIndices() []ValidatorIndex
+	// VoteHistory returns the attestations that are tracked to detect slashable votes with, each attestation once.
+	VoteHistory() []*phase0.IndexedAttestation
 	ComputeDeltas(indices map[NodeRef]NodeIndex, oldBalances []Gwei, newBalances []Gwei) []SignedGwei
+	// PruneVoteHistory forgets the tracked source and target votes with a target before the given epoch.
+	PruneVoteHistory(minTargetEpoch Epoch)
+	// Copy returns an independent copy of the votes.
+	Copy() VoteStore
 }
 
 type Forkchoice interface {
@@ -63,4 +168,22 @@ type Forkchoice interface {
 	Justified() Checkpoint
 	Finalized() Checkpoint
 	Head() (NodeRef, error)
+	LatestVotes() []LatestVote
+	// EquivocatingIndices returns the validators that are equivocating, ordered by validator index.
+	EquivocatingIndices() []ValidatorIndex
+	// VoteHistory returns the attestations that are tracked to detect slashable votes with, each attestation once.
+	VoteHistory() []*phase0.IndexedAttestation
+	// OnTick updates the current time of the forkchoice.
+	OnTick(ctx context.Context, time Timestamp) error
+	// CurrentSlot returns the slot of the current time, if the forkchoice received any time yet.
+	CurrentSlot() (slot Slot, ok bool)
+	// Copy returns an independent copy of the forkchoice, that prunes into the given sink.
+	Copy(sink PrunedNodeSink) Forkchoice
+	// Snapshot writes the forkchoice, to restore from later, e.g. after a restart.
+	Snapshottable
+	// SnapshotVotes writes only the vote store, to restore into a rebuilt forkchoice with SetVotes.
+	SnapshotVotes(w io.Writer) error
+	// SetVotes replaces the vote store, e.g. with votes restored from a snapshot.
+	// The voting weight of the previous votes is moved to the new votes.
+	SetVotes(votes VoteStore) error
 }
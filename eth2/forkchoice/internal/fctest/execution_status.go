@@ -0,0 +1,241 @@
+package fctest
+
+import (
+	"encoding/binary"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func ExecutionStatusTestDef() *ForkChoiceTestDef {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	init := ForkChoiceTestInit{
+		Spec:         spec,
+		Finalized:    forkchoice.Checkpoint{Root: hash(0), Epoch: 0},
+		Justified:    forkchoice.Checkpoint{Root: hash(0), Epoch: 0},
+		AnchorRoot:   hash(0),
+		AnchorSlot:   0,
+		AnchorParent: hash(0),
+		Balances:     []forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE, spec.MAX_EFFECTIVE_BALANCE},
+	}
+	var ops []Operation
+	add := func(op Operation) {
+		ops = append(ops, op)
+	}
+
+	// Blocks without execution payload are valid, and cannot change.
+	add(&OpProcessBlock{
+		Parent:         hash(0),
+		BlockRoot:      hash(1),
+		BlockSlot:      1,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+	})
+	add(&OpExecutionStatus{
+		BlockRoot: hash(1),
+		Status:    forkchoice.ExecutionValid,
+		Ok:        true,
+	})
+	for _, status := range []forkchoice.ExecutionStatus{forkchoice.ExecutionValid, forkchoice.ExecutionSyncing, forkchoice.ExecutionInvalid} {
+		add(&OpProcessExecutionStatus{
+			BlockRoot: hash(1),
+			Status:    status,
+			Ok:        false,
+		})
+	}
+
+	// Blocks with execution payload are syncing, until the execution engine responds.
+	//
+	//          0
+	//          |
+	//          1
+	//          |
+	//          2 <- syncing
+	//          |
+	//          *
+	//         / \
+	//        3   *
+	//            |
+	//            4
+	add(&OpProcessBlock{
+		Parent:         hash(1),
+		BlockRoot:      hash(2),
+		BlockSlot:      2,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+		Payload:        true,
+	})
+	add(&OpProcessBlock{
+		Parent:         hash(2),
+		BlockRoot:      hash(3),
+		BlockSlot:      3,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+		Payload:        true,
+	})
+	add(&OpProcessBlock{
+		Parent:         hash(2),
+		BlockRoot:      hash(4),
+		BlockSlot:      4,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+		Payload:        true,
+	})
+	for _, i := range []uint64{2, 3, 4} {
+		add(&OpExecutionStatus{
+			BlockRoot: hash(i),
+			Status:    forkchoice.ExecutionSyncing,
+			Ok:        true,
+		})
+	}
+	// Syncing blocks cannot be marked as syncing again
+	add(&OpProcessExecutionStatus{
+		BlockRoot: hash(3),
+		Status:    forkchoice.ExecutionSyncing,
+		Ok:        false,
+	})
+
+	// Vote for block 3, it is the head, even though it is still syncing.
+	add(&OpProcessAttestation{
+		ValidatorIndex: 0,
+		BlockRoot:      hash(3),
+		HeadSlot:       3,
+		CanAdd:         true,
+	})
+	add(&OpHead{
+		ExpectedHead: forkchoice.NodeRef{Root: hash(3), Slot: 3},
+		Ok:           true,
+	})
+
+	// The payload of block 3 is invalid, the head moves to 4, despite the vote for 3.
+	add(&OpProcessExecutionStatus{
+		BlockRoot: hash(3),
+		Status:    forkchoice.ExecutionInvalid,
+		Ok:        true,
+	})
+	add(&OpHead{
+		ExpectedHead: forkchoice.NodeRef{Root: hash(4), Slot: 4},
+		Ok:           true,
+	})
+	// Invalid blocks stay invalid
+	for _, status := range []forkchoice.ExecutionStatus{forkchoice.ExecutionValid, forkchoice.ExecutionSyncing, forkchoice.ExecutionInvalid} {
+		add(&OpProcessExecutionStatus{
+			BlockRoot: hash(3),
+			Status:    status,
+			Ok:        false,
+		})
+	}
+
+	// The payload of block 4 is valid, which makes its ancestor 2 valid too.
+	add(&OpProcessExecutionStatus{
+		BlockRoot: hash(4),
+		Status:    forkchoice.ExecutionValid,
+		Ok:        true,
+	})
+	add(&OpExecutionStatus{
+		BlockRoot: hash(2),
+		Status:    forkchoice.ExecutionValid,
+		Ok:        true,
+	})
+	add(&OpExecutionStatus{
+		BlockRoot: hash(3),
+		Status:    forkchoice.ExecutionInvalid,
+		Ok:        true,
+	})
+	// Valid blocks stay valid
+	for _, i := range []uint64{2, 4} {
+		for _, status := range []forkchoice.ExecutionStatus{forkchoice.ExecutionValid, forkchoice.ExecutionSyncing, forkchoice.ExecutionInvalid} {
+			add(&OpProcessExecutionStatus{
+				BlockRoot: hash(i),
+				Status:    status,
+				Ok:        false,
+			})
+		}
+	}
+
+	// Unknown blocks cannot change
+	add(&OpProcessExecutionStatus{
+		BlockRoot: hash(42),
+		Status:    forkchoice.ExecutionInvalid,
+		Ok:        false,
+	})
+	add(&OpExecutionStatus{
+		BlockRoot: hash(42),
+		Status:    forkchoice.ExecutionValid,
+		Ok:        false,
+	})
+
+	// New blocks on top of an invalid block are invalid too, with or without payload.
+	add(&OpProcessBlock{
+		Parent:         hash(3),
+		BlockRoot:      hash(5),
+		BlockSlot:      5,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+		Payload:        true,
+	})
+	add(&OpExecutionStatus{
+		BlockRoot: hash(5),
+		Status:    forkchoice.ExecutionInvalid,
+		Ok:        true,
+	})
+
+	// Invalidate block 6 on top of 4, with a vote, and with that its descendant 7.
+	// The head falls back to the empty slot after 4.
+	//
+	//          4
+	//          |
+	//          *
+	//         / \
+	//        6   * <- head
+	//        |
+	//        7
+	add(&OpProcessBlock{
+		Parent:         hash(4),
+		BlockRoot:      hash(6),
+		BlockSlot:      6,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+		Payload:        true,
+	})
+	add(&OpProcessBlock{
+		Parent:         hash(6),
+		BlockRoot:      hash(7),
+		BlockSlot:      7,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+		Payload:        true,
+	})
+	add(&OpProcessAttestation{
+		ValidatorIndex: 1,
+		BlockRoot:      hash(7),
+		HeadSlot:       7,
+		CanAdd:         true,
+	})
+	add(&OpHead{
+		ExpectedHead: forkchoice.NodeRef{Root: hash(7), Slot: 7},
+		Ok:           true,
+	})
+	add(&OpProcessExecutionStatus{
+		BlockRoot: hash(6),
+		Status:    forkchoice.ExecutionInvalid,
+		Ok:        true,
+	})
+	add(&OpExecutionStatus{
+		BlockRoot: hash(7),
+		Status:    forkchoice.ExecutionInvalid,
+		Ok:        true,
+	})
+	add(&OpHead{
+		ExpectedHead: forkchoice.NodeRef{Root: hash(4), Slot: 6},
+		Ok:           true,
+	})
+
+	return &ForkChoiceTestDef{
+		Init:       init,
+		Operations: ops,
+	}
+}
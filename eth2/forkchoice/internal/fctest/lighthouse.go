@@ -79,15 +79,16 @@ func LighthouseTestDef() *ForkChoiceTestDef {
 		FinalizedEpoch: 0,
 	})
 
-	// Ensure that the head changed to 1, because of bad tiebreaking based on parent-root (TODO)
+	// Ensure that the head is still 2: the tie is broken by the higher block root,
+	// the empty slot before 2 is compared by the block it leads to, not the root of 0.
 	//
 	//          0
 	//         / \
 	//        *   1
 	//        |
-	//        2
+	//        2 <- head
 	add(&OpHead{
-		ExpectedHead: forkchoice.NodeRef{Root: hash(1), Slot: 1},
+		ExpectedHead: forkchoice.NodeRef{Root: hash(2), Slot: 2},
 		Ok:           true,
 	})
 
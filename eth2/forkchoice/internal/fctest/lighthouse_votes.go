@@ -0,0 +1,548 @@
+package fctest
+
+import (
+	"encoding/binary"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+// LighthouseVotesTestDef is a port of the votes test of the Lighthouse proto-array.
+//
+// Votes in this forkchoice are (block root, head slot) pairs, and the target epoch of a vote is that of the head slot.
+// The spec has a single slot per epoch here, and blocks are placed at slots such that every vote in the sequence
+// is for a later epoch than the previous vote of the same validator, like the target epochs of the original test.
+// Justification and finalization happen together, which prunes the graph at the same time.
+// Balances only change with justification here, removal of validators is done with equivocations instead.
+func LighthouseVotesTestDef() *ForkChoiceTestDef {
+	spec := *configs.Mainnet
+	spec.SLOTS_PER_EPOCH = 1
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	ref := func(i uint64, slot forkchoice.Slot) forkchoice.NodeRef {
+		return forkchoice.NodeRef{Root: hash(i), Slot: slot}
+	}
+	balance := spec.MAX_EFFECTIVE_BALANCE
+	init := ForkChoiceTestInit{
+		Spec:         &spec,
+		Finalized:    forkchoice.Checkpoint{Root: hash(0), Epoch: 1},
+		Justified:    forkchoice.Checkpoint{Root: hash(0), Epoch: 1},
+		AnchorRoot:   hash(0),
+		AnchorSlot:   0,
+		AnchorParent: hash(0),
+		// Validators 2 and 3 do not vote until later in the test.
+		Balances: []forkchoice.Gwei{balance, balance, balance, balance},
+	}
+	var ops []Operation
+	add := func(op Operation) {
+		ops = append(ops, op)
+	}
+
+	// Ensure that the head starts at the finalized block.
+	add(&OpHead{
+		ExpectedHead: ref(0, 0),
+		Ok:           true,
+	})
+
+	// Add a block with a hash of 2, at slot 1
+	//
+	//          0
+	//         /
+	//        2
+	add(&OpProcessBlock{
+		Parent:         hash(0),
+		BlockRoot:      hash(2),
+		BlockSlot:      1,
+		JustifiedEpoch: 1,
+		FinalizedEpoch: 1,
+	})
+
+	// Ensure that the head is 2
+	//
+	//          0
+	//         /
+	// head-> 2
+	add(&OpHead{
+		ExpectedHead: ref(2, 1),
+		Ok:           true,
+	})
+
+	// Add a block with a hash of 1 that comes off the genesis block (this is a fork compared
+	// to the previous block). At slot 2, after an empty slot 1.
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1
+	add(&OpProcessBlock{
+		Parent:         hash(0),
+		BlockRoot:      hash(1),
+		BlockSlot:      2,
+		JustifiedEpoch: 1,
+		FinalizedEpoch: 1,
+	})
+
+	// Ensure that the head is still 2: 1 and 2 are both children of 0, without weight,
+	// and the tie is broken by the higher block root.
+	// The empty slot before 1 is compared by the block it leads to, not the root of 0.
+	//
+	//          0
+	//         / \
+	// head-> 2   *
+	//            |
+	//            1
+	add(&OpHead{
+		ExpectedHead: ref(2, 1),
+		Ok:           true,
+	})
+
+	// Add a vote to block 1
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1 <- +vote
+	add(&OpProcessAttestation{
+		ValidatorIndex: 0,
+		BlockRoot:      hash(1),
+		HeadSlot:       2,
+		CanAdd:         true,
+	})
+
+	// Ensure that the head is now 1, because 1 has a vote.
+	add(&OpHead{
+		ExpectedHead: ref(1, 2),
+		Ok:           true,
+	})
+
+	// Add a vote to block 2
+	//
+	//           0
+	//          / \
+	// +vote-> 2   *
+	//             |
+	//             1
+	add(&OpProcessAttestation{
+		ValidatorIndex: 1,
+		BlockRoot:      hash(2),
+		HeadSlot:       1,
+		CanAdd:         true,
+	})
+
+	// Ensure that the head is 2 since 1 and 2 both have a vote, and the tie is broken by root.
+	add(&OpHead{
+		ExpectedHead: ref(2, 1),
+		Ok:           true,
+	})
+
+	// Add block 3, on top of 1
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1
+	//            |
+	//            3
+	add(&OpProcessBlock{
+		Parent:         hash(1),
+		BlockRoot:      hash(3),
+		BlockSlot:      3,
+		JustifiedEpoch: 1,
+		FinalizedEpoch: 1,
+	})
+
+	// Ensure that the head is still 2
+	add(&OpHead{
+		ExpectedHead: ref(2, 1),
+		Ok:           true,
+	})
+
+	// Move validator #0 vote from 1 to 3
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1 <- -vote
+	//            |
+	//            3 <- +vote
+	add(&OpProcessAttestation{
+		ValidatorIndex: 0,
+		BlockRoot:      hash(3),
+		HeadSlot:       3,
+		CanAdd:         true,
+	})
+
+	// Ensure that the head is still 2, the branch of 1 still has a single vote.
+	add(&OpHead{
+		ExpectedHead: ref(2, 1),
+		Ok:           true,
+	})
+
+	// Move validator #1 vote from 2 to 1 (this is an equivocation, but fork choice doesn't
+	// care)
+	//
+	//           0
+	//          / \
+	// -vote-> 2   *
+	//             |
+	//    +vote->  1
+	//             |
+	//             3
+	add(&OpProcessAttestation{
+		ValidatorIndex: 1,
+		BlockRoot:      hash(1),
+		HeadSlot:       2,
+		CanAdd:         true,
+	})
+
+	// Ensure that the head is now 3
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1
+	//            |
+	//            3 <- head
+	add(&OpHead{
+		ExpectedHead: ref(3, 3),
+		Ok:           true,
+	})
+
+	// Add block 4, on top of 3
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1
+	//            |
+	//            3
+	//            |
+	//            4
+	add(&OpProcessBlock{
+		Parent:         hash(3),
+		BlockRoot:      hash(4),
+		BlockSlot:      4,
+		JustifiedEpoch: 1,
+		FinalizedEpoch: 1,
+	})
+
+	// Ensure that the head is 4
+	add(&OpHead{
+		ExpectedHead: ref(4, 4),
+		Ok:           true,
+	})
+
+	// Add block 5, which has a justified epoch of 5.
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1
+	//            |
+	//            3
+	//            |
+	//            4
+	//           /
+	//          5 <- justified epoch = 5
+	add(&OpProcessBlock{
+		Parent:         hash(4),
+		BlockRoot:      hash(5),
+		BlockSlot:      5,
+		JustifiedEpoch: 5,
+		FinalizedEpoch: 5,
+	})
+
+	// Ensure that 5 is filtered out and the head stays at 4.
+	add(&OpHead{
+		ExpectedHead: ref(4, 4),
+		Ok:           true,
+	})
+
+	// Add block 6, on top of 4, after the empty slot 5, which has the justification of block 5.
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1
+	//            |
+	//            3
+	//            |
+	//            4
+	//           / \
+	//          5   *
+	//              |
+	//              6
+	add(&OpProcessBlock{
+		Parent:         hash(4),
+		BlockRoot:      hash(6),
+		BlockSlot:      6,
+		JustifiedEpoch: 1,
+		FinalizedEpoch: 1,
+	})
+
+	// Ensure that the head is now 6
+	add(&OpHead{
+		ExpectedHead: ref(6, 6),
+		Ok:           true,
+	})
+
+	// Move both votes to 5.
+	//
+	//           0
+	//          / \
+	//         2   *
+	//             |
+	//             1
+	//             |
+	//             3
+	//             |
+	//             4
+	//            / \
+	// +2 vote-> 5   *
+	//               |
+	//               6
+	add(&OpProcessAttestation{
+		ValidatorIndex: 0,
+		BlockRoot:      hash(5),
+		HeadSlot:       5,
+		CanAdd:         true,
+	})
+	add(&OpProcessAttestation{
+		ValidatorIndex: 1,
+		BlockRoot:      hash(5),
+		HeadSlot:       5,
+		CanAdd:         true,
+	})
+
+	// Add blocks 7, 8 and 9. Adding these blocks helps test the `best_descendant`
+	// functionality.
+	//
+	//          0
+	//         / \
+	//        2   *
+	//            |
+	//            1
+	//            |
+	//            3
+	//            |
+	//            4
+	//           / \
+	//          5   *
+	//          |   |
+	//          7   6
+	//          |
+	//          8
+	//         /
+	//         9
+	add(&OpProcessBlock{
+		Parent:         hash(5),
+		BlockRoot:      hash(7),
+		BlockSlot:      6,
+		JustifiedEpoch: 5,
+		FinalizedEpoch: 5,
+	})
+	add(&OpProcessBlock{
+		Parent:         hash(7),
+		BlockRoot:      hash(8),
+		BlockSlot:      7,
+		JustifiedEpoch: 5,
+		FinalizedEpoch: 5,
+	})
+	add(&OpProcessBlock{
+		Parent:         hash(8),
+		BlockRoot:      hash(9),
+		BlockSlot:      8,
+		JustifiedEpoch: 5,
+		FinalizedEpoch: 5,
+	})
+
+	// Ensure that 6 is still the head, even though 5 has all the votes.
+	add(&OpHead{
+		ExpectedHead: ref(6, 6),
+		Ok:           true,
+	})
+
+	// Justify and finalize block 5. All nodes before 5 are pruned.
+	// The nodes that lead to the new head are pruned as canonical, the others are not.
+	for _, n := range []struct {
+		ref       forkchoice.NodeRef
+		canonical bool
+	}{
+		{ref(0, 0), true},
+		{ref(0, 1), true},
+		{ref(2, 1), false},
+		{ref(0, 2), false},
+		{ref(1, 2), true},
+		{ref(1, 3), false},
+		{ref(3, 3), true},
+		{ref(3, 4), false},
+		{ref(4, 4), true},
+		{ref(4, 5), false},
+	} {
+		add(&OpPruneable{Pruneable: n.ref, Canonical: n.canonical})
+	}
+	add(&OpUpdateJustified{
+		Trigger:   hash(5),
+		Justified: forkchoice.Checkpoint{Root: hash(5), Epoch: 5},
+		Finalized: forkchoice.Checkpoint{Root: hash(5), Epoch: 5},
+		JustifiedStateBalances: func() ([]forkchoice.Gwei, error) {
+			return init.Balances, nil
+		},
+		Ok: true,
+	})
+
+	// Ensure that the head is now 9, from the new justified block 5.
+	//
+	//          5
+	//          |
+	//          7
+	//          |
+	//          8
+	//         /
+	//        9 <- head
+	add(&OpHead{
+		ExpectedHead: ref(9, 8),
+		Ok:           true,
+	})
+	add(&OpFindHead{
+		AnchorRoot:   hash(5),
+		AnchorSlot:   5,
+		ExpectedHead: ref(9, 8),
+		Ok:           true,
+	})
+
+	// Pruned blocks are gone, the remaining blocks are still known.
+	add(&OpGetSlot{BlockRoot: hash(4), Ok: false})
+	add(&OpGetSlot{BlockRoot: hash(5), Slot: 5, Ok: true})
+	add(&OpGetSlot{BlockRoot: hash(9), Slot: 8, Ok: true})
+
+	// Move both votes to 9.
+	//
+	//          5
+	//          |
+	//          7
+	//          |
+	//          8
+	//         /
+	//        9 <- +2 votes
+	add(&OpProcessAttestation{
+		ValidatorIndex: 0,
+		BlockRoot:      hash(9),
+		HeadSlot:       8,
+		CanAdd:         true,
+	})
+	add(&OpProcessAttestation{
+		ValidatorIndex: 1,
+		BlockRoot:      hash(9),
+		HeadSlot:       8,
+		CanAdd:         true,
+	})
+
+	// Add block 10, at the same slot as 9
+	//
+	//          5
+	//          |
+	//          7
+	//          |
+	//          8
+	//         / \
+	//        9   10
+	add(&OpProcessBlock{
+		Parent:         hash(8),
+		BlockRoot:      hash(10),
+		BlockSlot:      8,
+		JustifiedEpoch: 5,
+		FinalizedEpoch: 5,
+	})
+
+	// Double-check the head is still 9 (9 has two votes, 10 has none)
+	add(&OpHead{
+		ExpectedHead: ref(9, 8),
+		Ok:           true,
+	})
+
+	// Validators 2 and 3 start voting for 10.
+	//
+	//          5
+	//          |
+	//          7
+	//          |
+	//          8
+	//         / \
+	//        9   10 <- +2 votes
+	add(&OpProcessAttestation{
+		ValidatorIndex: 2,
+		BlockRoot:      hash(10),
+		HeadSlot:       8,
+		CanAdd:         true,
+	})
+	add(&OpProcessAttestation{
+		ValidatorIndex: 3,
+		BlockRoot:      hash(10),
+		HeadSlot:       8,
+		CanAdd:         true,
+	})
+
+	// Check the head is now 10: 9 and 10 both have two votes, and the tie is broken by root.
+	add(&OpHead{
+		ExpectedHead: ref(10, 8),
+		Ok:           true,
+	})
+
+	// Remove the weight of validators 2 and 3, by marking them as equivocating.
+	add(&OpProcessEquivocation{ValidatorIndex: 2})
+	add(&OpProcessEquivocation{ValidatorIndex: 3})
+
+	// Equivocating validators cannot vote anymore.
+	add(&OpProcessAttestation{
+		ValidatorIndex: 2,
+		BlockRoot:      hash(9),
+		HeadSlot:       8,
+		CanAdd:         false,
+	})
+
+	// Check the head is now 9 again.
+	add(&OpHead{
+		ExpectedHead: ref(9, 8),
+		Ok:           true,
+	})
+
+	// Add block 11
+	//
+	//          5
+	//          |
+	//          7
+	//          |
+	//          8
+	//         / \
+	//        9   10
+	//        |
+	//        11
+	add(&OpProcessBlock{
+		Parent:         hash(9),
+		BlockRoot:      hash(11),
+		BlockSlot:      9,
+		JustifiedEpoch: 5,
+		FinalizedEpoch: 5,
+	})
+
+	// Ensure the head is now 11
+	add(&OpHead{
+		ExpectedHead: ref(11, 9),
+		Ok:           true,
+	})
+
+	return &ForkChoiceTestDef{
+		Init:       init,
+		Operations: ops,
+	}
+}
@@ -0,0 +1,153 @@
+package fctest
+
+import (
+	"encoding/binary"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func ProposerBoostTestDef() *ForkChoiceTestDef {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesisTime := forkchoice.Timestamp(1000)
+	slotTime := func(slot forkchoice.Slot) forkchoice.Timestamp {
+		return genesisTime + forkchoice.Timestamp(slot)*spec.SECONDS_PER_SLOT
+	}
+	// 64 validators: the committee weight is 2 validators, the boost of 70% of that outweighs a single vote.
+	balances := make([]forkchoice.Gwei, 64)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	init := ForkChoiceTestInit{
+		Spec:         spec,
+		GenesisTime:  genesisTime,
+		Finalized:    forkchoice.Checkpoint{Root: hash(0), Epoch: 0},
+		Justified:    forkchoice.Checkpoint{Root: hash(0), Epoch: 0},
+		AnchorRoot:   hash(0),
+		AnchorSlot:   0,
+		AnchorParent: hash(0),
+		Balances:     balances,
+	}
+	var ops []Operation
+	add := func(op Operation) {
+		ops = append(ops, op)
+	}
+
+	// Without a clock, blocks are not boosted
+	add(&OpProcessBlock{
+		Parent:         hash(0),
+		BlockRoot:      hash(1),
+		BlockSlot:      1,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+	})
+	add(&OpProcessProposerBoost{
+		BlockRoot: hash(1),
+		BlockSlot: 1,
+		Boosted:   false,
+	})
+
+	// Add a vote to block 1, in slot 1. It is applied after slot 1.
+	//
+	//          0
+	//          |
+	//          1 <- vote
+	add(&OpOnTick{Time: slotTime(1)})
+	add(&OpProcessAttestation{
+		ValidatorIndex: 0,
+		BlockRoot:      hash(1),
+		HeadSlot:       1,
+		CanAdd:         true,
+	})
+	add(&OpOnTick{Time: slotTime(2)})
+	add(&OpHead{
+		ExpectedHead: forkchoice.NodeRef{Root: hash(1), Slot: 1},
+		Ok:           true,
+	})
+
+	// Add a competing block 2 in slot 2, on time. The boost outweighs the vote.
+	//
+	//          0
+	//         / \
+	//        1   *
+	//            |
+	//            2 <- boost
+	add(&OpOnTick{Time: slotTime(2) + 1})
+	add(&OpProcessBlock{
+		Parent:         hash(0),
+		BlockRoot:      hash(2),
+		BlockSlot:      2,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+	})
+	add(&OpProcessProposerBoost{
+		BlockRoot: hash(2),
+		BlockSlot: 2,
+		Boosted:   true,
+	})
+	add(&OpHead{
+		ExpectedHead: forkchoice.NodeRef{Root: hash(2), Slot: 2},
+		Ok:           true,
+	})
+
+	// Another block 3 in slot 2 arrives late in the slot, and is not boosted. Block 2 keeps the boost.
+	//
+	//          0
+	//         / \
+	//        1   *
+	//           / \
+	//          2   3
+	add(&OpOnTick{Time: slotTime(2) + spec.SECONDS_PER_SLOT/2})
+	add(&OpProcessBlock{
+		Parent:         hash(0),
+		BlockRoot:      hash(3),
+		BlockSlot:      2,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+	})
+	add(&OpProcessProposerBoost{
+		BlockRoot: hash(3),
+		BlockSlot: 2,
+		Boosted:   false,
+	})
+	add(&OpHead{
+		ExpectedHead: forkchoice.NodeRef{Root: hash(2), Slot: 2},
+		Ok:           true,
+	})
+
+	// Gap slots cannot be boosted
+	add(&OpProcessProposerBoost{
+		BlockRoot: hash(0),
+		BlockSlot: 2,
+		Boosted:   false,
+	})
+
+	// The boost is removed at the next slot, the vote for block 1 counts again
+	add(&OpOnTick{Time: slotTime(3)})
+	add(&OpHead{
+		ExpectedHead: forkchoice.NodeRef{Root: hash(1), Slot: 1},
+		Ok:           true,
+	})
+
+	// Blocks of earlier slots are not boosted
+	add(&OpProcessBlock{
+		Parent:         hash(1),
+		BlockRoot:      hash(4),
+		BlockSlot:      2,
+		JustifiedEpoch: 0,
+		FinalizedEpoch: 0,
+	})
+	add(&OpProcessProposerBoost{
+		BlockRoot: hash(4),
+		BlockSlot: 2,
+		Boosted:   false,
+	})
+
+	return &ForkChoiceTestDef{
+		Init:       init,
+		Operations: ops,
+	}
+}
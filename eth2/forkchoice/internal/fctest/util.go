@@ -150,6 +150,26 @@ func (op *OpHead) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) erro
 	return nil
 }
 
+type OpExecutionStatus struct {
+	BlockRoot forkchoice.Root
+	Status    forkchoice.ExecutionStatus
+	Ok        bool
+}
+
+func (op *OpExecutionStatus) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
+	status, ok := fc.ExecutionStatus(op.BlockRoot)
+	if op.Ok && !ok {
+		return fmt.Errorf("unexpected fail")
+	}
+	if !op.Ok && ok {
+		return fmt.Errorf("unexpected no fail")
+	}
+	if status != op.Status {
+		return fmt.Errorf("different execution status: %s <> %s", status, op.Status)
+	}
+	return nil
+}
+
 type OpIsAncestor struct {
 	Anchor    forkchoice.Root
 	Root      forkchoice.Root
@@ -184,10 +204,16 @@ type OpProcessBlock struct {
 	BlockSlot      forkchoice.Slot
 	JustifiedEpoch forkchoice.Epoch
 	FinalizedEpoch forkchoice.Epoch
+	// Payload adds the block as a block with an execution payload
+	Payload bool
 }
 
 func (op *OpProcessBlock) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
-	fc.ProcessBlock(op.Parent, op.BlockRoot, op.BlockSlot, op.JustifiedEpoch, op.FinalizedEpoch)
+	if op.Payload {
+		fc.ProcessPayloadBlock(op.Parent, op.BlockRoot, op.BlockSlot, op.JustifiedEpoch, op.FinalizedEpoch)
+	} else {
+		fc.ProcessBlock(op.Parent, op.BlockRoot, op.BlockSlot, op.JustifiedEpoch, op.FinalizedEpoch)
+	}
 	return nil
 }
 
@@ -206,6 +232,51 @@ func (op *OpProcessAttestation) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Fo
 	return nil
 }
 
+type OpProcessEquivocation struct {
+	ValidatorIndex forkchoice.ValidatorIndex
+}
+
+func (op *OpProcessEquivocation) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
+	fc.ProcessEquivocation(op.ValidatorIndex)
+	return nil
+}
+
+type OpProcessExecutionStatus struct {
+	BlockRoot forkchoice.Root
+	Status    forkchoice.ExecutionStatus
+	Ok        bool
+}
+
+func (op *OpProcessExecutionStatus) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
+	res := fc.ProcessExecutionStatus(op.BlockRoot, op.Status)
+	if res != op.Ok {
+		return fmt.Errorf("processing execution status different result: ok %v <> %v", res, op.Ok)
+	}
+	return nil
+}
+
+type OpProcessProposerBoost struct {
+	BlockRoot forkchoice.Root
+	BlockSlot forkchoice.Slot
+	Boosted   bool
+}
+
+func (op *OpProcessProposerBoost) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
+	res := fc.ProcessProposerBoost(op.BlockRoot, op.BlockSlot)
+	if res != op.Boosted {
+		return fmt.Errorf("processing proposer boost different result: boosted %v <> %v", res, op.Boosted)
+	}
+	return nil
+}
+
+type OpOnTick struct {
+	Time forkchoice.Timestamp
+}
+
+func (op *OpOnTick) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
+	return fc.OnTick(context.Background(), op.Time)
+}
+
 type OpPruneable struct {
 	Pruneable forkchoice.NodeRef
 	Canonical bool
@@ -225,7 +296,7 @@ type OpUpdateJustified struct {
 }
 
 func (op *OpUpdateJustified) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
-	err := fc.UpdateJustified(context.Background(), op.Trigger, op.Finalized, op.Justified, op.JustifiedStateBalances)
+	err := fc.UpdateJustified(context.Background(), op.Trigger, op.Justified, op.Finalized, op.JustifiedStateBalances)
 	if op.Ok && err != nil {
 		return fmt.Errorf("unexpected error: %v", err)
 	}
@@ -235,8 +306,24 @@ func (op *OpUpdateJustified) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkc
 	return nil
 }
 
+type OpCheckpoints struct {
+	Justified forkchoice.Checkpoint
+	Finalized forkchoice.Checkpoint
+}
+
+func (op *OpCheckpoints) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
+	if j := fc.Justified(); j != op.Justified {
+		return fmt.Errorf("expected justified %s, got %s", op.Justified, j)
+	}
+	if f := fc.Finalized(); f != op.Finalized {
+		return fmt.Errorf("expected finalized %s, got %s", op.Finalized, f)
+	}
+	return nil
+}
+
 type ForkChoiceTestInit struct {
 	Spec         *common.Spec
+	GenesisTime  forkchoice.Timestamp
 	Finalized    forkchoice.Checkpoint
 	Justified    forkchoice.Checkpoint
 	AnchorRoot   forkchoice.Root
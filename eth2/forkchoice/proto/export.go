@@ -0,0 +1,64 @@
+package proto
+
+import (
+	. "github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+// ExportTree collects the nodes of the forkchoice subtree of the anchor, with the chain to the head marked as canonical.
+func (pr *ProtoArray) ExportTree(anchorRoot Root, anchorSlot Slot) (*ForkchoiceTree, error) {
+	head, err := pr.FindHead(anchorRoot, anchorSlot)
+	if err != nil {
+		return nil, err
+	}
+	anchorRef := NodeRef{Root: anchorRoot, Slot: anchorSlot}
+	anchorIndex, ok := pr.indices[anchorRef]
+	if !ok {
+		return nil, UnknownAnchorErr
+	}
+	headIndex := pr.indices[head]
+	refAt := func(index NodeIndex) *NodeRef {
+		if index == NONE {
+			return nil
+		}
+		node, err := pr.getNode(index)
+		if err != nil {
+			return nil
+		}
+		ref := node.Ref
+		return &ref
+	}
+	tree := &ForkchoiceTree{Anchor: anchorRef, Head: head}
+	// Parents are always before their children in the array
+	inTree := map[NodeIndex]struct{}{anchorIndex: {}}
+	for index := anchorIndex; index < pr.indexOffset+NodeIndex(len(pr.nodes)); index++ {
+		node, err := pr.getNode(index)
+		if err != nil {
+			return nil, err
+		}
+		if index != anchorIndex {
+			if _, ok := inTree[node.ForkchoiceParent]; !ok {
+				continue
+			}
+			inTree[index] = struct{}{}
+		}
+		exported := ExportNode{
+			NodeRef: node.Ref,
+			// Empty slots repeat the block root as their own root.
+			Block:           node.Ref.Root != node.ParentRoot,
+			ParentRoot:      node.ParentRoot,
+			Weight:          node.Weight,
+			BestChild:       refAt(node.BestChild),
+			BestDescendant:  refAt(node.BestDescendant),
+			JustifiedEpoch:  node.JustifiedEpoch,
+			FinalizedEpoch:  node.FinalizedEpoch,
+			ExecutionStatus: node.ExecutionStatus,
+			Viable:          pr.isNodeViableForHead(node),
+			Canonical:       index == headIndex || node.BestDescendant == headIndex,
+		}
+		if index != anchorIndex {
+			exported.Parent = refAt(node.ForkchoiceParent)
+		}
+		tree.Nodes = append(tree.Nodes, exported)
+	}
+	return tree, nil
+}
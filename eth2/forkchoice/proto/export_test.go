@@ -0,0 +1,114 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func TestExportTree(t *testing.T) {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0),
+		[]forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE, spec.MAX_EFFECTIVE_BALANCE},
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//      0
+	//     / \
+	//    1   *
+	//        |
+	//        2 <- vote
+	fc.ProcessBlock(hash(0), hash(1), 1, 0, 0)
+	fc.ProcessBlock(hash(0), hash(2), 2, 0, 0)
+	fc.ProcessAttestation(0, hash(2), 2)
+
+	tree, err := fc.ExportTree(hash(0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := forkchoice.NodeRef{Root: hash(2), Slot: 2}
+	if tree.Head != head {
+		t.Fatalf("expected head %s, got %s", head, tree.Head)
+	}
+	nodes := make(map[forkchoice.NodeRef]*forkchoice.ExportNode)
+	for i := range tree.Nodes {
+		nodes[tree.Nodes[i].NodeRef] = &tree.Nodes[i]
+	}
+	// Anchor, block 1, the empty slot 1, and the empty slot 2 and block 2 after it.
+	if len(nodes) != 5 {
+		t.Fatalf("expected 5 nodes, got %d", len(nodes))
+	}
+	for ref, canonical := range map[forkchoice.NodeRef]bool{
+		{Root: hash(0), Slot: 0}: true,
+		{Root: hash(1), Slot: 1}: false,
+		{Root: hash(0), Slot: 1}: true,
+		{Root: hash(0), Slot: 2}: false,
+		{Root: hash(2), Slot: 2}: true,
+	} {
+		n, ok := nodes[ref]
+		if !ok {
+			t.Fatalf("missing node %s", ref)
+		}
+		if n.Canonical != canonical {
+			t.Fatalf("expected node %s canonical=%v", ref, canonical)
+		}
+		if !n.Viable {
+			t.Fatalf("expected node %s to be viable", ref)
+		}
+	}
+	block := nodes[head]
+	if !block.Block || block.ParentRoot != hash(0) || block.Parent == nil || *block.Parent != (forkchoice.NodeRef{Root: hash(0), Slot: 1}) {
+		t.Fatalf("unexpected block node: %+v", block)
+	}
+	if block.Weight != forkchoice.SignedGwei(spec.MAX_EFFECTIVE_BALANCE) {
+		t.Fatalf("expected weight of vote, got %d", block.Weight)
+	}
+	if anchor := nodes[tree.Anchor]; anchor.Parent != nil || anchor.BestDescendant == nil || *anchor.BestDescendant != head {
+		t.Fatalf("unexpected anchor node: %+v", anchor)
+	}
+	if gap := nodes[forkchoice.NodeRef{Root: hash(0), Slot: 1}]; gap.Block {
+		t.Fatal("expected empty slot node")
+	}
+	chain, err := fc.CanonicalChain(hash(0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) == 0 || chain[0].NodeRef != head {
+		t.Fatalf("unexpected canonical chain: %v", chain)
+	}
+
+	var buf bytes.Buffer
+	if err := tree.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded forkchoice.ForkchoiceTree
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Head != head || len(decoded.Nodes) != len(tree.Nodes) {
+		t.Fatal("JSON export does not match tree")
+	}
+
+	buf.Reset()
+	if err := tree.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph forkchoice {") || strings.Count(dot, " -> ") != 4 || !strings.Contains(dot, "peripheries=2") {
+		t.Fatalf("unexpected DOT export:\n%s", dot)
+	}
+}
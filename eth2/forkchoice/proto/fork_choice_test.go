@@ -2,30 +2,372 @@ package proto
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"github.com/protolambda/zrnt/eth2/configs"
 	"github.com/protolambda/zrnt/eth2/forkchoice"
 	"github.com/protolambda/zrnt/eth2/forkchoice/internal/fctest"
 	"testing"
+	"time"
 )
 
+func prepareProtoForkChoice(init *fctest.ForkChoiceTestInit, ft *fctest.ForkChoiceTestTarget) (forkchoice.Forkchoice, error) {
+	return NewProtoForkChoice(init.Spec, init.GenesisTime, init.Finalized, init.Justified, init.AnchorRoot, init.AnchorSlot, init.AnchorParent, init.Balances,
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			// whenever something is pruned, check if it was allowed to be pruned,
+			// and if it's marked as canonical correctly.
+			expectedCanonical, ok := ft.Pruneable[ref]
+			if !ok {
+				return fmt.Errorf("unexpected pruning of node %s", ref)
+			}
+			if canonical != expectedCanonical {
+				return fmt.Errorf("bad pruning, pruned as canonical=%v, but expected %v", canonical, expectedCanonical)
+			}
+			return nil
+		}))
+}
+
 func TestProtoArray(t *testing.T) {
 	lhtest := fctest.LighthouseTestDef()
-	err := lhtest.Run(func(init *fctest.ForkChoiceTestInit, ft *fctest.ForkChoiceTestTarget) (forkchoice.Forkchoice, error) {
-		return NewProtoForkChoice(init.Spec, init.Finalized, init.Justified, init.AnchorRoot, init.AnchorSlot, init.AnchorParent, init.Balances,
-			NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
-				// whenever something is pruned, check if it was allowed to be pruned,
-				// and if it's marked as canonical correctly.
-				expectedCanonical, ok := ft.Pruneable[ref]
-				if !ok {
-					return fmt.Errorf("unexpected pruning of node %s", ref)
-				}
-				if canonical != expectedCanonical {
-					return fmt.Errorf("bad pruning, pruned as canonical=%v, but expected %v", canonical, expectedCanonical)
-				}
-				return nil
-			}))
-	})
-	if err != nil {
+	if err := lhtest.Run(prepareProtoForkChoice); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLighthouseVotes(t *testing.T) {
+	if err := fctest.LighthouseVotesTestDef().Run(prepareProtoForkChoice); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProposerBoost(t *testing.T) {
+	if err := fctest.ProposerBoostTestDef().Run(prepareProtoForkChoice); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExecutionStatus(t *testing.T) {
+	if err := fctest.ExecutionStatusTestDef().Run(prepareProtoForkChoice); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateJustified(t *testing.T) {
+	// A single slot per epoch, to only prune the anchor and the empty slot after it
+	spec := *configs.Mainnet
+	spec.SLOTS_PER_EPOCH = 1
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	balances := func() ([]forkchoice.Gwei, error) {
+		return []forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE}, nil
+	}
+	justified := forkchoice.Checkpoint{Root: hash(2), Epoch: 2}
+	finalized := forkchoice.Checkpoint{Root: hash(1), Epoch: 1}
+	def := &fctest.ForkChoiceTestDef{
+		Init: fctest.ForkChoiceTestInit{
+			Spec:         &spec,
+			Finalized:    genesis,
+			Justified:    genesis,
+			AnchorRoot:   hash(0),
+			AnchorSlot:   0,
+			AnchorParent: hash(0),
+			Balances:     []forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE},
+		},
+		Operations: []fctest.Operation{
+			&fctest.OpProcessBlock{Parent: hash(0), BlockRoot: hash(1), BlockSlot: 1},
+			&fctest.OpProcessBlock{Parent: hash(1), BlockRoot: hash(2), BlockSlot: 2,
+				JustifiedEpoch: 2, FinalizedEpoch: 1},
+			&fctest.OpPruneable{Pruneable: forkchoice.NodeRef{Root: hash(0), Slot: 0}, Canonical: true},
+			&fctest.OpPruneable{Pruneable: forkchoice.NodeRef{Root: hash(0), Slot: 1}, Canonical: false},
+			&fctest.OpUpdateJustified{Trigger: hash(2), Justified: justified, Finalized: finalized,
+				JustifiedStateBalances: balances, Ok: true},
+			&fctest.OpCheckpoints{Justified: justified, Finalized: finalized},
+			// The finalized checkpoint cannot be ahead of the justified checkpoint
+			&fctest.OpUpdateJustified{Trigger: hash(2), Justified: finalized, Finalized: justified,
+				JustifiedStateBalances: balances, Ok: false},
+			&fctest.OpCheckpoints{Justified: justified, Finalized: finalized},
+		},
+	}
+	if err := def.Run(prepareProtoForkChoice); err != nil {
 		t.Error(err)
 	}
 }
+
+func TestUpdateJustifiedPinned(t *testing.T) {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	balances := func() ([]forkchoice.Gwei, error) {
+		return []forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE}, nil
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	bals, _ := balances()
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0), bals,
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//	0 -- 1 -- 2
+	//	|
+	//	3
+	fc.ProcessBlock(hash(0), hash(1), 1, 0, 0)
+	fc.ProcessBlock(hash(1), hash(2), 2, 0, 0)
+	fc.ProcessBlock(hash(0), hash(3), 2, 0, 0)
+	if err := fc.SetPin(hash(1), 1); err != nil {
+		t.Fatal(err)
+	}
+	// The trigger is checked against the pin while holding the lock, this must not deadlock.
+	update := func(trigger forkchoice.Root, justified forkchoice.Checkpoint) error {
+		t.Helper()
+		done := make(chan error, 1)
+		go func() {
+			done <- fc.UpdateJustified(context.Background(), trigger, justified, genesis, balances)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatal("UpdateJustified did not return")
+			return nil
+		}
+	}
+	justified := forkchoice.Checkpoint{Root: hash(1), Epoch: 1}
+	if err := update(hash(3), justified); err == nil {
+		t.Fatal("expected trigger outside of the pinned subtree to fail")
+	}
+	if err := update(hash(2), justified); err != nil {
+		t.Fatal(err)
+	}
+	// The justified and finalized checkpoints are not swapped
+	if j, f := fc.Justified(), fc.Finalized(); j != justified || f != genesis {
+		t.Fatalf("expected justified %s and finalized %s, got %s and %s", justified, genesis, j, f)
+	}
+}
+
+func TestGapSlotVotes(t *testing.T) {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0),
+		[]forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE, spec.MAX_EFFECTIVE_BALANCE},
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//	0 -- 1 -- * (gap slot 3)
+	//	|
+	//	* -- 2
+	fc.ProcessBlock(hash(0), hash(1), 1, 0, 0)
+	fc.ProcessBlock(hash(0), hash(2), 2, 0, 0)
+	fc.ProcessSlot(hash(1), 3, 0, 0)
+
+	// A vote for a block cannot be at a slot before the block
+	if fc.ProcessAttestation(0, hash(2), 1) {
+		t.Fatal("expected vote before the block slot to be rejected")
+	}
+	// A vote may be for a gap slot after the block
+	if !fc.ProcessAttestation(0, hash(1), 3) {
+		t.Fatal("expected vote for gap slot to be accepted")
+	}
+	if head, err := fc.Head(); err != nil || head != (forkchoice.NodeRef{Root: hash(1), Slot: 3}) {
+		t.Fatalf("expected head at gap slot 3 of block 1, got %s (%v)", head, err)
+	}
+	if votes := fc.LatestVotes(); len(votes) != 1 || votes[0].Root != hash(1) || votes[0].Slot != 3 {
+		t.Fatalf("expected only the gap slot vote, got %v", votes)
+	}
+}
+
+func TestProposerBoostAfterPrune(t *testing.T) {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	timeAt := func(slot forkchoice.Slot) forkchoice.Timestamp {
+		t, _ := spec.TimeAtSlot(slot, 0)
+		return t
+	}
+	balances := func() ([]forkchoice.Gwei, error) {
+		// Validator 1 votes with less weight than the proposer boost
+		return []forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE, 1}, nil
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	bals, _ := balances()
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0), bals,
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	epochStart := spec.SLOTS_PER_EPOCH
+	fc.ProcessBlock(hash(0), hash(1), epochStart, 0, 0)
+	fc.ProcessBlock(hash(1), hash(2), epochStart+1, 1, 1)
+	// Finalizing block 1 prunes all nodes before it
+	fin := forkchoice.Checkpoint{Root: hash(1), Epoch: 1}
+	if err := fc.UpdateJustified(ctx, hash(1), fin, fin, balances); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.ProcessAttestation(1, hash(2), epochStart+1) {
+		t.Fatal("expected vote to be accepted")
+	}
+	if head, err := fc.Head(); err != nil || head.Root != hash(2) {
+		t.Fatalf("expected head 2, got %s (%v)", head, err)
+	}
+
+	// A timely competing block is boosted over the vote
+	if err := fc.OnTick(ctx, timeAt(epochStart+2)); err != nil {
+		t.Fatal(err)
+	}
+	fc.ProcessBlock(hash(1), hash(3), epochStart+2, 1, 1)
+	if !fc.ProcessProposerBoost(hash(3), epochStart+2) {
+		t.Fatal("expected block 3 to be boosted")
+	}
+	if head, err := fc.Head(); err != nil || head.Root != hash(3) {
+		t.Fatalf("expected boosted head 3, got %s (%v)", head, err)
+	}
+	// Without the boost the vote decides again
+	if err := fc.OnTick(ctx, timeAt(epochStart+3)); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := fc.Head(); err != nil || head.Root != hash(2) {
+		t.Fatalf("expected head 2 after the boost, got %s (%v)", head, err)
+	}
+}
+
+func TestProposerBoostNoActiveBalance(t *testing.T) {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	// Without active validators, the total active balance is still one effective balance increment
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0), []forkchoice.Gwei{0, 0},
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slotTime, _ := spec.TimeAtSlot(1, 0)
+	if err := fc.OnTick(context.Background(), slotTime); err != nil {
+		t.Fatal(err)
+	}
+	fc.ProcessBlock(hash(0), hash(2), 1, 0, 0)
+	fc.ProcessBlock(hash(0), hash(3), 1, 0, 0)
+	// Without weight, block 3 wins the tie by root
+	if head, err := fc.Head(); err != nil || head.Root != hash(3) {
+		t.Fatalf("expected head 3, got %s (%v)", head, err)
+	}
+	if !fc.ProcessProposerBoost(hash(2), 1) {
+		t.Fatal("expected block 2 to be boosted")
+	}
+	if head, err := fc.Head(); err != nil || head.Root != hash(2) {
+		t.Fatalf("expected boosted head 2, got %s (%v)", head, err)
+	}
+}
+
+func TestOnTick(t *testing.T) {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	timeAt := func(slot forkchoice.Slot) forkchoice.Timestamp {
+		t, _ := spec.TimeAtSlot(slot, 0)
+		return t
+	}
+	balances := func() ([]forkchoice.Gwei, error) {
+		return []forkchoice.Gwei{spec.MAX_EFFECTIVE_BALANCE, spec.MAX_EFFECTIVE_BALANCE}, nil
+	}
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	bals, _ := balances()
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0), bals,
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, ok := fc.CurrentSlot(); ok {
+		t.Fatal("expected no current slot before first tick")
+	}
+	// Two competing blocks
+	fc.ProcessBlock(hash(0), hash(1), 1, 0, 0)
+	fc.ProcessBlock(hash(0), hash(2), 2, 0, 0)
+
+	// Votes are held back until their slot has passed
+	if err := fc.OnTick(ctx, timeAt(2)); err != nil {
+		t.Fatal(err)
+	}
+	if slot, ok := fc.CurrentSlot(); !ok || slot != 2 {
+		t.Fatalf("expected current slot 2, got %d", slot)
+	}
+	if !fc.ProcessAttestation(0, hash(1), 2) {
+		t.Fatal("expected vote to be accepted")
+	}
+	// Votes of future slots are rejected, not held back
+	if fc.ProcessAttestation(1, hash(2), 3) {
+		t.Fatal("expected vote of future slot to be rejected")
+	}
+	if votes := fc.LatestVotes(); len(votes) != 0 {
+		t.Fatalf("expected vote to be held back, got %v", votes)
+	}
+	if err := fc.OnTick(ctx, timeAt(3)); err != nil {
+		t.Fatal(err)
+	}
+	if votes := fc.LatestVotes(); len(votes) != 1 || votes[0].Root != hash(1) {
+		t.Fatalf("expected vote to be applied, got %v", votes)
+	}
+
+	// Early in the epoch the justified checkpoint is updated immediately
+	if err := fc.OnTick(ctx, timeAt(spec.SLOTS_PER_EPOCH+1)); err != nil {
+		t.Fatal(err)
+	}
+	justA := forkchoice.Checkpoint{Root: hash(1), Epoch: 1}
+	if err := fc.UpdateJustified(ctx, hash(1), justA, genesis, balances); err != nil {
+		t.Fatal(err)
+	}
+	if j := fc.Justified(); j != justA {
+		t.Fatalf("expected justified %s, got %s", justA, j)
+	}
+
+	// Later in the epoch, a conflicting justified checkpoint is held back until the next epoch
+	if err := fc.OnTick(ctx, timeAt(spec.SLOTS_PER_EPOCH+forkchoice.Slot(spec.SAFE_SLOTS_TO_UPDATE_JUSTIFIED))); err != nil {
+		t.Fatal(err)
+	}
+	justB := forkchoice.Checkpoint{Root: hash(2), Epoch: 2}
+	if err := fc.UpdateJustified(ctx, hash(2), justB, genesis, balances); err != nil {
+		t.Fatal(err)
+	}
+	if j := fc.Justified(); j != justA {
+		t.Fatalf("expected justified %s to be kept, got %s", justA, j)
+	}
+	if err := fc.OnTick(ctx, timeAt(spec.SLOTS_PER_EPOCH*2-1)); err != nil {
+		t.Fatal(err)
+	}
+	if j := fc.Justified(); j != justA {
+		t.Fatalf("expected justified %s to be kept until the next epoch, got %s", justA, j)
+	}
+	if err := fc.OnTick(ctx, timeAt(spec.SLOTS_PER_EPOCH*2)); err != nil {
+		t.Fatal(err)
+	}
+	if j := fc.Justified(); j != justB {
+		t.Fatalf("expected best justified %s at epoch boundary, got %s", justB, j)
+	}
+}
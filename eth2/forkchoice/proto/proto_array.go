@@ -22,22 +22,19 @@ type ProtoNode struct {
 	ParentRoot     Root
 	JustifiedEpoch Epoch
 	FinalizedEpoch Epoch
-	Weight         SignedGwei
+	// The status of the execution payload of the block, empty slots share the status of the block before them.
+	ExecutionStatus ExecutionStatus
+	Weight          SignedGwei
 	// Relative to ForkchoiceParent relations
 	BestChild NodeIndex
 	// Relative to ForkchoiceParent relations
 	BestDescendant NodeIndex
 }
 
-type NodeSinkFn func(ctx context.Context, ref NodeRef, canonical bool) error
+// NodeSink and NodeSinkFn are kept as aliases, the types are shared with the forkchoice copies.
+type NodeSinkFn = PrunedNodeSinkFn
 
-func (fn NodeSinkFn) OnPrunedNode(ctx context.Context, ref NodeRef, canonical bool) error {
-	return fn(ctx, ref, canonical)
-}
-
-type NodeSink interface {
-	OnPrunedNode(ctx context.Context, ref NodeRef, canonical bool) error
-}
+type NodeSink = PrunedNodeSink
 
 // Tracks slots and blocks as nodes.
 // Every block has two nodes: with and without the block. The node with the block is the child of that without it.
@@ -55,6 +52,11 @@ type ProtoArray struct {
 	// The lowest slot for a block does not equal the block.slot itself, that may have been pruned.
 	blockSlots         map[Root]Slot
 	updatedConnections bool
+	// The block to boost the weight of, if any.
+	proposerBoost *NodeRef
+	// The block that the boost score was last applied to, to remove it again with the next score changes.
+	appliedBoost      *NodeRef
+	appliedBoostScore SignedGwei
 }
 
 var _ ForkchoiceGraph = (*ProtoArray)(nil)
@@ -87,6 +89,35 @@ func NewProtoArray(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch E
 	return &pr
 }
 
+// Copy returns a copy of the proto array, that prunes into the given sink.
+// The copy does not share any mutable data with the original.
+func (pr *ProtoArray) Copy(sink NodeSink) ForkchoiceGraph {
+	nodes := make([]ProtoNode, len(pr.nodes), cap(pr.nodes))
+	copy(nodes, pr.nodes)
+	indices := make(map[NodeRef]NodeIndex, len(pr.indices))
+	for k, v := range pr.indices {
+		indices[k] = v
+	}
+	blockSlots := make(map[Root]Slot, len(pr.blockSlots))
+	for k, v := range pr.blockSlots {
+		blockSlots[k] = v
+	}
+	return &ProtoArray{
+		sink:               sink,
+		indexOffset:        pr.indexOffset,
+		justifiedEpoch:     pr.justifiedEpoch,
+		finalizedEpoch:     pr.finalizedEpoch,
+		nodes:              nodes,
+		indices:            indices,
+		blockSlots:         blockSlots,
+		updatedConnections: pr.updatedConnections,
+		// the boost refs are replaced, not modified, when updated
+		proposerBoost:     pr.proposerBoost,
+		appliedBoost:      pr.appliedBoost,
+		appliedBoostScore: pr.appliedBoostScore,
+	}
+}
+
 var invalidIndexErr = errors.New("invalid index")
 
 func (pr *ProtoArray) getNode(index NodeIndex) (*ProtoNode, error) {
@@ -94,7 +125,7 @@ func (pr *ProtoArray) getNode(index NodeIndex) (*ProtoNode, error) {
 		return nil, invalidIndexErr
 	}
 	i := index - pr.indexOffset
-	if i > NodeIndex(len(pr.nodes)) {
+	if i >= NodeIndex(len(pr.nodes)) {
 		return nil, invalidIndexErr
 	}
 	return &pr.nodes[i], nil
@@ -182,7 +213,7 @@ func (pr *ProtoArray) CanonAtSlot(anchor Root, slot Slot, withBlock bool) (at No
 			if !ok {
 				panic("anchor node is missing")
 			}
-			node := &pr.nodes[i]
+			node := &pr.nodes[i-pr.indexOffset]
 			// Is the anchor a filled node?
 			if node.ParentRoot != anchor {
 				return NodeRef{}, fmt.Errorf("cannot look for pre-block %d at anchor, anchor is post-block", slot)
@@ -252,7 +283,7 @@ func (pr *ProtoArray) Search(anchor NodeRef, parentRoot *Root, slot *Slot) (nonC
 			// if it has no child, it's a head.
 			if node.BestChild != NONE {
 				// if it has only empty slots as children, it's a head.
-				desc := &pr.nodes[node.BestDescendant]
+				desc := &pr.nodes[node.BestDescendant-pr.indexOffset]
 				if desc.Ref.Root != node.Ref.Root {
 					continue
 				}
@@ -295,10 +326,27 @@ var lengthMismatchErr = errors.New("length mismatch")
 // - Compare the current node with the parents best-child, updating it if the current node
 // should become the best child.
 // - If required, update the parents best-descendant with the current node or its best-descendant.
-func (pr *ProtoArray) ApplyScoreChanges(deltas []SignedGwei, justifiedEpoch Epoch, finalizedEpoch Epoch) error {
+//
+// The proposer boost score is removed from the previously boosted block, and applied to the currently boosted block.
+func (pr *ProtoArray) ApplyScoreChanges(deltas []SignedGwei, justifiedEpoch Epoch, finalizedEpoch Epoch, proposerBoostScore Gwei) error {
 	if len(deltas) != len(pr.nodes) {
 		return lengthMismatchErr
 	}
+	if pr.appliedBoost != nil {
+		// If the boosted block was pruned, then so was its weight.
+		if index, ok := pr.indices[*pr.appliedBoost]; ok {
+			deltas[index-pr.indexOffset] -= pr.appliedBoostScore
+		}
+		pr.appliedBoost = nil
+		pr.appliedBoostScore = 0
+	}
+	if pr.proposerBoost != nil && proposerBoostScore > 0 {
+		if index, ok := pr.indices[*pr.proposerBoost]; ok {
+			deltas[index-pr.indexOffset] += SignedGwei(proposerBoostScore)
+			pr.appliedBoost = pr.proposerBoost
+			pr.appliedBoostScore = SignedGwei(proposerBoostScore)
+		}
+	}
 	if justifiedEpoch != pr.justifiedEpoch || finalizedEpoch != pr.finalizedEpoch {
 		pr.justifiedEpoch = justifiedEpoch
 		pr.finalizedEpoch = finalizedEpoch
@@ -348,9 +396,14 @@ func (pr *ProtoArray) ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch,
 		return
 	}
 	parentIndex := NONE
+	// Empty slots share the execution status of the block before them.
+	status := ExecutionValid
 	parentSlot, ok := pr.blockSlots[parent]
 	if ok {
 		parentIndex = pr.indices[NodeRef{Root: parent, Slot: parentSlot}]
+		if parentNode, err := pr.getNode(parentIndex); err == nil {
+			status = parentNode.ExecutionStatus
+		}
 		for i := parentSlot + 1; i < slot; i++ {
 			nodeRef := NodeRef{Root: parent, Slot: i}
 			// remember the last node before (up to and including same slot)
@@ -370,6 +423,7 @@ func (pr *ProtoArray) ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch,
 				ParentRoot:       parent,
 				JustifiedEpoch:   justifiedEpoch,
 				FinalizedEpoch:   finalizedEpoch,
+				ExecutionStatus:  status,
 				Weight:           0,
 				BestChild:        NONE,
 				BestDescendant:   NONE,
@@ -388,6 +442,7 @@ func (pr *ProtoArray) ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch,
 		ParentRoot:       parent,
 		JustifiedEpoch:   justifiedEpoch,
 		FinalizedEpoch:   finalizedEpoch,
+		ExecutionStatus:  status,
 		Weight:           0,
 		BestChild:        NONE,
 		BestDescendant:   NONE,
@@ -401,6 +456,16 @@ func (pr *ProtoArray) ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch,
 //
 // The parent root of the genesis block should be zeroed.
 func (pr *ProtoArray) ProcessBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool) {
+	return pr.processBlock(parent, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch, false)
+}
+
+// ProcessPayloadBlock registers a block with an execution payload, like ProcessBlock.
+// The block is syncing until the execution engine verified the payload, or invalid if its parent is invalid.
+func (pr *ProtoArray) ProcessPayloadBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool) {
+	return pr.processBlock(parent, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch, true)
+}
+
+func (pr *ProtoArray) processBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch, payload bool) (ok bool) {
 	blockRef := NodeRef{Root: blockRoot, Slot: blockSlot}
 	// If the block is already known, simply ignore it.
 	if _, ok := pr.indices[blockRef]; ok {
@@ -425,6 +490,14 @@ func (pr *ProtoArray) ProcessBlock(parent Root, blockRoot Root, blockSlot Slot,
 	if !ok {
 		panic("OnSlot failed to add node for block slot (transition parent)")
 	}
+	// The block gets the execution status of its parent, a payload is syncing until the execution engine says otherwise.
+	status := ExecutionValid
+	if transitionParent, err := pr.getNode(transitionParentIndex); err == nil {
+		status = transitionParent.ExecutionStatus
+	}
+	if payload && status == ExecutionValid {
+		status = ExecutionSyncing
+	}
 	nodeIndex := pr.indexOffset + NodeIndex(len(pr.nodes))
 	pr.blockSlots[blockRoot] = blockSlot
 	pr.indices[blockRef] = nodeIndex
@@ -435,6 +508,7 @@ func (pr *ProtoArray) ProcessBlock(parent Root, blockRoot Root, blockSlot Slot,
 		ParentRoot:       parent,
 		JustifiedEpoch:   justifiedEpoch,
 		FinalizedEpoch:   finalizedEpoch,
+		ExecutionStatus:  status,
 		Weight:           0,
 		BestChild:        NONE,
 		BestDescendant:   NONE,
@@ -444,6 +518,110 @@ func (pr *ProtoArray) ProcessBlock(parent Root, blockRoot Root, blockSlot Slot,
 	return true
 }
 
+// ProcessProposerBoost boosts the given block with the next score changes.
+// The boost is not limited by time, the caller decides when a block qualifies, and when to reset the boost.
+func (pr *ProtoArray) ProcessProposerBoost(blockRoot Root, blockSlot Slot) (ok bool) {
+	// Only block nodes can be boosted, not the gap slots after them.
+	if slot, ok := pr.blockSlots[blockRoot]; !ok || slot != blockSlot {
+		return false
+	}
+	ref := NodeRef{Root: blockRoot, Slot: blockSlot}
+	if _, ok := pr.indices[ref]; !ok {
+		return false
+	}
+	pr.proposerBoost = &ref
+	return true
+}
+
+func (pr *ProtoArray) ResetProposerBoost() {
+	pr.proposerBoost = nil
+}
+
+// blockIndex returns the index of the first known node of the block:
+// the block node itself, or the first empty slot after it if the block node was pruned.
+func (pr *ProtoArray) blockIndex(blockRoot Root) (NodeIndex, bool) {
+	slot, ok := pr.blockSlots[blockRoot]
+	if !ok {
+		return NONE, false
+	}
+	index, ok := pr.indices[NodeRef{Root: blockRoot, Slot: slot}]
+	return index, ok
+}
+
+func (pr *ProtoArray) ExecutionStatus(blockRoot Root) (status ExecutionStatus, ok bool) {
+	index, ok := pr.blockIndex(blockRoot)
+	if !ok {
+		return ExecutionValid, false
+	}
+	node, err := pr.getNode(index)
+	if err != nil {
+		return ExecutionValid, false
+	}
+	return node.ExecutionStatus, true
+}
+
+// ProcessExecutionStatus updates the execution status of a syncing block, and of the empty slots after it.
+// Only syncing blocks can change, to valid or invalid: a valid block makes its syncing ancestors valid,
+// an invalid block makes its descendants invalid. Valid and invalid blocks do not change anymore.
+func (pr *ProtoArray) ProcessExecutionStatus(blockRoot Root, status ExecutionStatus) (ok bool) {
+	index, ok := pr.blockIndex(blockRoot)
+	if !ok {
+		return false
+	}
+	node, err := pr.getNode(index)
+	if err != nil {
+		return false
+	}
+	if node.ExecutionStatus != ExecutionSyncing {
+		return false
+	}
+	switch status {
+	case ExecutionValid:
+		// Walk back the transition parents, and collect the roots of the blocks that are still syncing.
+		roots := make(map[Root]struct{})
+		for i := index; i != NONE && i >= pr.indexOffset; {
+			n, err := pr.getNode(i)
+			if err != nil {
+				return false
+			}
+			if n.ExecutionStatus == ExecutionValid {
+				break // the ancestors of a valid block are valid already.
+			}
+			roots[n.Ref.Root] = struct{}{}
+			i = n.TransitionParent
+		}
+		// Nodes with the root of a block are that block, or the empty slots after it.
+		for i := range pr.nodes {
+			n := &pr.nodes[i]
+			if _, ok := roots[n.Ref.Root]; ok && n.ExecutionStatus == ExecutionSyncing {
+				n.ExecutionStatus = ExecutionValid
+			}
+		}
+	case ExecutionInvalid:
+		// Parents are always before their children in the array.
+		// The descendants of a syncing block are syncing or invalid.
+		inSubtree := map[NodeIndex]struct{}{index: {}}
+		for i := index; i < pr.indexOffset+NodeIndex(len(pr.nodes)); i++ {
+			n, err := pr.getNode(i)
+			if err != nil {
+				return false
+			}
+			if i != index {
+				if _, ok := inSubtree[n.ForkchoiceParent]; !ok {
+					continue
+				}
+				inSubtree[i] = struct{}{}
+			}
+			n.ExecutionStatus = ExecutionInvalid
+		}
+		// Invalid nodes are not viable for the head anymore.
+		pr.updatedConnections = false
+	default:
+		return false
+	}
+	return true
+}
+
 var UnknownAnchorErr = errors.New("anchor unknown")
 var NoViableHeadErr = errors.New("not a viable head anymore, invalid forkchoice state")
 
@@ -541,16 +719,24 @@ func (pr *ProtoArray) inSubtree(anchorIndex NodeIndex, lookupIndex NodeIndex) (u
 		// So anchor may be in subtree of the looked up node, but not vice versa.
 		return false, false
 	}
+	// Nodes without a viable head, e.g. leaf nodes, all have a NONE best descendant, this says nothing about the chain.
+	anchorHead := anchorNode.BestDescendant
 	// shortcut: if they have the same relative head, they are on the same chain.
-	if anchorNode.BestDescendant == lookupIndex || anchorNode.BestDescendant == lookupNode.BestDescendant {
+	if anchorHead != NONE && (anchorHead == lookupIndex || anchorHead == lookupNode.BestDescendant) {
 		return false, true
 	}
 	// Root may still be on a different non-canonical branch out of the anchor.
 	for i := lookupNode.TransitionParent; i != NONE && i >= anchorIndex; {
-		tmp := &pr.nodes[i]
+		if i == anchorIndex {
+			return false, true
+		}
+		tmp, err := pr.getNode(i)
+		if err != nil {
+			return true, false
+		}
 		// early exit: as soon as we find a node that has the same relative head as the anchor,
 		// we know we are in-between the anchor and the head, thus in the subtree, thus an ancestor.
-		if tmp.BestDescendant == anchorNode.BestDescendant {
+		if anchorHead != NONE && tmp.BestDescendant == anchorHead {
 			return false, true
 		}
 		i = tmp.TransitionParent
@@ -590,10 +776,9 @@ func (pr *ProtoArray) OnPrune(ctx context.Context, anchorRoot Root, anchorSlot S
 		return HeadUnknownErr
 	}
 	// Remove the `self.indices` and `self.blockSlots` key/values for all the to-be-deleted nodes.
-	j := 0
 	var pruned []prunedNode
 	for i := pr.indexOffset; i < anchorIndex; i++ {
-		node := &pr.nodes[j]
+		node := &pr.nodes[i-pr.indexOffset]
 		if pr.sink != nil {
 			canonical := node.BestDescendant == headIndex
 			pruned = append(pruned, prunedNode{canonical, node})
@@ -608,8 +793,6 @@ func (pr *ProtoArray) OnPrune(ctx context.Context, anchorRoot Root, anchorSlot S
 		}
 		prunedUpTo++
 	}
-	// adjust the slot we know for the anchor root, everything before it was pruned.
-	pr.blockSlots[anchorRoot] = anchorSlot
 	for _, p := range pruned[:prunedUpTo] {
 		delete(pr.indices, p.node.Ref)
 		// Remove the block-slots ref
@@ -619,6 +802,23 @@ func (pr *ProtoArray) OnPrune(ctx context.Context, anchorRoot Root, anchorSlot S
 		// update offset
 		pr.indexOffset++
 	}
+	// adjust the slot we know for the anchor root, everything before it was pruned.
+	// This is done after removing the pruned block-slots refs, the anchor may share the root of pruned nodes.
+	pr.blockSlots[anchorRoot] = anchorSlot
+	// Remaining nodes must not refer to pruned nodes.
+	for i := range pr.nodes {
+		node := &pr.nodes[i]
+		if node.TransitionParent < pr.indexOffset {
+			node.TransitionParent = NONE
+		}
+		if node.ForkchoiceParent < pr.indexOffset {
+			node.ForkchoiceParent = NONE
+		}
+		if node.BestChild < pr.indexOffset {
+			node.BestChild = NONE
+			node.BestDescendant = NONE
+		}
+	}
 	return err
 }
 
@@ -686,8 +886,16 @@ func (pr *ProtoArray) maybeUpdateBestChildAndDescendant(parentIndex NodeIndex, c
 				// The best child leads to a viable head, but the child doesn't.
 				// *No change*
 			} else if child.Weight == bestChild.Weight {
-				// Tie-breaker of equal weights by root.
-				if bytes.Compare(child.Ref.Root[:], bestChild.Ref.Root[:]) > 0 {
+				// Tie-breaker of equal weights by root, like the spec does between sibling blocks.
+				childKey, err := pr.tieBreakRef(child)
+				if err != nil {
+					return err
+				}
+				bestChildKey, err := pr.tieBreakRef(bestChild)
+				if err != nil {
+					return err
+				}
+				if tieBreakLess(bestChildKey, childKey) {
 					changeToChild()
 				}
 				// otherwise *no change*
@@ -711,6 +919,30 @@ func (pr *ProtoArray) maybeUpdateBestChildAndDescendant(parentIndex NodeIndex, c
 	return nil
 }
 
+// The node to compare by root when breaking a tie between equal-weight siblings.
+// A block node is compared as-is. An empty-slot node carries the root of the parent block,
+// so it is compared as the first block its best chain of empty slots leads to:
+// that block is a sibling block of the other block in the spec, which breaks ties between the block roots.
+// An empty-slot node that does not lead to any block is compared as its own (root, slot) pair.
+func (pr *ProtoArray) tieBreakRef(node *ProtoNode) (NodeRef, error) {
+	for node.Ref.Root == node.ParentRoot && node.BestChild != NONE {
+		next, err := pr.getNode(node.BestChild)
+		if err != nil {
+			return NodeRef{}, err
+		}
+		node = next
+	}
+	return node.Ref, nil
+}
+
+// Lexicographic ordering of (root, slot) pairs, the greater pair wins a tie.
+func tieBreakLess(a NodeRef, b NodeRef) bool {
+	if c := bytes.Compare(a.Root[:], b.Root[:]); c != 0 {
+		return c < 0
+	}
+	return a.Slot < b.Slot
+}
+
 // Indicates if the node itself is viable for the head, or if it's best descendant is viable for the head.
 func (pr *ProtoArray) nodeLeadsToViableHead(node *ProtoNode) (bool, error) {
 	if node.BestDescendant != NONE {
@@ -729,7 +961,9 @@ func (pr *ProtoArray) nodeLeadsToViableHead(node *ProtoNode) (bool, error) {
 //https://github.com/ethereum/eth2.0-specs/blob/v0.11.1/specs/phase0/fork-choice.md#filter_block_tree
 //
 //Any node that has a different finalized or justified epoch should not be viable for the head.
+//Nodes with an invalid execution payload are not viable either.
 func (pr *ProtoArray) isNodeViableForHead(node *ProtoNode) bool {
 	return (node.JustifiedEpoch == pr.justifiedEpoch || pr.justifiedEpoch == common.GENESIS_EPOCH) &&
-		(node.FinalizedEpoch == pr.finalizedEpoch || pr.finalizedEpoch == common.GENESIS_EPOCH)
+		(node.FinalizedEpoch == pr.finalizedEpoch || pr.finalizedEpoch == common.GENESIS_EPOCH) &&
+		node.ExecutionStatus != ExecutionInvalid
 }
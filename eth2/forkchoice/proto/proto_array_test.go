@@ -0,0 +1,145 @@
+package proto
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func TestGetNodeBounds(t *testing.T) {
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	pr := NewProtoArray(hash(0), hash(0), 0, 0, 0, nil)
+	pr.ProcessBlock(hash(0), hash(1), 1, 0, 0)
+	last := forkchoice.NodeIndex(len(pr.nodes)) - 1
+	if node, err := pr.getNode(last); err != nil || node.Ref != (forkchoice.NodeRef{Root: hash(1), Slot: 1}) {
+		t.Fatalf("expected last node to be block 1, got %v (%v)", node, err)
+	}
+	// One past the last node is out of range
+	if node, err := pr.getNode(last + 1); err == nil {
+		t.Fatalf("expected no node past the end, got %v", node)
+	}
+	if node, err := pr.getNode(NONE); err == nil {
+		t.Fatalf("expected no node for NONE, got %v", node)
+	}
+}
+
+type prunedRef struct {
+	ref       forkchoice.NodeRef
+	canonical bool
+}
+
+// pruneTestArray builds a chain with gap slots, and records the nodes it prunes.
+//
+//	0 -- 1 -- * -- * -- 3
+//	          |
+//	          2 (at slot 3)
+func pruneTestArray(t *testing.T) (pr *ProtoArray, pruned *[]prunedRef, hash func(i uint64) forkchoice.Root) {
+	hash = func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	pruned = new([]prunedRef)
+	pr = NewProtoArray(hash(0), hash(0), 0, 0, 0,
+		NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			*pruned = append(*pruned, prunedRef{ref, canonical})
+			return nil
+		}))
+	for _, b := range []struct {
+		parent, root uint64
+		slot         forkchoice.Slot
+	}{{0, 1, 1}, {1, 2, 3}, {2, 3, 4}} {
+		if !pr.ProcessBlock(hash(b.parent), hash(b.root), b.slot, 0, 0) {
+			t.Fatalf("failed to add block %d", b.root)
+		}
+	}
+	return
+}
+
+func TestPruneIndexOffset(t *testing.T) {
+	pr, pruned, hash := pruneTestArray(t)
+	ref := func(i uint64, slot forkchoice.Slot) forkchoice.NodeRef {
+		return forkchoice.NodeRef{Root: hash(i), Slot: slot}
+	}
+	check := func(expected ...prunedRef) {
+		t.Helper()
+		if len(*pruned) != len(expected) {
+			t.Fatalf("expected %d pruned nodes, got %v", len(expected), *pruned)
+		}
+		for i, p := range expected {
+			if (*pruned)[i] != p {
+				t.Fatalf("pruned node %d: expected %v, got %v", i, p, (*pruned)[i])
+			}
+		}
+		*pruned = nil
+	}
+
+	// Prune up to the gap slot after block 1
+	if err := pr.OnPrune(context.Background(), hash(1), 2); err != nil {
+		t.Fatal(err)
+	}
+	check(prunedRef{ref(0, 0), true}, prunedRef{ref(0, 1), false}, prunedRef{ref(1, 1), true})
+
+	// The anchor is a gap slot node, it can be found without block
+	if at, err := pr.CanonAtSlot(hash(1), 2, false); err != nil || at != ref(1, 2) {
+		t.Fatalf("expected gap slot anchor, got %s (%v)", at, err)
+	}
+	if at, err := pr.CanonAtSlot(hash(1), 3, true); err != nil || at != ref(2, 3) {
+		t.Fatalf("expected block 2, got %s (%v)", at, err)
+	}
+	// Block 2 is not a head, its best descendant is block 3
+	nonCanon, canon, err := pr.Search(ref(1, 2), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonCanon) != 0 || len(canon) != 1 || canon[0] != ref(3, 4) {
+		t.Fatalf("expected block 3 as only head, got canonical %v, non-canonical %v", canon, nonCanon)
+	}
+
+	// Prune again, starting at the offset of the remaining nodes
+	if err := pr.OnPrune(context.Background(), hash(2), 3); err != nil {
+		t.Fatal(err)
+	}
+	check(prunedRef{ref(1, 2), true}, prunedRef{ref(1, 3), false})
+	if head, err := pr.FindHead(hash(2), 3); err != nil || head != ref(3, 4) {
+		t.Fatalf("expected head block 3, got %s (%v)", head, err)
+	}
+}
+
+func TestPruneDanglingRefs(t *testing.T) {
+	pr, _, hash := pruneTestArray(t)
+	if err := pr.OnPrune(context.Background(), hash(1), 2); err != nil {
+		t.Fatal(err)
+	}
+	// The anchor shares the root of the pruned block 1, it is still known by its new slot
+	if slot, ok := pr.GetSlot(hash(1)); !ok || slot != 2 {
+		t.Fatalf("expected anchor root at slot 2, got %d (known: %v)", slot, ok)
+	}
+	for i := range pr.nodes {
+		node := &pr.nodes[i]
+		for _, index := range []forkchoice.NodeIndex{node.TransitionParent, node.ForkchoiceParent, node.BestChild, node.BestDescendant} {
+			if index != NONE && index < pr.indexOffset {
+				t.Fatalf("node %s refers to pruned node %d", node.Ref, index)
+			}
+		}
+	}
+	if anchor := &pr.nodes[0]; anchor.TransitionParent != NONE || anchor.ForkchoiceParent != NONE {
+		t.Fatalf("expected anchor without parents, got %d, %d", anchor.TransitionParent, anchor.ForkchoiceParent)
+	}
+	// Score changes propagate up to the anchor, and not beyond it
+	deltas := make([]forkchoice.SignedGwei, len(pr.nodes))
+	deltas[pr.indices[forkchoice.NodeRef{Root: hash(3), Slot: 4}]-pr.indexOffset] = 10
+	if err := pr.ApplyScoreChanges(deltas, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if w := pr.nodes[0].Weight; w != 10 {
+		t.Fatalf("expected anchor weight 10, got %d", w)
+	}
+	if head, err := pr.FindHead(hash(1), 2); err != nil || head != (forkchoice.NodeRef{Root: hash(3), Slot: 4}) {
+		t.Fatalf("expected head block 3, got %s (%v)", head, err)
+	}
+}
@@ -0,0 +1,285 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	. "github.com/protolambda/zrnt/eth2/forkchoice"
+	"github.com/protolambda/ztyp/codec"
+	"io"
+	"sort"
+)
+
+// RestoreProtoForkChoice reads a forkchoice with a ProtoArray and ProtoVoteStore, as written by ProtoForkChoice.Snapshot.
+// Pruned nodes are sent to the given sink, like the forkchoice of NewProtoForkChoice.
+func RestoreProtoForkChoice(spec *common.Spec, r io.Reader, sink NodeSink) (Forkchoice, error) {
+	return RestoreForkChoice(spec, r,
+		func(r io.Reader) (ForkchoiceGraph, error) {
+			return RestoreProtoArray(r, sink)
+		},
+		func(r io.Reader) (VoteStore, error) {
+			return RestoreProtoVoteStore(spec, r)
+		})
+}
+
+type protoArraySnapshot struct {
+	IndexOffset        NodeIndex
+	JustifiedEpoch     Epoch
+	FinalizedEpoch     Epoch
+	UpdatedConnections bool
+	HasProposerBoost   bool
+	ProposerBoost      NodeRef
+	HasAppliedBoost    bool
+	AppliedBoost       NodeRef
+	AppliedBoostScore  SignedGwei
+	NodesCount         uint64
+	IndicesCount       uint64
+	BlockSlotsCount    uint64
+}
+
+type indexRecord struct {
+	Ref   NodeRef
+	Index NodeIndex
+}
+
+type blockSlotRecord struct {
+	Root Root
+	Slot Slot
+}
+
+// Snapshot writes the nodes, indices, block slots and proposer boost of the proto array.
+// The indices and block slots are sorted, the snapshot of the same array is always the same.
+func (pr *ProtoArray) Snapshot(w io.Writer) error {
+	header := protoArraySnapshot{
+		IndexOffset:        pr.indexOffset,
+		JustifiedEpoch:     pr.justifiedEpoch,
+		FinalizedEpoch:     pr.finalizedEpoch,
+		UpdatedConnections: pr.updatedConnections,
+		AppliedBoostScore:  pr.appliedBoostScore,
+		NodesCount:         uint64(len(pr.nodes)),
+		IndicesCount:       uint64(len(pr.indices)),
+		BlockSlotsCount:    uint64(len(pr.blockSlots)),
+	}
+	if pr.proposerBoost != nil {
+		header.HasProposerBoost = true
+		header.ProposerBoost = *pr.proposerBoost
+	}
+	if pr.appliedBoost != nil {
+		header.HasAppliedBoost = true
+		header.AppliedBoost = *pr.appliedBoost
+	}
+	indices := make([]indexRecord, 0, len(pr.indices))
+	for ref, index := range pr.indices {
+		indices = append(indices, indexRecord{Ref: ref, Index: index})
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i].Index < indices[j].Index
+	})
+	blockSlots := make([]blockSlotRecord, 0, len(pr.blockSlots))
+	for root, slot := range pr.blockSlots {
+		blockSlots = append(blockSlots, blockSlotRecord{Root: root, Slot: slot})
+	}
+	sort.Slice(blockSlots, func(i, j int) bool {
+		return bytes.Compare(blockSlots[i].Root[:], blockSlots[j].Root[:]) < 0
+	})
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, pr.nodes); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, indices); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, blockSlots)
+}
+
+// RestoreProtoArray reads a proto array, as written by ProtoArray.Snapshot.
+func RestoreProtoArray(r io.Reader, sink NodeSink) (*ProtoArray, error) {
+	var header protoArraySnapshot
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	nodes := make([]ProtoNode, 0)
+	if err := ReadSnapshotList(r, header.NodesCount, &nodes); err != nil {
+		return nil, fmt.Errorf("failed to read nodes: %v", err)
+	}
+	if err := checkNodeIndices(header.IndexOffset, nodes); err != nil {
+		return nil, err
+	}
+	indices := make([]indexRecord, 0)
+	if err := ReadSnapshotList(r, header.IndicesCount, &indices); err != nil {
+		return nil, fmt.Errorf("failed to read indices: %v", err)
+	}
+	blockSlots := make([]blockSlotRecord, 0)
+	if err := ReadSnapshotList(r, header.BlockSlotsCount, &blockSlots); err != nil {
+		return nil, fmt.Errorf("failed to read block slots: %v", err)
+	}
+	pr := &ProtoArray{
+		sink:               sink,
+		indexOffset:        header.IndexOffset,
+		justifiedEpoch:     header.JustifiedEpoch,
+		finalizedEpoch:     header.FinalizedEpoch,
+		nodes:              nodes,
+		indices:            make(map[NodeRef]NodeIndex, len(indices)),
+		blockSlots:         make(map[Root]Slot, len(blockSlots)),
+		updatedConnections: header.UpdatedConnections,
+		appliedBoostScore:  header.AppliedBoostScore,
+	}
+	for _, rec := range indices {
+		if rec.Index < pr.indexOffset || rec.Index-pr.indexOffset >= NodeIndex(len(nodes)) {
+			return nil, fmt.Errorf("index %d of node %s is out of range", rec.Index, rec.Ref)
+		}
+		pr.indices[rec.Ref] = rec.Index
+	}
+	for _, rec := range blockSlots {
+		pr.blockSlots[rec.Root] = rec.Slot
+	}
+	if header.HasProposerBoost {
+		ref := header.ProposerBoost
+		pr.proposerBoost = &ref
+	}
+	if header.HasAppliedBoost {
+		ref := header.AppliedBoost
+		pr.appliedBoost = &ref
+	}
+	return pr, nil
+}
+
+// checkNodeIndices checks that the nodes only refer to each other:
+// parents are earlier nodes, best children and descendants are later nodes.
+func checkNodeIndices(offset NodeIndex, nodes []ProtoNode) error {
+	end := offset + NodeIndex(len(nodes))
+	if end < offset {
+		return fmt.Errorf("index offset %d with %d nodes is out of range", offset, len(nodes))
+	}
+	for i := range nodes {
+		node := &nodes[i]
+		self := offset + NodeIndex(i)
+		for _, parent := range []NodeIndex{node.TransitionParent, node.ForkchoiceParent} {
+			if parent != NONE && (parent < offset || parent >= self) {
+				return fmt.Errorf("node %d (%s) has parent %d outside of the nodes before it", self, node.Ref, parent)
+			}
+		}
+		for _, desc := range []NodeIndex{node.BestChild, node.BestDescendant} {
+			if desc != NONE && (desc <= self || desc >= end) {
+				return fmt.Errorf("node %d (%s) has descendant %d outside of the nodes after it", self, node.Ref, desc)
+			}
+		}
+	}
+	return nil
+}
+
+type voteStoreSnapshot struct {
+	Changed           bool
+	VotesCount        uint64
+	AttestationsCount uint64
+	HistoryCount      uint64
+}
+
+// Snapshot writes the vote trackers, and the attestations of the validators to detect slashable votes with.
+// Attestations shared by validators are written once, the history of each validator refers to them by index.
+func (st *ProtoVoteStore) Snapshot(w io.Writer) error {
+	validators := make([]ValidatorIndex, 0, len(st.history))
+	for index := range st.history {
+		validators = append(validators, index)
+	}
+	sort.Slice(validators, func(i, j int) bool {
+		return validators[i] < validators[j]
+	})
+	atts := st.VoteHistory()
+	attIndices := make(map[*phase0.IndexedAttestation]uint64, len(atts))
+	for i, att := range atts {
+		attIndices[att] = uint64(i)
+	}
+	header := voteStoreSnapshot{
+		Changed:           st.changed,
+		VotesCount:        uint64(len(st.votes)),
+		AttestationsCount: uint64(len(atts)),
+		HistoryCount:      uint64(len(validators)),
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, st.votes); err != nil {
+		return err
+	}
+	// The attestations are SSZ encoded, with the byte length in front of each
+	var buf bytes.Buffer
+	for _, att := range atts {
+		buf.Reset()
+		if err := att.Serialize(st.spec, codec.NewEncodingWriter(&buf)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint64(buf.Len())); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	for _, index := range validators {
+		history := st.history[index]
+		refs := make([]uint64, len(history))
+		for i, att := range history {
+			refs[i] = attIndices[att]
+		}
+		if err := binary.Write(w, binary.LittleEndian, [2]uint64{uint64(index), uint64(len(refs))}); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreProtoVoteStore reads a vote store, as written by ProtoVoteStore.Snapshot.
+func RestoreProtoVoteStore(spec *common.Spec, r io.Reader) (*ProtoVoteStore, error) {
+	var header voteStoreSnapshot
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	votes := make([]VoteTracker, 0)
+	if err := ReadSnapshotList(r, header.VotesCount, &votes); err != nil {
+		return nil, fmt.Errorf("failed to read vote trackers: %v", err)
+	}
+	// The counts are not trusted: the entries are appended as they are read.
+	var atts []*phase0.IndexedAttestation
+	for i := uint64(0); i < header.AttestationsCount; i++ {
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		if size > phase0.IndexedAttestationType(spec).MaxByteLength() {
+			return nil, fmt.Errorf("attestation %d is too large: %d bytes", i, size)
+		}
+		var att phase0.IndexedAttestation
+		if err := att.Deserialize(spec, codec.NewDecodingReader(io.LimitReader(r, int64(size)), size)); err != nil {
+			return nil, fmt.Errorf("failed to read attestation %d: %v", i, err)
+		}
+		atts = append(atts, &att)
+	}
+	history := make(map[ValidatorIndex][]*phase0.IndexedAttestation)
+	for i := uint64(0); i < header.HistoryCount; i++ {
+		var entry [2]uint64
+		if err := binary.Read(r, binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+		refs := make([]uint64, 0)
+		if err := ReadSnapshotList(r, entry[1], &refs); err != nil {
+			return nil, fmt.Errorf("failed to read history of validator %d: %v", entry[0], err)
+		}
+		prev := make([]*phase0.IndexedAttestation, len(refs))
+		for j, ref := range refs {
+			if ref >= uint64(len(atts)) {
+				return nil, fmt.Errorf("history of validator %d refers to unknown attestation %d", entry[0], ref)
+			}
+			prev[j] = atts[ref]
+		}
+		history[ValidatorIndex(entry[0])] = prev
+	}
+	return &ProtoVoteStore{spec: spec, votes: votes, changed: header.Changed, history: history}, nil
+}
@@ -0,0 +1,218 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	timeAt := func(slot forkchoice.Slot) forkchoice.Timestamp {
+		return forkchoice.Timestamp(slot) * spec.SECONDS_PER_SLOT
+	}
+	balances := make([]forkchoice.Gwei, 64)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	sink := NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+		return nil
+	})
+	genesis := forkchoice.Checkpoint{Root: hash(0), Epoch: 0}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, hash(0), 0, hash(0), balances, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	attest := func(fc forkchoice.Forkchoice, root forkchoice.Root, slot forkchoice.Slot, indices ...common.ValidatorIndex) []*phase0.AttesterSlashing {
+		att := &phase0.IndexedAttestation{
+			AttestingIndices: indices,
+			Data: phase0.AttestationData{
+				Slot:            slot,
+				BeaconBlockRoot: root,
+				Target:          forkchoice.Checkpoint{Epoch: 0, Root: hash(0)},
+			},
+		}
+		slashings := fc.ProcessIndexedAttestation(att)
+		for _, index := range indices {
+			fc.ProcessAttestation(index, root, slot)
+		}
+		return slashings
+	}
+
+	//      0
+	//     / \
+	//    1   *
+	//    |   |
+	//    *   2
+	//    |
+	//    3 <- boost
+	fc.ProcessBlock(hash(0), hash(1), 1, 0, 0)
+	fc.ProcessBlock(hash(0), hash(2), 2, 0, 0)
+	fc.ProcessBlock(hash(1), hash(3), 3, 0, 0)
+	if err := fc.OnTick(ctx, timeAt(3)+1); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.ProcessProposerBoost(hash(3), 3) {
+		t.Fatal("expected proposer boost")
+	}
+	attest(fc, hash(2), 2, 0, 1, 2)
+	// Held back until the next slot
+	attest(fc, hash(3), 3, 5)
+	if err := fc.SetPin(hash(0), 0); err != nil {
+		t.Fatal(err)
+	}
+	head, err := fc.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := fc.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	restored, err := RestoreProtoForkChoice(spec, bytes.NewReader(data), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := restored.Snapshot(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again.Bytes()) {
+		t.Fatal("snapshot of restored forkchoice differs")
+	}
+	restoredHead, err := restored.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredHead != head {
+		t.Fatalf("expected head %s after restore, got %s", head, restoredHead)
+	}
+	if restored.Justified() != fc.Justified() || restored.Finalized() != fc.Finalized() || *restored.Pin() != *fc.Pin() {
+		t.Fatal("checkpoints or pin differ after restore")
+	}
+	if slot, ok := restored.CurrentSlot(); !ok || slot != 3 {
+		t.Fatalf("expected restored clock at slot 3, got %d", slot)
+	}
+
+	// Both continue the same: the held back vote, the removed boost, and the slashable vote detection.
+	for _, f := range []forkchoice.Forkchoice{fc, restored} {
+		if err := f.OnTick(ctx, timeAt(4)); err != nil {
+			t.Fatal(err)
+		}
+		if slashings := attest(f, hash(1), 2, 1); len(slashings) != 1 {
+			t.Fatalf("expected double vote to be detected, got %d slashings", len(slashings))
+		}
+	}
+	head, err = fc.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredHead, err = restored.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredHead != head {
+		t.Fatalf("expected head %s, got %s", head, restoredHead)
+	}
+	// Detection does not remove the weight of validator 1, the slashing is not verified.
+	if a, b := fc.LatestVotes(), restored.LatestVotes(); len(a) != len(b) || len(a) != 4 {
+		t.Fatalf("expected same 4 votes, got %v and %v", a, b)
+	}
+
+	// Unknown versions are rejected
+	data[0] = 0xff
+	if _, err := RestoreProtoForkChoice(spec, bytes.NewReader(data), sink); err == nil {
+		t.Fatal("expected unknown snapshot version to be rejected")
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	spec := configs.Mainnet
+	hash := func(i uint64) (out forkchoice.Root) {
+		binary.LittleEndian.PutUint64(out[:8], i)
+		return
+	}
+	pr := NewProtoArray(hash(0), hash(0), 0, 0, 0, nil)
+	pr.ProcessBlock(hash(0), hash(1), 1, 0, 0)
+	pr.ProcessBlock(hash(1), hash(2), 3, 0, 0)
+	if _, err := pr.FindHead(hash(0), 0); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func(pr *ProtoArray) []byte {
+		var buf bytes.Buffer
+		if err := pr.Snapshot(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	if _, err := RestoreProtoArray(bytes.NewReader(snapshot(pr)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts are not trusted, the input ends long before
+	headerSize := binary.Size(protoArraySnapshot{})
+	for i, name := range []string{"nodes", "indices", "block slots"} {
+		data := snapshot(pr)
+		binary.LittleEndian.PutUint64(data[headerSize-8*(3-i):], 1<<50)
+		if _, err := RestoreProtoArray(bytes.NewReader(data), nil); err == nil {
+			t.Fatalf("expected restore with corrupt %s count to fail", name)
+		}
+	}
+
+	// Node indices must refer to other nodes in the right order
+	last := forkchoice.NodeIndex(len(pr.nodes)) - 1
+	for name, corrupt := range map[string]func(node *ProtoNode){
+		"transition parent after node":   func(node *ProtoNode) { node.TransitionParent = last },
+		"forkchoice parent out of range": func(node *ProtoNode) { node.ForkchoiceParent = 1000 },
+		"best child before node":         func(node *ProtoNode) { node.BestChild = 0 },
+		"best descendant out of range":   func(node *ProtoNode) { node.BestDescendant = last + 1 },
+	} {
+		cp := pr.Copy(nil).(*ProtoArray)
+		corrupt(&cp.nodes[1])
+		if _, err := RestoreProtoArray(bytes.NewReader(snapshot(cp)), nil); err == nil {
+			t.Fatalf("expected restore with %s to fail", name)
+		}
+	}
+
+	// Vote store counts are not trusted either
+	st := NewProtoVoteStore(spec)
+	st.ProcessAttestation(0, hash(1), 1)
+	st.ProcessIndexedAttestation(&phase0.IndexedAttestation{
+		AttestingIndices: []common.ValidatorIndex{0},
+		Data:             phase0.AttestationData{Slot: 1, BeaconBlockRoot: hash(1)},
+	})
+	var buf bytes.Buffer
+	if err := st.(forkchoice.Snapshottable).Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreProtoVoteStore(spec, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	voteHeaderSize := binary.Size(voteStoreSnapshot{})
+	for i, name := range []string{"votes", "attestations", "history"} {
+		data := append([]byte(nil), buf.Bytes()...)
+		binary.LittleEndian.PutUint64(data[voteHeaderSize-8*(3-i):], 1<<50)
+		if _, err := RestoreProtoVoteStore(spec, bytes.NewReader(data)); err == nil {
+			t.Fatalf("expected restore with corrupt %s count to fail", name)
+		}
+	}
+	// The count of attestations in the history of the validator is the last 8 bytes before the references
+	data := append([]byte(nil), buf.Bytes()...)
+	binary.LittleEndian.PutUint64(data[len(data)-16:], 1<<50)
+	if _, err := RestoreProtoVoteStore(spec, bytes.NewReader(data)); err == nil {
+		t.Fatal("expected restore with corrupt history length to fail")
+	}
+}
@@ -2,7 +2,9 @@ package proto
 
 import (
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	. "github.com/protolambda/zrnt/eth2/forkchoice"
+	"sort"
 )
 
 type VoteTracker struct {
@@ -10,22 +12,26 @@ type VoteTracker struct {
 	Next               NodeRef
 	CurrentTargetEpoch Epoch
 	NextTargetEpoch    Epoch
+	// Equivocating validators have no voting weight
+	Equivocating bool
 }
 
 type ProtoVoteStore struct {
 	spec    *common.Spec
 	votes   []VoteTracker
 	changed bool
+	// The attestations of each validator that are not pruned yet, to detect slashable votes with.
+	// The attestations are shared between validators, and never modified.
+	history map[ValidatorIndex][]*phase0.IndexedAttestation
 }
 
 var _ VoteStore = (*ProtoVoteStore)(nil)
 
 func NewProtoVoteStore(spec *common.Spec) VoteStore {
-	return &ProtoVoteStore{spec: spec, changed: true}
+	return &ProtoVoteStore{spec: spec, changed: true, history: make(map[ValidatorIndex][]*phase0.IndexedAttestation)}
 }
 
-// Process an attestation. (Note that the head slot may be for a gap slot after the block root)
-func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool) {
+func (st *ProtoVoteStore) tracker(index ValidatorIndex) *VoteTracker {
 	if index >= ValidatorIndex(len(st.votes)) {
 		if index < ValidatorIndex(cap(st.votes)) {
 			st.votes = st.votes[:index+1]
@@ -34,7 +40,15 @@ func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Roo
 			st.votes = append(st.votes, extension...)
 		}
 	}
-	vote := &st.votes[index]
+	return &st.votes[index]
+}
+
+// Process an attestation. (Note that the head slot may be for a gap slot after the block root)
+func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool) {
+	vote := st.tracker(index)
+	if vote.Equivocating {
+		return false
+	}
 	targetEpoch := st.spec.SlotToEpoch(headSlot)
 	// only update if it's a newer vote, or if it's genesis and no vote has happened yet.
 	if targetEpoch > vote.NextTargetEpoch || (targetEpoch == 0 && *vote == (VoteTracker{})) {
@@ -42,10 +56,137 @@ func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Roo
 		vote.Next = NodeRef{Root: blockRoot, Slot: headSlot}
 		st.changed = true
 	}
-	// TODO: maybe help detect slashable votes on the fly?
 	return true
 }
 
+// ProcessIndexedAttestation checks the attestation against the earlier attestations of each attester.
+// For each earlier attestation that conflicts, one attester slashing is returned, for all attesters in common.
+// The signatures may not be verified: no vote weight is removed, that is up to ProcessEquivocation,
+// once a slashing is verified. Attesters that are equivocating already are not checked.
+func (st *ProtoVoteStore) ProcessIndexedAttestation(att *phase0.IndexedAttestation) []*phase0.AttesterSlashing {
+	if st.history == nil {
+		st.history = make(map[ValidatorIndex][]*phase0.IndexedAttestation)
+	}
+	var slashings []*phase0.AttesterSlashing
+	conflicts := make(map[*phase0.IndexedAttestation]struct{})
+	for _, index := range att.AttestingIndices {
+		if st.tracker(index).Equivocating {
+			continue
+		}
+		prev := st.history[index]
+		duplicate := false
+		for _, other := range prev {
+			if other.Data == att.Data {
+				duplicate = true
+				continue
+			}
+			if phase0.IsSlashableAttestationData(&other.Data, &att.Data) || phase0.IsSlashableAttestationData(&att.Data, &other.Data) {
+				if _, ok := conflicts[other]; ok {
+					continue
+				}
+				conflicts[other] = struct{}{}
+				// The first attestation must surround the second, if it is a surround vote.
+				if phase0.IsSlashableAttestationData(&other.Data, &att.Data) {
+					slashings = append(slashings, &phase0.AttesterSlashing{Attestation1: *other, Attestation2: *att})
+				} else {
+					slashings = append(slashings, &phase0.AttesterSlashing{Attestation1: *att, Attestation2: *other})
+				}
+			}
+		}
+		if !duplicate {
+			st.history[index] = append(prev, att)
+		}
+	}
+	return slashings
+}
+
+// PruneVoteHistory forgets the attestations with a target before the given epoch, e.g. the finalized epoch.
+func (st *ProtoVoteStore) PruneVoteHistory(minTargetEpoch Epoch) {
+	for index, prev := range st.history {
+		// The history may be shared with copies of the vote store, filter into a new slice.
+		var kept []*phase0.IndexedAttestation
+		for _, att := range prev {
+			if att.Data.Target.Epoch >= minTargetEpoch {
+				kept = append(kept, att)
+			}
+		}
+		if len(kept) == 0 {
+			delete(st.history, index)
+		} else {
+			st.history[index] = kept
+		}
+	}
+}
+
+// ProcessEquivocation marks the validator as equivocating, its vote weight is removed with the next deltas.
+// The tracked attestations of the validator are forgotten, later slashable votes are not reported anymore.
+func (st *ProtoVoteStore) ProcessEquivocation(index ValidatorIndex) {
+	vote := st.tracker(index)
+	if vote.Equivocating {
+		return
+	}
+	vote.Equivocating = true
+	vote.Next = NodeRef{}
+	delete(st.history, index)
+	st.changed = true
+}
+
+// EquivocatingIndices returns the validators that are equivocating, ordered by validator index.
+func (st *ProtoVoteStore) EquivocatingIndices() []ValidatorIndex {
+	var out []ValidatorIndex
+	for i := range st.votes {
+		if st.votes[i].Equivocating {
+			out = append(out, ValidatorIndex(i))
+		}
+	}
+	return out
+}
+
+// VoteHistory returns the tracked attestations, each attestation once, ordered by the first validator index it is tracked for.
+func (st *ProtoVoteStore) VoteHistory() []*phase0.IndexedAttestation {
+	validators := make([]ValidatorIndex, 0, len(st.history))
+	for index := range st.history {
+		validators = append(validators, index)
+	}
+	sort.Slice(validators, func(i, j int) bool {
+		return validators[i] < validators[j]
+	})
+	var out []*phase0.IndexedAttestation
+	seen := make(map[*phase0.IndexedAttestation]struct{})
+	for _, index := range validators {
+		for _, att := range st.history[index] {
+			if _, ok := seen[att]; !ok {
+				seen[att] = struct{}{}
+				out = append(out, att)
+			}
+		}
+	}
+	return out
+}
+
+func (st *ProtoVoteStore) LatestVotes() []LatestVote {
+	out := make([]LatestVote, 0, len(st.votes))
+	for i := range st.votes {
+		vote := &st.votes[i]
+		if vote.Next == (NodeRef{}) {
+			continue
+		}
+		out = append(out, LatestVote{Index: ValidatorIndex(i), NodeRef: vote.Next})
+	}
+	return out
+}
+
+func (st *ProtoVoteStore) Copy() VoteStore {
+	votes := make([]VoteTracker, len(st.votes), cap(st.votes))
+	copy(votes, st.votes)
+	history := make(map[ValidatorIndex][]*phase0.IndexedAttestation, len(st.history))
+	for index, prev := range st.history {
+		// Limit the capacity, appends to the copy must not affect the original.
+		history[index] = prev[:len(prev):len(prev)]
+	}
+	return &ProtoVoteStore{spec: st.spec, votes: votes, changed: st.changed, history: history}
+}
+
 func (st *ProtoVoteStore) HasChanges() bool {
 	return st.changed
 }
@@ -53,10 +194,27 @@ func (st *ProtoVoteStore) HasChanges() bool {
 // Returns a list of `deltas`, where there is one delta for each of the ProtoArray nodes.
 // The deltas are calculated between `oldBalances` and `newBalances`, and/or a change of vote.
 // The votestore is updated, the next deltas will be 0 if ProcessAttestation is not changing any vote.
+// The deltas start at the lowest node index, the nodes before it may have been pruned.
 func (st *ProtoVoteStore) ComputeDeltas(indices map[NodeRef]NodeIndex, oldBalances []Gwei, newBalances []Gwei) []SignedGwei {
 	deltas := make([]SignedGwei, len(indices), len(indices))
+	offset := NONE
+	for _, index := range indices {
+		if index < offset {
+			offset = index
+		}
+	}
 	for i := 0; i < len(st.votes); i++ {
 		vote := &st.votes[i]
+		// Equivocating validators lose the weight of their current vote, and do not vote again.
+		if vote.Equivocating {
+			if vote.Current != (NodeRef{}) {
+				if currentIndex, ok := indices[vote.Current]; ok && i < len(oldBalances) {
+					deltas[currentIndex-offset] -= SignedGwei(oldBalances[i])
+				}
+				vote.Current = NodeRef{}
+			}
+			continue
+		}
 		// There is no need to create a score change if the validator has never voted (may not be active)
 		// or both their votes are for the zero checkpoint (alias to the genesis block).
 		if vote.Current == (NodeRef{}) && vote.Next == (NodeRef{}) {
@@ -77,10 +235,10 @@ func (st *ProtoVoteStore) ComputeDeltas(indices map[NodeRef]NodeIndex, oldBalanc
 			// Ignore the current or next vote if it is not known in `indices`.
 			// We assume that it is outside of our tree (i.e., pre-finalization) and therefore not interesting.
 			if currentIndex, ok := indices[vote.Current]; ok {
-				deltas[currentIndex] -= SignedGwei(oldBal)
+				deltas[currentIndex-offset] -= SignedGwei(oldBal)
 			}
 			if nextIndex, ok := indices[vote.Next]; ok {
-				deltas[nextIndex] += SignedGwei(newBal)
+				deltas[nextIndex-offset] += SignedGwei(newBal)
 				vote.Current = vote.Next
 				vote.CurrentTargetEpoch = vote.NextTargetEpoch
 			}
@@ -0,0 +1,116 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func TestSlashableVotes(t *testing.T) {
+	spec := configs.Mainnet
+	st := NewProtoVoteStore(spec)
+	att := func(source common.Epoch, target common.Epoch, root byte, indices ...common.ValidatorIndex) *phase0.IndexedAttestation {
+		return &phase0.IndexedAttestation{
+			AttestingIndices: indices,
+			Data: phase0.AttestationData{
+				Slot:            common.Slot(target) * spec.SLOTS_PER_EPOCH,
+				BeaconBlockRoot: common.Root{root},
+				Source:          common.Checkpoint{Epoch: source},
+				Target:          common.Checkpoint{Epoch: target, Root: common.Root{root}},
+			},
+		}
+	}
+	vote := func(a *phase0.IndexedAttestation) []*phase0.AttesterSlashing {
+		slashings := st.ProcessIndexedAttestation(a)
+		for _, index := range a.AttestingIndices {
+			st.ProcessAttestation(index, a.Data.BeaconBlockRoot, a.Data.Slot)
+		}
+		return slashings
+	}
+	equivocating := func(index common.ValidatorIndex) bool {
+		return st.(*ProtoVoteStore).votes[index].Equivocating
+	}
+
+	first := att(1, 2, 0xa, 0, 1, 2)
+	if slashings := vote(first); len(slashings) != 0 {
+		t.Fatalf("unexpected slashings: %v", slashings)
+	}
+	// The same vote again is not slashable
+	if slashings := vote(att(1, 2, 0xa, 1, 2)); len(slashings) != 0 {
+		t.Fatalf("unexpected slashings for duplicate vote: %v", slashings)
+	}
+	// A later vote is not slashable
+	if slashings := vote(att(2, 3, 0xb, 2)); len(slashings) != 0 {
+		t.Fatalf("unexpected slashings for later vote: %v", slashings)
+	}
+
+	// Double vote of validator 0
+	double := att(1, 2, 0xc, 0, 5)
+	slashings := vote(double)
+	if len(slashings) != 1 || slashings[0].Attestation1.Data != first.Data || slashings[0].Attestation2.Data != double.Data {
+		t.Fatalf("expected double vote slashing, got %v", slashings)
+	}
+	// Detection does not remove any weight, the slashing is not verified yet.
+	if equivocating(0) || equivocating(5) {
+		t.Fatal("expected no equivocating validators before the slashing is verified")
+	}
+	st.ProcessEquivocation(0)
+	if !equivocating(0) || equivocating(5) {
+		t.Fatal("expected only validator 0 to be equivocating")
+	}
+	// Equivocating validators are not checked anymore
+	if slashings := vote(att(1, 2, 0xf, 0)); len(slashings) != 0 {
+		t.Fatalf("unexpected slashings of equivocating validator: %v", slashings)
+	}
+
+	// Surround vote of validator 1: the new vote surrounds the first vote.
+	surround := att(0, 3, 0xd, 1)
+	slashings = vote(surround)
+	if len(slashings) != 1 || slashings[0].Attestation1.Data != surround.Data || slashings[0].Attestation2.Data != first.Data {
+		t.Fatalf("expected surround vote slashing, got %v", slashings)
+	}
+	if equivocating(1) {
+		t.Fatal("expected validator 1 to keep its weight before the slashing is verified")
+	}
+	st.ProcessEquivocation(1)
+	if eq := st.EquivocatingIndices(); len(eq) != 2 || eq[0] != 0 || eq[1] != 1 {
+		t.Fatalf("expected validators 0 and 1 to be equivocating, got %v", eq)
+	}
+
+	// Equivocating validators have no weight and no latest vote
+	for _, v := range st.LatestVotes() {
+		if v.Index == 0 || v.Index == 1 {
+			t.Fatalf("unexpected vote of equivocating validator %d", v.Index)
+		}
+	}
+	indices := map[forkchoice.NodeRef]forkchoice.NodeIndex{}
+	for _, v := range st.LatestVotes() {
+		if _, ok := indices[v.NodeRef]; !ok {
+			indices[v.NodeRef] = forkchoice.NodeIndex(len(indices))
+		}
+	}
+	balances := make([]common.Gwei, 6)
+	for i := range balances {
+		balances[i] = 1
+	}
+	total := forkchoice.SignedGwei(0)
+	for _, d := range st.ComputeDeltas(indices, balances, balances) {
+		total += d
+	}
+	if total != 2 {
+		t.Fatalf("expected weight of validators 2 and 5 only, got %d", total)
+	}
+
+	// Pruned history is not used for detection anymore, copies are not affected.
+	cp := st.Copy()
+	st.PruneVoteHistory(3)
+	if slashings := vote(att(1, 2, 0xe, 2)); len(slashings) != 0 {
+		t.Fatalf("unexpected slashings after pruning: %v", slashings)
+	}
+	if slashings := cp.ProcessIndexedAttestation(att(1, 2, 0xe, 2)); len(slashings) != 1 {
+		t.Fatalf("expected slashing in copy, got %v", slashings)
+	}
+}
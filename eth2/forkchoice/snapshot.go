@@ -0,0 +1,217 @@
+package forkchoice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"io"
+	"reflect"
+)
+
+// SnapshotVersion is the version of the forkchoice snapshot encoding, see ProtoForkChoice.Snapshot.
+const SnapshotVersion uint64 = 2
+
+// snapshotBatchSize is the maximum number of list entries that is allocated before reading them.
+const snapshotBatchSize = 1024
+
+// ReadSnapshotList reads count fixed-size entries, and appends them to the slice that list points to.
+// The count is read from the snapshot itself and not trusted: the entries are read in batches,
+// so a corrupt count fails at the end of the input, without allocating memory for all entries up-front.
+func ReadSnapshotList(r io.Reader, count uint64, list interface{}) error {
+	v := reflect.ValueOf(list).Elem()
+	for count > 0 {
+		n := count
+		if n > snapshotBatchSize {
+			n = snapshotBatchSize
+		}
+		batch := reflect.MakeSlice(v.Type(), int(n), int(n))
+		if err := binary.Read(r, binary.LittleEndian, batch.Interface()); err != nil {
+			return err
+		}
+		v.Set(reflect.AppendSlice(v, batch))
+		count -= n
+	}
+	return nil
+}
+
+// Snapshottable is implemented by forkchoice graphs and vote stores that can be included in a forkchoice snapshot.
+type Snapshottable interface {
+	// Snapshot writes the complete contents, to restore from later.
+	Snapshot(w io.Writer) error
+}
+
+// forkchoiceSnapshot is the fixed-size part of the snapshot of a ProtoForkChoice.
+type forkchoiceSnapshot struct {
+	Version           uint64
+	Justified         Checkpoint
+	Finalized         Checkpoint
+	HasPin            bool
+	Pin               NodeRef
+	GenesisTime       Timestamp
+	Time              Timestamp
+	Ticked            bool
+	BestJustified     Checkpoint
+	HasBestBalances   bool
+	VotesApplied      bool
+	BoostChanged      bool
+	BalancesCount     uint64
+	BestBalancesCount uint64
+	QueuedVotesCount  uint64
+}
+
+// Snapshot writes the forkchoice to w: the checkpoints, balances, pin and clock,
+// followed by the snapshots of the forkchoice graph and the vote store.
+// The encoding is little-endian and fixed-size, with the length of each list in front of it,
+// and starts with the SnapshotVersion. The forkchoice can be restored with RestoreForkChoice.
+func (fc *ProtoForkChoice) Snapshot(w io.Writer) error {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	graph, ok := fc.protoArray.(Snapshottable)
+	if !ok {
+		return fmt.Errorf("forkchoice graph %T does not support snapshots", fc.protoArray)
+	}
+	votes, ok := fc.voteStore.(Snapshottable)
+	if !ok {
+		return fmt.Errorf("vote store %T does not support snapshots", fc.voteStore)
+	}
+	// The balances of the best justified checkpoint are fetched lazily, they are stored as-is in the snapshot.
+	var bestBalances []Gwei
+	if fc.bestJustifiedBalances != nil {
+		var err error
+		bestBalances, err = fc.bestJustifiedBalances()
+		if err != nil {
+			return fmt.Errorf("failed to get balances of best justified checkpoint: %v", err)
+		}
+	}
+	header := forkchoiceSnapshot{
+		Version:           SnapshotVersion,
+		Justified:         fc.justified,
+		Finalized:         fc.finalized,
+		GenesisTime:       fc.genesisTime,
+		Time:              fc.time,
+		Ticked:            fc.ticked,
+		BestJustified:     fc.bestJustified,
+		HasBestBalances:   fc.bestJustifiedBalances != nil,
+		VotesApplied:      fc.votesApplied,
+		BoostChanged:      fc.boostChanged,
+		BalancesCount:     uint64(len(fc.balances)),
+		BestBalancesCount: uint64(len(bestBalances)),
+		QueuedVotesCount:  uint64(len(fc.queuedVotes)),
+	}
+	if fc.pin != nil {
+		header.HasPin = true
+		header.Pin = *fc.pin
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, fc.balances); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bestBalances); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, fc.queuedVotes); err != nil {
+		return err
+	}
+	if err := graph.Snapshot(w); err != nil {
+		return fmt.Errorf("failed to write forkchoice graph: %v", err)
+	}
+	if err := votes.Snapshot(w); err != nil {
+		return fmt.Errorf("failed to write vote store: %v", err)
+	}
+	return nil
+}
+
+// SnapshotVotes writes the snapshot of the vote store, without the rest of the forkchoice.
+func (fc *ProtoForkChoice) SnapshotVotes(w io.Writer) error {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	votes, ok := fc.voteStore.(Snapshottable)
+	if !ok {
+		return fmt.Errorf("vote store %T does not support snapshots", fc.voteStore)
+	}
+	return votes.Snapshot(w)
+}
+
+// SetVotes replaces the vote store. The weight of the applied votes is removed from the graph,
+// and the weight of the new votes is applied, with the balances of the justified state.
+// The weight of any vote of the new store is applied, also if the vote store considered it applied already:
+// that weight was applied to the graph the votes were taken from, not to this graph.
+func (fc *ProtoForkChoice) SetVotes(votes VoteStore) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	indices := fc.protoArray.Indices()
+	// Like a change of balances: from the justified balances to none for the previous votes,
+	// and from none to the justified balances for the new votes.
+	deltas := fc.voteStore.ComputeDeltas(indices, fc.balances, nil)
+	for i, d := range votes.ComputeDeltas(indices, nil, fc.balances) {
+		deltas[i] += d
+	}
+	if err := fc.protoArray.ApplyScoreChanges(deltas, fc.justified.Epoch, fc.finalized.Epoch, fc.proposerBoostScore(fc.balances)); err != nil {
+		return err
+	}
+	fc.voteStore = votes
+	fc.votesApplied = true
+	fc.boostChanged = false
+	return nil
+}
+
+// RestoreForkChoice reads a forkchoice, as written by ProtoForkChoice.Snapshot.
+// The graph and vote store are read with the given functions, in the same order as written by the snapshot.
+func RestoreForkChoice(spec *common.Spec, r io.Reader,
+	readGraph func(r io.Reader) (ForkchoiceGraph, error),
+	readVotes func(r io.Reader) (VoteStore, error)) (Forkchoice, error) {
+	var header forkchoiceSnapshot
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed to read forkchoice snapshot header: %v", err)
+	}
+	if header.Version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported forkchoice snapshot version %d, expected %d", header.Version, SnapshotVersion)
+	}
+	balances := make([]Gwei, 0)
+	if err := ReadSnapshotList(r, header.BalancesCount, &balances); err != nil {
+		return nil, fmt.Errorf("failed to read balances: %v", err)
+	}
+	bestBalances := make([]Gwei, 0)
+	if err := ReadSnapshotList(r, header.BestBalancesCount, &bestBalances); err != nil {
+		return nil, fmt.Errorf("failed to read best justified balances: %v", err)
+	}
+	queuedVotes := make([]LatestVote, 0)
+	if err := ReadSnapshotList(r, header.QueuedVotesCount, &queuedVotes); err != nil {
+		return nil, fmt.Errorf("failed to read queued votes: %v", err)
+	}
+	graph, err := readGraph(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forkchoice graph: %v", err)
+	}
+	votes, err := readVotes(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vote store: %v", err)
+	}
+	fc := &ProtoForkChoice{
+		protoArray:    graph,
+		voteStore:     votes,
+		balances:      balances,
+		justified:     header.Justified,
+		finalized:     header.Finalized,
+		spec:          spec,
+		genesisTime:   header.GenesisTime,
+		time:          header.Time,
+		ticked:        header.Ticked,
+		bestJustified: header.BestJustified,
+		queuedVotes:   queuedVotes,
+		votesApplied:  header.VotesApplied,
+		boostChanged:  header.BoostChanged,
+	}
+	if header.HasPin {
+		pin := header.Pin
+		fc.pin = &pin
+	}
+	if header.HasBestBalances {
+		fc.bestJustifiedBalances = func() ([]Gwei, error) {
+			return bestBalances, nil
+		}
+	}
+	return fc, nil
+}